@@ -21,16 +21,56 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
   await login();
 });
 
+// authFetch is fetch with the access token attached. When the token has
+// expired it gets a new one with the refresh token and retries once.
+async function authFetch(url, options = {}, retried = false) {
+  const res = await fetch(url, {
+    ...options,
+    headers: {
+      ...options.headers,
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+  });
+  if (res.status !== 401 || retried) {
+    return res;
+  }
+
+  const data = await res.clone().json().catch(() => ({}));
+  if (data.code !== 'TOKEN_EXPIRED' || !(await refreshAccessToken())) {
+    return res;
+  }
+  return authFetch(url, options, true);
+}
+
+async function refreshAccessToken() {
+  const refreshToken = localStorage.getItem('refresh_token');
+  if (!refreshToken) {
+    return false;
+  }
+
+  const res = await fetch('/api/refresh', {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${refreshToken}`,
+    },
+  });
+  if (!res.ok) {
+    return false;
+  }
+  const data = await res.json();
+  localStorage.setItem('token', data.token);
+  return true;
+}
+
 async function createVideoDraft() {
   const title = document.getElementById('video-title').value;
   const description = document.getElementById('video-description').value;
 
   try {
-    const res = await fetch('/api/videos', {
+    const res = await authFetch('/api/videos', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
       body: JSON.stringify({ title, description }),
     });
@@ -68,6 +108,7 @@ async function login() {
 
     if (data.token) {
       localStorage.setItem('token', data.token);
+      localStorage.setItem('refresh_token', data.refresh_token);
       document.getElementById('auth-section').style.display = 'none';
       document.getElementById('video-section').style.display = 'block';
       await getVideos();
@@ -104,6 +145,7 @@ async function signup() {
 
 function logout() {
   localStorage.removeItem('token');
+  localStorage.removeItem('refresh_token');
   document.getElementById('auth-section').style.display = 'block';
   document.getElementById('video-section').style.display = 'none';
 }
@@ -130,11 +172,8 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await authFetch(`/api/thumbnail_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -163,11 +202,8 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const res = await authFetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -188,18 +224,15 @@ const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
+    const res = await authFetch('/api/videos', {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       const data = await res.json();
       throw new Error(`Failed to get videos. Error: ${data.error}`);
     }
 
-    const videos = await res.json();
+    const { videos } = await res.json();
     const videoList = document.getElementById('video-list');
     videoList.innerHTML = '';
     for (const video of videos) {
@@ -231,11 +264,8 @@ function createVideoStateHandler() {
 
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
+    const res = await authFetch(`/api/videos/${videoID}`, {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to get video.');
@@ -283,11 +313,8 @@ async function deleteVideo() {
   }
 
   try {
-    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+    const res = await authFetch(`/api/videos/${currentVideo.id}`, {
       method: 'DELETE',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to delete video.');
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// otherAspectPrefix is the key prefix for videos that don't match any
+// configured aspect ratio.
+const otherAspectPrefix = "other/"
+
+// defaultAspectRatioPrefixes is the default value of ASPECT_RATIO_PREFIXES.
+const defaultAspectRatioPrefixes = "16:9=landscape,9:16=portrait,1:1=square"
+
+// aspectRatioPrefix maps an aspect ratio (width / height) to the S3 key
+// prefix videos with that shape are stored under.
+type aspectRatioPrefix struct {
+	ratio  float64
+	prefix string
+}
+
+var validAspectPrefix = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// parseAspectRatioPrefixes parses a comma-separated list of ratio=prefix
+// pairs such as "16:9=landscape,4:3=standard".
+func parseAspectRatioPrefixes(value string) ([]aspectRatioPrefix, error) {
+	var mappings []aspectRatioPrefix
+	for _, pair := range strings.Split(value, ",") {
+		ratioText, prefix, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a ratio=prefix pair", pair)
+		}
+		widthText, heightText, ok := strings.Cut(ratioText, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a width:height ratio", ratioText)
+		}
+		width, err := strconv.ParseFloat(widthText, 64)
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("invalid width in %q", ratioText)
+		}
+		height, err := strconv.ParseFloat(heightText, 64)
+		if err != nil || height <= 0 {
+			return nil, fmt.Errorf("invalid height in %q", ratioText)
+		}
+		if !validAspectPrefix.MatchString(prefix) || prefix+"/" == otherAspectPrefix {
+			return nil, fmt.Errorf("invalid prefix %q", prefix)
+		}
+		mappings = append(mappings, aspectRatioPrefix{ratio: width / height, prefix: prefix + "/"})
+	}
+	return mappings, nil
+}
+
+// aspectPrefixFor returns the prefix of the configured ratio closest to
+// width x height, or otherAspectPrefix when none is within the tolerance.
+func (cfg *apiConfig) aspectPrefixFor(width, height int) string {
+	ratio := float64(width) / float64(height)
+	prefix := otherAspectPrefix
+	best := cfg.aspectRatioTolerance
+	for _, m := range cfg.aspectRatios {
+		if diff := math.Abs(ratio - m.ratio); diff < best {
+			best = diff
+			prefix = m.prefix
+		}
+	}
+	return prefix
+}
+
+// normalizeAspectPrefix checks a client-chosen prefix against the configured
+// ones (plus otherAspectPrefix) and returns it with its trailing slash.
+func (cfg *apiConfig) normalizeAspectPrefix(value string) (string, error) {
+	prefix := strings.TrimSuffix(value, "/") + "/"
+	if prefix == otherAspectPrefix {
+		return prefix, nil
+	}
+	for _, m := range cfg.aspectRatios {
+		if m.prefix == prefix {
+			return prefix, nil
+		}
+	}
+	return "", fmt.Errorf("unknown prefix %q", value)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAspectPrefixForCustomRatios(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	var err error
+	cfg.aspectRatios, err = parseAspectRatioPrefixes(defaultAspectRatioPrefixes + ",4:3=standard,21:9=ultrawide")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		width, height int
+		want          string
+	}{
+		{1920, 1080, "landscape/"},
+		{1440, 1080, "standard/"},
+		{2560, 1080, "ultrawide/"},
+		{1080, 1920, "portrait/"},
+		{1000, 3000, otherAspectPrefix},
+	}
+	for _, tt := range tests {
+		if got := cfg.aspectPrefixFor(tt.width, tt.height); got != tt.want {
+			t.Errorf("aspectPrefixFor(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestUploadVideoAspectPrefix(t *testing.T) {
+	installFakeMedia(t, strings.Replace(testProbeOutput, `"width": 1920, "height": 1080`, `"width": 1440, "height": 1080`, 1))
+
+	tests := []struct {
+		name       string
+		query      string
+		wantCode   int
+		wantPrefix string
+	}{
+		{name: "4:3 clip", wantCode: http.StatusCreated, wantPrefix: "standard/"},
+		{name: "allowed override", query: "prefixOverride=portrait", wantCode: http.StatusCreated, wantPrefix: "portrait/"},
+		{name: "unknown override", query: "prefixOverride=secret", wantCode: http.StatusBadRequest},
+		{name: "traversal override", query: "prefixOverride=../landscape", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			var err error
+			cfg.aspectRatios, err = parseAspectRatioPrefixes(defaultAspectRatioPrefixes + ",4:3=standard")
+			if err != nil {
+				t.Fatal(err)
+			}
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			r := newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil)
+			r.URL.RawQuery = tt.query
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			keys := mock.Keys()
+			if tt.wantPrefix == "" {
+				if len(keys) != 0 {
+					t.Errorf("stored %q for a rejected upload", keys)
+				}
+				return
+			}
+			if len(keys) == 0 {
+				t.Fatal("nothing was stored")
+			}
+			for _, key := range keys {
+				if !strings.HasPrefix(key, tt.wantPrefix) {
+					t.Errorf("key %q isn't under %q", key, tt.wantPrefix)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// audioFormat describes an audio-only output that can be extracted from an
+// uploaded video.
+type audioFormat struct {
+	ext         string
+	contentType string
+	// args are the ffmpeg encoding options for the audio stream
+	args []string
+}
+
+// audioFormats are the codecs clients may request via the audio_codec form
+// field. AAC is the default.
+var audioFormats = map[string]audioFormat{
+	"aac": {ext: ".m4a", contentType: "audio/mp4", args: []string{"-c:a", "aac", "-b:a", "128k"}},
+	"mp3": {ext: ".mp3", contentType: "audio/mpeg", args: []string{"-c:a", "libmp3lame", "-q:a", "2"}},
+}
+
+const defaultAudioCodec = "aac"
+
+// audioKey returns the S3 key for the audio-only copy of the video stored at
+// videoKey, e.g. landscape/abc.mp4 -> landscape/abc/audio.m4a.
+func audioKey(videoKey string, codec string) string {
+	base := strings.TrimSuffix(videoKey, path.Ext(videoKey))
+	return base + "/audio" + audioFormats[codec].ext
+}
+
+// extractAudio writes the audio track of the video at filePath to a new file
+// encoded with codec and returns its path. The caller removes the file.
+func (cfg *apiConfig) extractAudio(ctx context.Context, filePath string, codec string) (string, error) {
+	format, ok := audioFormats[codec]
+	if !ok {
+		return "", fmt.Errorf("unsupported audio codec %q", codec)
+	}
+
+	done := logStage(ctx, "extract_audio", "codec", codec)
+	outputPath := filePath + ".audio" + format.ext
+	args := append([]string{"-i", filePath, "-vn", "-map", "0:a:0"}, format.args...)
+	_, err := cfg.runMedia(ctx, "ffmpeg", append(args, outputPath)...)
+	done(err)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
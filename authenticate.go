@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// authenticate returns the ID of the user whose access token authorizes r.
+// An expired token gets a TOKEN_EXPIRED code, telling the client to get a
+// new one from /api/refresh and retry.
+func (cfg *apiConfig) authenticate(w http.ResponseWriter, r *http.Request) (uuid.UUID, error) {
+	if userID, ok := jobUser(r.Context()); ok {
+		return userID, nil
+	}
+
+	token, err := auth.GetAccessToken(r, cfg.jwtCookieName, cfg.jwtCookieOrigins)
+	if errors.Is(err, auth.ErrCrossSiteCookie) {
+		respondWithError(w, http.StatusForbidden, "Cookie can't authorize cross-site requests", err)
+		return uuid.Nil, err
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, err
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if errors.Is(err, auth.ErrTokenExpired) {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeTokenExpired, "Token has expired", err)
+		return uuid.Nil, err
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, err
+	}
+	return userID, nil
+}
+
+// authorizeAdmin checks that r carries the admin API key, as
+// "Authorization: ApiKey <key>", responding with an error when it doesn't.
+// Admin endpoints are turned off when no key is configured.
+func (cfg *apiConfig) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminAPIKey == "" {
+		respondWithError(w, http.StatusForbidden, "Admin API is disabled", nil)
+		return false
+	}
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find API key", err)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateRejectsCrossSiteCookie(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.jwtCookieName = "tubely_token"
+	userID, token := createTestUser(t, cfg)
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		wantCode int
+	}{
+		{"cross-site", http.Header{"Sec-Fetch-Site": {"cross-site"}}, http.StatusForbidden},
+		{"same-origin", http.Header{"Sec-Fetch-Site": {"same-origin"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/api/videos/x", nil)
+			r.AddCookie(&http.Cookie{Name: cfg.jwtCookieName, Value: token})
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			got, err := cfg.authenticate(w, r)
+			if tt.wantCode == 0 {
+				if err != nil || got != userID {
+					t.Errorf("authenticate = %v, %v, want %v", got, err, userID)
+				}
+				return
+			}
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+			if code := responseErrorCode(t, w); code != errCodeForbidden {
+				t.Errorf("code = %q, want %q", code, errCodeForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// bucketCORSMaxAge is how long, in seconds, browsers may cache the bucket's
+// answer to a preflight request.
+const bucketCORSMaxAge = 3600
+
+// parseCORSOrigins parses a comma-separated list of origins, such as
+// "https://app.example.com,http://localhost:8091". "*" allows any origin.
+func parseCORSOrigins(value string) ([]string, error) {
+	var origins []string
+	for _, field := range strings.Split(value, ",") {
+		origin := strings.TrimSpace(field)
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+				(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+				return nil, fmt.Errorf("invalid origin %q: must be a scheme and host, like https://example.com", origin)
+			}
+			origin = strings.TrimSuffix(origin, "/")
+		}
+		origins = append(origins, origin)
+	}
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("no origins given")
+	}
+	return origins, nil
+}
+
+// bucketCORSConfiguration lets pages from origins fetch the bucket's objects
+// with GET and HEAD, including the range requests players seek with, and
+// read the headers they need.
+func bucketCORSConfiguration(origins []string) *types.CORSConfiguration {
+	return &types.CORSConfiguration{
+		CORSRules: []types.CORSRule{{
+			ID:             aws.String("tubely-playback"),
+			AllowedOrigins: origins,
+			AllowedMethods: []string{"GET", "HEAD"},
+			AllowedHeaders: []string{"*"},
+			ExposeHeaders:  []string{"Accept-Ranges", "Content-Length", "Content-Range", "Content-Type", "ETag"},
+			MaxAgeSeconds:  aws.Int32(bucketCORSMaxAge),
+		}},
+	}
+}
+
+// applyBucketCORS sets the CORS configuration of the bucket, and of the
+// replica when there is one, to bucketCORSConfiguration for
+// cfg.s3CORSOrigins. It replaces whatever rules the buckets had.
+func (cfg *apiConfig) applyBucketCORS(ctx context.Context) error {
+	corsConfig := bucketCORSConfiguration(cfg.s3CORSOrigins)
+	if _, err := cfg.s3Client.PutBucketCors(ctx, &s3.PutBucketCorsInput{
+		Bucket:            &cfg.s3Bucket,
+		CORSConfiguration: corsConfig,
+	}); err != nil {
+		return fmt.Errorf("bucket %s: %w", cfg.s3Bucket, err)
+	}
+	if cfg.s3Replica != nil {
+		if _, err := cfg.s3Replica.client.PutBucketCors(ctx, &s3.PutBucketCorsInput{
+			Bucket:            &cfg.s3Replica.bucket,
+			CORSConfiguration: corsConfig,
+		}); err != nil {
+			return fmt.Errorf("replica bucket %s: %w", cfg.s3Replica.bucket, err)
+		}
+	}
+	return nil
+}
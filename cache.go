@@ -1,10 +1,80 @@
 package main
 
-import "net/http"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
 
+// noCacheMiddleware makes clients revalidate responses before reusing them.
+// Paired with an ETag, an unchanged file costs a 304 rather than a download.
 func noCacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Cache-Control", "no-cache")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// assetETag is the ETag of a file as of its size and modification time.
+type assetETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// etagMiddleware sets a strong ETag, the hash of the file's contents, on
+// requests for files in root before passing them to next, a file server for
+// root. The file server then answers a matching If-None-Match with a 304.
+// Hashes are cached until a file's size or modification time changes.
+func etagMiddleware(root http.FileSystem, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	etags := map[string]assetETag{}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := r.URL.Path
+
+		f, err := root.Open(name)
+		if err != nil {
+			mu.Lock()
+			delete(etags, name)
+			mu.Unlock()
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mu.Lock()
+		cached, ok := etags[name]
+		mu.Unlock()
+		if !ok || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cached = assetETag{
+				size:    info.Size(),
+				modTime: info.ModTime(),
+				etag:    `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`,
+			}
+			mu.Lock()
+			etags[name] = cached
+			mu.Unlock()
+		}
+
+		w.Header().Set("ETag", cached.etag)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssetsRangeRequests(t *testing.T) {
+	root := t.TempDir()
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := os.WriteFile(filepath.Join(root, "video.mp4"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Served as main serves /assets/
+	fs := http.Dir(root)
+	handler := noCacheMiddleware(http.StripPrefix("/assets", etagMiddleware(fs, http.FileServer(fs))))
+
+	get := func(header http.Header) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/assets/video.mp4", nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	full := get(nil)
+	etag := full.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("response has no ETag")
+	}
+
+	tests := []struct {
+		name             string
+		header           http.Header
+		wantStatus       int
+		wantContentRange string
+		wantBody         []byte
+	}{
+		{
+			name:             "range",
+			header:           http.Header{"Range": {"bytes=100-199"}},
+			wantStatus:       http.StatusPartialContent,
+			wantContentRange: "bytes 100-199/5000",
+			wantBody:         data[100:200],
+		},
+		{
+			name:             "range with current If-Range",
+			header:           http.Header{"Range": {"bytes=100-199"}, "If-Range": {etag}},
+			wantStatus:       http.StatusPartialContent,
+			wantContentRange: "bytes 100-199/5000",
+			wantBody:         data[100:200],
+		},
+		{
+			name:       "range with stale If-Range",
+			header:     http.Header{"Range": {"bytes=100-199"}, "If-Range": {`"stale"`}},
+			wantStatus: http.StatusOK,
+			wantBody:   data,
+		},
+		{
+			name:             "suffix range",
+			header:           http.Header{"Range": {"bytes=-500"}},
+			wantStatus:       http.StatusPartialContent,
+			wantContentRange: "bytes 4500-4999/5000",
+			wantBody:         data[4500:],
+		},
+		{
+			name:             "unsatisfiable range",
+			header:           http.Header{"Range": {"bytes=6000-"}},
+			wantStatus:       http.StatusRequestedRangeNotSatisfiable,
+			wantContentRange: "bytes */5000",
+		},
+		{
+			name:       "current If-None-Match",
+			header:     http.Header{"If-None-Match": {etag}},
+			wantStatus: http.StatusNotModified,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(tt.header)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get("Content-Range"); got != tt.wantContentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantContentRange)
+			}
+			// http.Error drops it from error responses, which aren't cached
+			if got := resp.Header.Get("Cache-Control"); got != "no-cache" && resp.StatusCode < 400 {
+				t.Errorf("Cache-Control = %q, want no-cache", got)
+			}
+			if tt.wantBody != nil {
+				body, _ := io.ReadAll(resp.Body)
+				if !bytes.Equal(body, tt.wantBody) {
+					t.Errorf("body is %d bytes, want the %d requested", len(body), len(tt.wantBody))
+				}
+			}
+		})
+	}
+}
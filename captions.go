@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// maxCaptionBytes caps the size of an uploaded subtitle file. Even feature
+// length subtitles are a few hundred KiB.
+const maxCaptionBytes = 1 << 20
+
+// captionLangPattern matches language tags like en, pt-BR or zh-Hant-TW.
+var captionLangPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// captionTimestampPattern matches a cue timestamp. WebVTT timestamps may
+// leave out the hours and separate milliseconds with a period; SRT ones
+// always have hours and use a comma.
+var captionTimestampPattern = regexp.MustCompile(`^(?:(\d{2,}):)?(\d{2}):(\d{2})[.,](\d{3})$`)
+
+// handlerUploadCaptions stores a subtitle track for one of the user's videos.
+// The form's captions file may be WebVTT or SRT, which is converted to
+// WebVTT, and lang is its language tag. A track uploaded for a language that
+// already has one replaces it.
+func (cfg *apiConfig) handlerUploadCaptions(w http.ResponseWriter, r *http.Request) {
+	video, userID, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	// Leave room for the rest of the form around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionBytes+maxStreamFieldBytes)
+	if err := r.ParseMultipartForm(cfg.thumbnailMultipartMemoryBytes); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			msg := translatef(w, "Captions exceed the maximum size of %s", formatBytes(maxCaptionBytes))
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	lang, err := normalizeCaptionLang(r.FormValue("lang"))
+	if err != nil {
+		respondWithFieldError(w, err)
+		return
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Missing captions file", err)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxCaptionBytes+1))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read captions", err)
+		return
+	}
+	if len(data) > maxCaptionBytes {
+		msg := translatef(w, "Captions exceed the maximum size of %s", formatBytes(maxCaptionBytes))
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, nil)
+		return
+	}
+
+	vtt, err := parseCaptions(data)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidCaptions, translatef(w, "Invalid captions: %s", err), err)
+		return
+	}
+
+	// Each upload gets a new key, so cached copies of a replaced track
+	// can't be served in its place
+	name, err := cfg.generateS3Key(".vtt")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return
+	}
+	key, err := cfg.videoKey(userID, "captions/"+video.ID.String()+"/"+lang, name)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return
+	}
+	if err := cfg.uploadToS3(r.Context(), w, bytes.NewReader(vtt), key, "text/vtt", userID); err != nil {
+		return
+	}
+
+	previousURL, replaced := video.Captions[lang]
+	captions := maps.Clone(video.Captions)
+	if captions == nil {
+		captions = database.Captions{}
+	}
+	captions[lang] = cfg.objectURL(key)
+	video.Captions = captions
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if replaced {
+		if err := cfg.deleteObjectURLs(r.Context(), []string{previousURL}); err != nil {
+			loggerFromContext(r.Context()).Warn("couldn't delete replaced captions", "video_id", video.ID, "lang", lang, "error", err)
+		}
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(*video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// normalizeCaptionLang validates a caption language tag and puts it in its
+// usual case, e.g. PT-br -> pt-BR, so each language has one track.
+func normalizeCaptionLang(lang string) (string, error) {
+	lang = strings.TrimSpace(lang)
+	if lang == "" {
+		return "", &fieldError{Field: "lang", Message: "lang is required"}
+	}
+	if len(lang) > 35 || !captionLangPattern.MatchString(lang) {
+		return "", &fieldError{Field: "lang", Message: "lang must be a language tag such as en or pt-BR"}
+	}
+	subtags := strings.Split(lang, "-")
+	subtags[0] = strings.ToLower(subtags[0])
+	for i := 1; i < len(subtags); i++ {
+		switch len(subtags[i]) {
+		case 2:
+			subtags[i] = strings.ToUpper(subtags[i])
+		case 4:
+			subtags[i] = strings.ToUpper(subtags[i][:1]) + strings.ToLower(subtags[i][1:])
+		default:
+			subtags[i] = strings.ToLower(subtags[i])
+		}
+	}
+	return strings.Join(subtags, "-"), nil
+}
+
+// parseCaptions validates a WebVTT or SRT subtitle file and returns it as
+// WebVTT. Files starting with the WEBVTT signature are read as WebVTT, and
+// anything else as SRT.
+func parseCaptions(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, errors.New("file isn't UTF-8 text")
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	blocks := captionBlocks(text)
+	if len(blocks) > 0 && isVTTSignature(blocks[0][0]) {
+		return parseVTT(blocks)
+	}
+	return srtToVTT(blocks)
+}
+
+// captionBlocks splits text into its blank-line separated blocks of lines.
+func captionBlocks(text string) [][]string {
+	var blocks [][]string
+	var block []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func isVTTSignature(line string) bool {
+	rest, ok := strings.CutPrefix(line, "WEBVTT")
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t')
+}
+
+// parseVTT checks the cues in a WebVTT file's blocks, the first of which is
+// its header, and returns the file with normalized line endings.
+func parseVTT(blocks [][]string) ([]byte, error) {
+	cues := 0
+	for _, block := range blocks[1:] {
+		if block[0] == "NOTE" || strings.HasPrefix(block[0], "NOTE ") ||
+			block[0] == "STYLE" || block[0] == "REGION" {
+			continue
+		}
+		cues++
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			// The first line is the cue's identifier
+			timing = 1
+		}
+		if timing >= len(block) {
+			return nil, fmt.Errorf("cue %d has no timing line", cues)
+		}
+		if _, err := parseCueTiming(block[timing], false); err != nil {
+			return nil, fmt.Errorf("cue %d: %w", cues, err)
+		}
+		if err := checkCueText(block[timing+1:]); err != nil {
+			return nil, fmt.Errorf("cue %d: %w", cues, err)
+		}
+	}
+	if cues == 0 {
+		return nil, errors.New("file has no cues")
+	}
+	return joinCaptionBlocks(blocks), nil
+}
+
+// srtToVTT converts the cues in an SRT file's blocks to WebVTT. Each SRT cue
+// is a sequence number, a timing line, then its text.
+func srtToVTT(blocks [][]string) ([]byte, error) {
+	if len(blocks) == 0 {
+		return nil, errors.New("file has no cues")
+	}
+	out := [][]string{{"WEBVTT"}}
+	for i, block := range blocks {
+		cue := i + 1
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			if _, err := strconv.Atoi(block[0]); err != nil {
+				return nil, fmt.Errorf("cue %d: expected a sequence number, got %q", cue, block[0])
+			}
+			timing = 1
+		}
+		if timing >= len(block) {
+			return nil, fmt.Errorf("cue %d has no timing line", cue)
+		}
+		timingLine, err := parseCueTiming(block[timing], true)
+		if err != nil {
+			return nil, fmt.Errorf("cue %d: %w", cue, err)
+		}
+		if err := checkCueText(block[timing+1:]); err != nil {
+			return nil, fmt.Errorf("cue %d: %w", cue, err)
+		}
+		converted := []string{strconv.Itoa(cue), timingLine}
+		out = append(out, append(converted, block[timing+1:]...))
+	}
+	return joinCaptionBlocks(out), nil
+}
+
+// parseCueTiming checks a "start --> end" timing line and returns it in
+// WebVTT form. WebVTT cue settings after the end time are kept; SRT has no
+// settings, so anything there (such as SRT's box coordinates) is dropped.
+func parseCueTiming(line string, srt bool) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "-->" {
+		return "", fmt.Errorf("malformed timing line %q", line)
+	}
+	start, err := parseCueTimestamp(fields[0])
+	if err != nil {
+		return "", err
+	}
+	end, err := parseCueTimestamp(fields[2])
+	if err != nil {
+		return "", err
+	}
+	if end <= start {
+		return "", fmt.Errorf("cue ends at %s, not after it starts at %s", fields[2], fields[0])
+	}
+	if srt {
+		return formatCueTimestamp(start) + " --> " + formatCueTimestamp(end), nil
+	}
+	return line, nil
+}
+
+// parseCueTimestamp parses a timestamp like 01:02:03.456 or 02:03,456.
+func parseCueTimestamp(s string) (time.Duration, error) {
+	m := captionTimestampPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("malformed timestamp %q", s)
+	}
+	hours, _ := strconv.Atoi(m[1])
+	minutes, _ := strconv.Atoi(m[2])
+	seconds, _ := strconv.Atoi(m[3])
+	millis, _ := strconv.Atoi(m[4])
+	if minutes > 59 || seconds > 59 {
+		return 0, fmt.Errorf("malformed timestamp %q", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second + time.Duration(millis)*time.Millisecond, nil
+}
+
+// formatCueTimestamp formats d as a WebVTT timestamp, e.g. 01:02:03.456.
+func formatCueTimestamp(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		int(d/time.Hour), int(d/time.Minute)%60, int(d/time.Second)%60, int(d/time.Millisecond)%1000)
+}
+
+// checkCueText rejects cue text that would be read as another timing line.
+func checkCueText(lines []string) error {
+	for _, line := range lines {
+		if strings.Contains(line, "-->") {
+			return fmt.Errorf("unexpected timing line %q in cue text", line)
+		}
+	}
+	return nil
+}
+
+func joinCaptionBlocks(blocks [][]string) []byte {
+	var b strings.Builder
+	for i, block := range blocks {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, line := range block {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
+	return []byte(b.String())
+}
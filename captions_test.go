@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/google/uuid"
+)
+
+// newCaptionsUploadRequest returns an authenticated upload of captions in
+// lang for videoID.
+func newCaptionsUploadRequest(t *testing.T, token string, videoID uuid.UUID, lang string, captions []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("lang", lang)
+	part, err := form.CreateFormFile("captions", "captions.srt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(captions)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+videoID.String()+"/captions", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestUploadCaptionsConvertsSRT(t *testing.T) {
+	cfg, mock := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	// A BOM and CRLF line endings, as Windows tools write them
+	srt := "\ufeff1\r\n00:00:01,000 --> 00:00:03,500\r\nHello, Boots!\r\n\r\n" +
+		"2\r\n00:00:04,000 --> 00:00:06,250 X1:10 X2:20 Y1:30 Y2:40\r\nTwo\r\nlines\r\n"
+	w := httptest.NewRecorder()
+	cfg.handlerUploadCaptions(w, newCaptionsUploadRequest(t, token, video.ID, "EN", []byte(srt)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captionsURL, ok := stored.Captions["en"]
+	if !ok {
+		t.Fatalf("captions = %v, want an en track", stored.Captions)
+	}
+	key, err := cfg.s3KeyFromURL(captionsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, ok := mock.Object(key)
+	if !ok {
+		t.Fatalf("%s wasn't stored", key)
+	}
+	want := "WEBVTT\n\n1\n00:00:01.000 --> 00:00:03.500\nHello, Boots!\n\n" +
+		"2\n00:00:04.000 --> 00:00:06.250\nTwo\nlines\n"
+	if string(obj.data) != want {
+		t.Errorf("stored captions:\n%s\nwant:\n%s", obj.data, want)
+	}
+	if _, err := parseCaptions(obj.data); err != nil {
+		t.Errorf("stored captions aren't valid WebVTT: %v", err)
+	}
+	if input, _ := mock.PutInput(key); input == nil || aws.ToString(input.ContentType) != "text/vtt" {
+		t.Errorf("captions weren't stored as text/vtt")
+	}
+}
+
+func TestUploadCaptionsRejectsInvalidSRT(t *testing.T) {
+	cfg, mock := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	srt := "1\n00:00:03,000 --> 00:00:01,000\nEnds before it starts\n"
+	w := httptest.NewRecorder()
+	cfg.handlerUploadCaptions(w, newCaptionsUploadRequest(t, token, video.ID, "en", []byte(srt)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if code := responseErrorCode(t, w); code != errCodeInvalidCaptions {
+		t.Errorf("error code = %q, want %q", code, errCodeInvalidCaptions)
+	}
+	if keys := mock.Keys(); len(keys) != 0 {
+		t.Errorf("stored %q for invalid captions", keys)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMiddleware gzips JSON responses of at least minSize bytes for clients
+// that accept it. Anything else, such as thumbnail bytes or event streams,
+// passes through untouched. A zero minSize disables compression.
+func gzipMiddleware(minSize int, next http.Handler) http.Handler {
+	if minSize == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, either
+// by name or through "*", with a nonzero quality.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.TrimSpace(coding)
+		if !strings.EqualFold(coding, "gzip") && coding != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		if quality, err := strconv.ParseFloat(q, 64); err == nil && quality > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the start of a response until it knows
+// whether to compress it: once the body reaches minSize, or when the handler
+// returns.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	w.status = status
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		if !w.compressible() {
+			w.start(false)
+		} else {
+			w.buf = append(w.buf, b...)
+			if len(w.buf) >= w.minSize {
+				return len(b), w.start(true)
+			}
+			return len(b), nil
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends what's been written so far, which rules out compressing
+// anything not yet decided on.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.start(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// compressible reports whether the response is JSON that hasn't already been
+// encoded.
+func (w *gzipResponseWriter) compressible() bool {
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || w.status < http.StatusOK ||
+		w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// start writes the held back status and body, compressed or not.
+func (w *gzipResponseWriter) start(compress bool) error {
+	w.decided = true
+	if compress {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// close finishes the response once the handler has returned.
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			return
+		}
+		w.start(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gunzip returns the decompressed contents of a gzip stream.
+func gunzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("body isn't gzipped: %v", err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("couldn't decompress body: %v", err)
+	}
+	return out
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	const minSize = 1024
+	large := map[string]string{"description": strings.Repeat("a long description ", 100)}
+	small := map[string]string{"id": "1"}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		handler        http.HandlerFunc
+		wantGzip       bool
+	}{
+		{
+			name:           "large JSON",
+			acceptEncoding: "gzip, deflate",
+			handler:        func(w http.ResponseWriter, r *http.Request) { respondWithJSON(w, http.StatusOK, large) },
+			wantGzip:       true,
+		},
+		{
+			name:           "small JSON",
+			acceptEncoding: "gzip",
+			handler:        func(w http.ResponseWriter, r *http.Request) { respondWithJSON(w, http.StatusOK, small) },
+		},
+		{
+			name:    "gzip not accepted",
+			handler: func(w http.ResponseWriter, r *http.Request) { respondWithJSON(w, http.StatusOK, large) },
+		},
+		{
+			name:           "gzip refused",
+			acceptEncoding: "gzip;q=0",
+			handler:        func(w http.ResponseWriter, r *http.Request) { respondWithJSON(w, http.StatusOK, large) },
+		},
+		{
+			name:           "binary body",
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(bytes.Repeat([]byte{0}, 4*minSize))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/videos", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			gzipMiddleware(minSize, tt.handler).ServeHTTP(w, r)
+
+			gzipped := w.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("gzipped = %v, want %v", gzipped, tt.wantGzip)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			body := w.Body.Bytes()
+			if gzipped {
+				body = gunzip(t, body)
+				var decoded map[string]string
+				if err := json.Unmarshal(body, &decoded); err != nil || decoded["description"] != large["description"] {
+					t.Errorf("decompressed body = %.60s..., want the JSON sent", body)
+				}
+			}
+		})
+	}
+}
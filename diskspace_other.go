@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// freeDiskSpace isn't available here, so the free space check is skipped.
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
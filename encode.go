@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// webFriendlyCodecs are the source codecs (as ffprobe names them) that
+// browsers play from an MP4, so fast start only has to remux them.
+var webFriendlyCodecs = map[string]bool{
+	"h264": true,
+	"vp9":  true,
+	"av1":  true,
+}
+
+// videoEncoder is an output codec videos can be re-encoded to.
+type videoEncoder struct {
+	// probeName is the codec's name as reported by ffprobe
+	probeName string
+	// maxCRF is the largest constant rate factor the encoder accepts
+	maxCRF int
+	args   func(crf int, preset string) []string
+}
+
+// videoEncoders are the codecs VIDEO_REENCODE_CODEC may name. libvpx has no
+// x264-style presets, so the preset is ignored for vp9.
+var videoEncoders = map[string]videoEncoder{
+	"h264": {
+		probeName: "h264",
+		maxCRF:    51,
+		args: func(crf int, preset string) []string {
+			return []string{"-c:v", "libx264", "-crf", strconv.Itoa(crf), "-preset", preset, "-pix_fmt", "yuv420p"}
+		},
+	},
+	"h265": {
+		probeName: "hevc",
+		maxCRF:    51,
+		args: func(crf int, preset string) []string {
+			// Safari only plays HEVC in MP4 when it's tagged hvc1
+			return []string{"-c:v", "libx265", "-crf", strconv.Itoa(crf), "-preset", preset, "-pix_fmt", "yuv420p", "-tag:v", "hvc1"}
+		},
+	},
+	"vp9": {
+		probeName: "vp9",
+		maxCRF:    63,
+		args: func(crf int, preset string) []string {
+			// A zero bitrate makes libvpx use constant quality
+			return []string{"-c:v", "libvpx-vp9", "-crf", strconv.Itoa(crf), "-b:v", "0", "-pix_fmt", "yuv420p"}
+		},
+	},
+}
+
+// validateReencodeSettings checks the re-encode codec and CRF read from the
+// environment. An empty codec disables re-encoding.
+func validateReencodeSettings(codec string, crf int) error {
+	if codec == "" {
+		return nil
+	}
+	encoder, ok := videoEncoders[codec]
+	if !ok {
+		return fmt.Errorf("unsupported codec %q, must be h264, h265 or vp9", codec)
+	}
+	if crf < 0 || crf > encoder.maxCRF {
+		return fmt.Errorf("CRF must be between 0 and %d for %s", encoder.maxCRF, codec)
+	}
+	return nil
+}
+
+// needsReencode reports whether a video whose stream ffprobe reported as
+// sourceCodec has to be re-encoded rather than remuxed. It's always false
+// when re-encoding isn't configured.
+func (cfg *apiConfig) needsReencode(sourceCodec string) bool {
+	encoder, ok := videoEncoders[cfg.reencodeCodec]
+	if !ok {
+		return false
+	}
+	return !webFriendlyCodecs[sourceCodec] && sourceCodec != encoder.probeName
+}
+
+// outputCodec returns the codec, as ffprobe names it, of the processed
+// version of a video whose source codec is sourceCodec.
+func (cfg *apiConfig) outputCodec(sourceCodec string) string {
+	if cfg.needsReencode(sourceCodec) {
+		return videoEncoders[cfg.reencodeCodec].probeName
+	}
+	return sourceCodec
+}
+
+// fastStartCodecArgs returns the ffmpeg codec arguments for fast start
+// processing: a stream copy, or a re-encode when the source codec needs one.
+func (cfg *apiConfig) fastStartCodecArgs(sourceCodec string) []string {
+	if !cfg.needsReencode(sourceCodec) {
+		return []string{"-c", "copy"}
+	}
+	args := videoEncoders[cfg.reencodeCodec].args(cfg.reencodeCRF, cfg.reencodePreset)
+	// The source's audio may not fit in an MP4 either
+	return append(args, "-c:a", "aac")
+}
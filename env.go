@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt64 returns the integer value of the named environment variable, or
+// fallback when it isn't set.
+func envInt64(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", name, err)
+	}
+	return n
+}
+
+// envInt is envInt64 for values that fit in an int.
+func envInt(name string, fallback int) int {
+	return int(envInt64(name, int64(fallback)))
+}
+
+// envFloat64 returns the numeric value of the named environment variable, or
+// fallback when it isn't set.
+func envFloat64(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("%s must be a number: %v", name, err)
+	}
+	return f
+}
+
+// envDuration returns the named environment variable parsed as a duration
+// (e.g. "90s" or "5m"), or fallback when it isn't set.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s must be a duration: %v", name, err)
+	}
+	return d
+}
+
+// envBool returns the named environment variable parsed as a boolean (e.g.
+// "true" or "1"), or fallback when it isn't set.
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be a boolean: %v", name, err)
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+package main
+
+import "net/http"
+
+// errorCode is a stable, machine-readable identifier sent with every error
+// response, so clients can branch on (and localize) failures without parsing
+// the message.
+type errorCode string
+
+// Generic codes, used when a call site doesn't give a more specific one.
+const (
+	errCodeBadRequest   errorCode = "BAD_REQUEST"
+	errCodeUnauthorized errorCode = "UNAUTHORIZED"
+	errCodeTokenExpired errorCode = "TOKEN_EXPIRED"
+	errCodeForbidden    errorCode = "FORBIDDEN"
+	errCodeNotFound     errorCode = "NOT_FOUND"
+	errCodeConflict     errorCode = "CONFLICT"
+	errCodeValidation   errorCode = "VALIDATION_FAILED"
+	errCodeRateLimited  errorCode = "RATE_LIMITED"
+	errCodeServerBusy   errorCode = "SERVER_BUSY"
+	errCodeTimeout      errorCode = "TIMEOUT"
+	errCodeInternal     errorCode = "INTERNAL_ERROR"
+)
+
+// Upload-specific codes.
+const (
+	errCodeInvalidID            errorCode = "INVALID_ID"
+	errCodeInvalidForm          errorCode = "INVALID_FORM"
+	errCodeMissingFile          errorCode = "MISSING_FILE"
+	errCodeFileTooLarge         errorCode = "FILE_TOO_LARGE"
+	errCodeUnsupportedMediaType errorCode = "UNSUPPORTED_MEDIA_TYPE"
+	errCodeInvalidUploadID      errorCode = "INVALID_UPLOAD_ID"
+	errCodeInvalidRenditions    errorCode = "INVALID_RENDITIONS"
+	errCodeInvalidImage         errorCode = "INVALID_IMAGE"
+	errCodeImageRejected        errorCode = "IMAGE_REJECTED"
+	errCodeInvalidVideo         errorCode = "INVALID_VIDEO"
+	errCodeVideoTooLong         errorCode = "VIDEO_TOO_LONG"
+	errCodeProcessingFailed     errorCode = "PROCESSING_FAILED"
+	errCodeStorageError         errorCode = "STORAGE_ERROR"
+	errCodeInsufficientStorage  errorCode = "INSUFFICIENT_STORAGE"
+	errCodeInvalidCaptions      errorCode = "INVALID_CAPTIONS"
+	errCodeEmptyFile            errorCode = "EMPTY_FILE"
+	errCodeTruncatedUpload      errorCode = "TRUNCATED_UPLOAD"
+	errCodeQuotaExceeded        errorCode = "QUOTA_EXCEEDED"
+	errCodeChecksumMismatch     errorCode = "CHECKSUM_MISMATCH"
+)
+
+// defaultErrorCode returns the generic code for an HTTP status.
+func defaultErrorCode(status int) errorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return errCodeBadRequest
+	case http.StatusUnauthorized:
+		return errCodeUnauthorized
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusConflict:
+		return errCodeConflict
+	case http.StatusTooManyRequests:
+		return errCodeRateLimited
+	case http.StatusRequestEntityTooLarge:
+		return errCodeFileTooLarge
+	case http.StatusUnsupportedMediaType:
+		return errCodeUnsupportedMediaType
+	}
+	if status >= 500 {
+		return errCodeInternal
+	}
+	return errCodeBadRequest
+}
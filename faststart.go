@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// mp4FastStart reports whether the MP4 at path is laid out for fast start,
+// with its moov atom (the index players need before they can seek) ahead of
+// the mdat atom holding the media. It walks only the top-level boxes, so
+// it reads a few bytes per box however big the file is.
+func mp4FastStart(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, errors.New("no moov or mdat atom")
+			}
+			return false, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		switch boxType {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+
+		switch size {
+		case 0:
+			// The box runs to the end of the file
+			return false, errors.New("no moov or mdat atom")
+		case 1:
+			// A 64-bit size follows the type
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return false, fmt.Errorf("truncated %q box: %w", boxType, err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			if size < 16 {
+				return false, fmt.Errorf("invalid %q box size %d", boxType, size)
+			}
+		default:
+			if size < 8 {
+				return false, fmt.Errorf("invalid %q box size %d", boxType, size)
+			}
+		}
+		offset += size
+	}
+}
+
+// remuxFastStart copies the MP4 at filePath to a new file with its moov atom
+// moved to the front, without re-encoding anything, and returns the new
+// file's path. The caller removes it.
+func (cfg *apiConfig) remuxFastStart(ctx context.Context, filePath string) (string, error) {
+	outputPath := filePath + ".faststart"
+	_, err := cfg.runMedia(ctx, "ffmpeg",
+		"-i", filePath,
+		"-map", "0",
+		"-c", "copy",
+		"-movflags", "faststart",
+		"-f", "mp4",
+		outputPath,
+	)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// fastStartBackfillPageSize is how many videos a backfill fetches at a
+	// time
+	fastStartBackfillPageSize = 50
+	// maxFastStartBackfillConcurrency caps the concurrency query parameter
+	maxFastStartBackfillConcurrency = 16
+	// maxFastStartBackfillFailures caps the failures a run's report lists
+	maxFastStartBackfillFailures = 100
+)
+
+// Backfill run states.
+const (
+	backfillRunning  = "running"
+	backfillFinished = "finished"
+)
+
+// fastStartBackfill holds the current or most recent backfill run. Only one
+// runs at a time.
+type fastStartBackfill struct {
+	mu  sync.Mutex
+	run *fastStartBackfillRun
+}
+
+// fastStartBackfillRun is the progress report of a backfill.
+type fastStartBackfillRun struct {
+	Status      string     `json:"status"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	Concurrency int        `json:"concurrency"`
+	// Checked counts every video looked at, which is then remuxed, found to
+	// be fast start already, skipped or failed
+	Checked          int                        `json:"checked"`
+	Remuxed          int                        `json:"remuxed"`
+	AlreadyFastStart int                        `json:"already_fast_start"`
+	Skipped          int                        `json:"skipped"`
+	Failed           int                        `json:"failed"`
+	Failures         []fastStartBackfillFailure `json:"failures"`
+	// Error says why the run stopped early, if it did
+	Error *string `json:"error"`
+}
+
+type fastStartBackfillFailure struct {
+	VideoID uuid.UUID `json:"video_id"`
+	Error   string    `json:"error"`
+}
+
+// Outcomes of backfilling one video.
+type backfillOutcome int
+
+const (
+	backfillRemuxed backfillOutcome = iota
+	backfillAlreadyFastStart
+	backfillSkipped
+)
+
+// snapshot returns a copy of the current run, or nil when none has run.
+func (b *fastStartBackfill) snapshot() *fastStartBackfillRun {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.run == nil {
+		return nil
+	}
+	run := *b.run
+	run.Failures = slices.Clone(run.Failures)
+	return &run
+}
+
+// record adds the outcome of backfilling video to the current run.
+func (b *fastStartBackfill) record(videoID uuid.UUID, outcome backfillOutcome, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	run := b.run
+	run.Checked++
+	switch {
+	case err != nil:
+		run.Failed++
+		if len(run.Failures) < maxFastStartBackfillFailures {
+			run.Failures = append(run.Failures, fastStartBackfillFailure{VideoID: videoID, Error: err.Error()})
+		}
+	case outcome == backfillRemuxed:
+		run.Remuxed++
+	case outcome == backfillAlreadyFastStart:
+		run.AlreadyFastStart++
+	default:
+		run.Skipped++
+	}
+}
+
+// finish marks the current run finished, with the error that stopped it
+// early, if any.
+func (b *fastStartBackfill) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now().UTC()
+	b.run.Status = backfillFinished
+	b.run.FinishedAt = &now
+	if err != nil {
+		msg := err.Error()
+		b.run.Error = &msg
+	}
+}
+
+// handlerStartFastStartBackfill starts remuxing every uploaded video not yet
+// known to be fast start in the background, concurrency videos at a time
+// (2 by default), and responds 202 with the run's progress report. Videos
+// are only ever remuxed once, so an interrupted run can simply be started
+// again.
+func (cfg *apiConfig) handlerStartFastStartBackfill(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	concurrency := 2
+	if value := r.URL.Query().Get("concurrency"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxFastStartBackfillConcurrency {
+			msg := translatef(w, "concurrency must be between 1 and %d", maxFastStartBackfillConcurrency)
+			respondWithError(w, http.StatusBadRequest, msg, err)
+			return
+		}
+		concurrency = n
+	}
+
+	b := cfg.fastStartBackfill
+	b.mu.Lock()
+	if b.run != nil && b.run.Status == backfillRunning {
+		b.mu.Unlock()
+		respondWithError(w, http.StatusConflict, "A backfill is already running", nil)
+		return
+	}
+	b.run = &fastStartBackfillRun{
+		Status:      backfillRunning,
+		StartedAt:   time.Now().UTC(),
+		Concurrency: concurrency,
+		Failures:    []fastStartBackfillFailure{},
+	}
+	b.mu.Unlock()
+
+	go cfg.runFastStartBackfill(concurrency)
+
+	w.Header().Set("Location", "/admin/videos/faststart")
+	respondWithJSON(w, http.StatusAccepted, b.snapshot())
+}
+
+// handlerGetFastStartBackfill returns the progress report of the current or
+// most recent backfill.
+func (cfg *apiConfig) handlerGetFastStartBackfill(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+	run := cfg.fastStartBackfill.snapshot()
+	if run == nil {
+		respondWithError(w, http.StatusNotFound, "No backfill has run", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, run)
+}
+
+// runFastStartBackfill pages through the videos needing fast start and
+// backfills them, concurrency at a time.
+func (cfg *apiConfig) runFastStartBackfill(concurrency int) {
+	logger := slog.Default().With("task", "faststart_backfill")
+	ctx := context.WithValue(context.Background(), loggerContextKey{}, logger)
+	logger.Info("backfill started", "concurrency", concurrency)
+
+	var g errgroup.Group
+	g.SetLimit(concurrency)
+	// Deduplicated videos share a file, which only needs remuxing once
+	seen := map[string]bool{}
+	var runErr error
+	after := uuid.Nil
+	for {
+		videos, err := cfg.db.GetVideosNeedingFastStart(after, fastStartBackfillPageSize)
+		if err != nil {
+			runErr = fmt.Errorf("couldn't get videos: %w", err)
+			break
+		}
+		if len(videos) == 0 {
+			break
+		}
+		after = videos[len(videos)-1].ID
+
+		for _, video := range videos {
+			if seen[*video.VideoURL] {
+				continue
+			}
+			seen[*video.VideoURL] = true
+			g.Go(func() error {
+				outcome, err := cfg.backfillFastStart(ctx, video)
+				if err != nil {
+					logger.Warn("couldn't backfill video", "video_id", video.ID, "error", err)
+				}
+				cfg.fastStartBackfill.record(video.ID, outcome, err)
+				return nil
+			})
+		}
+	}
+	g.Wait()
+
+	cfg.fastStartBackfill.finish(runErr)
+	run := cfg.fastStartBackfill.snapshot()
+	logger.Info("backfill finished", "checked", run.Checked, "remuxed", run.Remuxed, "failed", run.Failed, "error", runErr)
+}
+
+// backfillFastStart makes sure the stored file of video is laid out for fast
+// start. A file that isn't is remuxed and uploaded under a new key in the
+// same place, every video using it is pointed at the new key, and the old
+// object is deleted. HLS videos are skipped.
+func (cfg *apiConfig) backfillFastStart(ctx context.Context, video database.Video) (backfillOutcome, error) {
+	if cfg.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.uploadTimeout)
+		defer cancel()
+	}
+
+	oldURL := *video.VideoURL
+	key, err := cfg.s3KeyFromURL(oldURL)
+	if err != nil {
+		return 0, err
+	}
+	if path.Base(key) == hlsPlaylistName {
+		return backfillSkipped, nil
+	}
+
+	sourcePath, err := cfg.downloadToTempFile(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer os.Remove(sourcePath)
+
+	fastStart, err := mp4FastStart(sourcePath)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read MP4 layout: %w", err)
+	}
+	if fastStart {
+		if err := cfg.db.SetVideoFastStart(oldURL); err != nil {
+			return 0, fmt.Errorf("couldn't update video: %w", err)
+		}
+		return backfillAlreadyFastStart, nil
+	}
+
+	// Remuxes share the processing capacity with uploads
+	if err := cfg.processingLimiter.sem.Acquire(ctx, 1); err != nil {
+		return 0, err
+	}
+	processedPath, err := cfg.remuxFastStart(ctx, sourcePath)
+	cfg.processingLimiter.sem.Release(1)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't remux video: %w", err)
+	}
+	defer os.Remove(processedPath)
+	if fastStart, err := mp4FastStart(processedPath); err != nil || !fastStart {
+		return 0, errors.New("remuxed video isn't fast start")
+	}
+
+	contentHash, err := hashFile(processedPath)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't hash video: %w", err)
+	}
+	ext := videoContainers["mp4"].ext
+	name := contentAddressedKey(contentHash, ext)
+	if !cfg.dedupe {
+		if name, err = cfg.generateS3Key(ext); err != nil {
+			return 0, err
+		}
+	}
+	newKey, err := normalizeS3Key(path.Dir(key) + "/" + name)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(processedPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := cfg.uploadObject(ctx, f, newKey, "video/mp4", video.UserID); err != nil {
+		return 0, fmt.Errorf("couldn't upload video: %w", err)
+	}
+	if err := cfg.db.ReplaceVideoFile(oldURL, cfg.objectURL(newKey), contentHash, info.Size()); err != nil {
+		return 0, fmt.Errorf("couldn't update video: %w", err)
+	}
+	// The old object is unused now, so failing to delete it only costs
+	// storage
+	if err := cfg.deleteObjectURLs(context.WithoutCancel(ctx), []string{oldURL}); err != nil {
+		loggerFromContext(ctx).Warn("couldn't delete old video object", "video_id", video.ID, "key", key, "error", err)
+	}
+	return backfillRemuxed, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBackfillFastStart(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	storeTestVideoFile(t, cfg, mock, &video, "landscape/old.mp4", testSlowStartMP4(4096))
+
+	outcome, err := cfg.backfillFastStart(context.Background(), video)
+	if err != nil {
+		t.Fatalf("backfillFastStart: %v", err)
+	}
+	if outcome != backfillRemuxed {
+		t.Fatalf("outcome = %v, want backfillRemuxed", outcome)
+	}
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := cfg.s3KeyFromURL(*video.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey == "landscape/old.mp4" || !strings.HasPrefix(newKey, "landscape/") {
+		t.Errorf("video moved to %s, want a new key in landscape/", newKey)
+	}
+	if video.FastStart == nil || !*video.FastStart {
+		t.Error("video isn't marked fast start")
+	}
+
+	// The remux is stored before the old file goes, so the video always has
+	// a file to point at
+	wantCalls := []string{
+		"GetObject landscape/old.mp4",
+		"PutObject " + newKey,
+		"DeleteObject landscape/old.mp4",
+	}
+	if calls := mock.Calls(); !slices.Equal(calls, wantCalls) {
+		t.Errorf("calls = %q, want %q", calls, wantCalls)
+	}
+	if keys := mock.Keys(); !slices.Equal(keys, []string{newKey}) {
+		t.Errorf("stored keys = %q, want only %s", keys, newKey)
+	}
+}
+
+func TestBackfillFastStartAlreadyFastStart(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	storeTestVideoFile(t, cfg, mock, &video, "landscape/video.mp4", testMP4(4096))
+
+	outcome, err := cfg.backfillFastStart(context.Background(), video)
+	if err != nil {
+		t.Fatalf("backfillFastStart: %v", err)
+	}
+	if outcome != backfillAlreadyFastStart {
+		t.Errorf("outcome = %v, want backfillAlreadyFastStart", outcome)
+	}
+	if calls := mock.Calls(); !slices.Equal(calls, []string{"GetObject landscape/video.mp4"}) {
+		t.Errorf("calls = %q, want only the download", calls)
+	}
+	video, _ = cfg.db.GetVideo(video.ID)
+	if video.FastStart == nil || !*video.FastStart {
+		t.Error("video isn't marked fast start")
+	}
+}
+
+func TestBackfillFastStartUploadFails(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	storeTestVideoFile(t, cfg, mock, &video, "landscape/old.mp4", testSlowStartMP4(4096))
+	mock.putErr = func(key string) error { return errors.New("AccessDenied") }
+
+	if _, err := cfg.backfillFastStart(context.Background(), video); err == nil {
+		t.Fatal("backfillFastStart succeeded, want an error")
+	}
+	if got, _ := cfg.db.GetVideo(video.ID); *got.VideoURL != *video.VideoURL {
+		t.Errorf("video URL = %s, want it unchanged", *got.VideoURL)
+	}
+	if _, ok := mock.Object("landscape/old.mp4"); !ok {
+		t.Error("old file was deleted although its replacement wasn't stored")
+	}
+	if deletes := mock.CallsTo("DeleteObject"); len(deletes) != 0 {
+		t.Errorf("DeleteObject calls = %q, want none", deletes)
+	}
+}
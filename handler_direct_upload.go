@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// stagingKeyPrefix is where browsers upload directly to S3. Staged objects
+// are only inputs to handlerFinalizeUpload, which stores the processed video
+// under the usual keys; a lifecycle rule on this prefix can expire uploads
+// that are never finalized.
+const stagingKeyPrefix = "staging/"
+
+// stagingPrefix returns the prefix of the staged uploads for a video.
+func stagingPrefix(videoID uuid.UUID) string {
+	return stagingKeyPrefix + videoID.String() + "/"
+}
+
+// handlerCreateUploadURL returns a presigned URL the client PUTs the video's
+// file to, straight to S3, and the key it will be stored under. The client
+// then passes the key to handlerFinalizeUpload to process it.
+func (cfg *apiConfig) handlerCreateUploadURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		UploadURL string            `json:"upload_url"`
+		Method    string            `json:"method"`
+		Headers   map[string]string `json:"headers"`
+		Key       string            `json:"key"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	name, err := cfg.generateS3Key(".mp4")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return
+	}
+	key, err := normalizeS3Key(stagingPrefix(video.ID) + name)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return
+	}
+
+	// The client sends the same Content-Type with the PUT
+	contentType := "video/mp4"
+	req, err := cfg.s3Client.PresignPutObject(r.Context(), &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &key,
+		ContentType: &contentType,
+	}, s3.WithPresignExpires(cfg.directUploadURLTTL))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't create upload URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadURL: req.URL,
+		Method:    req.Method,
+		Headers:   map[string]string{"Content-Type": contentType},
+		Key:       key,
+		ExpiresAt: time.Now().Add(cfg.directUploadURLTTL).UTC(),
+	})
+}
+
+// handlerFinalizeUpload runs the upload pipeline on a file the client
+// uploaded with a URL from handlerCreateUploadURL, named by the key in the
+// JSON body. The staged object is deleted afterwards, whether or not it was
+// a valid video, except after a dry run. Upload options such as renditions
+// go in the query string.
+func (cfg *apiConfig) handlerFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+	var params parameters
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	// Set once the key is known to belong to the video, so a request for
+	// someone else's video can't delete their staged upload
+	staged := false
+	cfg.uploadVideo(w, r, false, func(w http.ResponseWriter, r *http.Request) (videoSource, error) {
+		source, err := cfg.openStagedUpload(w, r, params.Key)
+		staged = !errors.Is(err, errNotStagedForVideo)
+		return source, err
+	})
+	// A dry run keeps the file so it can be finalized for real
+	if dryRun, _ := strconv.ParseBool(r.FormValue("dryRun")); staged && !dryRun {
+		// The request may have timed out, which mustn't stop the cleanup
+		ctx := context.WithoutCancel(r.Context())
+		if _, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &params.Key,
+		}); err != nil {
+			loggerFromContext(ctx).Warn("couldn't delete staged upload", "key", params.Key, "error", err)
+		}
+	}
+}
+
+// errNotStagedForVideo is returned for finalize keys outside the video's
+// staging prefix.
+var errNotStagedForVideo = errors.New("key isn't a staged upload for this video")
+
+// openStagedUpload opens the staged object at key, checking it belongs to
+// the video in the request path and fits the upload limit.
+func (cfg *apiConfig) openStagedUpload(w http.ResponseWriter, r *http.Request, key string) (videoSource, error) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return videoSource{}, errNotStagedForVideo
+	}
+	name, ok := strings.CutPrefix(key, stagingPrefix(videoID))
+	if !ok || name == "" || strings.Contains(name, "/") {
+		err := fmt.Errorf("%w: %q", errNotStagedForVideo, key)
+		respondWithError(w, http.StatusBadRequest, "Invalid upload key", err)
+		return videoSource{}, err
+	}
+
+	out, err := cfg.s3Client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			respondWithError(w, http.StatusNotFound, "Upload not found", err)
+			return videoSource{}, err
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't get uploaded video", err)
+		return videoSource{}, err
+	}
+
+	size := int64(-1)
+	if out.ContentLength != nil {
+		size = *out.ContentLength
+	}
+	if size > cfg.maxVideoUploadBytes {
+		out.Body.Close()
+		msg := translatef(w, "Video exceeds the maximum upload size of %s (%d bytes)", formatBytes(cfg.maxVideoUploadBytes), cfg.maxVideoUploadBytes)
+		err := fmt.Errorf("staged object is %d bytes, over %d", size, cfg.maxVideoUploadBytes)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+		return videoSource{}, err
+	}
+
+	var contentType string
+	if out.ContentType != nil {
+		contentType = *out.ContentType
+	}
+	return videoSource{
+		body:        http.MaxBytesReader(nil, out.Body, cfg.maxVideoUploadBytes),
+		size:        size,
+		contentType: contentType,
+	}, nil
+}
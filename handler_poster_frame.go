@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPosterCacheEntries bounds the poster frames kept in memory. Expired
+// frames are dropped when it's reached, and every frame if that isn't
+// enough.
+const maxPosterCacheEntries = 256
+
+// posterCache keeps recently extracted poster frames for ttl, so clients
+// asking for the same frame again don't cost another download and ffmpeg
+// run.
+type posterCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]posterCacheEntry
+}
+
+type posterCacheEntry struct {
+	jpeg      []byte
+	expiresAt time.Time
+}
+
+func newPosterCache(ttl time.Duration) *posterCache {
+	return &posterCache{ttl: ttl, entries: map[string]posterCacheEntry{}}
+}
+
+func (c *posterCache) get(key string, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.jpeg, true
+}
+
+func (c *posterCache) put(key string, frame []byte, now time.Time) {
+	if c.ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxPosterCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxPosterCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = posterCacheEntry{jpeg: frame, expiresAt: now.Add(c.ttl)}
+}
+
+// handlerGetPosterFrame responds with the frame of one of the user's videos
+// at t seconds as a JPEG, extracted on demand rather than stored. Frames are
+// cached for posterCacheTTL, both here and by the client.
+func (cfg *apiConfig) handlerGetPosterFrame(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	timestamp, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || timestamp < 0 || math.IsNaN(timestamp) || math.IsInf(timestamp, 0) {
+		respondWithError(w, http.StatusBadRequest, "Invalid timestamp", err)
+		return
+	}
+
+	// The URL changes whenever the video is replaced, so frames of an old
+	// file are never served for a new one
+	var cacheKey string
+	if video.VideoURL != nil {
+		cacheKey = *video.VideoURL + "@" + formatSeconds(timestamp)
+	}
+	poster, ok := cfg.posterCache.get(cacheKey, time.Now())
+	if !ok {
+		release, ok := cfg.acquireProcessingSlot(w, r, 1)
+		if !ok {
+			return
+		}
+		frame, err := cfg.videoFrame(w, r, video, timestamp, false)
+		release()
+		if err != nil {
+			return // error already handled
+		}
+		poster, err = posterJPEG(frame, cfg.thumbnailMaxEdge, cfg.thumbnailQuality)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't extract frame", err)
+			return
+		}
+		cfg.posterCache.put(cacheKey, poster, time.Now())
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(poster)))
+	// Frames are only served to the video's owner
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(cfg.posterCache.ttl.Seconds())))
+	w.Write(poster)
+}
+
+// posterJPEG scales a frame down to thumbnail size, as resizeThumbnail does,
+// and encodes it as a JPEG whether or not it needed scaling.
+func posterJPEG(frame []byte, maxEdge int, quality int) ([]byte, error) {
+	resized, ext, err := resizeThumbnail(bytes.NewReader(frame), maxEdge, quality)
+	if err != nil {
+		return nil, err
+	}
+	if ext != ".jpg" {
+		img, _, err := image.Decode(resized)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode frame: %w", err)
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, fmt.Errorf("couldn't encode frame: %w", err)
+		}
+		return buf.Bytes(), nil
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resized); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
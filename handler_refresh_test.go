@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestRefreshToken(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	createRefreshToken := func(token string, expiresIn time.Duration) string {
+		t.Helper()
+		_, err := cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+			Token:     token,
+			UserID:    userID,
+			ExpiresAt: time.Now().Add(expiresIn),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := createRefreshToken("valid-token", time.Hour)
+	expired := createRefreshToken("expired-token", -time.Hour)
+	revoked := createRefreshToken("revoked-token", time.Hour)
+
+	w := httptest.NewRecorder()
+	cfg.handlerRevoke(w, newUserRequest(http.MethodPost, "/api/revoke", revoked))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"expired", expired, http.StatusUnauthorized},
+		{"revoked", revoked, http.StatusUnauthorized},
+		{"unknown", "never-issued", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.handlerRefresh(w, newUserRequest(http.MethodPost, "/api/refresh", tt.token))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			got, err := auth.ValidateJWT(body.Token, cfg.jwtSecret)
+			if err != nil || got != userID {
+				t.Errorf("new access token is for %v (%v), want %v", got, err, userID)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// handlerCreateSignedCookies sets CloudFront signed cookies that let the
+// user load any of their objects from the distribution for signedCookieTTL,
+// so a page listing many videos needs no signed URL per asset. The cookies
+// are also returned in the body, for clients that can't share cookies with
+// the distribution's domain. They need the per-user key layout, which keeps
+// each user's objects under one prefix.
+func (cfg *apiConfig) handlerCreateSignedCookies(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Cookies   map[string]string `json:"cookies"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	userID, err := cfg.authenticate(w, r)
+	if err != nil {
+		return
+	}
+	if cfg.s3KeyLayout != keyLayoutUser || cfg.cfPrivateKey == nil || cfg.s3URLMode != urlModeCloudFront {
+		respondWithError(w, http.StatusNotImplemented, "Signed cookies aren't enabled", nil)
+		return
+	}
+
+	expiresAt := time.Now().Add(cfg.signedCookieTTL).UTC()
+	cookies, err := cfg.generateSignedCookies(userID.String()+"/", cfg.signedCookieTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign cookies", err)
+		return
+	}
+	for name, value := range cookies {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/",
+			Domain:   cfg.signedCookieDomain,
+			Expires:  expiresAt,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Cookies:   cookies,
+		ExpiresAt: expiresAt,
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerAddGalleryThumbnail adds an uploaded image to the end of a video's
+// thumbnail gallery. A video's first gallery thumbnail becomes its primary
+// thumbnail.
+func (cfg *apiConfig) handlerAddGalleryThumbnail(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	filePath, err := cfg.saveUploadedThumbnail(w, r)
+	if err != nil {
+		return
+	}
+
+	thumbnail, err := cfg.db.CreateThumbnail(video.ID, cfg.thumbnailURL(filePath))
+	if err != nil {
+		os.Remove(filePath)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
+	if thumbnail.IsPrimary {
+		video.ThumbnailURL = &thumbnail.URL
+		video.ThumbnailSrcset = nil
+		if err := cfg.db.UpdateVideo(*video); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusCreated, thumbnail)
+}
+
+// handlerListGalleryThumbnails returns a video's thumbnail gallery in
+// display order.
+func (cfg *apiConfig) handlerListGalleryThumbnails(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+	cfg.respondWithGallery(w, video.ID)
+}
+
+// handlerReorderGalleryThumbnails sets the display order of a video's
+// thumbnail gallery. thumbnail_ids must list every thumbnail exactly once.
+func (cfg *apiConfig) handlerReorderGalleryThumbnails(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ThumbnailIDs []uuid.UUID `json:"thumbnail_ids"`
+	}
+
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	var params parameters
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	err = cfg.db.ReorderThumbnails(video.ID, params.ThumbnailIDs)
+	if errors.Is(err, database.ErrThumbnailOrderMismatch) {
+		respondWithError(w, http.StatusBadRequest, "thumbnail_ids must list each of the video's thumbnails once", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reorder thumbnails", err)
+		return
+	}
+	cfg.respondWithGallery(w, video.ID)
+}
+
+// handlerSetPrimaryGalleryThumbnail makes a gallery thumbnail the video's
+// primary thumbnail.
+func (cfg *apiConfig) handlerSetPrimaryGalleryThumbnail(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+	thumbnail, err := cfg.galleryThumbnail(w, r, video.ID)
+	if err != nil {
+		return
+	}
+
+	if err := cfg.db.SetPrimaryThumbnail(video.ID, thumbnail.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update thumbnail", err)
+		return
+	}
+	video.ThumbnailURL = &thumbnail.URL
+	video.ThumbnailSrcset = nil
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.respondWithGallery(w, video.ID)
+}
+
+// handlerDeleteGalleryThumbnail removes a thumbnail from a video's gallery
+// and deletes its file. When it was the primary, the first remaining
+// thumbnail takes over.
+func (cfg *apiConfig) handlerDeleteGalleryThumbnail(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+	thumbnail, err := cfg.galleryThumbnail(w, r, video.ID)
+	if err != nil {
+		return
+	}
+
+	if err := cfg.db.DeleteThumbnail(video.ID, thumbnail.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete thumbnail", err)
+		return
+	}
+
+	if thumbnail.IsPrimary {
+		thumbnails, err := cfg.db.GetThumbnails(video.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnails", err)
+			return
+		}
+		video.ThumbnailURL = nil
+		video.ThumbnailSrcset = nil
+		for _, t := range thumbnails {
+			if t.IsPrimary {
+				video.ThumbnailURL = &t.URL
+			}
+		}
+		if err := cfg.db.UpdateVideo(*video); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+			return
+		}
+	}
+
+	if err := cfg.deleteThumbnailFile(&thumbnail.URL); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete thumbnail", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// galleryThumbnail looks up the thumbnail named by the thumbnailID path
+// value in videoID's gallery, responding with an error if there's none.
+func (cfg *apiConfig) galleryThumbnail(w http.ResponseWriter, r *http.Request, videoID uuid.UUID) (database.Thumbnail, error) {
+	thumbnailID, err := uuid.Parse(r.PathValue("thumbnailID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return database.Thumbnail{}, err
+	}
+
+	thumbnail, err := cfg.db.GetThumbnail(videoID, thumbnailID)
+	if errors.Is(err, database.ErrThumbnailNotFound) {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", err)
+		return database.Thumbnail{}, err
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail", err)
+		return database.Thumbnail{}, err
+	}
+	return thumbnail, nil
+}
+
+func (cfg *apiConfig) respondWithGallery(w http.ResponseWriter, videoID uuid.UUID) {
+	thumbnails, err := cfg.db.GetThumbnails(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnails", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, thumbnails)
+}
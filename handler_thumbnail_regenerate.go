@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerRegenerateThumbnail replaces a video's thumbnail with the frame at a
+// chosen timestamp, taken from the stored video. By default the frame is
+// found by fast seeking, which may land on a nearby keyframe; accurate
+// seeking gets the exact frame but decodes the video up to it, so it's
+// slower the later the timestamp.
+func (cfg *apiConfig) handlerRegenerateThumbnail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// Timestamp is the position of the frame, in seconds
+		Timestamp float64 `json:"timestamp"`
+		// Accurate selects accurate rather than fast seeking
+		Accurate bool `json:"accurate"`
+	}
+
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Timestamp < 0 || math.IsNaN(params.Timestamp) {
+		respondWithError(w, http.StatusBadRequest, "Invalid timestamp", nil)
+		return
+	}
+
+	frame, err := cfg.videoFrame(w, r, video, params.Timestamp, params.Accurate)
+	if err != nil {
+		return // error already handled
+	}
+
+	resized, fileExtension, err := resizeThumbnail(bytes.NewReader(frame), cfg.thumbnailMaxEdge, cfg.thumbnailQuality)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't extract frame", err)
+		return
+	}
+
+	filePath, err := cfg.saveThumbnailFile(fileExtension, resized)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
+
+	previousThumbnail := video.ThumbnailURL
+	if err := cfg.updateVideoThumbnail(w, video, filePath, nil); err != nil {
+		os.Remove(filePath)
+		return // error already handled
+	}
+	if err := cfg.deleteThumbnailFile(previousThumbnail); err != nil {
+		loggerFromContext(r.Context()).Warn("couldn't delete previous thumbnail", "video_id", video.ID, "error", err)
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(*video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// videoFrame returns the frame of the stored video at timestamp (in seconds)
+// as a PNG, responding with an error when there's no such frame or it can't
+// be extracted.
+func (cfg *apiConfig) videoFrame(w http.ResponseWriter, r *http.Request, video *database.Video, timestamp float64, accurate bool) ([]byte, error) {
+	key, err := cfg.frameSourceKey(w, video)
+	if err != nil {
+		return nil, err
+	}
+
+	// Videos uploaded before metadata was recorded have their duration read
+	// from the downloaded file below.
+	if video.Duration != nil && timestamp >= *video.Duration {
+		respondWithError(w, http.StatusBadRequest, translatef(w, "Timestamp is past the end of the video (%ss)", formatSeconds(*video.Duration)), nil)
+		return nil, errors.New("timestamp is past the end of the video")
+	}
+
+	sourcePath, duration, err := cfg.downloadFrameSource(w, r, video, key)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(sourcePath)
+	if timestamp >= duration {
+		respondWithError(w, http.StatusBadRequest, translatef(w, "Timestamp is past the end of the video (%ss)", formatSeconds(duration)), nil)
+		return nil, errors.New("timestamp is past the end of the video")
+	}
+
+	frame, err := cfg.extractFrame(r.Context(), sourcePath, timestamp, accurate)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't extract frame", err)
+		return nil, err
+	}
+	return frame, nil
+}
+
+// frameSourceKey returns the key of the stored video frames are taken from,
+// responding with an error when there isn't one frames can be taken from.
+func (cfg *apiConfig) frameSourceKey(w http.ResponseWriter, video *database.Video) (string, error) {
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been uploaded yet", nil)
+		return "", errors.New("video not uploaded")
+	}
+	key, err := cfg.s3KeyFromURL(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video in S3", err)
+		return "", err
+	}
+	if path.Base(key) == hlsPlaylistName {
+		respondWithError(w, http.StatusConflict, "Frames can't be extracted from HLS videos", nil)
+		return "", errors.New("HLS video")
+	}
+	return key, nil
+}
+
+// downloadFrameSource downloads the video at key to a temp file, returning
+// its path and the video's duration, which is probed for when it wasn't
+// recorded. The caller removes the file.
+func (cfg *apiConfig) downloadFrameSource(w http.ResponseWriter, r *http.Request, video *database.Video, key string) (string, float64, error) {
+	sourcePath, err := cfg.downloadToTempFile(r.Context(), key)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't download video", err)
+		return "", 0, err
+	}
+	if video.Duration != nil {
+		return sourcePath, *video.Duration, nil
+	}
+	meta, err := cfg.probeVideo(r.Context(), sourcePath)
+	if err != nil {
+		os.Remove(sourcePath)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't read video metadata", err)
+		return "", 0, err
+	}
+	return sourcePath, meta.Duration, nil
+}
+
+// downloadToTempFile copies the object at key to a new temp file and returns
+// its path. The caller removes the file.
+func (cfg *apiConfig) downloadToTempFile(ctx context.Context, key string) (string, error) {
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer out.Body.Close()
+
+	f, err := os.CreateTemp(cfg.tempDir, tempFilePrefix+"*"+path.Ext(key))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, out.Body); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// extractFrame returns the frame at timestamp (in seconds) as a PNG. Fast
+// seeking (-ss before -i) jumps straight to the keyframes around timestamp;
+// accurate seeking (-ss after -i) decodes every frame up to it instead.
+func (cfg *apiConfig) extractFrame(ctx context.Context, filePath string, timestamp float64, accurate bool) ([]byte, error) {
+	seek := []string{"-ss", formatSeconds(timestamp)}
+	input := []string{"-i", filePath}
+	var args []string
+	if accurate {
+		args = append(input, seek...)
+	} else {
+		args = append(seek, input...)
+	}
+	args = append(args,
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "png",
+		"pipe:1",
+	)
+	frame, err := cfg.runMedia(ctx, "ffmpeg", args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("no frame at %ss", formatSeconds(timestamp))
+	}
+	return frame, nil
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', -1, 64)
+}
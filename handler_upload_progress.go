@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const progressPollInterval = 250 * time.Millisecond
+
+// handlerUploadCreate registers an upload whose progress can be followed with
+// handlerUploadEvents. The returned ID is passed to the video upload as the
+// upload_id query parameter.
+func (cfg *apiConfig) handlerUploadCreate(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		UploadID string `json:"upload_id"`
+	}
+
+	userID, err := cfg.authenticate(w, r)
+	if err != nil {
+		return
+	}
+
+	uploadID, err := cfg.uploadProgress.create(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadID: uploadID,
+	})
+}
+
+// handlerUploadEvents streams an upload's progress as Server-Sent Events until
+// it completes or fails. EventSource can't send an Authorization header, so
+// the unguessable upload ID is what grants access here.
+func (cfg *apiConfig) handlerUploadEvents(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.PathValue("uploadID")
+	if _, ok := cfg.uploadProgress.get(uploadID); !ok {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+
+	var last uploadProgress
+	first := true
+	for {
+		progress, ok := cfg.uploadProgress.get(uploadID)
+		if !ok {
+			return
+		}
+
+		if first || progress.Stage != last.Stage || progress.Percent != last.Percent {
+			event := "progress"
+			if progress.Done {
+				event = progress.Stage
+			}
+			dat, err := json.Marshal(progress)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dat); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			first = false
+			last = progress
+		}
+		if progress.Done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -11,7 +13,6 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
@@ -23,58 +24,132 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return // error already handled
 	}
 
+	filePath, err := cfg.saveUploadedThumbnail(w, r)
+	if err != nil {
+		return // error already handled
+	}
+
+	var srcset database.ThumbnailSrcset
+	if len(cfg.thumbnailSrcsetSizes) > 0 {
+		srcset, err = cfg.saveThumbnailSrcset(r.Context(), filePath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail sizes", err)
+			return
+		}
+	}
+
+	// Update video record
+	if err := cfg.updateVideoThumbnail(w, video, filePath, srcset); err != nil {
+		return // error already handled
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// saveUploadedThumbnail validates the thumbnail in the request's form, shrinks
+// it if needed and saves it under assetsRoot, returning its path. Images the
+// moderator rejects aren't kept.
+func (cfg *apiConfig) saveUploadedThumbnail(w http.ResponseWriter, r *http.Request) (string, error) {
 	// Process thumbnail upload
 	file, header, err := cfg.processThumbnailUpload(w, r)
 	if err != nil {
-		return // error already handled
+		return "", err
 	}
 	defer file.Close()
+	// As with videos, spilled parts are only cleaned up for the server's own
+	// copy of the request
+	defer r.MultipartForm.RemoveAll()
+
+	return cfg.saveThumbnail(w, r, file, header.Header.Get("Content-Type"))
+}
+
+// saveThumbnail is saveUploadedThumbnail for an image already read from the
+// request, declared as contentType.
+func (cfg *apiConfig) saveThumbnail(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, contentType string) (string, error) {
+	// iPhone photos are HEICs, whatever they're declared as, and are stored
+	// as JPEGs
+	heif, err := isHEIF(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail", err)
+		return "", err
+	}
+	if heif {
+		converted, err := cfg.convertHEIFToJPEG(w, r, file)
+		if err != nil {
+			return "", err
+		}
+		file, contentType = bytes.NewReader(converted), "image/jpeg"
+	}
 
 	// Determine and validate file extension
-	fileExtension, err := cfg.determineFileExtension(header)
+	if _, err := cfg.determineFileExtension(contentType, file); err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Unsupported file type", nil)
+		return "", err
+	}
+
+	// Reject tracking pixels and huge images before decoding them
+	width, height, err := imageDimensions(file)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unsupported file type", nil)
-		return
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Invalid image", err)
+		return "", err
+	}
+	if err := cfg.checkThumbnailDimensions(w, width, height); err != nil {
+		return "", err
+	}
+
+	// Shrink oversized images before storing them
+	resized, fileExtension, err := resizeThumbnail(file, cfg.thumbnailMaxEdge, cfg.thumbnailQuality)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Invalid image", err)
+		return "", err
 	}
 
 	// Save file to disk
-	filePath, err := cfg.saveThumbnailFile(fileExtension, file)
+	filePath, err := cfg.saveThumbnailFile(fileExtension, resized)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
-		return
+		return "", err
 	}
 
-	// Update video record
-	if err := cfg.updateVideoThumbnail(w, video, filePath); err != nil {
-		return // error already handled
+	if err := cfg.moderateThumbnail(w, r, filePath); err != nil {
+		return "", err
 	}
-
-	respondWithJSON(w, http.StatusOK, video)
+	return filePath, nil
 }
 
 // Helper methods:
 
+// checkThumbnailDimensions responds with an error when a width x height
+// image is outside the thumbnail size bounds.
+func (cfg *apiConfig) checkThumbnailDimensions(w http.ResponseWriter, width, height int) error {
+	if width < cfg.thumbnailMinDimension || height < cfg.thumbnailMinDimension ||
+		width > cfg.thumbnailMaxDimension || height > cfg.thumbnailMaxDimension {
+		msg := translatef(w, "Image must be between %d and %d pixels on each side", cfg.thumbnailMinDimension, cfg.thumbnailMaxDimension)
+		err := fmt.Errorf("image is %dx%d", width, height)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, msg, err)
+		return err
+	}
+	return nil
+}
+
 func (cfg *apiConfig) validateUserAndVideo(w http.ResponseWriter, r *http.Request) (*database.Video, uuid.UUID, error) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return nil, uuid.Nil, err
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	userID, err := cfg.authenticate(w, r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return nil, uuid.Nil, err
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return nil, uuid.Nil, err
 	}
-
-	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return nil, uuid.Nil, err
@@ -89,32 +164,57 @@ func (cfg *apiConfig) validateUserAndVideo(w http.ResponseWriter, r *http.Reques
 	return &video, userID, nil
 }
 
-func (cfg *apiConfig) processThumbnailUpload(w http.ResponseWriter, r *http.Request) (io.ReadCloser, *multipart.FileHeader, error) {
-	const maxMemory = 10 << 20
-	if err := r.ParseMultipartForm(maxMemory); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+func (cfg *apiConfig) processThumbnailUpload(w http.ResponseWriter, r *http.Request) (multipart.File, *multipart.FileHeader, error) {
+	if err := cfg.parseThumbnailForm(w, r); err != nil {
 		return nil, nil, err
 	}
 
 	file, header, err := r.FormFile("thumbnail")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Missing thumbnail file", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Missing thumbnail file", err)
 		return nil, nil, err
 	}
 	return file, header, nil
 }
 
-func (cfg *apiConfig) determineFileExtension(header *multipart.FileHeader) (string, error) {
+// parseThumbnailForm parses a thumbnail upload's multipart form, refusing
+// with a 413 requests over maxThumbnailUploadBytes before any more of them is
+// buffered.
+func (cfg *apiConfig) parseThumbnailForm(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailUploadBytes)
+	if err := r.ParseMultipartForm(cfg.thumbnailMultipartMemoryBytes); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			msg := translatef(w, "Thumbnail exceeds the maximum upload size of %s (%d bytes)", formatBytes(maxBytesErr.Limit), maxBytesErr.Limit)
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+			return err
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+		return err
+	}
+	return nil
+}
+
+// determineFileExtension returns the extension for the uploaded image. When
+// the declared Content-Type is missing or generic, the type is sniffed from
+// the start of file instead.
+func (cfg *apiConfig) determineFileExtension(contentType string, file io.ReadSeeker) (string, error) {
 	extensions := map[string]string{
 		"image/jpeg": ".jpg",
 		"image/png":  ".png",
+		"image/webp": ".webp",
 	}
 
 	// Parse media type from Content-Type header
-	contentType := header.Header.Get("Content-Type")
-	mediaType, _, err := mime.ParseMediaType(contentType)
-	if err != nil {
-		return "", fmt.Errorf("invalid Content-Type header: %w", err)
+	var mediaType string
+	if untrustedContentType(contentType) {
+		var err error
+		mediaType, err = sniffContentType(file)
+		if err != nil {
+			return "", fmt.Errorf("couldn't sniff content type: %w", err)
+		}
+	} else {
+		mediaType, _, _ = mime.ParseMediaType(contentType)
 	}
 
 	// Check against allowed types
@@ -124,18 +224,19 @@ func (cfg *apiConfig) determineFileExtension(header *multipart.FileHeader) (stri
 	return "", fmt.Errorf("unsupported media type: %s", mediaType)
 }
 
+// saveThumbnailFile stores the image read from src under assetsRoot with a
+// random name, stripped of its metadata, and returns its path.
 func (cfg *apiConfig) saveThumbnailFile(ext string, src io.Reader) (string, error) {
-	// Generate 32 random bytes
-	randomBytes := make([]byte, 32)
-	_, err := rand.Read(randomBytes)
+	// EXIF can carry the GPS position the photo was taken at
+	src, err := cfg.sanitizeImage(src)
 	if err != nil {
-		return "", fmt.Errorf("could not generate random bytes: %w", err)
+		return "", fmt.Errorf("couldn't sanitize image: %w", err)
 	}
 
-	// Encode to URL-safe base64 without padding
-	randomString := base64.RawURLEncoding.EncodeToString(randomBytes)
-	fileName := randomString + ext
-	filePath := filepath.Join(cfg.assetsRoot, fileName)
+	filePath, err := cfg.newThumbnailPath(ext)
+	if err != nil {
+		return "", err
+	}
 
 	dst, err := os.Create(filePath)
 	if err != nil {
@@ -149,104 +250,35 @@ func (cfg *apiConfig) saveThumbnailFile(ext string, src io.Reader) (string, erro
 	return filePath, nil
 }
 
-func (cfg *apiConfig) updateVideoThumbnail(w http.ResponseWriter, video *database.Video, filePath string) error {
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filepath.Base(filePath))
-	video.ThumbnailURL = &thumbnailURL
-
-	if err := cfg.db.UpdateVideo(*video); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return err
-	}
-	return nil
-}
-
-func (cfg *apiConfig) handlerUploadThumbnailMonolith(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
-		return
-	}
-
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
-	}
-
-	// Parse multipart form (10MB max)
-	const maxMemory = 10 << 20
-	if err := r.ParseMultipartForm(maxMemory); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
-		return
-	}
-
-	// Get file from form
-	file, header, err := r.FormFile("thumbnail")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Missing thumbnail file", err)
-		return
-	}
-	defer file.Close()
-
-	// Get video from database
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
-		return
-	}
-
-	// Verify ownership
-	userIDUUID, err := uuid.Parse(userID.String())
-	if err != nil || video.UserID != userIDUUID {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized access", nil)
-		return
-	}
-	// Determine file extension from Content-Type header
-	extensions := map[string]string{
-		"image/jpeg": ".jpg",
-		"image/png":  ".png",
-		// Add more extensions as needed
-	}
-	fileExtension, ok := extensions[header.Header.Get("Content-Type")]
-	if !ok {
-		respondWithError(w, http.StatusBadRequest, "Unsupported file type", nil)
-		return
+// newThumbnailPath returns a random path under assetsRoot for a thumbnail
+// stored with the extension ext.
+func (cfg *apiConfig) newThumbnailPath(ext string) (string, error) {
+	// Generate 32 random bytes
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("could not generate random bytes: %w", err)
 	}
 
-	// Create full path for new file
-	filePath := filepath.Join(cfg.assetsRoot, fmt.Sprintf("%s%s", videoID, fileExtension))
-
-	// Create new file
-	newFile, err := os.Create(filePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create file", err)
-		return
-	}
-	defer newFile.Close()
+	// Encode to URL-safe base64 without padding
+	randomString := base64.RawURLEncoding.EncodeToString(randomBytes)
+	return filepath.Join(cfg.assetsRoot, randomString+ext), nil
+}
 
-	// Copy contents from multipart.File to new file on disk
-	_, err = io.Copy(newFile, file)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't copy file contents", err)
-		return
-	}
+// thumbnailURL returns the URL a thumbnail saved at filePath is served from.
+func (cfg *apiConfig) thumbnailURL(filePath string) string {
+	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filepath.Base(filePath))
+}
 
-	// Update thumbnail_url
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s%s", cfg.port, videoID, fileExtension)
+// updateVideoThumbnail points video at the thumbnail saved at filePath,
+// replacing the previous thumbnail's sizes with srcset.
+func (cfg *apiConfig) updateVideoThumbnail(w http.ResponseWriter, video *database.Video, filePath string, srcset database.ThumbnailSrcset) error {
+	thumbnailURL := cfg.thumbnailURL(filePath)
 	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailSrcset = srcset
 
-	// Update database record
-	if err := cfg.db.UpdateVideo(video); err != nil {
+	if err := cfg.db.UpdateVideo(*video); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+		return err
 	}
-
-	respondWithJSON(w, http.StatusOK, video)
+	return nil
 }
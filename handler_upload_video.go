@@ -3,150 +3,709 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"path"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
 )
 
+// uploadDryRunResult is the response to a dryRun upload: what the video
+// would be stored as, without storing it.
+type uploadDryRunResult struct {
+	DryRun      bool    `json:"dry_run"`
+	Prefix      string  `json:"prefix"`
+	ContentType string  `json:"content_type"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Duration    float64 `json:"duration"`
+	Codec       string  `json:"codec"`
+	Format      string  `json:"format"`
+	HasAudio    bool    `json:"has_audio"`
+	// Reencode reports whether the video would be re-encoded rather than
+	// remuxed
+	Reencode bool `json:"reencode"`
+}
+
+// handlerUploadVideo uploads a video's file. It responds 201 Created, with
+// the video's URL in Location, since the file is a new resource.
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
+	cfg.uploadVideo(w, r, false, cfg.openVideoUpload)
+}
+
+// handlerReplaceVideo uploads a new file for an existing video, keeping its
+// ID, metadata and thumbnail. The previous file and the assets derived from
+// it are deleted only once the new file is stored.
+func (cfg *apiConfig) handlerReplaceVideo(w http.ResponseWriter, r *http.Request) {
+	cfg.uploadVideo(w, r, true, cfg.openVideoUpload)
+}
+
+// videoSource is the file an upload receives, before it's saved.
+type videoSource struct {
+	body io.ReadCloser
+	// size is the file's length in bytes, or -1 when it isn't known up
+	// front
+	size int64
+	// contentType is the type the client (or remote server) declared
+	contentType string
+	// thumbnail is the image sent in the form's thumbnail field, if any
+	thumbnail *formThumbnail
+	// contentMD5 is the Content-MD5 header of the video's form part, the
+	// base64 MD5 digest the client says the file has, if any. A request's
+	// own Content-MD5 covers the whole form rather than the file.
+	contentMD5 string
+}
+
+// openVideoFunc opens the file of an upload request. It responds with an
+// error itself when the file can't be opened.
+type openVideoFunc func(w http.ResponseWriter, r *http.Request) (videoSource, error)
+
+// openVideoUpload opens the file pushed in the request's multipart form.
+// With streamUploads, it's read straight off the request body rather than
+// the form being parsed (and the file spilled to disk) first.
+func (cfg *apiConfig) openVideoUpload(w http.ResponseWriter, r *http.Request) (videoSource, error) {
+	if cfg.streamUploads {
+		return cfg.openVideoUploadStream(w, r)
+	}
+	file, header, err := cfg.processVideoUpload(w, r)
+	if err != nil {
+		return videoSource{}, err
+	}
+	thumbnail, err := cfg.openFormThumbnail(r)
+	if err != nil {
+		file.Close()
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail", err)
+		return videoSource{}, err
+	}
+	return videoSource{
+		body:        file,
+		size:        header.Size,
+		contentType: header.Header.Get("Content-Type"),
+		thumbnail:   thumbnail,
+		contentMD5:  header.Header.Get("Content-MD5"),
+	}, nil
+}
+
+// uploadVideo runs the upload pipeline for the video in the request path,
+// on the file opened by open. With replace, assets derived from the previous
+// file are dropped from the record and their objects deleted after the new
+// file is stored.
+func (cfg *apiConfig) uploadVideo(w http.ResponseWriter, r *http.Request, replace bool, open openVideoFunc) {
+	// Deferred first so it runs last: by the time a panic is recovered here,
+	// the other deferred calls have already removed the temp files.
+	defer func() {
+		if rec := recover(); rec != nil {
+			loggerFromContext(r.Context()).Error("panic uploading video", "video_id", r.PathValue("videoID"), "panic", rec, "stack", string(debug.Stack()))
+			respondWithError(w, http.StatusInternalServerError, "Couldn't upload video", nil)
+		}
+	}()
+
+	// Warn about uploads slower than slowUploadThreshold, with the time
+	// each stage took
+	start := time.Now()
+	ctx, timings := withStageTimings(r.Context())
+	r = r.WithContext(ctx)
+	defer cfg.logSlowUpload(r, start, timings)
+
 	// Validate user and video ownership
-	video, _, err := cfg.validateUserAndVideo(w, r)
+	video, userID, err := cfg.validateUserAndVideo(w, r)
 	if err != nil {
 		return
 	}
+	previous := *video
+	if replace {
+		video.Renditions = nil
+		video.AudioURL = nil
+		video.PreviewURL = nil
+		video.SpriteVTTURL = nil
+		video.PerceptualHash = nil
+	}
 
-	// Process video upload
-	file, header, err := cfg.processVideoUpload(w, r)
-	if err != nil {
+	// A retried request with the same Idempotency-Key gets the original
+	// response rather than uploading the video again
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			msg := translatef(w, "Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength)
+			respondWithError(w, http.StatusBadRequest, msg, nil)
+			return
+		}
+		state, stored := cfg.uploadIdempotency.begin(userID, key, r.Method+" "+r.URL.Path, time.Now())
+		switch state {
+		case idempotencyReplay:
+			stored.replay(w)
+			return
+		case idempotencyInFlight:
+			respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress", nil)
+			return
+		case idempotencyKeyReused:
+			respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request", nil)
+			return
+		}
+		rec := &recordingResponseWriter{ResponseWriter: w}
+		w = rec
+		defer func() {
+			cfg.uploadIdempotency.finish(userID, key, rec, time.Now())
+		}()
+	}
+
+	// Limit how often each user can upload. A background job was counted
+	// when it was queued.
+	_, isJob := jobUser(r.Context())
+	if cfg.uploadLimiter != nil && !isJob {
+		if ok, retryAfter := cfg.uploadLimiter.allow(userID, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			respondWithError(w, http.StatusTooManyRequests, "Too many uploads, try again later", nil)
+			return
+		}
+	}
+
+	// Clients can follow this upload's progress by passing an ID created
+	// with POST /api/uploads.
+	uploadID := r.URL.Query().Get("upload_id")
+	if uploadID != "" && !cfg.uploadProgress.belongsTo(uploadID, userID) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidUploadID, "Invalid upload ID", nil)
 		return
 	}
-	defer file.Close()
+	succeeded := false
+	defer func() {
+		cfg.uploadProgress.finish(uploadID, succeeded)
+		result := outcomeError
+		if succeeded {
+			result = outcomeSuccess
+		}
+		videoUploadsTotal.WithLabelValues(result).Inc()
+	}()
 
-	// Validate file type
-	if err := cfg.validateVideoType(header); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unsupported file type", err)
+	// Receive the video, if there's room for it
+	if err := cfg.checkFreeDiskSpace(w, r, r.ContentLength); err != nil {
+		return
+	}
+	source, err := open(w, r)
+	if err != nil {
 		return
 	}
+	defer source.body.Close()
+	// The server only cleans up the form of the request it created, and
+	// middleware hands handlers a copy, so remove spilled parts here
+	defer func() {
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+		}
+	}()
 
-	// Create temp file
-	tempFile, err := cfg.createTempFile(w)
+	// Optional renditions, e.g. renditions=720,480
+	renditionHeights, err := parseRenditionHeights(r.FormValue("renditions"))
 	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRenditions, "Invalid renditions", err)
 		return
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
 
-	// Save to temp file
-	if err := cfg.saveToTempFile(w, file, tempFile); err != nil {
+	// Optional delivery format: a single MP4 (the default) or an HLS package
+	format := r.FormValue("format")
+	if format != "" && format != videoFormatMP4 && format != videoFormatHLS {
+		respondWithError(w, http.StatusBadRequest, "Invalid format", fmt.Errorf("unsupported format %q", format))
+		return
+	}
+
+	// Optional audio-only copy, e.g. extractAudio=true&audio_codec=mp3
+	extractAudio := false
+	if value := r.FormValue("extractAudio"); value != "" {
+		extractAudio, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid extractAudio", err)
+			return
+		}
+	}
+	audioCodec := r.FormValue("audio_codec")
+	if audioCodec == "" {
+		audioCodec = defaultAudioCodec
+	}
+	if _, ok := audioFormats[audioCodec]; !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid audio codec", fmt.Errorf("unsupported audio codec %q", audioCodec))
 		return
 	}
 
-	// Process video for fast start
-	processedPath, err := cfg.processVideoForFastStart(tempFile.Name())
+	// Optional animated GIF preview, e.g. animatedPreview=true&preview_start=5
+	animatedPreview := false
+	if value := r.FormValue("animatedPreview"); value != "" {
+		animatedPreview, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid animatedPreview", err)
+			return
+		}
+	}
+	previewStart, err := parsePreviewSeconds(r.FormValue("preview_start"), 0)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to process video", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid preview_start", err)
+		return
+	}
+	previewDuration, err := parsePreviewSeconds(r.FormValue("preview_duration"), defaultPreviewDurationSeconds)
+	if err != nil || previewDuration == 0 || previewDuration > maxPreviewDurationSeconds {
+		msg := translatef(w, "preview_duration must be greater than 0 and at most %d seconds", maxPreviewDurationSeconds)
+		respondWithError(w, http.StatusBadRequest, msg, err)
+		return
+	}
+
+	// Optional watermark, e.g. watermark=true&watermark_position=top-left
+	watermark := false
+	if value := r.FormValue("watermark"); value != "" {
+		watermark, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid watermark", err)
+			return
+		}
+	}
+	watermarkPosition := cfg.watermarkPosition
+	if value := r.FormValue("watermark_position"); value != "" {
+		if _, ok := watermarkPositions[value]; !ok {
+			respondWithError(w, http.StatusBadRequest, "Invalid watermark_position", nil)
+			return
+		}
+		watermarkPosition = value
+	}
+	if watermark && cfg.watermarkPath == "" {
+		respondWithError(w, http.StatusNotImplemented, "Watermarking isn't enabled", nil)
 		return
 	}
-	defer os.Remove(processedPath)
 
-	// Open processed file
-	processedFile, err := os.Open(processedPath)
+	// Options whose stage the operator took out of the pipeline
+	for name, requested := range map[string]bool{
+		stageWatermark:  watermark,
+		stageRenditions: len(renditionHeights) > 0,
+		stageAudio:      extractAudio,
+		stagePreview:    animatedPreview,
+	} {
+		if requested && !cfg.hasUploadStage(name) {
+			msg := translatef(w, "The %s stage is turned off", name)
+			respondWithError(w, http.StatusNotImplemented, msg, nil)
+			return
+		}
+	}
+
+	// With dryRun=true the file is only validated and probed: nothing is
+	// stored and the video record is left alone
+	dryRun := false
+	if value := r.FormValue("dryRun"); value != "" {
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid dryRun", err)
+			return
+		}
+	}
+
+	// Optional key prefix chosen by the client instead of the one derived
+	// from the aspect ratio, e.g. prefixOverride=landscape
+	prefixOverride := ""
+	if value := r.FormValue("prefixOverride"); value != "" {
+		prefixOverride, err = cfg.normalizeAspectPrefix(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid prefix override", err)
+			return
+		}
+	}
+
+	// Validate file type. A missing or generic Content-Type is checked
+	// against the file itself once it's been probed.
+	contentType, err := cfg.validateVideoType(source.contentType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Unsupported file type", err)
 		return
 	}
-	defer processedFile.Close()
 
-	// Determine prefix
-	// Get aspect ratio
-	prefix, err := cfg.getVideoAspectRatio(tempFile.Name())
+	// Optional checksum of the file, checked once it's been received
+	var expectedMD5 []byte
+	if source.contentMD5 != "" {
+		expectedMD5, err = base64.StdEncoding.DecodeString(source.contentMD5)
+		if err != nil || len(expectedMD5) != md5.Size {
+			respondWithError(w, http.StatusBadRequest, "Invalid Content-MD5", err)
+			return
+		}
+	}
+
+	// Create temp file
+	tempFile, err := cfg.createTempFile(w)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't determine aspect ratio", err)
 		return
 	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	src := newProgressReader(source.body, source.size, func(fraction float64) {
+		cfg.uploadProgress.update(uploadID, stageSaving, fraction*50)
+	})
+
+	// A fast start MP4 that needs no processing can be streamed to S3 as
+	// it's received, with only its head, up to the end of the moov atom,
+	// saved for probing. Anything else is saved whole first.
+	// Uploads processed in the background are stored whole first, as are
+	// ones of unknown size when there's a quota to check them against.
+	enqueue := cfg.asyncProcessing && !isJob
+	streaming := cfg.streamUploads && !enqueue && !dryRun && !cfg.dedupe && format != videoFormatHLS &&
+		len(renditionHeights) == 0 && !extractAudio && !animatedPreview && !watermark &&
+		(cfg.storageQuotaBytes == 0 || source.size >= 0) && expectedMD5 == nil
+	var head []byte
+	if streaming {
+		head, streaming, err = readMP4Head(src, maxStreamHeadBytes)
+		if err != nil {
+			respondWithSaveError(w, err)
+			return
+		}
+	}
 
-	// Generate S3 key (i.e., random filename)
-	key, err := cfg.generateS3Key()
+	// Save to temp file
+	if streaming {
+		err = cfg.saveToTempFile(w, bytes.NewReader(head), tempFile)
+	} else {
+		received := md5.New()
+		err = cfg.saveToTempFile(w, io.TeeReader(io.MultiReader(bytes.NewReader(head), src), received), tempFile)
+		if err == nil && expectedMD5 != nil && !bytes.Equal(received.Sum(nil), expectedMD5) {
+			err = fmt.Errorf("received file's MD5 is %s, expected %s", base64.StdEncoding.EncodeToString(received.Sum(nil)), source.contentMD5)
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeChecksumMismatch, "Video doesn't match its Content-MD5", err)
+		}
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
 		return
 	}
+	if !streaming {
+		if err := checkReceivedSize(w, src.pos, source.size); err != nil {
+			return
+		}
+		videoUploadBytes.Observe(float64(src.pos))
+	}
 
-	// pseudo file path
-	prefixedKey := prefix + key
+	// Wait for processing capacity before running ffmpeg. Each rendition,
+	// and the watermark, is another transcode. A streamed upload only needs
+	// it for the probe.
+	weight := 1 + len(renditionHeights)
+	if watermark {
+		weight++
+	}
+	release, ok := cfg.acquireProcessingSlot(w, r, int64(weight))
+	if !ok {
+		return
+	}
+	release = sync.OnceFunc(release)
+	defer release()
 
-	// Upload to S3 with prefixed key
-	if err := cfg.uploadToS3(r.Context(), w, processedFile, prefixedKey, header); err != nil {
+	// Read the video's metadata, and reject overly long videos before
+	// spending CPU on processing them
+	meta, err := cfg.probeVideo(r.Context(), tempFile.Name())
+	switch {
+	case errors.Is(err, errNoVideoStream):
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeInvalidVideo, "File has no video stream", err)
+		return
+	case errors.Is(err, errInvalidDimensions), errors.Is(err, errInvalidDuration):
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeInvalidVideo, "Video stream is invalid", err)
 		return
+	case errors.Is(err, errProbeTimeout):
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeInvalidVideo, "Timed out reading video metadata", err)
+		return
+	case err != nil:
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't read video metadata", err)
+		return
+	}
+	if contentType == "" {
+		var ok bool
+		if contentType, ok = videoTypeFromFormat(meta.Format); !ok {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Unsupported file type", fmt.Errorf("unsupported container format: %s", meta.Format))
+			return
+		}
+	}
+	if extractAudio && !meta.HasAudio {
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeInvalidVideo, "Video has no audio track", nil)
+		return
+	}
+	if cfg.maxVideoDuration > 0 && meta.Duration > cfg.maxVideoDuration.Seconds() {
+		length := time.Duration(meta.Duration * float64(time.Second)).Round(time.Second)
+		msg := translatef(w, "Video is too long: %s exceeds the maximum duration of %s", length, cfg.maxVideoDuration)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeVideoTooLong, msg, nil)
+		return
+	}
+	if animatedPreview {
+		if previewStart >= meta.Duration {
+			respondWithError(w, http.StatusBadRequest, "preview_start is past the end of the video", nil)
+			return
+		}
+		previewDuration = min(previewDuration, meta.Duration-previewStart)
+	}
+	if dryRun {
+		prefix := prefixOverride
+		if prefix == "" {
+			prefix = cfg.aspectPrefixFor(meta.Width, meta.Height)
+		}
+		succeeded = true
+		respondWithJSON(w, http.StatusOK, uploadDryRunResult{
+			DryRun:      true,
+			Prefix:      prefix,
+			ContentType: contentType,
+			Width:       meta.Width,
+			Height:      meta.Height,
+			Duration:    meta.Duration,
+			Codec:       meta.Codec,
+			Format:      meta.Format,
+			HasAudio:    meta.HasAudio,
+			Reencode:    cfg.needsReencode(meta.Codec),
+		})
+		return
+	}
+	// A thumbnail sent along with the video is stored with it, in the same
+	// update of the record. One that's invalid is dropped with a warning
+	// rather than failing the upload.
+	var warnings []uploadWarning
+	var thumbnailPath string
+	thumbnailStored := false
+	if source.thumbnail != nil {
+		var warning *uploadWarning
+		thumbnailPath, warning = cfg.saveFormThumbnail(w, r, source.thumbnail)
+		if warning != nil {
+			warnings = append(warnings, *warning)
+		} else {
+			defer func() {
+				if !thumbnailStored {
+					os.Remove(thumbnailPath)
+				}
+			}()
+			thumbnailURL := cfg.thumbnailURL(thumbnailPath)
+			video.ThumbnailURL = &thumbnailURL
+			video.ThumbnailSrcset = nil
+		}
+	}
+
+	// The file's valid, so the rest can happen in the background. The
+	// thumbnail doesn't need to wait for it. The quota is checked against
+	// the file as received, to fail early, and again once it's processed.
+	if enqueue {
+		release()
+		if err := cfg.checkStorageQuota(w, *video, src.pos); err != nil {
+			return
+		}
+		if thumbnailPath != "" {
+			if err := cfg.db.UpdateVideo(*video); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+				return
+			}
+			thumbnailStored = true
+			cfg.deleteReplacedThumbnail(r.Context(), previous)
+		}
+		if err := cfg.enqueueVideoJob(w, r, video, tempFile.Name(), contentType, replace, warnings); err == nil {
+			succeeded = true
+		}
+		return
+	}
+	video.Width = &meta.Width
+	video.Height = &meta.Height
+	video.Duration = &meta.Duration
+	codec := cfg.outputCodec(meta.Codec)
+	video.Codec = &codec
+
+	// A streamed video that turns out to need re-encoding can't skip
+	// processing after all, so the rest of it is saved too
+	if streaming && cfg.needsReencode(meta.Codec) {
+		streaming = false
+		if _, err := tempFile.Seek(0, io.SeekEnd); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
+			return
+		}
+		if err := cfg.saveToTempFile(w, src, tempFile); err != nil {
+			return
+		}
+		if err := checkReceivedSize(w, src.pos, source.size); err != nil {
+			return
+		}
+		videoUploadBytes.Observe(float64(src.pos))
+	}
+
+	var objectKey string
+	if streaming {
+		// Nothing left to run ffmpeg on
+		release()
+		cfg.uploadProgress.update(uploadID, stageUploading, 50)
+		if err := cfg.checkStorageQuota(w, *video, source.size); err != nil {
+			return
+		}
+		objectKey, err = cfg.uploadStreamedVideo(r.Context(), w, video, meta, bytes.NewReader(head), src, prefixOverride, contentType, userID)
+		if err != nil {
+			return
+		}
+		videoUploadBytes.Observe(float64(src.pos))
+		storedSize := src.pos
+		video.StorageBytes = &storedSize
+	} else {
+		cfg.uploadProgress.update(uploadID, stageProcessing, 50)
+		state := &pipelineState{
+			w:                 w,
+			video:             video,
+			userID:            userID,
+			uploadID:          uploadID,
+			meta:              meta,
+			format:            format,
+			watermark:         watermark,
+			watermarkPosition: watermarkPosition,
+			renditionHeights:  renditionHeights,
+			extractAudio:      extractAudio,
+			audioCodec:        audioCodec,
+			animatedPreview:   animatedPreview,
+			previewStart:      previewStart,
+			previewDuration:   previewDuration,
+			filePath:          tempFile.Name(),
+			codec:             meta.Codec,
+			container:         containerForType(contentType),
+			contentType:       contentType,
+			prefix:            prefixOverride,
+		}
+		defer func() {
+			for _, cleanup := range state.cleanup {
+				cleanup()
+			}
+		}()
+		if err := cfg.runUploadPipeline(r.Context(), state); err != nil {
+			loggerFromContext(r.Context()).Info("upload pipeline stopped", "video_id", video.ID, "error", err)
+			return
+		}
+		objectKey = state.objectKey
+	}
+
+	// Make sure the object actually landed before pointing the video at it
+	if cfg.verifyUploads {
+		if err := cfg.verifyObject(r.Context(), objectKey); err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't verify uploaded video", err)
+			return
+		}
 	}
 
 	// Update video record with prefixed key
-	if err := cfg.updateVideoURL(w, video, prefixedKey); err != nil {
+	if err := cfg.updateVideoURL(w, video, objectKey); err != nil {
 		return
 	}
+	if thumbnailPath != "" {
+		thumbnailStored = true
+		cfg.deleteReplacedThumbnail(r.Context(), previous)
+	}
+
+	// The new file is in place, so a failure here only leaves unused
+	// objects behind
+	if replace {
+		if err := cfg.deleteReplacedObjects(r.Context(), previous, *video); err != nil {
+			loggerFromContext(r.Context()).Warn("couldn't delete replaced video objects", "video_id", video.ID, "error", err)
+		}
+	}
 
-	// // Update response to use signed URL
-	// signedVideo, err := cfg.dbVideoToSignedVideo(*video)
-	// if err != nil {
-	// 	if video.VideoURL == nil {
-	// 		signedVideo = *video
-	// 	} else {
-	// 		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
-	// 		return
-	// 	}
-	// }
+	// Update response to use signed URL
+	signedVideo, err := cfg.dbVideoToSignedVideo(*video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	succeeded = true
+	cfg.notifyUploadComplete(loggerFromContext(r.Context()), *video)
+	resp := videoUploadResponse{Video: signedVideo, Warnings: warnings}
+	if replace {
+		respondWithJSON(w, http.StatusOK, resp)
+		return
+	}
+	// The first upload creates the video's file
+	w.Header().Set("Location", "/api/videos/"+video.ID.String())
+	respondWithJSON(w, http.StatusCreated, resp)
 }
 
-func (cfg *apiConfig) processVideoUpload(w http.ResponseWriter, r *http.Request) (multipart.File, *multipart.FileHeader, error) {
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+func (cfg *apiConfig) processVideoUpload(w http.ResponseWriter, r *http.Request) (file multipart.File, header *multipart.FileHeader, err error) {
+	done := logStage(r.Context(), "receive_upload")
+	defer func() { done(err) }()
+
+	if err := cfg.limitVideoUploadBody(w, r); err != nil {
+		return nil, nil, err
+	}
+	if err := r.ParseMultipartForm(cfg.multipartMemoryBytes); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			msg := translatef(w, "Video exceeds the maximum upload size of %s (%d bytes)", formatBytes(maxBytesErr.Limit), maxBytesErr.Limit)
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+			return nil, nil, err
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeTruncatedUpload, "Video upload was truncated", err)
+			return nil, nil, err
+		}
+		if isNoSpace(err) {
+			respondWithErrorCode(w, http.StatusInsufficientStorage, errCodeInsufficientStorage, "Not enough disk space to process the upload", err)
+			return nil, nil, err
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
 		return nil, nil, err
 	}
 
-	file, header, err := r.FormFile("video")
+	file, header, err = r.FormFile("video")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Missing video file", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Missing video file", err)
 		return nil, nil, err
 	}
 	return file, header, nil
 }
 
-func (cfg *apiConfig) validateVideoType(header *multipart.FileHeader) error {
+// limitVideoUploadBody caps the request body at the upload limit. A declared
+// oversized body is rejected before any of it is read; bodies of unknown
+// length (or with a lying Content-Length) fail once they pass the limit.
+func (cfg *apiConfig) limitVideoUploadBody(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength > cfg.maxVideoUploadBytes {
+		msg := translatef(w, "Video exceeds the maximum upload size of %s (%d bytes)", formatBytes(cfg.maxVideoUploadBytes), cfg.maxVideoUploadBytes)
+		err := fmt.Errorf("declared Content-Length %d exceeds %d", r.ContentLength, cfg.maxVideoUploadBytes)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+		return err
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadBytes)
+	return nil
+}
+
+// validateVideoType checks the declared Content-Type and returns its media
+// type. A missing or generic type isn't rejected: it returns "" so the caller
+// can sniff the real type with ffprobe.
+func (cfg *apiConfig) validateVideoType(contentType string) (string, error) {
 	extensions := map[string]string{
 		"video/mp4": ".mp4",
 	}
 
-	// Parse media type from Content-Type header
-	contentType := header.Header.Get("Content-Type")
-	mediaType, _, err := mime.ParseMediaType(contentType)
-	if err != nil {
-		return fmt.Errorf("invalid Content-Type header: %w", err)
+	if untrustedContentType(contentType) {
+		return "", nil
 	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
 
 	// Check against allowed types
 	if _, ok := extensions[mediaType]; ok {
-		return nil
+		return mediaType, nil
 	}
-	return fmt.Errorf("unsupported media type: %s", mediaType)
+	return "", fmt.Errorf("unsupported media type: %s", mediaType)
 }
 
 func (cfg *apiConfig) createTempFile(w http.ResponseWriter) (*os.File, error) {
-	tempFile, err := os.CreateTemp("", "tubely-upload-*.mp4")
+	tempFile, err := os.CreateTemp(cfg.tempDir, tempFilePrefix+"*.mp4")
 	if err != nil {
+		if isNoSpace(err) {
+			respondWithErrorCode(w, http.StatusInsufficientStorage, errCodeInsufficientStorage, "Not enough disk space to process the upload", err)
+			return nil, err
+		}
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
 		return nil, err
 	}
@@ -155,7 +714,7 @@ func (cfg *apiConfig) createTempFile(w http.ResponseWriter) (*os.File, error) {
 
 func (cfg *apiConfig) saveToTempFile(w http.ResponseWriter, src io.Reader, dst *os.File) error {
 	if _, err := io.Copy(dst, src); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
+		respondWithSaveError(w, err)
 		return err
 	}
 
@@ -166,31 +725,331 @@ func (cfg *apiConfig) saveToTempFile(w http.ResponseWriter, src io.Reader, dst *
 	return nil
 }
 
-func (cfg *apiConfig) generateS3Key() (string, error) {
+// checkReceivedSize rejects a received video that's empty, or whose size
+// doesn't match the size declared for it (-1 when there was none), as when
+// the client disconnected part way.
+func checkReceivedSize(w http.ResponseWriter, received, declared int64) error {
+	if received == 0 {
+		err := errors.New("video file is empty")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeEmptyFile, "Video file is empty", err)
+		return err
+	}
+	if declared >= 0 && received != declared {
+		err := fmt.Errorf("received %d of %d bytes", received, declared)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeTruncatedUpload, "Video upload was truncated", err)
+		return err
+	}
+	return nil
+}
+
+// respondWithSaveError responds to a failure receiving the video: a body
+// over the upload limit, one that ended early, a full disk, or anything
+// else.
+func respondWithSaveError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		msg := translatef(w, "Video exceeds the maximum upload size of %s (%d bytes)", formatBytes(maxBytesErr.Limit), maxBytesErr.Limit)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+		return
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeTruncatedUpload, "Video upload was truncated", err)
+		return
+	}
+	if isNoSpace(err) {
+		respondWithErrorCode(w, http.StatusInsufficientStorage, errCodeInsufficientStorage, "Not enough disk space to process the upload", err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
+}
+
+// generateS3Key returns a random object name ending in ext, the extension of
+// the object's real format, e.g. ".mp4".
+func (cfg *apiConfig) generateS3Key(ext string) (string, error) {
 	randomBytes := make([]byte, 32)
 	if _, err := rand.Read(randomBytes); err != nil {
 		return "", fmt.Errorf("couldn't generate random bytes: %w", err)
 	}
-	return base64.RawURLEncoding.EncodeToString(randomBytes) + ".mp4", nil
+	return base64.RawURLEncoding.EncodeToString(randomBytes) + ext, nil
 }
 
-func (cfg *apiConfig) uploadToS3(ctx context.Context, w http.ResponseWriter, file io.Reader, key string, header *multipart.FileHeader) error {
-	contentType := header.Header.Get("Content-Type")
-	_, err := cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &key,
-		Body:        file,
-		ContentType: &contentType,
+// Delivery formats accepted in the upload's format field.
+const (
+	videoFormatMP4 = "mp4"
+	videoFormatHLS = "hls"
+)
+
+// URL modes selected by S3_URL_MODE: how the URLs videos are stored with
+// reach the bucket.
+const (
+	// urlModeCloudFront serves objects from the CloudFront distribution
+	urlModeCloudFront = "cloudfront"
+	// urlModeS3VirtualHosted serves them from the bucket directly, as
+	// https://<bucket>.<endpoint>/<key>
+	urlModeS3VirtualHosted = "s3-virtual-hosted"
+	// urlModeS3PathStyle serves them from the bucket directly, as
+	// https://<endpoint>/<bucket>/<key>
+	urlModeS3PathStyle = "s3-path-style"
+)
+
+// Key layouts selected by S3_KEY_LAYOUT.
+const (
+	// keyLayoutFlat stores videos as <aspectPrefix><key>
+	keyLayoutFlat = "flat"
+	// keyLayoutUser stores videos as <userID>/<aspectPrefix><key>, so
+	// lifecycle rules and access policies can target one user's objects
+	keyLayoutUser = "user"
+)
+
+// videoKey composes the full S3 key for a video from the owner, the aspect
+// ratio prefix and the generated key, according to the configured layout.
+func (cfg *apiConfig) videoKey(userID uuid.UUID, prefix, key string) (string, error) {
+	if cfg.s3KeyLayout == keyLayoutUser {
+		return normalizeS3Key(userID.String() + "/" + prefix + "/" + key)
+	}
+	return normalizeS3Key(prefix + "/" + key)
+}
+
+// contentAddressedKey returns the S3 key for a video identified by the hex
+// SHA-256 of its contents, stored with the extension ext.
+func contentAddressedKey(contentHash, ext string) string {
+	return contentHash + ext
+}
+
+// objectExists reports whether key is already stored in the bucket.
+func (cfg *apiConfig) objectExists(ctx context.Context, key string) (bool, error) {
+	_, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err == nil {
+		return true, nil
+	}
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// verifyObject confirms key exists in the bucket and isn't empty.
+func (cfg *apiConfig) verifyObject(ctx context.Context, key string) error {
+	out, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload to S3", err)
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return fmt.Errorf("object %s not found after upload", key)
+		}
+		return fmt.Errorf("couldn't check object %s: %w", key, err)
+	}
+	if out.ContentLength == nil || *out.ContentLength == 0 {
+		return fmt.Errorf("object %s is empty", key)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) uploadToS3(ctx context.Context, w http.ResponseWriter, file io.Reader, key string, contentType string, ownerID uuid.UUID) error {
+	done := logStage(ctx, "s3_upload", "key", key)
+	err := cfg.uploadObject(ctx, file, key, contentType, ownerID)
+	done(err)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't upload to S3", err)
 		return err
 	}
 	return nil
 }
 
+// uploadObject stores file in the bucket under key. Large files (or ones we
+// can't size) go through the multipart uploader, which streams parts instead
+// of sending one huge request. Objects get the configured storage class, ACL
+// and Cache-Control, KMS encryption when a key is set and, when enabled, tags
+// recording the owner and upload time.
+func (cfg *apiConfig) uploadObject(ctx context.Context, file io.Reader, key string, contentType string, ownerID uuid.UUID) error {
+	cacheControl := cfg.cacheControlFor(contentType)
+	input := &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &key,
+		Body:         file,
+		ContentType:  &contentType,
+		CacheControl: &cacheControl,
+		StorageClass: cfg.s3StorageClass,
+		ACL:          cfg.s3ACL,
+	}
+	if cfg.s3TagObjects {
+		tagging := objectTagging(ownerID, time.Now())
+		input.Tagging = &tagging
+	}
+	// Without a KMS key, objects get the bucket's default encryption
+	// (SSE-S3). Presigned GETs of KMS-encrypted objects need no changes, as
+	// they're signed with SigV4.
+	if cfg.s3KMSKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = &cfg.s3KMSKeyID
+	}
+
+	start := time.Now()
+	var err error
+	if size, ok := readerSize(file); !ok || size > cfg.s3MultipartThreshold {
+		err = cfg.uploadToS3Multipart(ctx, input)
+	} else {
+		// S3 rejects a body that doesn't match its ContentMD5, so nothing
+		// corrupted on the way is stored
+		var sum string
+		sum, err = bodyMD5(file)
+		if err == nil {
+			input.ContentMD5 = &sum
+			err = cfg.putObjectWithRetry(ctx, input)
+		}
+	}
+	observeDuration(s3UploadDuration, start, outcome(err))
+	return err
+}
+
+// cacheControlFor returns the Cache-Control header for an object of
+// contentType. Images get their own, usually shorter, lifetime.
+func (cfg *apiConfig) cacheControlFor(contentType string) string {
+	if strings.HasPrefix(contentType, "image/") {
+		return cfg.s3ImageCacheControl
+	}
+	return cfg.s3CacheControl
+}
+
+// objectTagging returns the URL-encoded tag set S3 expects in Tagging.
+func objectTagging(ownerID uuid.UUID, uploadedAt time.Time) string {
+	tags := url.Values{}
+	tags.Set("userID", ownerID.String())
+	tags.Set("uploadedAt", uploadedAt.UTC().Format(time.RFC3339))
+	return tags.Encode()
+}
+
+func (cfg *apiConfig) uploadToS3Multipart(ctx context.Context, input *s3.PutObjectInput) error {
+	uploader := manager.NewUploader(cfg.s3Client, func(u *manager.Uploader) {
+		u.PartSize = cfg.s3PartSize
+		u.Concurrency = cfg.s3UploadConcurrency
+		// Abort the multipart upload on failure so incomplete parts don't
+		// linger in the bucket.
+		u.LeavePartsOnError = false
+	})
+
+	_, err := uploader.Upload(ctx, input)
+	if err != nil {
+		var failure manager.MultiUploadFailure
+		if errors.As(err, &failure) {
+			return fmt.Errorf("multipart upload %s aborted: %w", failure.UploadID(), err)
+		}
+		return fmt.Errorf("multipart upload failed: %w", err)
+	}
+	return nil
+}
+
+// bodyMD5 returns the base64 MD5 digest of what remains in r, a seekable
+// body, leaving its position unchanged. A progressReader's own reader is
+// hashed, so reading ahead doesn't count as progress.
+func bodyMD5(r io.Reader) (string, error) {
+	if p, ok := r.(*progressReader); ok {
+		r = p.r
+	}
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		return "", fmt.Errorf("can't hash a %T body", r)
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return "", err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// readerSize reports how many bytes remain in r when it's seekable, leaving
+// its position unchanged.
+func readerSize(r io.Reader) (int64, bool) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	cur, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := seeker.Seek(cur, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return end - cur, true
+}
+
+// objectURL returns the URL the object at key is served from: the CloudFront
+// distribution when there is one, and the custom S3 endpoint otherwise.
+func (cfg *apiConfig) objectURL(key string) string {
+	switch cfg.s3URLMode {
+	case urlModeCloudFront:
+		return fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
+	case urlModeS3PathStyle:
+		return bucketObjectURL(cfg.s3BaseURL(cfg.s3Region), cfg.s3Bucket, key, true)
+	default:
+		return bucketObjectURL(cfg.s3BaseURL(cfg.s3Region), cfg.s3Bucket, key, false)
+	}
+}
+
+// s3BaseURL is the URL buckets in region are addressed under: the custom S3
+// endpoint when there is one, and AWS's regional endpoint otherwise.
+func (cfg *apiConfig) s3BaseURL(region string) *url.URL {
+	if cfg.s3Endpoint != nil {
+		return cfg.s3Endpoint
+	}
+	return &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+}
+
+// bucketObjectURL returns the URL of the object at key in bucket under base,
+// with the bucket in the path when pathStyle is set and in the host
+// otherwise.
+func bucketObjectURL(base *url.URL, bucket, key string, pathStyle bool) string {
+	basePath := strings.TrimSuffix(base.Path, "/")
+	if pathStyle {
+		return fmt.Sprintf("%s://%s%s/%s/%s", base.Scheme, base.Host, basePath, bucket, key)
+	}
+	return fmt.Sprintf("%s://%s.%s%s/%s", base.Scheme, bucket, base.Host, basePath, key)
+}
+
+// s3KeyFromURL extracts the object key from a URL built by objectURL. The
+// URL's host tells which form it takes, so URLs stored under another URL mode
+// still resolve; CloudFront URLs, and any others, are taken to be the key.
+func (cfg *apiConfig) s3KeyFromURL(objectURL string) (string, error) {
+	u, err := url.Parse(objectURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid object URL: %w", err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	base := cfg.s3BaseURL(cfg.s3Region)
+	// Endpoint URLs may carry a base path, and path-style ones the bucket
+	basePath := strings.Trim(base.Path, "/")
+	if basePath != "" && (u.Host == base.Host || u.Host == cfg.s3Bucket+"."+base.Host) {
+		key = strings.TrimPrefix(key, basePath+"/")
+	}
+	if u.Host == base.Host {
+		key = strings.TrimPrefix(key, cfg.s3Bucket+"/")
+	}
+	if key == "" {
+		return "", fmt.Errorf("object URL has no key: %s", objectURL)
+	}
+	return key, nil
+}
+
 func (cfg *apiConfig) updateVideoURL(w http.ResponseWriter, video *database.Video, key string) error {
-	videoURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
+	videoURL := cfg.objectURL(key)
 	video.VideoURL = &videoURL
 	if err := cfg.db.UpdateVideo(*video); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
@@ -199,101 +1058,276 @@ func (cfg *apiConfig) updateVideoURL(w http.ResponseWriter, video *database.Vide
 	return nil
 }
 
-func (cfg *apiConfig) getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
+func (cfg *apiConfig) getVideoAspectRatio(ctx context.Context, filePath string) (string, error) {
+	meta, err := cfg.probeVideo(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+
+	return cfg.aspectPrefixFor(meta.Width, meta.Height), nil
+}
+
+// Errors returned by probeVideo when ffprobe ran but the file isn't a usable
+// video. These are the uploader's fault, unlike ffprobe failing to run.
+var (
+	errNoVideoStream     = errors.New("no video stream found")
+	errInvalidDimensions = errors.New("invalid video dimensions")
+	errInvalidDuration   = errors.New("invalid video duration")
+)
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffprobe error: %w", err)
+// ffprobeOutput is the subset of `ffprobe -print_format json` output we use.
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		// ffprobe reports the duration in seconds as a string, e.g. "12.345000"
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+type ffprobeStream struct {
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+}
+
+// VideoMeta describes a video file as reported by ffprobe.
+type VideoMeta struct {
+	Width    int
+	Height   int
+	Duration float64 // seconds
+	Codec    string
+	Format   string // container, as ffprobe's format_name
+	HasAudio bool
+}
+
+func (cfg *apiConfig) probeVideo(ctx context.Context, filePath string) (VideoMeta, error) {
+	done := logStage(ctx, "probe")
+	stdout, err := cfg.runProbe(ctx, "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+	done(err)
+	if err != nil {
+		return VideoMeta{}, err
 	}
 
-	var probeOutput struct {
-		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-		} `json:"streams"`
+	var probeOutput ffprobeOutput
+	if err := json.Unmarshal(stdout, &probeOutput); err != nil {
+		return VideoMeta{}, fmt.Errorf("failed to parse ffprobe output: %w", err)
 	}
 
-	if err := json.Unmarshal(stdout.Bytes(), &probeOutput); err != nil {
-		return "", fmt.Errorf("failed to parse ffprobe output: %w", err)
+	stream, ok := primaryVideoStream(probeOutput.Streams)
+	if !ok {
+		return VideoMeta{}, errNoVideoStream
+	}
+	if stream.Width <= 0 || stream.Height <= 0 {
+		return VideoMeta{}, fmt.Errorf("%w: %dx%d", errInvalidDimensions, stream.Width, stream.Height)
 	}
 
-	if len(probeOutput.Streams) == 0 {
-		return "", fmt.Errorf("no streams found in video")
+	duration, err := parseProbeDuration(probeOutput.Format.Duration)
+	if err != nil {
+		return VideoMeta{}, err
 	}
 
-	stream := probeOutput.Streams[0]
-	if stream.Width == 0 || stream.Height == 0 {
-		return "", fmt.Errorf("invalid video dimensions")
+	return VideoMeta{
+		Width:    stream.Width,
+		Height:   stream.Height,
+		Duration: duration,
+		Codec:    stream.CodecName,
+		Format:   probeOutput.Format.FormatName,
+		HasAudio: slices.ContainsFunc(probeOutput.Streams, func(s ffprobeStream) bool {
+			return s.CodecType == "audio"
+		}),
+	}, nil
+}
+
+// primaryVideoStream picks the video stream to describe the file by. Stream 0
+// is often audio, so streams are filtered by type, and when a file carries
+// several video streams the largest one wins.
+func primaryVideoStream(streams []ffprobeStream) (ffprobeStream, bool) {
+	var best ffprobeStream
+	found := false
+	for _, s := range streams {
+		if s.CodecType != "video" {
+			continue
+		}
+		if !found || s.Width*s.Height > best.Width*best.Height {
+			best = s
+			found = true
+		}
+	}
+	return best, found
+}
+
+func parseProbeDuration(value string) (float64, error) {
+	if value == "" || value == "N/A" {
+		return 0, fmt.Errorf("%w: video has no duration", errInvalidDuration)
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q: %w", errInvalidDuration, value, err)
+	}
+	if seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, fmt.Errorf("%w %q", errInvalidDuration, value)
 	}
+	return seconds, nil
+}
 
-	// Define common aspect ratios with tolerance
-	ratio := float64(stream.Width) / float64(stream.Height)
-	const tolerance = 0.1
+// prepareVideo processes the video at filePath for fast start while probing
+// its aspect ratio. The probe reads the original file, so the two run
+// concurrently; if either fails, the other is cancelled and the first error
+// is returned. A non-empty prefixOverride is used as the prefix instead of
+// probing.
+func (cfg *apiConfig) prepareVideo(ctx context.Context, filePath, sourceCodec, prefixOverride string) (processedPath string, container videoContainer, prefix string, err error) {
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		var err error
+		processedPath, container, err = cfg.processVideoForFastStart(gctx, filePath, sourceCodec)
+		return err
+	})
+	prefix = prefixOverride
+	if prefix == "" {
+		g.Go(func() error {
+			var err error
+			prefix, err = cfg.getVideoAspectRatio(gctx, filePath)
+			if err != nil {
+				return fmt.Errorf("couldn't determine aspect ratio: %w", err)
+			}
+			return nil
+		})
+	}
 
-	switch {
-	case math.Abs(ratio-16.0/9.0) < tolerance:
-		return "landscape/", nil
-	case math.Abs(ratio-9.0/16.0) < tolerance:
-		return "portrait/", nil
-	case math.Abs(ratio-1.0) < tolerance:
-		return "square/", nil
-	default:
-		return "other/", nil
+	if err := g.Wait(); err != nil {
+		if processedPath != "" {
+			os.Remove(processedPath)
+		}
+		return "", videoContainer{}, "", err
 	}
+	return processedPath, container, prefix, nil
 }
 
-func (cfg *apiConfig) processVideoForFastStart(filePath string) (string, error) {
+// processVideoForFastStart rewrites the video at filePath as an MP4 with its
+// index up front, returning its path and container. The streams are copied
+// as they are, unless re-encoding is configured and sourceCodec isn't one
+// browsers play.
+func (cfg *apiConfig) processVideoForFastStart(ctx context.Context, filePath, sourceCodec string) (string, videoContainer, error) {
+	reencode := cfg.needsReencode(sourceCodec)
+	done := logStage(ctx, "fast_start", "reencode", reencode)
+	const muxer = "mp4"
 	outputPath := filePath + ".processing"
-	cmd := exec.Command("ffmpeg",
-		"-i", filePath,
-		"-c", "copy",
+	args := append([]string{"-i", filePath}, cfg.fastStartCodecArgs(sourceCodec)...)
+	args = append(args,
 		"-movflags", "faststart",
-		"-f", "mp4",
+		"-f", muxer,
 		outputPath,
 	)
+	_, err := cfg.runMedia(ctx, "ffmpeg", args...)
+	done(err)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", videoContainer{}, err
+	}
+	return outputPath, videoContainers[muxer], nil
+}
+
+// supportedRenditionHeights are the heights clients may request via the
+// renditions form field.
+var supportedRenditionHeights = map[int]bool{
+	1080: true,
+	720:  true,
+	480:  true,
+}
+
+// parseRenditionHeights parses a comma-separated list of heights such as
+// "720,480". An empty value means no renditions were requested.
+func parseRenditionHeights(value string) ([]int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
 
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffmpeg error: %s: %w", stderr.String(), err)
-	}
-	return outputPath, nil
-}
-
-// func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
-// 	presignClient := s3.NewPresignClient(s3Client)
-
-// 	req, err := presignClient.PresignGetObject(context.Background(),
-// 		&s3.GetObjectInput{
-// 			Bucket: &bucket,
-// 			Key:    &key,
-// 		},
-// 		s3.WithPresignExpires(expireTime),
-// 	)
-// 	if err != nil {
-// 		return "", fmt.Errorf("failed to presign URL: %w", err)
-// 	}
-// 	return req.URL, nil
-// }
-
-// func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
-// 	if video.VideoURL == nil {
-// 		return video, fmt.Errorf("video URL is nil")
-// 	}
-
-// 	// parts[0] = bucket; parts[1] = key/filepath
-// 	parts := strings.Split(*video.VideoURL, ",")
-// 	if len(parts) != 2 {
-// 		return video, fmt.Errorf("invalid video URL format")
-// 	}
-
-// 	presignedURL, err := generatePresignedURL(cfg.s3Client, parts[0], parts[1], 24*time.Hour)
-// 	if err != nil {
-// 		return video, fmt.Errorf("failed to generate presigned URL: %w", err)
-// 	}
-
-// 	video.VideoURL = &presignedURL
-// 	return video, nil
-// }
+	seen := map[int]bool{}
+	heights := []int{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSuffix(strings.TrimSpace(field), "p")
+		height, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rendition height %q", field)
+		}
+		if !supportedRenditionHeights[height] {
+			return nil, fmt.Errorf("unsupported rendition height: %d", height)
+		}
+		if seen[height] {
+			continue
+		}
+		seen[height] = true
+		heights = append(heights, height)
+	}
+	return heights, nil
+}
+
+// transcodeRenditions scales the video at filePath down to each of the
+// requested heights. Heights above the source height are skipped, since
+// upscaling only wastes storage. The result maps each produced height to the
+// path of its transcoded file.
+func (cfg *apiConfig) transcodeRenditions(ctx context.Context, filePath string, heights []int) (map[int]string, error) {
+	source, err := cfg.probeVideo(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := map[int]string{}
+	for _, height := range heights {
+		if height > source.Height {
+			continue
+		}
+
+		outputPath := fmt.Sprintf("%s.%dp.mp4", filePath, height)
+		_, err := cfg.runMedia(ctx, "ffmpeg",
+			"-i", filePath,
+			"-vf", fmt.Sprintf("scale=-2:%d", height),
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-crf", "23",
+			"-c:a", "aac",
+			"-movflags", "faststart",
+			"-f", "mp4",
+			outputPath,
+		)
+		if err != nil {
+			os.Remove(outputPath)
+			for _, p := range outputs {
+				os.Remove(p)
+			}
+			return nil, fmt.Errorf("transcoding %dp: %w", height, err)
+		}
+		outputs[height] = outputPath
+	}
+	return outputs, nil
+}
+
+// renditionKey returns the S3 key for a rendition of the video stored at
+// videoKey, e.g. landscape/abc.mp4 -> landscape/abc/720p.mp4.
+func renditionKey(videoKey string, height int) string {
+	base := strings.TrimSuffix(videoKey, path.Ext(videoKey))
+	return fmt.Sprintf("%s/%dp.mp4", base, height)
+}
+
+func (cfg *apiConfig) uploadRenditions(ctx context.Context, w http.ResponseWriter, renditionPaths map[int]string, videoKey string, contentType string, ownerID uuid.UUID) (database.Renditions, error) {
+	renditions := database.Renditions{}
+	for height, renditionPath := range renditionPaths {
+		f, err := os.Open(renditionPath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't open rendition", err)
+			return nil, err
+		}
+
+		key := renditionKey(videoKey, height)
+		err = cfg.uploadToS3(ctx, w, f, key, contentType, ownerID)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		renditions[height] = cfg.objectURL(key)
+	}
+	return renditions, nil
+}
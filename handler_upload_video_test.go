@@ -0,0 +1,900 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func TestUploadToS3(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		threshold int64
+		wantCalls []string
+	}{
+		{
+			name:      "single PutObject",
+			size:      1 << 10,
+			threshold: 100 << 20,
+			wantCalls: []string{"PutObject landscape/video.mp4"},
+		},
+		{
+			name:      "multipart above the threshold",
+			size:      6 << 20,
+			threshold: 1 << 20,
+			wantCalls: []string{"CreateMultipartUpload landscape/video.mp4", "CompleteMultipartUpload landscape/video.mp4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.s3MultipartThreshold = tt.threshold
+			data := bytes.Repeat([]byte("tubely"), tt.size/6)
+
+			w := httptest.NewRecorder()
+			err := cfg.uploadToS3(context.Background(), w, bytes.NewReader(data), "landscape/video.mp4", "video/mp4", uuid.New())
+			if err != nil {
+				t.Fatalf("uploadToS3: %v", err)
+			}
+			if calls := mock.Calls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %q, want %q", calls, tt.wantCalls)
+			}
+			obj, ok := mock.Object("landscape/video.mp4")
+			if !ok {
+				t.Fatal("object wasn't stored")
+			}
+			if !bytes.Equal(obj.data, data) {
+				t.Errorf("stored %d bytes, want the %d uploaded", len(obj.data), len(data))
+			}
+		})
+	}
+}
+
+func TestUploadObjectMultipartThreshold(t *testing.T) {
+	const size = 6 << 20
+	data := bytes.Repeat([]byte("x"), size)
+	tests := []struct {
+		name      string
+		threshold int64
+		wantOp    string
+	}{
+		{"at the threshold", size, "PutObject"},
+		{"one byte over", size - 1, "CreateMultipartUpload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.s3MultipartThreshold = tt.threshold
+
+			if err := cfg.uploadObject(context.Background(), bytes.NewReader(data), "video.mp4", "video/mp4", uuid.New()); err != nil {
+				t.Fatalf("uploadObject: %v", err)
+			}
+			if calls := mock.Calls(); len(calls) == 0 || calls[0] != tt.wantOp+" video.mp4" {
+				t.Errorf("calls = %q, want %s first", calls, tt.wantOp)
+			}
+			if obj, ok := mock.Object("video.mp4"); !ok || len(obj.data) != size {
+				t.Errorf("object wasn't stored whole")
+			}
+		})
+	}
+}
+
+func TestUploadObjectStorageClassAndTagging(t *testing.T) {
+	checkTagging := func(t *testing.T, tagging *string, ownerID uuid.UUID) {
+		t.Helper()
+		tags, err := url.ParseQuery(aws.ToString(tagging))
+		if err != nil {
+			t.Fatalf("Tagging %q: %v", aws.ToString(tagging), err)
+		}
+		if got := tags.Get("userID"); got != ownerID.String() {
+			t.Errorf("userID tag = %q, want %q", got, ownerID)
+		}
+		uploadedAt, err := time.Parse(time.RFC3339, tags.Get("uploadedAt"))
+		if err != nil || time.Since(uploadedAt) > time.Minute {
+			t.Errorf("uploadedAt tag = %q, want the upload time", tags.Get("uploadedAt"))
+		}
+	}
+
+	t.Run("single PutObject", func(t *testing.T) {
+		cfg, mock := newTestConfig(t)
+		cfg.s3StorageClass = types.StorageClassStandardIa
+		cfg.s3TagObjects = true
+		ownerID := uuid.New()
+
+		if err := cfg.uploadObject(context.Background(), strings.NewReader("tubely"), "video.mp4", "video/mp4", ownerID); err != nil {
+			t.Fatalf("uploadObject: %v", err)
+		}
+		input, ok := mock.PutInput("video.mp4")
+		if !ok {
+			t.Fatal("PutObject wasn't called")
+		}
+		if input.StorageClass != types.StorageClassStandardIa {
+			t.Errorf("StorageClass = %q, want %q", input.StorageClass, types.StorageClassStandardIa)
+		}
+		checkTagging(t, input.Tagging, ownerID)
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		cfg, mock := newTestConfig(t)
+		cfg.s3MultipartThreshold = 1 << 20
+		cfg.s3StorageClass = types.StorageClassStandardIa
+		cfg.s3TagObjects = true
+		ownerID := uuid.New()
+
+		data := bytes.Repeat([]byte("x"), 6<<20)
+		if err := cfg.uploadObject(context.Background(), bytes.NewReader(data), "video.mp4", "video/mp4", ownerID); err != nil {
+			t.Fatalf("uploadObject: %v", err)
+		}
+		input, ok := mock.MultipartInput("video.mp4")
+		if !ok {
+			t.Fatal("CreateMultipartUpload wasn't called")
+		}
+		if input.StorageClass != types.StorageClassStandardIa {
+			t.Errorf("StorageClass = %q, want %q", input.StorageClass, types.StorageClassStandardIa)
+		}
+		checkTagging(t, input.Tagging, ownerID)
+	})
+
+	t.Run("tagging off", func(t *testing.T) {
+		cfg, mock := newTestConfig(t)
+
+		if err := cfg.uploadObject(context.Background(), strings.NewReader("tubely"), "video.mp4", "video/mp4", uuid.New()); err != nil {
+			t.Fatalf("uploadObject: %v", err)
+		}
+		input, _ := mock.PutInput("video.mp4")
+		if input == nil || input.Tagging != nil {
+			t.Errorf("input = %+v, want no Tagging", input)
+		}
+	})
+}
+
+func TestUploadVideoCacheControl(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	cfg.s3CacheControl = "public, max-age=31536000, immutable"
+	cfg.s3ImageCacheControl = "public, max-age=600"
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	// The animated preview is an image stored alongside the video
+	r := newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil)
+	r.URL.RawQuery = "animatedPreview=true"
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	checked := map[string]bool{}
+	for _, key := range mock.Keys() {
+		input, ok := mock.PutInput(key)
+		if !ok {
+			t.Fatalf("%s wasn't stored with PutObject", key)
+		}
+		contentType := aws.ToString(input.ContentType)
+		want := cfg.s3CacheControl
+		if strings.HasPrefix(contentType, "image/") {
+			want = cfg.s3ImageCacheControl
+		}
+		if got := aws.ToString(input.CacheControl); got != want {
+			t.Errorf("%s (%s): CacheControl = %q, want %q", key, contentType, got, want)
+		}
+		checked[contentType] = true
+	}
+	if !checked["video/mp4"] || !checked["image/gif"] {
+		t.Errorf("checked %v, want the video and its preview", checked)
+	}
+}
+
+func TestUploadObjectACL(t *testing.T) {
+	tests := []struct {
+		name string
+		acl  types.ObjectCannedACL
+	}{
+		// Buckets with ACLs disabled reject any ACL, so none is the default
+		{name: "none by default"},
+		{name: "configured", acl: types.ObjectCannedACLPrivate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.s3ACL = tt.acl
+
+			if err := cfg.uploadObject(context.Background(), strings.NewReader("tubely"), "video.mp4", "video/mp4", uuid.New()); err != nil {
+				t.Fatalf("uploadObject: %v", err)
+			}
+			input, ok := mock.PutInput("video.mp4")
+			if !ok {
+				t.Fatal("PutObject wasn't called")
+			}
+			if input.ACL != tt.acl {
+				t.Errorf("ACL = %q, want %q", input.ACL, tt.acl)
+			}
+		})
+	}
+}
+
+func TestUploadObjectKMSEncryption(t *testing.T) {
+	const keyARN = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	data := bytes.Repeat([]byte("x"), 6<<20)
+	tests := []struct {
+		name      string
+		keyARN    string
+		threshold int64
+		wantSSE   types.ServerSideEncryption
+	}{
+		{name: "single PutObject", keyARN: keyARN, threshold: 100 << 20, wantSSE: types.ServerSideEncryptionAwsKms},
+		{name: "multipart", keyARN: keyARN, threshold: 1 << 20, wantSSE: types.ServerSideEncryptionAwsKms},
+		{name: "no key", threshold: 100 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.s3KMSKeyID = tt.keyARN
+			cfg.s3MultipartThreshold = tt.threshold
+
+			if err := cfg.uploadObject(context.Background(), bytes.NewReader(data), "video.mp4", "video/mp4", uuid.New()); err != nil {
+				t.Fatalf("uploadObject: %v", err)
+			}
+			var sse types.ServerSideEncryption
+			var keyID *string
+			if input, ok := mock.PutInput("video.mp4"); ok {
+				sse, keyID = input.ServerSideEncryption, input.SSEKMSKeyId
+			} else if input, ok := mock.MultipartInput("video.mp4"); ok {
+				sse, keyID = input.ServerSideEncryption, input.SSEKMSKeyId
+			} else {
+				t.Fatal("object wasn't uploaded")
+			}
+			if sse != tt.wantSSE {
+				t.Errorf("ServerSideEncryption = %q, want %q", sse, tt.wantSSE)
+			}
+			if got := aws.ToString(keyID); got != tt.keyARN {
+				t.Errorf("SSEKMSKeyId = %q, want %q", got, tt.keyARN)
+			}
+		})
+	}
+}
+
+func TestUploadVideoRecoversPanic(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	cfg.uploadPipeline = append(slices.Clone(cfg.uploadPipeline), uploadStage{
+		name: "panics",
+		run: func(cfg *apiConfig, ctx context.Context, s *pipelineState) error {
+			panic("stage bug")
+		},
+	})
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusInternalServerError, w.Body)
+	}
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
+
+func TestUploadVideoErrorCodes(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	cfg.maxVideoUploadBytes = 64 << 10
+	ownerID, token := createTestUser(t, cfg)
+	_, otherToken := createTestUser(t, cfg)
+	expiredToken, err := auth.MakeJWT(ownerID, cfg.jwtSecret, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := createTestVideo(t, cfg, ownerID)
+	data := testMP4(4096)
+
+	tests := []struct {
+		name      string
+		request   func() *http.Request
+		wantCode  int
+		wantError errorCode
+	}{
+		{
+			name:      "no token",
+			request:   func() *http.Request { return newVideoUploadRequest(t, "", video.ID, data, nil) },
+			wantCode:  http.StatusUnauthorized,
+			wantError: errCodeUnauthorized,
+		},
+		{
+			name:      "expired token",
+			request:   func() *http.Request { return newVideoUploadRequest(t, expiredToken, video.ID, data, nil) },
+			wantCode:  http.StatusUnauthorized,
+			wantError: errCodeTokenExpired,
+		},
+		{
+			name:      "someone else's video",
+			request:   func() *http.Request { return newVideoUploadRequest(t, otherToken, video.ID, data, nil) },
+			wantCode:  http.StatusUnauthorized,
+			wantError: errCodeUnauthorized,
+		},
+		{
+			name: "invalid ID",
+			request: func() *http.Request {
+				r := newVideoUploadRequest(t, token, video.ID, data, nil)
+				r.SetPathValue("videoID", "not-a-uuid")
+				return r
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errCodeInvalidID,
+		},
+		{
+			name:      "unknown video",
+			request:   func() *http.Request { return newVideoUploadRequest(t, token, uuid.New(), data, nil) },
+			wantCode:  http.StatusNotFound,
+			wantError: errCodeNotFound,
+		},
+		{
+			name: "invalid upload ID",
+			request: func() *http.Request {
+				r := newVideoUploadRequest(t, token, video.ID, data, nil)
+				r.URL.RawQuery = "upload_id=not-mine"
+				return r
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errCodeInvalidUploadID,
+		},
+		{
+			name: "not a form",
+			request: func() *http.Request {
+				r := newVideoUploadRequest(t, token, video.ID, data, nil)
+				r.Header.Set("Content-Type", "video/mp4")
+				return r
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errCodeInvalidForm,
+		},
+		{
+			name: "missing file",
+			request: func() *http.Request {
+				return newVideoUploadRequest(t, token, video.ID, data, textproto.MIMEHeader{
+					"Content-Disposition": {`form-data; name="file"; filename="video.mp4"`},
+				})
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errCodeMissingFile,
+		},
+		{
+			name:      "too large",
+			request:   func() *http.Request { return newVideoUploadRequest(t, token, video.ID, testMP4(128<<10), nil) },
+			wantCode:  http.StatusRequestEntityTooLarge,
+			wantError: errCodeFileTooLarge,
+		},
+		{
+			name: "unsupported type",
+			request: func() *http.Request {
+				return newVideoUploadRequest(t, token, video.ID, data, textproto.MIMEHeader{"Content-Type": {"video/quicktime"}})
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errCodeUnsupportedMediaType,
+		},
+		{
+			name: "invalid renditions",
+			request: func() *http.Request {
+				r := newVideoUploadRequest(t, token, video.ID, data, nil)
+				r.URL.RawQuery = "renditions=tall"
+				return r
+			},
+			wantCode:  http.StatusBadRequest,
+			wantError: errCodeInvalidRenditions,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, tt.request())
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+			if got := responseErrorCode(t, w); got != tt.wantError {
+				t.Errorf("code = %q, want %q", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestVideoKeyLayout(t *testing.T) {
+	userID := uuid.MustParse("6734e104-d5c3-42d6-af1e-1951283c82e0")
+	tests := []struct {
+		layout string
+		want   string
+	}{
+		{keyLayoutFlat, "landscape/abc.mp4"},
+		{keyLayoutUser, "6734e104-d5c3-42d6-af1e-1951283c82e0/landscape/abc.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.layout, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.s3KeyLayout = tt.layout
+
+			key, err := cfg.videoKey(userID, "landscape/", "abc.mp4")
+			if err != nil {
+				t.Fatalf("videoKey: %v", err)
+			}
+			if key != tt.want {
+				t.Errorf("videoKey = %q, want %q", key, tt.want)
+			}
+			got, err := cfg.s3KeyFromURL(cfg.objectURL(key))
+			if err != nil || got != key {
+				t.Errorf("s3KeyFromURL(objectURL(%q)) = %q, %v", key, got, err)
+			}
+		})
+	}
+}
+
+func TestUploadVideoUserKeyLayout(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	cfg.s3KeyLayout = keyLayoutUser
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := cfg.s3KeyFromURL(*stored.VideoURL)
+	if err != nil {
+		t.Fatalf("s3KeyFromURL(%q): %v", *stored.VideoURL, err)
+	}
+	if want := userID.String() + "/landscape/"; !strings.HasPrefix(key, want) {
+		t.Errorf("key = %q, want it under %q", key, want)
+	}
+	if _, ok := mock.Object(key); !ok {
+		t.Errorf("video URL resolves to %q, which wasn't stored (have %q)", key, mock.Keys())
+	}
+}
+
+func TestObjectURLRoundTrip(t *testing.T) {
+	const key = "user/landscape/abc.mp4"
+	minio := &url.URL{Scheme: "http", Host: "minio.local:9000"}
+	behindProxy := &url.URL{Scheme: "https", Host: "storage.example.com", Path: "/s3/"}
+	tests := []struct {
+		name     string
+		mode     string
+		endpoint *url.URL
+		wantURL  string
+	}{
+		{"CloudFront", urlModeCloudFront, nil, "https://d111111abcdef8.cloudfront.net/" + key},
+		{"virtual-hosted", urlModeS3VirtualHosted, nil, "https://tubely-test.s3.us-east-1.amazonaws.com/" + key},
+		{"path-style", urlModeS3PathStyle, nil, "https://s3.us-east-1.amazonaws.com/tubely-test/" + key},
+		{"virtual-hosted endpoint", urlModeS3VirtualHosted, minio, "http://tubely-test.minio.local:9000/" + key},
+		{"path-style endpoint", urlModeS3PathStyle, minio, "http://minio.local:9000/tubely-test/" + key},
+		{"path-style endpoint with a base path", urlModeS3PathStyle, behindProxy, "https://storage.example.com/s3/tubely-test/" + key},
+		{"virtual-hosted endpoint with a base path", urlModeS3VirtualHosted, behindProxy, "https://tubely-test.storage.example.com/s3/" + key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.s3URLMode = tt.mode
+			cfg.s3CfDistribution = testCfDistribution
+			cfg.s3Endpoint = tt.endpoint
+
+			objectURL := cfg.objectURL(key)
+			if objectURL != tt.wantURL {
+				t.Errorf("objectURL = %q, want %q", objectURL, tt.wantURL)
+			}
+			got, err := cfg.s3KeyFromURL(objectURL)
+			if err != nil || got != key {
+				t.Errorf("s3KeyFromURL(%q) = %q, %v, want %q", objectURL, got, err, key)
+			}
+
+			// URLs stored before a switch to another mode still resolve
+			for _, mode := range []string{urlModeCloudFront, urlModeS3VirtualHosted, urlModeS3PathStyle} {
+				cfg.s3URLMode = mode
+				if got, err := cfg.s3KeyFromURL(objectURL); err != nil || got != key {
+					t.Errorf("in %s mode, s3KeyFromURL(%q) = %q, %v, want %q", mode, objectURL, got, err, key)
+				}
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestUploadVideoContentLengthLimit(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	const limit = 64 << 10
+	tests := []struct {
+		name          string
+		size          int
+		contentLength int64
+		// maxRead is how much of the body may be read before rejecting it
+		maxRead int64
+	}{
+		{name: "declared too large", size: 128 << 10, contentLength: 128 << 10, maxRead: 0},
+		{name: "lying small Content-Length", size: 128 << 10, contentLength: 4 << 10, maxRead: limit + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.maxVideoUploadBytes = limit
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			r := newVideoUploadRequest(t, token, video.ID, testMP4(tt.size), nil)
+			body := &countingReader{r: r.Body}
+			r.Body = io.NopCloser(body)
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+			}
+			if code := responseErrorCode(t, w); code != errCodeFileTooLarge {
+				t.Errorf("error code = %q, want %q", code, errCodeFileTooLarge)
+			}
+			if body.n > tt.maxRead {
+				t.Errorf("read %d bytes of the body, want at most %d", body.n, tt.maxRead)
+			}
+			if keys := mock.Keys(); len(keys) != 0 {
+				t.Errorf("stored %q for a rejected upload", keys)
+			}
+		})
+	}
+}
+
+func TestUploadVideoEmptyOrTruncated(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	tests := []struct {
+		name      string
+		stream    bool
+		request   func(t *testing.T, token string, videoID uuid.UUID) *http.Request
+		wantError errorCode
+	}{
+		{
+			name: "zero-byte file",
+			request: func(t *testing.T, token string, videoID uuid.UUID) *http.Request {
+				return newVideoUploadRequest(t, token, videoID, nil, nil)
+			},
+			wantError: errCodeEmptyFile,
+		},
+		{
+			name: "body cut off part way",
+			request: func(t *testing.T, token string, videoID uuid.UUID) *http.Request {
+				r := newVideoUploadRequest(t, token, videoID, testMP4(64<<10), nil)
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body[:len(body)/2]))
+				r.ContentLength = -1
+				return r
+			},
+			wantError: errCodeTruncatedUpload,
+		},
+	}
+	// Each case again with the video read straight off the request body
+	for _, tt := range slices.Clone(tests) {
+		tt.name += " streamed"
+		tt.stream = true
+		tests = append(tests, tt)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.streamUploads = tt.stream
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, tt.request(t, token, video.ID))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			if code := responseErrorCode(t, w); code != tt.wantError {
+				t.Errorf("error code = %q, want %q", code, tt.wantError)
+			}
+			if keys := mock.Keys(); len(keys) != 0 {
+				t.Errorf("stored %q for a failed upload", keys)
+			}
+		})
+	}
+}
+
+func TestCheckReceivedSize(t *testing.T) {
+	tests := []struct {
+		name               string
+		received, declared int64
+		wantError          errorCode
+	}{
+		{"complete", 100, 100, ""},
+		{"no declared size", 100, -1, ""},
+		{"empty", 0, -1, errCodeEmptyFile},
+		{"short of the declared size", 60, 100, errCodeTruncatedUpload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			err := checkReceivedSize(w, tt.received, tt.declared)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Errorf("checkReceivedSize = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || w.Code != http.StatusBadRequest {
+				t.Fatalf("checkReceivedSize = %v with status %d, want a 400", err, w.Code)
+			}
+			if code := responseErrorCode(t, w); code != tt.wantError {
+				t.Errorf("error code = %q, want %q", code, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestUploadVideoWithoutUsableVideoStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		probe    string
+		wantCode int
+	}{
+		{
+			name: "audio only",
+			probe: `{
+				"streams": [{"codec_type": "audio", "codec_name": "aac"}],
+				"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "3.0"}
+			}`,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "audio first with a corrupt video stream",
+			probe: `{
+				"streams": [
+					{"codec_type": "audio", "codec_name": "aac"},
+					{"codec_type": "video", "codec_name": "h264", "width": 0, "height": 0}
+				],
+				"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "3.0"}
+			}`,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "ffprobe output unreadable",
+			probe:    `not json`,
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeMedia(t, tt.probe)
+			cfg, mock := newTestConfig(t)
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode == http.StatusUnprocessableEntity {
+				if code := responseErrorCode(t, w); code != errCodeInvalidVideo {
+					t.Errorf("error code = %q, want %q", code, errCodeInvalidVideo)
+				}
+			}
+			if keys := mock.Keys(); len(keys) != 0 {
+				t.Errorf("stored %q for a rejected video", keys)
+			}
+		})
+	}
+}
+
+func TestProbeVideoPicksVideoStream(t *testing.T) {
+	// Audio first, then a thumbnail-sized attached picture before the main
+	// video stream
+	installFakeMedia(t, `{
+		"streams": [
+			{"codec_type": "audio", "codec_name": "aac"},
+			{"codec_type": "video", "codec_name": "mjpeg", "width": 320, "height": 180},
+			{"codec_type": "video", "codec_name": "hevc", "width": 1080, "height": 1920}
+		],
+		"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "12.5"}
+	}`)
+	cfg, _ := newTestConfig(t)
+
+	meta, err := cfg.probeVideo(context.Background(), "video.mp4")
+	if err != nil {
+		t.Fatalf("probeVideo: %v", err)
+	}
+	want := VideoMeta{
+		Width:    1080,
+		Height:   1920,
+		Duration: 12.5,
+		Codec:    "hevc",
+		Format:   "mov,mp4,m4a,3gp,3g2,mj2",
+		HasAudio: true,
+	}
+	if meta != want {
+		t.Errorf("meta = %+v, want %+v", meta, want)
+	}
+}
+
+func TestUploadVideoVerifiesObject(t *testing.T) {
+	tests := []struct {
+		name string
+		// onHead changes the stored object as HeadObject looks at it
+		onHead   func(obj mockObject, ok bool) (mockObject, bool)
+		wantCode int
+	}{
+		{
+			name:     "stored",
+			onHead:   func(obj mockObject, ok bool) (mockObject, bool) { return obj, ok },
+			wantCode: http.StatusCreated,
+		},
+		{
+			name:     "not found",
+			onHead:   func(obj mockObject, ok bool) (mockObject, bool) { return mockObject{}, false },
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name: "empty",
+			onHead: func(obj mockObject, ok bool) (mockObject, bool) {
+				obj.data = nil
+				return obj, ok
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeMedia(t, testProbeOutput)
+			cfg, mock := newTestConfig(t)
+			cfg.verifyUploads = true
+			mock.onCall = func(call string) {
+				key, ok := strings.CutPrefix(call, "HeadObject ")
+				if !ok {
+					return
+				}
+				obj, ok := mock.objects[key]
+				obj, ok = tt.onHead(obj, ok)
+				delete(mock.objects, key)
+				if ok {
+					mock.objects[key] = obj
+				}
+			}
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+			if heads := mock.CallsTo("HeadObject"); len(heads) != 1 {
+				t.Errorf("HeadObject calls = %q, want 1", heads)
+			}
+			video, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := video.VideoURL != nil; stored != (tt.wantCode == http.StatusCreated) {
+				t.Errorf("video URL = %v after a %d", video.VideoURL, w.Code)
+			}
+		})
+	}
+}
+
+func TestUploadToS3Failure(t *testing.T) {
+	cfg, mock := newTestConfig(t)
+	mock.putErr = func(key string) error { return errors.New("AccessDenied") }
+
+	w := httptest.NewRecorder()
+	err := cfg.uploadToS3(context.Background(), w, bytes.NewReader([]byte("video")), "landscape/video.mp4", "video/mp4", uuid.New())
+	if err == nil {
+		t.Fatal("uploadToS3 succeeded, want an error")
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != errCodeStorageError {
+		t.Errorf("code = %q, want %q", body.Code, errCodeStorageError)
+	}
+	if len(mock.Keys()) != 0 {
+		t.Errorf("stored %q, want nothing", mock.Keys())
+	}
+}
+
+func TestUploadVideoContentMD5(t *testing.T) {
+	data := testMP4(4096)
+	sum := md5.Sum(data)
+	otherSum := md5.Sum([]byte("another video"))
+
+	tests := []struct {
+		name       string
+		contentMD5 string
+		wantCode   int
+		wantError  errorCode
+		wantPuts   int
+	}{
+		{
+			name:       "matching",
+			contentMD5: base64.StdEncoding.EncodeToString(sum[:]),
+			wantCode:   http.StatusCreated,
+			wantPuts:   1,
+		},
+		{
+			name:       "mismatched",
+			contentMD5: base64.StdEncoding.EncodeToString(otherSum[:]),
+			wantCode:   http.StatusBadRequest,
+			wantError:  errCodeChecksumMismatch,
+		},
+		{
+			name:       "malformed",
+			contentMD5: "not-an-md5",
+			wantCode:   http.StatusBadRequest,
+			wantError:  errCodeBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeMedia(t, testProbeOutput)
+			cfg, mock := newTestConfig(t)
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, data, textproto.MIMEHeader{
+				"Content-Md5": {tt.contentMD5},
+			}))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantError != "" {
+				if got := responseErrorCode(t, w); got != tt.wantError {
+					t.Errorf("code = %q, want %q", got, tt.wantError)
+				}
+			}
+			if puts := mock.CallsTo("PutObject"); len(puts) != tt.wantPuts {
+				t.Errorf("PutObject calls = %q, want %d", puts, tt.wantPuts)
+			}
+		})
+	}
+}
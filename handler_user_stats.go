@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// handlerGetUserStats sums up the authenticated user's library: how many
+// videos it has, the storage and running time of their files, and how many
+// videos there are of each shape, bucketed by aspect ratio as their keys
+// are. Videos without an upload only count towards the total.
+func (cfg *apiConfig) handlerGetUserStats(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		TotalVideos          int            `json:"total_videos"`
+		TotalStorageBytes    int64          `json:"total_storage_bytes"`
+		TotalDurationSeconds float64        `json:"total_duration_seconds"`
+		AspectRatios         map[string]int `json:"aspect_ratios"`
+	}
+
+	userID, err := cfg.authenticate(w, r)
+	if err != nil {
+		return
+	}
+
+	stats, err := cfg.db.GetUserVideoStats(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video stats", err)
+		return
+	}
+
+	aspectRatios := map[string]int{}
+	for _, d := range stats.Dimensions {
+		bucket := strings.TrimSuffix(cfg.aspectPrefixFor(d.Width, d.Height), "/")
+		aspectRatios[bucket] += d.Count
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		TotalVideos:          stats.Videos,
+		TotalStorageBytes:    stats.StorageBytes,
+		TotalDurationSeconds: stats.DurationSeconds,
+		AspectRatios:         aspectRatios,
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerDeleteVideo deletes a video along with its S3 objects and local
+// thumbnails. It's idempotent: deleting a video that's already gone succeeds.
+// Only authenticated users get that answer, so it can't be used to probe
+// which video IDs exist.
+func (cfg *apiConfig) handlerDeleteVideo(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	userID, err := cfg.authenticate(w, r)
+	if err != nil {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized access", nil)
+		return
+	}
+
+	if err := cfg.deleteVideoObjects(r.Context(), video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video from S3", err)
+		return
+	}
+	// Captions belong to this video alone, even when its file is shared
+	if err := cfg.deleteObjectURLs(r.Context(), slices.Collect(maps.Values(video.Captions))); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete captions from S3", err)
+		return
+	}
+
+	if err := cfg.deleteThumbnailFile(video.ThumbnailURL); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete thumbnail", err)
+		return
+	}
+	for _, source := range video.ThumbnailSrcset {
+		for _, sourceURL := range []string{source.WebP, source.JPEG} {
+			if err := cfg.deleteThumbnailFile(&sourceURL); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't delete thumbnail", err)
+				return
+			}
+		}
+	}
+	gallery, err := cfg.db.GetThumbnails(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnails", err)
+		return
+	}
+	for _, thumbnail := range gallery {
+		if err := cfg.deleteThumbnailFile(&thumbnail.URL); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't delete thumbnail", err)
+			return
+		}
+	}
+	if err := cfg.discardThumbnailCandidates(video.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete thumbnail", err)
+		return
+	}
+
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteVideoObjects removes a video's S3 object, renditions, audio and
+// previews. Objects shared with other (deduplicated) videos are left in place.
+func (cfg *apiConfig) deleteVideoObjects(ctx context.Context, video database.Video) error {
+	if video.VideoURL == nil {
+		return nil
+	}
+
+	others, err := cfg.db.CountOtherVideosWithURL(*video.VideoURL, video.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't check for shared objects: %w", err)
+	}
+	if others > 0 {
+		return nil
+	}
+
+	return cfg.deleteObjectURLs(ctx, videoObjectURLs(video))
+}
+
+// deleteReplacedObjects removes the objects of previous that current, the
+// same video after its file was replaced, no longer uses. Nothing is deleted
+// while other (deduplicated) videos share the previous file.
+func (cfg *apiConfig) deleteReplacedObjects(ctx context.Context, previous, current database.Video) error {
+	if previous.VideoURL == nil {
+		return nil
+	}
+
+	others, err := cfg.db.CountOtherVideosWithURL(*previous.VideoURL, previous.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't check for shared objects: %w", err)
+	}
+	if others > 0 {
+		return nil
+	}
+
+	kept := videoObjectURLs(current)
+	var stale []string
+	for _, objectURL := range videoObjectURLs(previous) {
+		if !slices.Contains(kept, objectURL) {
+			stale = append(stale, objectURL)
+		}
+	}
+	return cfg.deleteObjectURLs(ctx, stale)
+}
+
+// videoObjectURLs lists the URLs of every object stored for video: the file
+// itself, its renditions, audio, animated preview and scrub preview.
+func videoObjectURLs(video database.Video) []string {
+	if video.VideoURL == nil {
+		return nil
+	}
+	urls := []string{*video.VideoURL}
+	for _, renditionURL := range video.Renditions {
+		urls = append(urls, renditionURL)
+	}
+	if video.AudioURL != nil {
+		urls = append(urls, *video.AudioURL)
+	}
+	if video.PreviewURL != nil {
+		urls = append(urls, *video.PreviewURL)
+	}
+	if video.SpriteVTTURL != nil {
+		vttURL := *video.SpriteVTTURL
+		urls = append(urls, vttURL, strings.TrimSuffix(vttURL, spriteVTTName)+spriteSheetName)
+	}
+	return urls
+}
+
+// deleteObjectURLs deletes the objects at urls, built by objectURL.
+func (cfg *apiConfig) deleteObjectURLs(ctx context.Context, urls []string) error {
+	for _, objectURL := range urls {
+		key, err := cfg.s3KeyFromURL(objectURL)
+		if err != nil {
+			return err
+		}
+		// An HLS package is a playlist plus segments under one prefix
+		if path.Base(key) == hlsPlaylistName {
+			if err := cfg.deleteObjectsWithPrefix(ctx, path.Dir(key)+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+		// DeleteObject succeeds for keys that don't exist, so a retried
+		// delete doesn't fail here.
+		_, err = cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// deleteThumbnailFile removes a thumbnail stored under assetsRoot. Thumbnails
+// hosted elsewhere, and files that are already gone, are ignored.
+func (cfg *apiConfig) deleteThumbnailFile(thumbnailURL *string) error {
+	if thumbnailURL == nil {
+		return nil
+	}
+	u, err := url.Parse(*thumbnailURL)
+	if err != nil || !strings.HasPrefix(u.Path, "/assets/") {
+		return nil
+	}
+
+	filePath := filepath.Join(cfg.assetsRoot, path.Base(u.Path))
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
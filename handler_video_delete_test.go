@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// newDeleteVideoRequest returns a request to delete videoID, authorized with
+// token when it isn't empty.
+func newDeleteVideoRequest(videoID uuid.UUID, token string) *http.Request {
+	r := newUserRequest(http.MethodDelete, "/api/videos/"+videoID.String(), token)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestDeleteVideoDoesNotRevealExistence(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	ownerID, ownerToken := createTestUser(t, cfg)
+	_, otherToken := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, ownerID)
+
+	tests := []struct {
+		name     string
+		videoID  uuid.UUID
+		token    string
+		wantCode int
+	}{
+		{"anonymous, existing video", video.ID, "", http.StatusUnauthorized},
+		{"anonymous, unknown video", uuid.New(), "", http.StatusUnauthorized},
+		{"signed in, unknown video", uuid.New(), ownerToken, http.StatusNoContent},
+		{"someone else's video", video.ID, otherToken, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.handlerDeleteVideo(w, newDeleteVideoRequest(tt.videoID, tt.token))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+	if _, err := cfg.db.GetVideo(video.ID); err != nil {
+		t.Errorf("video was deleted: %v", err)
+	}
+}
+
+func TestDeleteVideoDeletesObject(t *testing.T) {
+	cfg, mock := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	storeTestVideoFile(t, cfg, mock, &video, "landscape/abc.mp4", testMP4(64))
+
+	w := httptest.NewRecorder()
+	cfg.handlerDeleteVideo(w, newDeleteVideoRequest(video.ID, token))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusNoContent, w.Body)
+	}
+	if got, want := mock.CallsTo("DeleteObject"), []string{"DeleteObject landscape/abc.mp4"}; !slices.Equal(got, want) {
+		t.Errorf("deletes = %v, want %v", got, want)
+	}
+	if _, ok := mock.Object("landscape/abc.mp4"); ok {
+		t.Error("object is still stored")
+	}
+	if _, err := cfg.db.GetVideo(video.ID); err == nil {
+		t.Error("video row is still there")
+	}
+
+	// Deleting it again succeeds without touching S3
+	w = httptest.NewRecorder()
+	cfg.handlerDeleteVideo(w, newDeleteVideoRequest(video.ID, token))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("second delete: status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := mock.CallsTo("DeleteObject"); len(got) != 1 {
+		t.Errorf("second delete called S3: %v", got)
+	}
+}
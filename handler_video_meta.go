@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
@@ -14,14 +20,8 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		database.CreateVideoParams
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	userID, err := cfg.authenticate(w, r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
@@ -32,6 +32,11 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
 		return
 	}
+	if err := validateVideoTitle(params.Title); err != nil {
+		respondWithFieldError(w, err)
+		return
+	}
+	params.Title = strings.TrimSpace(params.Title)
 	params.UserID = userID
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
@@ -43,102 +48,222 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
-func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
+// handlerGetVideo returns one of the user's videos, with its stored
+// metadata and freshly signed URLs. With download=true, video_url saves the
+// file, named after the video's title, rather than playing it inline.
+func (cfg *apiConfig) handlerGetVideo(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.validateUserAndVideo(w, r)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	download := false
+	if value := r.URL.Query().Get("download"); value != "" {
+		download, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid download", err)
+			return
+		}
+	}
+	if download {
+		if cfg.signedURLTTL == 0 {
+			respondWithError(w, http.StatusNotImplemented, "Download links need URL signing", nil)
+			return
+		}
+		if video.VideoURL == nil {
+			respondWithError(w, http.StatusConflict, "Video has no upload", nil)
+			return
+		}
+		if path.Base(*video.VideoURL) == hlsPlaylistName {
+			respondWithError(w, http.StatusConflict, "HLS videos can't be downloaded as a file", nil)
+			return
+		}
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(*video)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if download {
+		disposition := attachmentDisposition(video.Title, path.Ext(*video.VideoURL))
+		downloadURL, err := cfg.signObjectURLWithDisposition(*video.VideoURL, disposition)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+			return
+		}
+		signedVideo.VideoURL = &downloadURL
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// maxDescriptionLength is the longest description, in characters, that
+// handlerUpdateVideoMetadata accepts.
+const maxDescriptionLength = 5000
+
+// handlerUpdateVideoMetadata edits a video's title and description. Fields
+// left out of the request body keep their current values.
+func (cfg *apiConfig) handlerUpdateVideoMetadata(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+
+	video, _, err := cfg.validateUserAndVideo(w, r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+
+	if params.Title != nil {
+		if err := validateVideoTitle(*params.Title); err != nil {
+			respondWithFieldError(w, err)
+			return
+		}
+		video.Title = strings.TrimSpace(*params.Title)
+	}
+	if params.Description != nil {
+		if utf8.RuneCountInString(*params.Description) > maxDescriptionLength {
+			msg := translatef(w, "Description must be at most %d characters", maxDescriptionLength)
+			respondWithError(w, http.StatusBadRequest, msg, nil)
+			return
+		}
+		video.Description = *params.Description
+	}
+
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	signedVideo, err := cfg.dbVideoToSignedVideo(*video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
 		return
 	}
-
-	w.WriteHeader(http.StatusNoContent)
+	respondWithJSON(w, http.StatusOK, signedVideo)
 }
 
-func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
+// Page sizes for handlerListVideos.
+const (
+	defaultVideosPageSize = 20
+	maxVideosPageSize     = 100
+)
+
+// handlerListVideos returns a page of the authenticated user's videos, newest
+// first. It accepts limit, an optional title search, and either offset or the
+// cursor a previous page returned as next_cursor. Cursors keep their place
+// when videos are uploaded between pages, where offsets drift.
+func (cfg *apiConfig) handlerListVideos(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Videos []database.Video `json:"videos"`
+		Total  int              `json:"total"`
+		Limit  int              `json:"limit"`
+		Offset int              `json:"offset"`
+		// NextCursor fetches the page after this one. It's null on the
+		// last page.
+		NextCursor *string `json:"next_cursor"`
+	}
+
+	userID, err := cfg.authenticate(w, r)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	query := r.URL.Query()
+	limit := defaultVideosPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxVideosPageSize {
+			msg := translatef(w, "limit must be between 1 and %d", maxVideosPageSize)
+			respondWithError(w, http.StatusBadRequest, msg, err)
+			return
+		}
+	}
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "offset must be a non-negative integer", err)
+			return
+		}
+	}
+	var cursor *database.VideoCursor
+	if value := query.Get("cursor"); value != "" {
+		if query.Has("offset") {
+			respondWithError(w, http.StatusBadRequest, "offset and cursor can't be combined", nil)
+			return
+		}
+		cursor, err = decodeVideoCursor(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+	}
+	search := strings.TrimSpace(query.Get("search"))
+
+	// One extra video tells whether there's a next page
+	videos, total, err := cfg.db.GetVideosByUser(userID, limit+1, offset, search, cursor)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	var nextCursor *string
+	if len(videos) > limit {
+		videos = videos[:limit]
+		last := videos[len(videos)-1]
+		next := encodeVideoCursor(database.VideoCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+		nextCursor = &next
+	}
 
-	// signedVideo, err := cfg.dbVideoToSignedVideo(video)
-	// if err != nil {
-	// 	if video.VideoURL == nil {
-	// 		signedVideo = video
-	// 	} else {
-	// 		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
-	// 		return
-	// 	}
-	// }
+	signedVideos := make([]database.Video, len(videos))
+	for i, video := range videos {
+		signedVideo, err := cfg.dbVideoToSignedVideo(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+			return
+		}
+		signedVideos[i] = signedVideo
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Videos:     signedVideos,
+		Total:      total,
+		Limit:      limit,
+		Offset:     offset,
+		NextCursor: nextCursor,
+	})
+}
 
-	respondWithJSON(w, http.StatusOK, video)
+// encodeVideoCursor packs a cursor into an opaque, URL-safe string. Clients
+// only pass it back.
+func encodeVideoCursor(cursor database.VideoCursor) string {
+	value := strconv.FormatInt(cursor.CreatedAt.Unix(), 10) + "_" + cursor.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
 }
 
-func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+func decodeVideoCursor(value string) (*database.VideoCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
+		return nil, err
+	}
+	seconds, id, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return nil, errors.New("malformed cursor")
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	unix, err := strconv.ParseInt(seconds, 10, 64)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
+		return nil, err
 	}
-
-	videos, err := cfg.db.GetVideos(userID)
+	videoID, err := uuid.Parse(id)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
-		return
+		return nil, err
 	}
-
-	// signedVideos := make([]database.Video, len(videos))
-	// for i, video := range videos {
-	// 	signedVideo, err := cfg.dbVideoToSignedVideo(video)
-	// 	if err != nil {
-	// 		if video.VideoURL == nil {
-	// 			signedVideos[i] = video
-	// 			continue
-	// 		}
-	// 		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
-	// 		return
-	// 	}
-	// 	signedVideos[i] = signedVideo
-	// }
-
-	respondWithJSON(w, http.StatusOK, videos)
+	return &database.VideoCursor{CreatedAt: time.Unix(unix, 0), ID: videoID}, nil
 }
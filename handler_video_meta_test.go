@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoListPage is the body of a handlerListVideos response.
+type videoListPage struct {
+	Videos     []database.Video `json:"videos"`
+	Total      int              `json:"total"`
+	NextCursor *string          `json:"next_cursor"`
+}
+
+// listVideos calls handlerListVideos with query as the query string and
+// returns the status and, for a 200, the page.
+func listVideos(t *testing.T, cfg *apiConfig, token, query string) (int, videoListPage) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	cfg.handlerListVideos(w, newUserRequest(http.MethodGet, "/api/videos?"+query, token))
+	var page videoListPage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, page
+}
+
+// createTitledVideos adds a video owned by userID for each title.
+func createTitledVideos(t *testing.T, cfg *apiConfig, userID uuid.UUID, titles ...string) {
+	t.Helper()
+	for _, title := range titles {
+		if _, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: title, UserID: userID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListVideosPaging(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	otherID, _ := createTestUser(t, cfg)
+	createTitledVideos(t, cfg, userID, "one", "two", "three", "four", "five")
+	createTitledVideos(t, cfg, otherID, "someone else's")
+
+	tests := []struct {
+		query      string
+		wantCount  int
+		wantCursor bool
+	}{
+		{query: "limit=2", wantCount: 2, wantCursor: true},
+		{query: "limit=2&offset=2", wantCount: 2, wantCursor: true},
+		{query: "limit=2&offset=4", wantCount: 1},
+		{query: "limit=5", wantCount: 5},
+		{query: "offset=5", wantCount: 0},
+		{query: "offset=50", wantCount: 0},
+	}
+	for _, tt := range tests {
+		code, page := listVideos(t, cfg, token, tt.query)
+		if code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d", tt.query, code, http.StatusOK)
+			continue
+		}
+		if len(page.Videos) != tt.wantCount || page.Total != 5 {
+			t.Errorf("%s: %d videos of %d, want %d of 5", tt.query, len(page.Videos), page.Total, tt.wantCount)
+		}
+		if (page.NextCursor != nil) != tt.wantCursor {
+			t.Errorf("%s: next_cursor = %v, want one %v", tt.query, page.NextCursor, tt.wantCursor)
+		}
+	}
+
+	// The pages hold every video once
+	seen := map[uuid.UUID]bool{}
+	for _, query := range []string{"limit=2", "limit=2&offset=2", "limit=2&offset=4"} {
+		_, page := listVideos(t, cfg, token, query)
+		for _, video := range page.Videos {
+			if seen[video.ID] {
+				t.Errorf("%s repeats %q", query, video.Title)
+			}
+			seen[video.ID] = true
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("pages held %d videos, want 5", len(seen))
+	}
+
+	for _, query := range []string{"limit=0", "limit=101", "limit=ten", "offset=-1"} {
+		if code, _ := listVideos(t, cfg, token, query); code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListVideosCursorStableAcrossInserts(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	createTitledVideos(t, cfg, userID, "one", "two", "three", "four", "five")
+
+	// Page through two at a time, adding a video before each next page. An
+	// offset would shift by one each time and repeat a video; the cursor
+	// carries on from the last video seen.
+	seen := map[string]int{}
+	query := "limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("paging didn't end")
+		}
+		code, page := listVideos(t, cfg, token, query)
+		if code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", query, code, http.StatusOK)
+		}
+		for _, video := range page.Videos {
+			seen[video.Title]++
+		}
+		if page.NextCursor == nil {
+			break
+		}
+		createTitledVideos(t, cfg, userID, "added before page "+strconv.Itoa(pages+2))
+		query = "limit=2&cursor=" + url.QueryEscape(*page.NextCursor)
+	}
+
+	for title, count := range seen {
+		if count > 1 {
+			t.Errorf("%q was listed %d times", title, count)
+		}
+	}
+	for _, title := range []string{"one", "two", "three", "four", "five"} {
+		if seen[title] != 1 {
+			t.Errorf("%q was skipped", title)
+		}
+	}
+
+	if code, _ := listVideos(t, cfg, token, "cursor=not-a-cursor"); code != http.StatusBadRequest {
+		t.Errorf("malformed cursor: status = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestListVideosSearch(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	createTitledVideos(t, cfg, userID, "Cat video", "Another cat", "Dog video", "100% dog")
+
+	tests := []struct {
+		search string
+		want   int
+	}{
+		{search: "", want: 4},
+		{search: "   ", want: 4},
+		{search: "cat", want: 2},
+		{search: "VIDEO", want: 2},
+		{search: "%", want: 1},
+		{search: "_", want: 0},
+		{search: "hamster", want: 0},
+	}
+	for _, tt := range tests {
+		code, page := listVideos(t, cfg, token, "search="+url.QueryEscape(tt.search))
+		if code != http.StatusOK {
+			t.Errorf("search %q: status = %d, want %d", tt.search, code, http.StatusOK)
+			continue
+		}
+		if len(page.Videos) != tt.want || page.Total != tt.want {
+			t.Errorf("search %q: %d videos of %d, want %d", tt.search, len(page.Videos), page.Total, tt.want)
+		}
+	}
+}
+
+func TestGetVideoNotFoundVersusDatabaseError(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	dbPath := filepath.Join(t.TempDir(), "tubely.db")
+	var err error
+	cfg.db, err = database.NewClient(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	getVideo := func(id uuid.UUID) int {
+		r := newUserRequest(http.MethodGet, "/api/videos/"+id.String(), token)
+		r.SetPathValue("videoID", id.String())
+		w := httptest.NewRecorder()
+		cfg.handlerGetVideo(w, r)
+		return w.Code
+	}
+
+	if code := getVideo(video.ID); code != http.StatusOK {
+		t.Errorf("existing video: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := getVideo(uuid.New()); code != http.StatusNotFound {
+		t.Errorf("unknown video: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Break the table behind the client's back, so the lookup itself fails
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err := raw.Exec("ALTER TABLE videos RENAME TO videos_moved"); err != nil {
+		t.Fatal(err)
+	}
+	if code := getVideo(video.ID); code != http.StatusInternalServerError {
+		t.Errorf("database error: status = %d, want %d", code, http.StatusInternalServerError)
+	}
+}
+
+func TestGetVideoDownloadDisposition(t *testing.T) {
+	const wantDisposition = `attachment; filename="Boots_ the bear.mp4"`
+	tests := []struct {
+		name       string
+		cloudFront bool
+		query      string
+		want       string
+	}{
+		{name: "presigned download", query: "download=true", want: wantDisposition},
+		{name: "presigned inline"},
+		{name: "CloudFront download", cloudFront: true, query: "download=true", want: wantDisposition},
+		{name: "CloudFront inline", cloudFront: true, query: "download=false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.signedURLTTL = time.Hour
+			if tt.cloudFront {
+				useCloudFrontSigning(cfg)
+			}
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			video.Title = "Boots: the bear"
+			videoURL := cfg.objectURL("landscape/video.mp4")
+			video.VideoURL = &videoURL
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				t.Fatal(err)
+			}
+
+			r := newUserRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"?"+tt.query, token)
+			r.SetPathValue("videoID", video.ID.String())
+			w := httptest.NewRecorder()
+			cfg.handlerGetVideo(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			var got database.Video
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			var u *url.URL
+			if tt.cloudFront {
+				u = verifyCloudFrontSignedURL(t, cfg, *got.VideoURL)
+			} else {
+				var err error
+				u, err = url.Parse(*got.VideoURL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if u.Query().Get("X-Amz-Signature") == "" {
+					t.Errorf("%s isn't presigned", u)
+				}
+			}
+			if disposition := u.Query().Get("response-content-disposition"); disposition != tt.want {
+				t.Errorf("response-content-disposition = %q, want %q", disposition, tt.want)
+			}
+		})
+	}
+}
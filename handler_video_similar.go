@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerFindSimilar returns the user's other videos whose perceptual hash
+// is within a Hamming distance of the video's, closest first, each with its
+// distance. The threshold is SIMILARITY_MAX_DISTANCE (10 by default) unless
+// max_distance, from 0 to 64, overrides it.
+func (cfg *apiConfig) handlerFindSimilar(w http.ResponseWriter, r *http.Request) {
+	type similarVideo struct {
+		database.Video
+		Distance int `json:"distance"`
+	}
+
+	video, userID, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	maxDistance := cfg.similarityMaxDistance
+	if value := r.URL.Query().Get("max_distance"); value != "" {
+		maxDistance, err = strconv.Atoi(value)
+		if err != nil || maxDistance < 0 || maxDistance > 64 {
+			respondWithError(w, http.StatusBadRequest, "Invalid max_distance", err)
+			return
+		}
+	}
+
+	if video.PerceptualHash == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been fingerprinted", nil)
+		return
+	}
+	hash, err := parsePerceptualHash(*video.PerceptualHash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read perceptual hash", err)
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	similar := []similarVideo{}
+	for _, candidate := range videos {
+		if candidate.ID == video.ID || candidate.PerceptualHash == nil {
+			continue
+		}
+		candidateHash, err := parsePerceptualHash(*candidate.PerceptualHash)
+		if err != nil {
+			continue
+		}
+		if distance := hammingDistance(hash, candidateHash); distance <= maxDistance {
+			signedCandidate, err := cfg.dbVideoToSignedVideo(candidate)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+				return
+			}
+			similar = append(similar, similarVideo{Video: signedCandidate, Distance: distance})
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Distance < similar[j].Distance
+	})
+
+	respondWithJSON(w, http.StatusOK, similar)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// readinessTimeout bounds each dependency check made by handlerReadyz.
+	readinessTimeout = 5 * time.Second
+	// mediaCheckInterval is how long the ffmpeg/ffprobe check result is
+	// reused, so frequent probes don't spawn processes every time.
+	mediaCheckInterval = 30 * time.Second
+)
+
+// handlerHealthz reports that the process is up.
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handlerReadyz reports whether the server can handle uploads: the bucket
+// must be reachable and ffmpeg/ffprobe must run. It responds 503 listing the
+// failed checks when not.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	// The checks run concurrently so a slow bucket doesn't use up the
+	// media tools' time
+	var bucketErr error
+	var mediaResults map[string]error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		bucketErr = cfg.checkBucket(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		mediaResults = cfg.mediaCheck.get(time.Now(), func() map[string]error {
+			return cfg.checkMediaTools(ctx)
+		})
+	}()
+	wg.Wait()
+
+	checks := map[string]error{"s3": bucketErr}
+	for name, err := range mediaResults {
+		checks[name] = err
+	}
+
+	resp := response{Status: "ready", Checks: map[string]string{}}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			loggerFromContext(r.Context()).Warn("readiness check failed", "check", name, "error", err)
+			resp.Checks[name] = err.Error()
+			resp.Status = "not ready"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		resp.Checks[name] = "ok"
+	}
+	respondWithJSON(w, status, resp)
+}
+
+func (cfg *apiConfig) checkBucket(ctx context.Context) error {
+	_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: &cfg.s3Bucket,
+	})
+	return err
+}
+
+// checkMediaTools runs ffmpeg and ffprobe's version checks.
+func (cfg *apiConfig) checkMediaTools(ctx context.Context) map[string]error {
+	results := map[string]error{}
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		_, results[name] = cfg.runMedia(ctx, name, "-version")
+	}
+	return results
+}
+
+// cachedCheck reuses the result of a dependency check for
+// mediaCheckInterval.
+type cachedCheck struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	results   map[string]error
+}
+
+// get returns the cached results, calling check for fresh ones when they're
+// missing or stale.
+func (c *cachedCheck) get(now time.Time, check func() map[string]error) map[string]error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results == nil || now.Sub(c.checkedAt) > mediaCheckInterval {
+		c.results = check()
+		c.checkedAt = now
+	}
+	return c.results
+}
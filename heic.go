@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// heifBrands are the ftyp major brands of HEIF images, such as the HEICs
+// iPhones take photos as.
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"}
+
+// isHEIF reports whether file is a HEIF image, going by its ftyp box: clients
+// often send HEICs as application/octet-stream, or not at all.
+func isHEIF(file io.ReadSeeker) (bool, error) {
+	header := make([]byte, 12)
+	n, err := io.ReadFull(file, header)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return false, seekErr
+	}
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	if n < len(header) || string(header[4:8]) != "ftyp" {
+		return false, nil
+	}
+	return slices.Contains(heifBrands, string(header[8:12])), nil
+}
+
+// errHEIFGridUnsupported is returned for tiled HEIF images, as iPhones take,
+// that the installed ffmpeg can't put back together. Before 7.1, ffmpeg
+// decodes such an image as its first 512x512 tile.
+var errHEIFGridUnsupported = errors.New("tiled HEIF image can't be composed by this ffmpeg")
+
+// heifProbeOutput is what ffprobe reports of a HEIF image. A tiled image is
+// a stream per tile, plus a tile grid stream group saying how they're put
+// together and how big the whole image is.
+type heifProbeOutput struct {
+	Streams      []ffprobeStream `json:"streams"`
+	StreamGroups []struct {
+		Type       string `json:"type"`
+		Components []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"components"`
+	} `json:"stream_groups"`
+}
+
+// probeHEIF returns the size of the image in the HEIF file at filePath,
+// without decoding it. Listing stream groups takes ffprobe 7.1 or newer,
+// the first that composes tiled images.
+func (cfg *apiConfig) probeHEIF(ctx context.Context, filePath string) (width, height int, err error) {
+	stdout, err := cfg.runProbe(ctx, "-v", "error", "-print_format", "json", "-show_streams", "-show_stream_groups", filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	var probeOutput heifProbeOutput
+	if err := json.Unmarshal(stdout, &probeOutput); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	for _, group := range probeOutput.StreamGroups {
+		if !strings.EqualFold(group.Type, "tile grid") {
+			continue
+		}
+		for _, grid := range group.Components {
+			if grid.Width > 0 && grid.Height > 0 {
+				return grid.Width, grid.Height, nil
+			}
+		}
+		return 0, 0, fmt.Errorf("%w: tile grid has no size", errHEIFGridUnsupported)
+	}
+
+	stream, ok := primaryVideoStream(probeOutput.Streams)
+	if !ok {
+		return 0, 0, errNoVideoStream
+	}
+	if stream.Width <= 0 || stream.Height <= 0 {
+		return 0, 0, fmt.Errorf("%w: %dx%d", errInvalidDimensions, stream.Width, stream.Height)
+	}
+	// Tiles reported without a grid to put them together. The embedded
+	// thumbnail is a stream too, but a smaller one.
+	tiles := 0
+	for _, s := range probeOutput.Streams {
+		if s.CodecType == "video" && s.Width == stream.Width && s.Height == stream.Height {
+			tiles++
+		}
+	}
+	if tiles > 1 {
+		return 0, 0, fmt.Errorf("%w: %d tiles but no tile grid", errHEIFGridUnsupported, tiles)
+	}
+	return stream.Width, stream.Height, nil
+}
+
+// convertHEIFToJPEG decodes the HEIF image read from src with ffmpeg and
+// re-encodes it as a JPEG at cfg.thumbnailQuality, since browsers mostly
+// can't show HEIF. The image's size is checked against the thumbnail bounds
+// before anything decodes it, and a tiled image is only accepted when ffmpeg
+// composed the whole grid. It responds with an error itself.
+func (cfg *apiConfig) convertHEIFToJPEG(w http.ResponseWriter, r *http.Request, src io.Reader) ([]byte, error) {
+	const unsupportedMsg = "Couldn't convert HEIC image, upload a JPEG, PNG or WebP instead"
+
+	f, err := os.CreateTemp(cfg.tempDir, tempFilePrefix+"*.heic")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail", err)
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, src)
+	f.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail", err)
+		return nil, err
+	}
+
+	width, height, err := cfg.probeHEIF(r.Context(), f.Name())
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, unsupportedMsg, err)
+		return nil, err
+	}
+	if err := cfg.checkThumbnailDimensions(w, width, height); err != nil {
+		return nil, err
+	}
+
+	// A tiled image's grid is composed into a single stream, which ffmpeg
+	// picks over the tiles as the largest
+	done := logStage(r.Context(), "heif_convert")
+	frame, err := cfg.runMedia(r.Context(), "ffmpeg",
+		"-i", f.Name(),
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "png",
+		"pipe:1",
+	)
+	done(err)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, unsupportedMsg, err)
+		return nil, err
+	}
+
+	// Anything smaller than the probed size is a tile, not the image. The
+	// size may come out rotated, as ffmpeg applies the image's rotation.
+	imgCfg, _, err := image.DecodeConfig(bytes.NewReader(frame))
+	if err != nil {
+		err = fmt.Errorf("couldn't decode converted image: %w", err)
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, unsupportedMsg, err)
+		return nil, err
+	}
+	if (imgCfg.Width != width || imgCfg.Height != height) && (imgCfg.Width != height || imgCfg.Height != width) {
+		err := fmt.Errorf("%w: converted to %dx%d, expected %dx%d", errHEIFGridUnsupported, imgCfg.Width, imgCfg.Height, width, height)
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, unsupportedMsg, err)
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(frame))
+	if err != nil {
+		err = fmt.Errorf("couldn't decode converted image: %w", err)
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, unsupportedMsg, err)
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: cfg.thumbnailQuality}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't convert HEIC image", err)
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
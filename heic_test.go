@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testHEIC returns the start of a HEIC as iPhones write it: an ftyp box with
+// the heic brand. The fake ffprobe and ffmpeg don't read the rest.
+func testHEIC() []byte {
+	return []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic" + "\x00\x00\x00\x08meta")
+}
+
+func TestSaveThumbnailHEIC(t *testing.T) {
+	// The fake ffmpeg always converts to a 64x36 PNG
+	tests := []struct {
+		name      string
+		probe     string
+		wantCode  int
+		wantError errorCode
+	}{
+		{
+			name: "single image",
+			probe: `{"streams": [
+				{"codec_type": "video", "codec_name": "hevc", "width": 64, "height": 36},
+				{"codec_type": "video", "codec_name": "hevc", "width": 32, "height": 18}
+			]}`,
+		},
+		{
+			name: "tiled, composed",
+			probe: `{"streams": [
+				{"codec_type": "video", "codec_name": "hevc", "width": 32, "height": 18},
+				{"codec_type": "video", "codec_name": "hevc", "width": 32, "height": 18},
+				{"codec_type": "video", "codec_name": "hevc", "width": 32, "height": 18},
+				{"codec_type": "video", "codec_name": "hevc", "width": 32, "height": 18}
+			], "stream_groups": [
+				{"type": "Tile Grid", "components": [{"nb_tiles": 4, "width": 64, "height": 36}]}
+			]}`,
+		},
+		{
+			name: "tiled, only a tile decoded",
+			probe: `{"streams": [
+				{"codec_type": "video", "codec_name": "hevc", "width": 64, "height": 36},
+				{"codec_type": "video", "codec_name": "hevc", "width": 64, "height": 36}
+			], "stream_groups": [
+				{"type": "Tile Grid", "components": [{"nb_tiles": 4, "width": 128, "height": 72}]}
+			]}`,
+			wantCode:  http.StatusUnsupportedMediaType,
+			wantError: errCodeUnsupportedMediaType,
+		},
+		{
+			name: "tiles without a grid",
+			probe: `{"streams": [
+				{"codec_type": "video", "codec_name": "hevc", "width": 64, "height": 36},
+				{"codec_type": "video", "codec_name": "hevc", "width": 64, "height": 36}
+			]}`,
+			wantCode:  http.StatusUnsupportedMediaType,
+			wantError: errCodeUnsupportedMediaType,
+		},
+		{
+			name: "grid too large",
+			probe: `{"streams": [
+				{"codec_type": "video", "codec_name": "hevc", "width": 512, "height": 512}
+			], "stream_groups": [
+				{"type": "Tile Grid", "components": [{"nb_tiles": 4096, "width": 32768, "height": 32768}]}
+			]}`,
+			wantCode:  http.StatusBadRequest,
+			wantError: errCodeInvalidImage,
+		},
+		{
+			name:      "unreadable",
+			probe:     `Unrecognized option 'show_stream_groups'.`,
+			wantCode:  http.StatusUnsupportedMediaType,
+			wantError: errCodeUnsupportedMediaType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installFakeMedia(t, tt.probe)
+			cfg, _ := newTestConfig(t)
+			r := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/x", nil)
+			w := httptest.NewRecorder()
+
+			filePath, err := cfg.saveThumbnail(w, r, bytes.NewReader(testHEIC()), "application/octet-stream")
+			if tt.wantCode != 0 {
+				if err == nil {
+					t.Fatal("saveThumbnail succeeded, want an error")
+				}
+				if w.Code != tt.wantCode {
+					t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+				}
+				if got := responseErrorCode(t, w); got != tt.wantError {
+					t.Errorf("code = %q, want %q", got, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("saveThumbnail: %v (body %s)", err, w.Body)
+			}
+			f, err := os.Open(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			imgCfg, format, err := image.DecodeConfig(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != "jpeg" || imgCfg.Width != 64 || imgCfg.Height != 36 {
+				t.Errorf("stored a %dx%d %s, want a 64x36 jpeg", imgCfg.Width, imgCfg.Height, format)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// newTestConfig returns an apiConfig like main builds with no optional
+// settings, backed by a fresh database and a mockS3.
+func newTestConfig(t *testing.T) (*apiConfig, *mockS3) {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("couldn't create database: %v", err)
+	}
+	uploadPipeline, err := parseUploadPipeline("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aspectRatios, err := parseAspectRatioPrefixes(defaultAspectRatioPrefixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := newMockS3()
+	cfg := &apiConfig{
+		db:           db,
+		jwtSecret:    testJWTSecret,
+		platform:     "dev",
+		assetsRoot:   t.TempDir(),
+		s3Bucket:     "tubely-test",
+		s3Region:     "us-east-1",
+		s3URLMode:    urlModeS3VirtualHosted,
+		port:         "8091",
+		s3Client:     mock,
+		s3KeyLayout:  keyLayoutFlat,
+		tempDir:      t.TempDir(),
+		adminAPIKey:  "test-admin-key",
+		gzipMinBytes: 1024,
+
+		s3MultipartThreshold: 100 << 20,
+		s3PartSize:           manager.MinUploadPartSize,
+		s3UploadConcurrency:  1,
+		s3CacheControl:       "public, max-age=31536000, immutable",
+		s3ImageCacheControl:  "public, max-age=86400",
+		s3RetryBaseDelay:     time.Millisecond,
+
+		accessTokenTTL:  time.Hour,
+		refreshTokenTTL: time.Hour,
+
+		uploadProgress:    newProgressTracker(time.Minute),
+		uploadIdempotency: newIdempotencyStore(time.Hour),
+		mediaCheck:        &cachedCheck{},
+		jobQueue:          newJobQueue(),
+		processingLimiter: newProcessingLimiter(4, time.Second),
+		fastStartBackfill: &fastStartBackfill{},
+		posterCache:       newPosterCache(time.Minute),
+		imageModerator:    noopModerator{},
+
+		maxVideoUploadBytes:           1 << 30,
+		multipartMemoryBytes:          10 << 20,
+		maxThumbnailUploadBytes:       10 << 20,
+		thumbnailMultipartMemoryBytes: 1 << 20,
+		thumbnailMaxEdge:              1280,
+		thumbnailQuality:              85,
+		thumbnailMinDimension:         16,
+		thumbnailMaxDimension:         10000,
+
+		mediaTimeout:         time.Minute,
+		probeTimeout:         time.Minute,
+		uploadPipeline:       uploadPipeline,
+		aspectRatios:         aspectRatios,
+		aspectRatioTolerance: 0.1,
+		hlsSegmentSeconds:    6,
+		reencodePreset:       "medium",
+		watermarkPosition:    "bottom-right",
+		watermarkOpacity:     0.8,
+		videoJobWorkers:      1,
+		videoJobMaxAttempts:  3,
+		maxVideoDuration:     time.Hour,
+		signedCookieTTL:      time.Hour,
+		directUploadURLTTL:   15 * time.Minute,
+	}
+	return cfg, mock
+}
+
+// createTestUser adds a user and returns its ID and an access token for it.
+func createTestUser(t *testing.T, cfg *apiConfig) (uuid.UUID, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "not-a-real-hash",
+	})
+	if err != nil {
+		t.Fatalf("couldn't create user: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.ID, token
+}
+
+// createTestVideo adds a video, with no file yet, owned by userID.
+func createTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID) database.Video {
+	t.Helper()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       "Test video",
+		Description: "A video for tests",
+		UserID:      userID,
+	})
+	if err != nil {
+		t.Fatalf("couldn't create video: %v", err)
+	}
+	return video
+}
+
+// testProbeOutput is what the fake ffprobe reports for every file: a short
+// 1080p H.264 video with an AAC track.
+const testProbeOutput = `{
+	"streams": [
+		{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080},
+		{"codec_type": "audio", "codec_name": "aac"}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "3.0"}
+}`
+
+// installFakeMedia puts fake ffprobe and ffmpeg commands first on PATH.
+// ffprobe prints probeOutput. ffmpeg copies its first input to its output,
+// writes a fast start MP4 when asked to remux for fast start, or writes a
+// frame when the output is pipe:1 (a small PNG, or grayscale pixels for
+// rawvideo), so the pipeline runs without either installed.
+func installFakeMedia(t *testing.T, probeOutput string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake media commands are shell scripts")
+	}
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte, perm os.FileMode) {
+		if err := os.WriteFile(filepath.Join(dir, name), data, perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("probe.json", []byte(probeOutput), 0644)
+	writeFile("frame.png", testPNG(t, 64, 36), 0644)
+	writeFile("faststart.mp4", testMP4(4096), 0644)
+	writeFile("ffprobe", []byte("#!/bin/sh\ncat '"+dir+"/probe.json'\n"), 0755)
+	writeFile("ffmpeg", []byte(`#!/bin/sh
+in=
+format=
+movflags=
+prev=
+for arg; do
+	if [ "$prev" = "-i" ] && [ -z "$in" ]; then in=$arg; fi
+	if [ "$prev" = "-f" ]; then format=$arg; fi
+	if [ "$prev" = "-movflags" ]; then movflags=$arg; fi
+	prev=$arg
+	out=$arg
+done
+if [ "$movflags" = "faststart" ]; then exec cp '`+dir+`/faststart.mp4' "$out"; fi
+if [ "$out" = "pipe:1" ] && [ "$format" = "rawvideo" ]; then exec head -c `+strconv.Itoa(phashSize*phashSize)+` /dev/zero; fi
+if [ "$out" = "pipe:1" ]; then exec cat '`+dir+`/frame.png'; fi
+exec cp "$in" "$out"
+`), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// testPNG returns a PNG of the given size.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testMP4 returns the box layout of a fast start MP4 (ftyp, moov, then
+// mdat), with size bytes of media data. It isn't playable, but the fake
+// ffprobe doesn't need it to be.
+func testMP4(size int) []byte {
+	return testMP4Boxes("ftyp", "moov", "mdat", size)
+}
+
+// testSlowStartMP4 is testMP4 with the moov after the mdat, as encoders
+// write it unless told to lay it out for fast start.
+func testSlowStartMP4(size int) []byte {
+	return testMP4Boxes("ftyp", "mdat", "moov", size)
+}
+
+func testMP4Boxes(first, second, third string, size int) []byte {
+	payloads := map[string][]byte{
+		"ftyp": []byte("isom\x00\x00\x02\x00isomiso2"),
+		"moov": make([]byte, 64),
+		"mdat": bytes.Repeat([]byte{0xab}, size),
+	}
+	var mp4 []byte
+	for _, boxType := range []string{first, second, third} {
+		mp4 = binary.BigEndian.AppendUint32(mp4, uint32(8+len(payloads[boxType])))
+		mp4 = append(append(mp4, boxType...), payloads[boxType]...)
+	}
+	return mp4
+}
+
+// newVideoUploadRequest returns an authorized upload of video to videoID,
+// as a multipart form with the file in its video field. partHeader is added
+// to the file part's headers.
+func newVideoUploadRequest(t *testing.T, token string, videoID uuid.UUID, video []byte, partHeader textproto.MIMEHeader) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	for name, values := range partHeader {
+		header[name] = values
+	}
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(video)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+// newThumbnailUploadRequest returns an authenticated thumbnail upload of
+// image, declared as contentType, for videoID.
+func newThumbnailUploadRequest(t *testing.T, token string, videoID uuid.UUID, image []byte, contentType string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="thumbnail"; filename="thumbnail"`)
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(image)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+videoID.String(), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+// responseErrorCode returns the code in w's JSON error response.
+func responseErrorCode(t *testing.T, w *httptest.ResponseRecorder) errorCode {
+	t.Helper()
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response isn't a JSON error: %v (body %s)", err, w.Body)
+	}
+	return body.Code
+}
+
+// storeTestVideoFile stores data under key in mock as video's file.
+func storeTestVideoFile(t *testing.T, cfg *apiConfig, mock *mockS3, video *database.Video, key string, data []byte) {
+	t.Helper()
+	mock.Put(key, data, "video/mp4")
+	videoURL := cfg.objectURL(key)
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		t.Fatalf("couldn't update video: %v", err)
+	}
+}
+
+// newUserRequest returns a request authorized with token, a user's JWT. An
+// empty token leaves it unauthenticated.
+func newUserRequest(method, target, token string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// newAdminRequest returns a request to the admin API, authorized with the
+// test config's API key.
+func newAdminRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "ApiKey test-admin-key")
+	return r
+}
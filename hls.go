@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// hlsPlaylistName is the name of the playlist within an HLS package.
+const hlsPlaylistName = "index.m3u8"
+
+// hlsContentTypes maps the files in an HLS package to their MIME types.
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
+
+// packageHLS splits the video at filePath into segments of roughly
+// segmentSeconds each, plus a VOD playlist referencing them, in a new temp
+// directory. Segments are cut at keyframes, so their lengths vary with the
+// source's keyframe interval. The caller removes segmentDir when done.
+func (cfg *apiConfig) packageHLS(ctx context.Context, filePath string, segmentSeconds int) (playlistPath string, segmentDir string, err error) {
+	segmentDir, err = os.MkdirTemp(cfg.tempDir, tempFilePrefix+"hls-*")
+	if err != nil {
+		return "", "", err
+	}
+
+	playlistPath = filepath.Join(segmentDir, hlsPlaylistName)
+	_, err = cfg.runMedia(ctx, "ffmpeg",
+		"-i", filePath,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(segmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(segmentDir, "segment%03d.ts"),
+		playlistPath,
+	)
+	if err != nil {
+		os.RemoveAll(segmentDir)
+		return "", "", err
+	}
+	return playlistPath, segmentDir, nil
+}
+
+// hlsBaseKey returns the S3 "directory" an HLS package for the video stored at
+// videoKey is uploaded under, e.g. landscape/abc.mp4 -> landscape/abc/.
+func hlsBaseKey(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/"
+}
+
+func hlsPlaylistKey(videoKey string) string {
+	return hlsBaseKey(videoKey) + hlsPlaylistName
+}
+
+// uploadHLS uploads every file in segmentDir under hlsBaseKey(videoKey).
+// The playlist goes last, so it's never served before its segments exist.
+func (cfg *apiConfig) uploadHLS(ctx context.Context, w http.ResponseWriter, segmentDir, videoKey string, ownerID uuid.UUID, onProgress func(fraction float64)) error {
+	entries, err := os.ReadDir(segmentDir)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read HLS segments", err)
+		return err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Name() != hlsPlaylistName {
+			names = append(names, entry.Name())
+		}
+	}
+	names = append(names, hlsPlaylistName)
+
+	baseKey := hlsBaseKey(videoKey)
+	for i, name := range names {
+		contentType, ok := hlsContentTypes[path.Ext(name)]
+		if !ok {
+			continue
+		}
+		f, err := os.Open(filepath.Join(segmentDir, name))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't open HLS segment", err)
+			return err
+		}
+		key, err := normalizeS3Key(baseKey + name)
+		if err == nil {
+			err = cfg.uploadObject(ctx, f, key, contentType, ownerID)
+		}
+		f.Close()
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't upload to S3", err)
+			return err
+		}
+		onProgress(float64(i+1) / float64(len(names)))
+	}
+	return nil
+}
+
+// deleteObjectsWithPrefix removes every object whose key starts with prefix.
+func (cfg *apiConfig) deleteObjectsWithPrefix(ctx context.Context, prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &cfg.s3Bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't list %s: %w", prefix, err)
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		objects := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			objects = append(objects, types.ObjectIdentifier{Key: obj.Key})
+		}
+		out, err := cfg.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &cfg.s3Bucket,
+			Delete: &types.Delete{Objects: objects},
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't delete objects under %s: %w", prefix, err)
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("couldn't delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultLocale = "en"
+
+// errorMessages holds translations of the error messages sent by
+// respondWithError, keyed by locale and then by the English message.
+// English needs no entry, and messages missing from a catalog fall back to
+// English.
+var errorMessages = map[string]map[string]string{
+	"es": {
+		"%d video URLs don't match the bucket, so orphans can't be deleted safely": "%d URL de videos no coinciden con el bucket, así que no se pueden eliminar los huérfanos con seguridad",
+		"A backfill is already running":                                            "Ya hay una migración en curso",
+		"A request with this Idempotency-Key is still in progress":                 "Una solicitud con este Idempotency-Key aún está en curso",
+		"Admin API is disabled":                                                    "La API de administración está desactivada",
+		"Captions exceed the maximum size of %s":                                   "Los subtítulos superan el tamaño máximo de %s",
+		"Cookie can't authorize cross-site requests":                               "La cookie no puede autorizar solicitudes entre sitios",
+		"Couldn't check for an existing video":                                     "No se pudo comprobar si el video ya existe",
+		"Couldn't check for shared objects":                                        "No se pudo comprobar si hay objetos compartidos",
+		"Couldn't check image":                                                     "No se pudo revisar la imagen",
+		"Couldn't check storage usage":                                             "No se pudo comprobar el uso de almacenamiento",
+		"Couldn't convert HEIC image":                                              "No se pudo convertir la imagen HEIC",
+		"Couldn't convert HEIC image, upload a JPEG, PNG or WebP instead":          "No se pudo convertir la imagen HEIC, sube un JPEG, PNG o WebP",
+		"Couldn't copy file contents":                                              "No se pudo copiar el contenido del archivo",
+		"Couldn't copy video":                                                      "No se pudo copiar el video",
+		"Couldn't create access JWT":                                               "No se pudo crear el JWT de acceso",
+		"Couldn't create file":                                                     "No se pudo crear el archivo",
+		"Couldn't create refresh token":                                            "No se pudo crear el token de actualización",
+		"Couldn't create temp file":                                                "No se pudo crear el archivo temporal",
+		"Couldn't create upload":                                                   "No se pudo crear la subida",
+		"Couldn't create upload URL":                                               "No se pudo crear la URL de subida",
+		"Couldn't create user":                                                     "No se pudo crear el usuario",
+		"Couldn't create video":                                                    "No se pudo crear el video",
+		"Couldn't decode parameters":                                               "No se pudieron decodificar los parámetros",
+		"Couldn't delete captions from S3":                                         "No se pudieron eliminar los subtítulos de S3",
+		"Couldn't delete old objects":                                              "No se pudieron eliminar los objetos antiguos",
+		"Couldn't delete orphaned objects":                                         "No se pudieron eliminar los objetos huérfanos",
+		"Couldn't delete previous candidates":                                      "No se pudieron eliminar los candidatos anteriores",
+		"Couldn't delete thumbnail":                                                "No se pudo eliminar la miniatura",
+		"Couldn't delete video":                                                    "No se pudo eliminar el video",
+		"Couldn't delete video from S3":                                            "No se pudo eliminar el video de S3",
+		"Couldn't download video":                                                  "No se pudo descargar el video",
+		"Couldn't extract audio":                                                   "No se pudo extraer el audio",
+		"Couldn't extract frame":                                                   "No se pudo extraer el fotograma",
+		"Couldn't fetch video":                                                     "No se pudo descargar el video",
+		"Couldn't find API key":                                                    "No se encontró la clave de API",
+		"Couldn't find JWT":                                                        "No se encontró el JWT",
+		"Couldn't find token":                                                      "No se encontró el token",
+		"Couldn't find video in S3":                                                "No se encontró el video en S3",
+		"Couldn't generate key":                                                    "No se pudo generar la clave",
+		"Couldn't generate preview":                                                "No se pudo generar la vista previa",
+		"Couldn't get thumbnail":                                                   "No se pudo obtener la miniatura",
+		"Couldn't get thumbnails":                                                  "No se pudieron obtener las miniaturas",
+		"Couldn't get uploaded video":                                              "No se pudo obtener el video subido",
+		"Couldn't get user for refresh token":                                      "No se pudo obtener el usuario del token de actualización",
+		"Couldn't get video":                                                       "No se pudo obtener el video",
+		"Couldn't get video stats":                                                 "No se pudieron obtener las estadísticas de los videos",
+		"Couldn't get video status":                                                "No se pudo obtener el estado del video",
+		"Couldn't get videos":                                                      "No se pudieron obtener los videos",
+		"Couldn't hash password":                                                   "No se pudo procesar la contraseña",
+		"Couldn't hash video":                                                      "No se pudo calcular el hash del video",
+		"Couldn't list objects":                                                    "No se pudieron listar los objetos",
+		"Couldn't open HLS segment":                                                "No se pudo abrir el segmento HLS",
+		"Couldn't open audio":                                                      "No se pudo abrir el audio",
+		"Couldn't open preview":                                                    "No se pudo abrir la vista previa",
+		"Couldn't open processed video":                                            "No se pudo abrir el video procesado",
+		"Couldn't open rendition":                                                  "No se pudo abrir la versión",
+		"Couldn't open video":                                                      "No se pudo abrir el video",
+		"Couldn't package HLS":                                                     "No se pudo empaquetar el video en HLS",
+		"Couldn't parse form":                                                      "No se pudo leer el formulario",
+		"Couldn't queue video for processing":                                      "No se pudo poner el video en cola para procesarlo",
+		"Couldn't read HLS segments":                                               "No se pudieron leer los segmentos HLS",
+		"Couldn't read captions":                                                   "No se pudieron leer los subtítulos",
+		"Couldn't read perceptual hash":                                            "No se pudo leer el hash perceptual",
+		"Couldn't read thumbnail":                                                  "No se pudo leer la miniatura",
+		"Couldn't read video metadata":                                             "No se pudieron leer los metadatos del video",
+		"Couldn't reorder thumbnails":                                              "No se pudieron reordenar las miniaturas",
+		"Couldn't reset database":                                                  "No se pudo reiniciar la base de datos",
+		"Couldn't reset file pointer":                                              "No se pudo reiniciar el puntero del archivo",
+		"Couldn't retrieve videos":                                                 "No se pudieron obtener los videos",
+		"Couldn't revoke session":                                                  "No se pudo revocar la sesión",
+		"Couldn't save refresh token":                                              "No se pudo guardar el token de actualización",
+		"Couldn't save thumbnail":                                                  "No se pudo guardar la miniatura",
+		"Couldn't save thumbnail sizes":                                            "No se pudieron guardar los tamaños de la miniatura",
+		"Couldn't save video":                                                      "No se pudo guardar el video",
+		"Couldn't sign cookies":                                                    "No se pudieron firmar las cookies",
+		"Couldn't transcode renditions":                                            "No se pudieron generar las versiones",
+		"Couldn't update thumbnail":                                                "No se pudo actualizar la miniatura",
+		"Couldn't update video":                                                    "No se pudo actualizar el video",
+		"Couldn't upload to S3":                                                    "No se pudo subir a S3",
+		"Couldn't upload video":                                                    "No se pudo subir el video",
+		"Couldn't validate JWT":                                                    "No se pudo validar el JWT",
+		"Couldn't validate token":                                                  "No se pudo validar el token",
+		"Couldn't verify uploaded video":                                           "No se pudo verificar el video subido",
+		"Couldn't watermark video":                                                 "No se pudo aplicar la marca de agua al video",
+		"Description must be at most %d characters":                                "La descripción debe tener como máximo %d caracteres",
+		"Download links need URL signing":                                          "Los enlaces de descarga requieren la firma de URL",
+		"Email and password are required":                                          "El correo y la contraseña son obligatorios",
+		"Error writing response":                                                   "Error al escribir la respuesta",
+		"Failed to generate video URL":                                             "No se pudo generar la URL del video",
+		"Failed to process video":                                                  "No se pudo procesar el video",
+		"File has no video stream":                                                 "El archivo no tiene una pista de video",
+		"Frames can't be extracted from HLS videos":                                "No se pueden extraer fotogramas de videos HLS",
+		"HLS videos can't be downloaded as a file":                                 "Los videos HLS no se pueden descargar como archivo",
+		"HLS videos can't be moved to a new key":                                   "Los videos HLS no se pueden mover a una clave nueva",
+		"Idempotency-Key must be at most %d characters":                            "Idempotency-Key debe tener como máximo %d caracteres",
+		"Idempotency-Key was already used for a different request":                 "Idempotency-Key ya se usó para otra solicitud",
+		"Image must be between %d and %d pixels on each side":                      "La imagen debe medir entre %d y %d píxeles por lado",
+		"Image rejected: %s":                                                       "Imagen rechazada: %s",
+		"Incorrect email or password":                                              "Correo o contraseña incorrectos",
+		"Invalid API key":                                                          "Clave de API no válida",
+		"Invalid Content-MD5":                                                      "Content-MD5 no válido",
+		"Invalid ID":                                                               "ID no válido",
+		"Invalid animatedPreview":                                                  "Valor de animatedPreview no válido",
+		"Invalid audio codec":                                                      "Códec de audio no válido",
+		"Invalid captions: %s":                                                     "Subtítulos no válidos: %s",
+		"Invalid cursor":                                                           "Cursor no válido",
+		"Invalid download":                                                         "Valor de download no válido",
+		"Invalid dryRun":                                                           "Valor de dryRun no válido",
+		"Invalid extractAudio":                                                     "Valor de extractAudio no válido",
+		"Invalid format":                                                           "Formato no válido",
+		"Invalid image":                                                            "Imagen no válida",
+		"Invalid max_distance":                                                     "max_distance no válido",
+		"Invalid min_age":                                                          "Valor de min_age no válido",
+		"Invalid prefix override":                                                  "Prefijo no válido",
+		"Invalid preview_start":                                                    "Valor de preview_start no válido",
+		"Invalid renditions":                                                       "Versiones no válidas",
+		"Invalid timestamp":                                                        "Marca de tiempo no válida",
+		"Invalid upload ID":                                                        "ID de subida no válido",
+		"Invalid upload key":                                                       "Clave de subida no válida",
+		"Invalid video ID":                                                         "ID de video no válido",
+		"Invalid watermark":                                                        "Valor de watermark no válido",
+		"Invalid watermark_position":                                               "Valor de watermark_position no válido",
+		"Missing captions file":                                                    "Falta el archivo de subtítulos",
+		"Missing thumbnail file":                                                   "Falta el archivo de miniatura",
+		"Missing video file":                                                       "Falta el archivo de video",
+		"No backfill has run":                                                      "No se ha ejecutado ninguna migración",
+		"Not enough disk space to process the upload":                              "No hay suficiente espacio en disco para procesar la subida",
+		"Previews can't be generated from HLS videos":                              "No se pueden generar vistas previas de videos HLS",
+		"Refresh token is invalid, revoked or expired":                             "El token de actualización no es válido, fue revocado o caducó",
+		"Request body too large":                                                   "El cuerpo de la solicitud es demasiado grande",
+		"Request timed out":                                                        "La solicitud excedió el tiempo de espera",
+		"Scrub previews need CloudFront signing or unsigned URLs":                  "Las vistas previas de desplazamiento requieren firma de CloudFront o URL sin firmar",
+		"Server is busy processing other videos, try again later":                  "El servidor está ocupado procesando otros videos, inténtalo más tarde",
+		"Signed cookies aren't enabled":                                            "Las cookies firmadas no están habilitadas",
+		"The %s stage is turned off":                                               "La etapa %s está desactivada",
+		"Thumbnail candidate not found":                                            "Candidato a miniatura no encontrado",
+		"Thumbnail exceeds the maximum upload size of %s (%d bytes)":               "La miniatura supera el tamaño máximo de subida de %s (%d bytes)",
+		"Thumbnail not found":                                                      "Miniatura no encontrada",
+		"Timed out reading video metadata":                                         "Se agotó el tiempo al leer los metadatos del video",
+		"Timestamp is past the end of the video (%ss)":                             "La marca de tiempo supera el final del video (%ss)",
+		"Title can't be empty":                                                     "El título no puede estar vacío",
+		"Title must be at most %d characters":                                      "El título debe tener como máximo %d caracteres",
+		"Token has expired":                                                        "El token ha caducado",
+		"Too many uploads, try again later":                                        "Demasiadas subidas, inténtalo más tarde",
+		"Unauthorized access":                                                      "Acceso no autorizado",
+		"Unsupported file type":                                                    "Tipo de archivo no admitido",
+		"Upload not found":                                                         "Subida no encontrada",
+		"Video doesn't match its Content-MD5":                                      "El video no coincide con su Content-MD5",
+		"Video exceeds the maximum upload size of %s (%d bytes)":                   "El video supera el tamaño máximo de subida de %s (%d bytes)",
+		"Video file is empty":                                                      "El archivo de video está vacío",
+		"Video has no audio track":                                                 "El video no tiene pista de audio",
+		"Video has no upload":                                                      "El video no tiene ningún archivo subido",
+		"Video hasn't been fingerprinted":                                          "El video aún no tiene huella digital",
+		"Video hasn't been uploaded yet":                                           "El video aún no se ha subido",
+		"Video is too long: %s exceeds the maximum duration of %s":                 "El video es demasiado largo: %s supera la duración máxima de %s",
+		"Video not found":                                                          "Video no encontrado",
+		"Video stream is invalid":                                                  "La pista de video no es válida",
+		"Video upload was truncated":                                               "La subida del video está incompleta",
+		"Video would exceed your storage quota of %s (%s used)":                    "El video superaría tu cuota de almacenamiento de %s (%s usados)",
+		"Video's file is shared with other videos":                                 "El archivo del video se comparte con otros videos",
+		"Watermarking isn't enabled":                                               "La marca de agua no está habilitada",
+		"columns must be between 1 and %d":                                         "columns debe estar entre 1 y %d",
+		"concurrency must be between 1 and %d":                                     "concurrency debe estar entre 1 y %d",
+		"count must be between 1 and %d":                                           "count debe estar entre 1 y %d",
+		"interval_seconds must be at least 1":                                      "interval_seconds debe ser al menos 1",
+		"lang is required":                                                         "lang es obligatorio",
+		"lang must be a language tag such as en or pt-BR":                          "lang debe ser una etiqueta de idioma como en o pt-BR",
+		"limit must be between 1 and %d":                                           "limit debe estar entre 1 y %d",
+		"offset and cursor can't be combined":                                      "offset y cursor no se pueden combinar",
+		"offset must be a non-negative integer":                                    "offset debe ser un entero no negativo",
+		"preview_duration must be greater than 0 and at most %d seconds":           "preview_duration debe ser mayor que 0 y como máximo %d segundos",
+		"preview_start is past the end of the video":                               "preview_start está después del final del video",
+		"thumbnail_ids must list each of the video's thumbnails once":              "thumbnail_ids debe incluir cada miniatura del video una vez",
+		"url must be an http(s) URL":                                               "url debe ser una URL http(s)",
+		"url must point at a public address":                                       "url debe apuntar a una dirección pública",
+	},
+}
+
+// localize returns msg translated for locale, or msg itself when there's no
+// translation.
+func localize(locale, msg string) string {
+	if translated, ok := errorMessages[locale][msg]; ok {
+		return translated
+	}
+	return msg
+}
+
+// translatef translates format for the locale negotiated for w before
+// formatting it. It's for messages with values in them, which can't be looked
+// up after formatting.
+func translatef(w http.ResponseWriter, format string, args ...interface{}) string {
+	return fmt.Sprintf(localize(localeFromWriter(w), format), args...)
+}
+
+// localizedResponseWriter carries the locale negotiated for a request so
+// respondWithError can translate its message.
+type localizedResponseWriter struct {
+	http.ResponseWriter
+	locale string
+}
+
+func (w *localizedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func localeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := negotiateLocale(r.Header.Get("Accept-Language"))
+		next.ServeHTTP(&localizedResponseWriter{ResponseWriter: w, locale: locale}, r)
+	})
+}
+
+// localeFromWriter returns the locale negotiated by localeMiddleware, looking
+// through any other wrappers around w.
+func localeFromWriter(w http.ResponseWriter) string {
+	for {
+		switch v := w.(type) {
+		case *localizedResponseWriter:
+			return v.locale
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return defaultLocale
+		}
+	}
+}
+
+// negotiateLocale picks the supported locale the client prefers most from an
+// Accept-Language header such as "es-MX,es;q=0.9,en;q=0.8".
+func negotiateLocale(header string) string {
+	type preference struct {
+		lang    string
+		quality float64
+	}
+
+	prefs := []preference{}
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality <= 0 {
+			continue
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		prefs = append(prefs, preference{lang: lang, quality: quality})
+	}
+	sort.SliceStable(prefs, func(i, j int) bool {
+		return prefs[i].quality > prefs[j].quality
+	})
+
+	for _, pref := range prefs {
+		if pref.lang == defaultLocale {
+			return defaultLocale
+		}
+		if _, ok := errorMessages[pref.lang]; ok {
+			return pref.lang
+		}
+	}
+	return defaultLocale
+}
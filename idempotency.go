@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotencyState says what to do with a request carrying an idempotency key.
+type idempotencyState int
+
+const (
+	// idempotencyNew means the key is unused and the request should run
+	idempotencyNew idempotencyState = iota
+	// idempotencyReplay means the stored response should be sent again
+	idempotencyReplay
+	// idempotencyInFlight means a request with the key is still running
+	idempotencyInFlight
+	// idempotencyKeyReused means the key was used for a different request
+	idempotencyKeyReused
+)
+
+// idempotencyStore remembers the responses to requests sent with an
+// Idempotency-Key header, so a client retrying after a timeout gets the
+// original response instead of the request being processed twice. Only
+// successful responses are kept; a failed request releases its key so it can
+// be retried.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	ttl     time.Duration
+}
+
+type idempotentResponse struct {
+	// request is the method and path the key was first used with
+	request string
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		entries: map[string]*idempotentResponse{},
+		ttl:     ttl,
+	}
+}
+
+func idempotencyStoreKey(userID uuid.UUID, key string) string {
+	return userID.String() + ":" + key
+}
+
+// begin claims key for userID's request. For a key that's already finished it
+// returns the stored response to replay.
+func (s *idempotencyStore) begin(userID uuid.UUID, key, request string, now time.Time) (idempotencyState, *idempotentResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	storeKey := idempotencyStoreKey(userID, key)
+	entry, ok := s.entries[storeKey]
+	if ok && entry.done && now.After(entry.expires) {
+		ok = false
+	}
+	switch {
+	case !ok:
+		s.entries[storeKey] = &idempotentResponse{request: request}
+		return idempotencyNew, nil
+	case entry.request != request:
+		return idempotencyKeyReused, nil
+	case !entry.done:
+		return idempotencyInFlight, nil
+	default:
+		return idempotencyReplay, entry
+	}
+}
+
+// finish stores the response recorded for key, or releases the key when the
+// request didn't succeed.
+func (s *idempotencyStore) finish(userID uuid.UUID, key string, rec *recordingResponseWriter, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	storeKey := idempotencyStoreKey(userID, key)
+	entry, ok := s.entries[storeKey]
+	if !ok {
+		return
+	}
+	if rec.status < 200 || rec.status > 299 {
+		delete(s.entries, storeKey)
+		return
+	}
+
+	// The recorded body is what the handler wrote, before any compression
+	// by gzipMiddleware, whose headers end up in the same map. A replay
+	// goes through the middleware again, which sets them for that request.
+	header := rec.Header().Clone()
+	header.Del(requestIDHeader)
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	header.Del("Vary")
+	entry.done = true
+	entry.status = rec.status
+	entry.header = header
+	entry.body = rec.body.Bytes()
+	entry.expires = now.Add(s.ttl)
+}
+
+// cleanup drops stored responses older than the TTL. Unfinished entries are
+// left alone; finish always resolves them.
+func (s *idempotencyStore) cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if entry.done && now.After(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (s *idempotencyStore) runCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.cleanup(now)
+	}
+}
+
+// replay writes a stored response to w.
+func (entry *idempotentResponse) replay(w http.ResponseWriter) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// recordingResponseWriter keeps a copy of the status and body written
+// through it.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUploadVideoIdempotencyKeyReplays(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	data := testMP4(4096)
+
+	upload := func() *httptest.ResponseRecorder {
+		r := newVideoUploadRequest(t, token, video.ID, data, nil)
+		r.Header.Set(idempotencyKeyHeader, "retry-me")
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, r)
+		return w
+	}
+	first := upload()
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first upload: status = %d, body = %s", first.Code, first.Body)
+	}
+	second := upload()
+
+	if puts := mock.CallsTo("PutObject"); len(puts) != 1 {
+		t.Errorf("PutObject calls = %q, want 1", puts)
+	}
+	if second.Code != first.Code {
+		t.Errorf("replayed status = %d, want %d", second.Code, first.Code)
+	}
+	if !bytes.Equal(second.Body.Bytes(), first.Body.Bytes()) {
+		t.Errorf("replayed body = %s, want %s", second.Body, first.Body)
+	}
+	if got := second.Header().Get(idempotentReplayedHeader); got != "true" {
+		t.Errorf("%s = %q, want true", idempotentReplayedHeader, got)
+	}
+	if got, want := second.Header().Get("Location"), first.Header().Get("Location"); got != want {
+		t.Errorf("replayed Location = %q, want %q", got, want)
+	}
+}
+
+func TestUploadVideoIdempotencyKeyReusedForAnotherVideo(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	first := createTestVideo(t, cfg, userID)
+	second := createTestVideo(t, cfg, userID)
+
+	for i, video := range []struct {
+		id       string
+		wantCode int
+	}{
+		{first.ID.String(), http.StatusCreated},
+		{second.ID.String(), http.StatusUnprocessableEntity},
+	} {
+		r := newVideoUploadRequest(t, token, first.ID, testMP4(4096), nil)
+		r.URL.Path = "/api/video_upload/" + video.id
+		r.SetPathValue("videoID", video.id)
+		r.Header.Set(idempotencyKeyHeader, "same-key")
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, r)
+		if w.Code != video.wantCode {
+			t.Errorf("upload %d: status = %d, want %d (body %s)", i+1, w.Code, video.wantCode, w.Body)
+		}
+	}
+	if puts := mock.CallsTo("PutObject"); len(puts) != 1 {
+		t.Errorf("PutObject calls = %q, want 1", puts)
+	}
+}
+
+func TestUploadVideoReplayThroughGzip(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	data := testMP4(4096)
+	handler := gzipMiddleware(1, http.HandlerFunc(cfg.handlerUploadVideo))
+
+	upload := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := newVideoUploadRequest(t, token, video.ID, data, nil)
+		r.Header.Set(idempotencyKeyHeader, "gzip-retry")
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	first := upload("gzip")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first upload: status = %d, body = %s", first.Code, first.Body)
+	}
+	if got := first.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("first upload: Content-Encoding = %q, want gzip", got)
+	}
+	want := gunzip(t, first.Body.Bytes())
+
+	// A client that doesn't accept gzip gets the replay as plain JSON
+	plain := upload("")
+	if got := plain.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("plain replay: Content-Encoding = %q, want none", got)
+	}
+	if !bytes.Equal(plain.Body.Bytes(), want) {
+		t.Errorf("plain replay: body = %s, want %s", plain.Body, want)
+	}
+	if got := plain.Header().Values("Vary"); len(got) != 1 {
+		t.Errorf("plain replay: Vary = %q, want it once", got)
+	}
+
+	// One that does gets it compressed, once
+	compressed := upload("gzip")
+	if got := compressed.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("gzip replay: Content-Encoding = %q, want gzip", got)
+	}
+	if got := gunzip(t, compressed.Body.Bytes()); !bytes.Equal(got, want) {
+		t.Errorf("gzip replay: body = %s, want %s", got, want)
+	}
+}
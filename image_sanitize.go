@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// sanitizeImage returns a copy of the image read from src with its metadata
+// (EXIF, including GPS location, XMP, comments) removed. JPEGs and PNGs are
+// decoded and re-encoded, which keeps nothing but the pixels. With
+// thumbnailKeepOrientation, a JPEG's EXIF orientation is applied to the
+// pixels first, so the image still displays the right way up without the
+// tag. WebP has no encoder in the standard library, so its metadata chunks
+// are cut out of the file instead.
+func (cfg *apiConfig) sanitizeImage(src io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read image: %w", err)
+	}
+	if format == "webp" {
+		return stripWebPMetadata(data)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if cfg.thumbnailKeepOrientation {
+			img = applyOrientation(img, jpegOrientation(data))
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: cfg.thumbnailQuality})
+	case "png":
+		err = png.Encode(&buf, img)
+	default:
+		return nil, fmt.Errorf("unsupported image format: %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode image: %w", err)
+	}
+	return &buf, nil
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of the JPEG in data,
+// or 1, meaning upright, when it has none or it can't be read.
+func jpegOrientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// Start of scan: the metadata segments are all behind us
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the Orientation tag from the first IFD of the TIFF
+// structure in tiff, returning 1 when it's missing or malformed.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		const orientationTag = 0x0112
+		if order.Uint16(tiff[entry:entry+2]) != orientationTag {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+// applyOrientation returns img transformed as EXIF orientation o says it
+// should be displayed.
+func applyOrientation(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5-8 swap the axes
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks from the WebP file in
+// data, clearing their flags in the VP8X header to match.
+func stripWebPMetadata(data []byte) (io.Reader, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("invalid WebP file")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		// Chunks are padded to an even size
+		end := i + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := bytes.Clone(data[i:end])
+			if len(chunk) > 8 {
+				const exifFlag, xmpFlag = 0x08, 0x04
+				chunk[8] &^= exifFlag | xmpFlag
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return bytes.NewReader(stripped), nil
+}
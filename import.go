@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Limits on fetching a video for import.
+const (
+	importDialTimeout   = 10 * time.Second
+	importHeaderTimeout = 30 * time.Second
+	importMaxRedirects  = 5
+	maxImportURLLength  = 2048
+	maxImportBodyBytes  = 4 << 10 // the JSON body holds little more than the URL
+	importUserAgent     = "tubely-import/1.0"
+)
+
+// errPrivateAddress is returned when an import would connect to an address
+// that isn't on the public internet.
+var errPrivateAddress = errors.New("address isn't publicly routable")
+
+// nonPublicPrefixes are ranges net/netip's predicates don't cover but that
+// still aren't reachable on the public internet.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// publicAddress reports whether addr is a globally routable unicast address.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// newImportClient returns the HTTP client imports are fetched with. Unless
+// allowPrivate is set, it refuses to connect to loopback, private and other
+// non-public addresses. The check runs on the address actually dialled, after
+// DNS resolution and on every redirect, so neither a hostname resolving to
+// an internal IP nor a redirect to one gets through.
+func newImportClient(allowPrivate bool) *http.Client {
+	if allowPrivate {
+		return importClientAllowing(func(netip.Addr) bool { return true })
+	}
+	return importClientAllowing(publicAddress)
+}
+
+// importClientAllowing is newImportClient for a client that only connects to
+// addresses allowed reports true for.
+func importClientAllowing(allowed func(netip.Addr) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: importDialTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allowed(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errPrivateAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			// No proxy: it would be the one dialled, bypassing the check
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ResponseHeaderTimeout: importHeaderTimeout,
+			ForceAttemptHTTP2:     true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= importMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// handlerImportVideoFromURL runs the upload pipeline on a video the server
+// downloads from the url in the JSON body, instead of one pushed by the
+// client. Upload options such as renditions go in the query string.
+func (cfg *apiConfig) handlerImportVideoFromURL(w http.ResponseWriter, r *http.Request) {
+	cfg.uploadVideo(w, r, false, cfg.openVideoFromURL)
+}
+
+// openVideoFromURL starts downloading the video named in the request body.
+// Declared sizes over the upload limit are rejected before any of the body
+// is read, and the body is capped at the limit as it streams.
+func (cfg *apiConfig) openVideoFromURL(w http.ResponseWriter, r *http.Request) (videoSource, error) {
+	type parameters struct {
+		URL string `json:"url"`
+	}
+	var params parameters
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large", err)
+			return videoSource{}, err
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return videoSource{}, err
+	}
+
+	u, err := url.Parse(params.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(params.URL) > maxImportURLLength {
+		if err == nil {
+			err = fmt.Errorf("invalid import URL %q", params.URL)
+		}
+		respondWithError(w, http.StatusBadRequest, "url must be an http(s) URL", err)
+		return videoSource{}, err
+	}
+
+	done := logStage(r.Context(), "import_fetch", "host", u.Host)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		done(err)
+		respondWithError(w, http.StatusBadRequest, "url must be an http(s) URL", err)
+		return videoSource{}, err
+	}
+	req.Header.Set("User-Agent", importUserAgent)
+	resp, err := cfg.importClient.Do(req)
+	done(err)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			respondWithError(w, http.StatusBadRequest, "url must point at a public address", err)
+			return videoSource{}, err
+		}
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch video", err)
+		return videoSource{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err := fmt.Errorf("remote server responded %s", resp.Status)
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch video", err)
+		return videoSource{}, err
+	}
+	if resp.ContentLength > cfg.maxVideoUploadBytes {
+		resp.Body.Close()
+		msg := translatef(w, "Video exceeds the maximum upload size of %s (%d bytes)", formatBytes(cfg.maxVideoUploadBytes), cfg.maxVideoUploadBytes)
+		err := fmt.Errorf("remote Content-Length %d exceeds %d", resp.ContentLength, cfg.maxVideoUploadBytes)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+		return videoSource{}, err
+	}
+
+	return videoSource{
+		body:        http.MaxBytesReader(nil, resp.Body, cfg.maxVideoUploadBytes),
+		size:        resp.ContentLength,
+		contentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
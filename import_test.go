@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"::ffff:8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false}, // cloud metadata
+		{"fe80::1", false},
+		{"fd00:ec2::254", false}, // IPv6 ULA, AWS's metadata endpoint
+		{"fc00::1", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestImportClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	_, err := newImportClient(false).Get(server.URL)
+	if !errors.Is(err, errPrivateAddress) {
+		t.Errorf("fetching %s: %v, want %v", server.URL, err, errPrivateAddress)
+	}
+	resp, err := newImportClient(true).Get(server.URL)
+	if err != nil {
+		t.Fatalf("fetching %s with private addresses allowed: %v", server.URL, err)
+	}
+	resp.Body.Close()
+}
+
+func TestImportClientRefusesRedirectToPrivateAddress(t *testing.T) {
+	targets := []string{
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/",
+		"http://[::1]:1/",
+		"http://[fd00:ec2::254]/",
+		"http://[::ffff:10.0.0.1]/",
+	}
+	for _, target := range targets {
+		t.Run(target, func(t *testing.T) {
+			server := httptest.NewServer(http.RedirectHandler(target, http.StatusFound))
+			defer server.Close()
+			serverAddr := netip.MustParseAddrPort(server.Listener.Addr().String()).Addr()
+
+			// The test server stands in for a public host
+			client := importClientAllowing(func(addr netip.Addr) bool {
+				return addr == serverAddr || publicAddress(addr)
+			})
+			_, err := client.Get(server.URL)
+			if !errors.Is(err, errPrivateAddress) {
+				t.Errorf("following redirect to %s: %v, want %v", target, err, errPrivateAddress)
+			}
+		})
+	}
+}
+
+// newImportRequest returns a request importing into videoID with body as
+// its JSON.
+func newImportRequest(token string, videoID uuid.UUID, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+videoID.String()+"/import", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestImportVideoFromURL(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(testMP4(4096))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		allowPrivate bool
+		wantCode     int
+	}{
+		{"allowed", true, http.StatusCreated},
+		{"internal address", false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.importClient = newImportClient(tt.allowPrivate)
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerImportVideoFromURL(w, newImportRequest(token, video.ID, `{"url": "`+server.URL+`/clip.mp4"}`))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+			stored := len(mock.CallsTo("PutObject")) > 0
+			if stored != (tt.wantCode == http.StatusCreated) {
+				t.Errorf("stored = %v, calls %q", stored, mock.Calls())
+			}
+		})
+	}
+}
+
+func TestImportVideoFromURLBodyLimit(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	body := `{"url": "https://example.com/` + strings.Repeat("a", maxImportBodyBytes) + `"}`
+	w := httptest.NewRecorder()
+	cfg.handlerImportVideoFromURL(w, newImportRequest(token, video.ID, body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d (body %s)", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+	}
+}
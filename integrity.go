@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// hashFile returns the hex SHA-256 of the file at filePath.
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runIntegritySweep checks a sample of stored videos every interval until the
+// process exits.
+func (cfg *apiConfig) runIntegritySweep(interval time.Duration, sampleSize int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := cfg.integritySweep(context.Background(), sampleSize); err != nil {
+			slog.Error("integrity sweep failed", "error", err)
+		}
+	}
+}
+
+// integritySweep re-downloads up to sampleSize videos (least recently checked
+// first), recomputes their SHA-256 and compares it with the hash recorded at
+// upload. Mismatches and missing objects are flagged on the video record.
+// Transient S3 errors are logged and the video is retried on a later run.
+func (cfg *apiConfig) integritySweep(ctx context.Context, sampleSize int) error {
+	videos, err := cfg.db.GetVideosForIntegrityCheck(sampleSize)
+	if err != nil {
+		return fmt.Errorf("couldn't get videos to check: %w", err)
+	}
+
+	logger := loggerFromContext(ctx)
+	mismatches := 0
+	for _, video := range videos {
+		key, err := cfg.s3KeyFromURL(*video.VideoURL)
+		if err != nil {
+			logger.Warn("integrity check skipped", "video_id", video.ID, "error", err)
+			continue
+		}
+
+		var integrityError *string
+		actual, err := cfg.hashS3Object(ctx, key)
+		var noSuchKey *types.NoSuchKey
+		switch {
+		case errors.As(err, &noSuchKey):
+			msg := "object is missing"
+			integrityError = &msg
+		case err != nil:
+			logger.Warn("integrity check skipped", "video_id", video.ID, "key", key, "error", err)
+			continue
+		case actual != *video.ContentSHA256:
+			msg := fmt.Sprintf("hash mismatch: expected %s, got %s", *video.ContentSHA256, actual)
+			integrityError = &msg
+		}
+
+		if integrityError != nil {
+			mismatches++
+			logger.Error("integrity check failed", "video_id", video.ID, "key", key, "problem", *integrityError)
+		}
+		if err := cfg.db.SetVideoIntegrity(video.ID, time.Now(), integrityError); err != nil {
+			return fmt.Errorf("couldn't record integrity check for video %s: %w", video.ID, err)
+		}
+	}
+
+	logger.Info("integrity sweep finished", "checked", len(videos), "failed", mismatches)
+	return nil
+}
+
+func (cfg *apiConfig) hashS3Object(ctx context.Context, key string) (string, error) {
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer out.Body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, out.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
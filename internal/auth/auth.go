@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -22,6 +23,13 @@ const (
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+// ValidateJWT wraps its errors in one of these, so callers can tell a token
+// that needs refreshing from one that will never be valid.
+var (
+	ErrTokenExpired = errors.New("token has expired")
+	ErrTokenInvalid = errors.New("invalid token")
+)
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -56,26 +64,29 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
 	)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return uuid.Nil, fmt.Errorf("%w: %w", ErrTokenExpired, err)
+	}
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, fmt.Errorf("%w: %w", ErrTokenInvalid, err)
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, fmt.Errorf("%w: %w", ErrTokenInvalid, err)
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, fmt.Errorf("%w: %w", ErrTokenInvalid, err)
 	}
 	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+		return uuid.Nil, fmt.Errorf("%w: invalid issuer", ErrTokenInvalid)
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return uuid.Nil, fmt.Errorf("%w: invalid user ID: %w", ErrTokenInvalid, err)
 	}
 	return id, nil
 }
@@ -93,6 +104,52 @@ func GetBearerToken(headers http.Header) (string, error) {
 	return splitAuth[1], nil
 }
 
+// ErrCrossSiteCookie is returned by GetAccessToken when the token is in a
+// cookie sent with an unsafe request that may come from another site.
+var ErrCrossSiteCookie = errors.New("access token cookie sent with a cross-site request")
+
+// CSRFHeader is a header browser clients authenticated by cookie set on
+// unsafe requests. Setting it cross-origin takes a CORS preflight, which the
+// API doesn't allow, so its presence shows the request came from the app.
+const CSRFHeader = "X-Requested-With"
+
+// GetAccessToken returns the bearer token in r's Authorization header, or,
+// when r has no such header and cookieName isn't empty, the value of the
+// cookie by that name. The header wins when both are present.
+//
+// Browsers attach cookies to requests other sites trigger, so on unsafe
+// methods the cookie is only accepted when r provably comes from the app:
+// Sec-Fetch-Site is same-origin, Origin is one of trustedOrigins, or
+// CSRFHeader is set. Otherwise it returns ErrCrossSiteCookie.
+func GetAccessToken(r *http.Request, cookieName string, trustedOrigins []string) (string, error) {
+	token, err := GetBearerToken(r.Header)
+	if !errors.Is(err, ErrNoAuthHeaderIncluded) || cookieName == "" {
+		return token, err
+	}
+	cookie, cookieErr := r.Cookie(cookieName)
+	if cookieErr != nil || cookie.Value == "" {
+		return "", err
+	}
+	if !safeMethod(r.Method) && !sameOriginRequest(r, trustedOrigins) {
+		return "", ErrCrossSiteCookie
+	}
+	return cookie.Value, nil
+}
+
+// safeMethod reports whether method only reads, so a forged request can't
+// change anything.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func sameOriginRequest(r *http.Request, trustedOrigins []string) bool {
+	if r.Header.Get(CSRFHeader) != "" || r.Header.Get("Sec-Fetch-Site") == "same-origin" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	return origin != "" && slices.Contains(trustedOrigins, origin)
+}
+
 func MakeRefreshToken() (string, error) {
 	token := make([]byte, 32)
 	_, err := rand.Read(token)
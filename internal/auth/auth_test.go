@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestGetAccessToken(t *testing.T) {
+	const cookieName = "tubely_token"
+	trustedOrigins := []string{"https://app.example.com"}
+
+	tests := []struct {
+		name       string
+		method     string
+		header     http.Header
+		cookie     string
+		cookieName string
+		wantToken  string
+		wantErr    error
+	}{
+		{
+			name:      "header only",
+			method:    http.MethodPost,
+			header:    http.Header{"Authorization": {"Bearer header-token"}},
+			wantToken: "header-token",
+		},
+		{
+			name:       "header wins over cookie",
+			method:     http.MethodPost,
+			header:     http.Header{"Authorization": {"Bearer header-token"}},
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantToken:  "header-token",
+		},
+		{
+			name:       "cookie on a safe request",
+			method:     http.MethodGet,
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantToken:  "cookie-token",
+		},
+		{
+			name:    "cookie not configured",
+			method:  http.MethodGet,
+			cookie:  "cookie-token",
+			wantErr: ErrNoAuthHeaderIncluded,
+		},
+		{
+			name:       "no token",
+			method:     http.MethodGet,
+			cookieName: cookieName,
+			wantErr:    ErrNoAuthHeaderIncluded,
+		},
+		{
+			name:       "cookie on a cross-site POST",
+			method:     http.MethodPost,
+			header:     http.Header{"Sec-Fetch-Site": {"cross-site"}, "Origin": {"https://evil.example"}},
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantErr:    ErrCrossSiteCookie,
+		},
+		{
+			name:       "cookie on a DELETE from a sibling subdomain",
+			method:     http.MethodDelete,
+			header:     http.Header{"Sec-Fetch-Site": {"same-site"}, "Origin": {"https://user-content.example.com"}},
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantErr:    ErrCrossSiteCookie,
+		},
+		{
+			name:       "cookie on a POST with no provenance",
+			method:     http.MethodPost,
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantErr:    ErrCrossSiteCookie,
+		},
+		{
+			name:       "cookie on a same-origin POST",
+			method:     http.MethodPost,
+			header:     http.Header{"Sec-Fetch-Site": {"same-origin"}},
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantToken:  "cookie-token",
+		},
+		{
+			name:       "cookie on a POST from a trusted origin",
+			method:     http.MethodPost,
+			header:     http.Header{"Sec-Fetch-Site": {"cross-site"}, "Origin": {"https://app.example.com"}},
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantToken:  "cookie-token",
+		},
+		{
+			name:       "cookie on a PATCH with the CSRF header",
+			method:     http.MethodPatch,
+			header:     http.Header{CSRFHeader: {"XMLHttpRequest"}},
+			cookie:     "cookie-token",
+			cookieName: cookieName,
+			wantToken:  "cookie-token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/videos", nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cookieName, Value: tt.cookie})
+			}
+
+			token, err := GetAccessToken(r, tt.cookieName, trustedOrigins)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if token != tt.wantToken {
+				t.Errorf("token = %q, want %q", token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestValidateJWT(t *testing.T) {
+	const secret = "test-secret"
+	userID := uuid.New()
+	token := func(secret string, expiresIn time.Duration) string {
+		t.Helper()
+		token, err := MakeJWT(userID, secret, expiresIn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		wantErr     bool
+		wantExpired bool
+	}{
+		{name: "valid", token: token(secret, time.Hour)},
+		{name: "expired", token: token(secret, -time.Minute), wantErr: true, wantExpired: true},
+		{name: "wrong secret", token: token("another-secret", time.Hour), wantErr: true},
+		{name: "malformed", token: "not.a.jwt", wantErr: true},
+		{name: "empty", token: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateJWT(tt.token, secret)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateJWT error = %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrTokenExpired) != tt.wantExpired {
+				t.Errorf("ValidateJWT error = %v, want expired %v", err, tt.wantExpired)
+			}
+			if !tt.wantErr && got != userID {
+				t.Errorf("ValidateJWT = %v, want %v", got, userID)
+			}
+		})
+	}
+}
@@ -72,9 +72,136 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	// Columns added after the initial schema. They're applied with ALTER TABLE
+	// so databases created by older versions pick them up too.
+	videoColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"renditions", "TEXT"},
+		{"perceptual_hash", "TEXT"},
+		{"content_sha256", "TEXT"},
+		{"integrity_checked_at", "TIMESTAMP"},
+		{"integrity_error", "TEXT"},
+		{"width", "INTEGER"},
+		{"height", "INTEGER"},
+		{"duration", "REAL"},
+		{"codec", "TEXT"},
+		{"audio_url", "TEXT"},
+		{"sprite_vtt_url", "TEXT"},
+		{"preview_url", "TEXT"},
+		{"fast_start", "BOOLEAN"},
+		{"storage_bytes", "INTEGER"},
+		{"captions", "TEXT"},
+		{"thumbnail_srcset", "TEXT"},
+	}
+	for _, col := range videoColumns {
+		if err := c.addColumnIfMissing("videos", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	// Serves listings of a user's videos, which are paged newest first
+	_, err = c.db.Exec(`CREATE INDEX IF NOT EXISTS videos_user_created ON videos(user_id, created_at, id)`)
+	if err != nil {
+		return err
+	}
+
+	videoThumbnailTable := `
+	CREATE TABLE IF NOT EXISTS video_thumbnails (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		url TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS video_thumbnails_video_id ON video_thumbnails(video_id, position);
+	`
+	_, err = c.db.Exec(videoThumbnailTable)
+	if err != nil {
+		return err
+	}
+
+	videoJobTable := `
+	CREATE TABLE IF NOT EXISTS video_jobs (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		status TEXT NOT NULL,
+		error TEXT,
+		source_key TEXT NOT NULL,
+		options TEXT NOT NULL,
+		replaces_file BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS video_jobs_status ON video_jobs(status, created_at);
+	CREATE INDEX IF NOT EXISTS video_jobs_video_id ON video_jobs(video_id, created_at);
+	`
+	_, err = c.db.Exec(videoJobTable)
+	if err != nil {
+		return err
+	}
+	// claimed_at is when a worker took a job, so a job left processing by a
+	// server that stopped can be told from one another server is running
+	if err := c.addColumnIfMissing("video_jobs", "claimed_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	// attempts counts the runs a job has had; a job requeued after a
+	// transient failure waits until run_after before its next one
+	if err := c.addColumnIfMissing("video_jobs", "attempts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := c.addColumnIfMissing("video_jobs", "run_after", "TIMESTAMP"); err != nil {
+		return err
+	}
 	return nil
 }
 
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	exists, err := c.columnExists(table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func (c *Client) columnExists(table, column string) (bool, error) {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
@@ -82,6 +209,12 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM video_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table video_jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_thumbnails"); err != nil {
+		return fmt.Errorf("failed to reset table video_thumbnails: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JobStatus is where a video processing job is in its lifecycle.
+type JobStatus string
+
+const (
+	JobPending    JobStatus = "pending"
+	JobProcessing JobStatus = "processing"
+	JobReady      JobStatus = "ready"
+	JobFailed     JobStatus = "failed"
+)
+
+// VideoJob is a queued run of the video pipeline on a file uploaded as is.
+type VideoJob struct {
+	ID        uuid.UUID `json:"id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    JobStatus `json:"status"`
+	// Error says why a failed job failed, or why a job waiting to be
+	// retried failed last time.
+	Error *string `json:"error"`
+	// Attempts counts the times the job has been run, including a run in
+	// progress.
+	Attempts int `json:"attempts"`
+	CreateVideoJobParams
+}
+
+type CreateVideoJobParams struct {
+	VideoID uuid.UUID `json:"-"`
+	// SourceKey is the S3 key of the uploaded file.
+	SourceKey string `json:"-"`
+	// Options are the upload's form values, URL-encoded.
+	Options string `json:"-"`
+	// Replace is set for jobs replacing an existing file.
+	Replace bool `json:"-"`
+}
+
+// ErrJobNotFound is returned when there's no job matching a lookup, and by
+// ClaimVideoJob when nothing is pending.
+var ErrJobNotFound = errors.New("job not found")
+
+const videoJobColumns = `
+		id,
+		video_id,
+		created_at,
+		updated_at,
+		status,
+		error,
+		source_key,
+		options,
+		replaces_file,
+		attempts
+`
+
+func scanVideoJob(s rowScanner) (VideoJob, error) {
+	var j VideoJob
+	err := s.Scan(&j.ID, &j.VideoID, &j.CreatedAt, &j.UpdatedAt, &j.Status, &j.Error, &j.SourceKey, &j.Options, &j.Replace, &j.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoJob{}, fmt.Errorf("%w: %w", ErrJobNotFound, err)
+	}
+	return j, err
+}
+
+// CreateVideoJob queues a pending job.
+func (c Client) CreateVideoJob(params CreateVideoJobParams) (VideoJob, error) {
+	id := uuid.New()
+	_, err := c.db.Exec(`
+	INSERT INTO video_jobs (
+		id,
+		video_id,
+		created_at,
+		updated_at,
+		status,
+		source_key,
+		options,
+		replaces_file
+	) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`, id, params.VideoID, JobPending, params.SourceKey, params.Options, params.Replace)
+	if err != nil {
+		return VideoJob{}, err
+	}
+	return c.GetVideoJob(id)
+}
+
+// GetVideoJob returns the job with the given ID.
+func (c Client) GetVideoJob(id uuid.UUID) (VideoJob, error) {
+	query := `
+	SELECT` + videoJobColumns + `
+	FROM video_jobs
+	WHERE id = ?
+	`
+	return scanVideoJob(c.db.QueryRow(query, id))
+}
+
+// GetLatestVideoJob returns the most recently queued job for videoID.
+func (c Client) GetLatestVideoJob(videoID uuid.UUID) (VideoJob, error) {
+	query := `
+	SELECT` + videoJobColumns + `
+	FROM video_jobs
+	WHERE video_id = ?
+	ORDER BY created_at DESC, rowid DESC
+	LIMIT 1
+	`
+	return scanVideoJob(c.db.QueryRow(query, videoID))
+}
+
+// ClaimVideoJob marks the oldest pending job that's due as processing,
+// claimed now, counts the attempt and returns it. It's a single statement,
+// so each job is handed to only one caller.
+func (c Client) ClaimVideoJob() (VideoJob, error) {
+	query := `
+	UPDATE video_jobs
+	SET status = ?, attempts = attempts + 1, claimed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id
+		FROM video_jobs
+		WHERE status = ? AND (run_after IS NULL OR run_after <= ?)
+		ORDER BY created_at, rowid
+		LIMIT 1
+	)
+	RETURNING` + videoJobColumns
+	now := time.Now().UTC().Format(sqliteTimeFormat)
+	return scanVideoJob(c.db.QueryRow(query, JobProcessing, JobPending, now))
+}
+
+// RetryVideoJob puts a job that failed with jobError back in the queue, to
+// be claimed again no earlier than runAfter.
+func (c Client) RetryVideoJob(id uuid.UUID, runAfter time.Time, jobError *string) error {
+	_, err := c.db.Exec(`
+	UPDATE video_jobs
+	SET status = ?, error = ?, run_after = ?, claimed_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`, JobPending, jobError, runAfter.UTC().Format(sqliteTimeFormat), id)
+	return err
+}
+
+// FinishVideoJob records the outcome of a job: JobReady, or JobFailed with
+// the reason in jobError.
+func (c Client) FinishVideoJob(id uuid.UUID, status JobStatus, jobError *string) error {
+	_, err := c.db.Exec(`
+	UPDATE video_jobs
+	SET status = ?, error = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`, status, jobError, id)
+	return err
+}
+
+// RequeueStaleJobs puts jobs still processing that were claimed before
+// claimedBefore back in the queue: the server that claimed them stopped
+// mid-job. Jobs claimed since may be running on another server sharing the
+// database, so they're left alone. It returns how many it requeued.
+func (c Client) RequeueStaleJobs(claimedBefore time.Time) (int64, error) {
+	res, err := c.db.Exec(`
+	UPDATE video_jobs
+	SET status = ?, claimed_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE status = ? AND (claimed_at IS NULL OR claimed_at < ?)
+	`, JobPending, JobProcessing, claimedBefore.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Thumbnail is one image in a video's thumbnail gallery. Thumbnails are
+// listed by Position, and at most one per video is the primary, whose URL is
+// also the video's ThumbnailURL.
+type Thumbnail struct {
+	ID        uuid.UUID `json:"id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Position  int       `json:"position"`
+	IsPrimary bool      `json:"is_primary"`
+}
+
+// ErrThumbnailNotFound is returned when a video has no thumbnail with the
+// requested ID.
+var ErrThumbnailNotFound = errors.New("thumbnail not found")
+
+// ErrThumbnailOrderMismatch is returned by ReorderThumbnails when the IDs
+// given aren't exactly the video's thumbnails.
+var ErrThumbnailOrderMismatch = errors.New("thumbnail IDs don't match the video's thumbnails")
+
+const thumbnailColumns = `
+		id,
+		video_id,
+		created_at,
+		url,
+		position,
+		is_primary
+`
+
+func scanThumbnail(s rowScanner) (Thumbnail, error) {
+	var t Thumbnail
+	err := s.Scan(&t.ID, &t.VideoID, &t.CreatedAt, &t.URL, &t.Position, &t.IsPrimary)
+	return t, err
+}
+
+// CreateThumbnail adds a thumbnail at url to the end of videoID's gallery.
+// The first thumbnail of a video becomes its primary.
+func (c Client) CreateThumbnail(videoID uuid.UUID, url string) (Thumbnail, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	defer tx.Rollback()
+
+	var count, nextPosition int
+	err = tx.QueryRow(`
+	SELECT COUNT(*), COALESCE(MAX(position) + 1, 0)
+	FROM video_thumbnails
+	WHERE video_id = ?
+	`, videoID).Scan(&count, &nextPosition)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+
+	id := uuid.New()
+	_, err = tx.Exec(`
+	INSERT INTO video_thumbnails (
+		id,
+		video_id,
+		created_at,
+		url,
+		position,
+		is_primary
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`, id, videoID, url, nextPosition, count == 0)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Thumbnail{}, err
+	}
+
+	return c.GetThumbnail(videoID, id)
+}
+
+// GetThumbnail returns videoID's thumbnail with the given ID.
+func (c Client) GetThumbnail(videoID, id uuid.UUID) (Thumbnail, error) {
+	query := `
+	SELECT` + thumbnailColumns + `
+	FROM video_thumbnails
+	WHERE id = ? AND video_id = ?
+	`
+	t, err := scanThumbnail(c.db.QueryRow(query, id, videoID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Thumbnail{}, fmt.Errorf("%w: %w", ErrThumbnailNotFound, err)
+	}
+	return t, err
+}
+
+// GetThumbnails returns videoID's gallery in display order.
+func (c Client) GetThumbnails(videoID uuid.UUID) ([]Thumbnail, error) {
+	query := `
+	SELECT` + thumbnailColumns + `
+	FROM video_thumbnails
+	WHERE video_id = ?
+	ORDER BY position ASC
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	thumbnails := []Thumbnail{}
+	for rows.Next() {
+		t, err := scanThumbnail(rows)
+		if err != nil {
+			return nil, err
+		}
+		thumbnails = append(thumbnails, t)
+	}
+	return thumbnails, rows.Err()
+}
+
+// SetPrimaryThumbnail makes id the primary thumbnail of videoID, unflagging
+// the previous one.
+func (c Client) SetPrimaryThumbnail(videoID, id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM video_thumbnails WHERE id = ? AND video_id = ?)
+	`, id, videoID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrThumbnailNotFound
+	}
+
+	_, err = tx.Exec(`
+	UPDATE video_thumbnails
+	SET is_primary = (id = ?)
+	WHERE video_id = ?
+	`, id, videoID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReorderThumbnails sets the display order of videoID's gallery to ids,
+// which must list each of its thumbnails exactly once.
+func (c Client) ReorderThumbnails(videoID uuid.UUID, ids []uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM video_thumbnails WHERE video_id = ?`, videoID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if len(ids) != count {
+		return ErrThumbnailOrderMismatch
+	}
+
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for position, id := range ids {
+		if seen[id] {
+			return ErrThumbnailOrderMismatch
+		}
+		seen[id] = true
+
+		res, err := tx.Exec(`
+		UPDATE video_thumbnails
+		SET position = ?
+		WHERE id = ? AND video_id = ?
+		`, position, id, videoID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrThumbnailOrderMismatch
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteThumbnail removes id from videoID's gallery. When it was the primary,
+// the first remaining thumbnail takes its place.
+func (c Client) DeleteThumbnail(videoID, id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+	DELETE FROM video_thumbnails
+	WHERE id = ? AND video_id = ?
+	`, id, videoID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrThumbnailNotFound
+	}
+
+	_, err = tx.Exec(`
+	UPDATE video_thumbnails
+	SET is_primary = TRUE
+	WHERE id = (
+		SELECT id FROM video_thumbnails
+		WHERE video_id = ?
+		ORDER BY position ASC
+		LIMIT 1
+	)
+	AND NOT EXISTS (
+		SELECT 1 FROM video_thumbnails
+		WHERE video_id = ? AND is_primary
+	)
+	`, videoID, videoID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
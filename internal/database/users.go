@@ -73,17 +73,21 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
+// GetUserByRefreshToken returns the user a refresh token was issued to, or
+// nil when the token is unknown, revoked or expired.
 func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	query := `
 		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
 		WHERE rt.token = ?
+		AND rt.revoked_at IS NULL
+		AND rt.expires_at > ?
 	`
 
 	var user User
 	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	err := c.db.QueryRow(query, token, time.Now().UTC()).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
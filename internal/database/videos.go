@@ -2,30 +2,169 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	ThumbnailURL *string    `json:"thumbnail_url"`
+	VideoURL     *string    `json:"video_url"`
+	Renditions   Renditions `json:"renditions,omitempty"`
+	// AudioURL points at an audio-only copy of the video, when one was
+	// requested at upload.
+	AudioURL *string `json:"audio_url"`
+	// SpriteVTTURL points at a WebVTT track of scrub preview tiles.
+	SpriteVTTURL *string `json:"sprite_vtt_url"`
+	// PreviewThumbnailsURL repeats SpriteVTTURL under the name players look
+	// for to wire up scrub previews. It isn't stored: responses fill it in,
+	// and leave it out when there's no track.
+	PreviewThumbnailsURL *string `json:"previewThumbnailsURL,omitempty"`
+	// PreviewURL points at a short looping GIF of the video, when one was
+	// requested at upload.
+	PreviewURL *string `json:"preview_url"`
+	// PerceptualHash is a hex-encoded pHash of a representative frame, used
+	// to find near-duplicate uploads.
+	PerceptualHash *string `json:"perceptual_hash"`
+	// ContentSHA256 is the hex SHA-256 of the object stored at VideoURL.
+	// The integrity sweep re-hashes the object and records the result in
+	// IntegrityCheckedAt and IntegrityError.
+	ContentSHA256      *string    `json:"content_sha256"`
+	IntegrityCheckedAt *time.Time `json:"integrity_checked_at"`
+	IntegrityError     *string    `json:"integrity_error"`
+	// Metadata read from the uploaded file by ffprobe. Duration is in
+	// seconds.
+	Width    *int     `json:"width"`
+	Height   *int     `json:"height"`
+	Duration *float64 `json:"duration"`
+	Codec    *string  `json:"codec"`
+	// FastStart records whether the stored MP4 was verified to have its
+	// index ahead of the media, so playback can start before it's all
+	// downloaded.
+	FastStart *bool `json:"fast_start"`
+	// StorageBytes is the size of the stored video file, which counts
+	// towards its owner's storage quota. Derived objects aren't included.
+	StorageBytes *int64 `json:"storage_bytes"`
+	// Captions are the video's WebVTT subtitle tracks, by language.
+	Captions Captions `json:"captions,omitempty"`
+	// ThumbnailSrcset holds the thumbnail scaled to each configured size,
+	// as a WebP with a JPEG fallback.
+	ThumbnailSrcset ThumbnailSrcset `json:"thumbnail_srcset,omitempty"`
 	CreateVideoParams
 }
 
+// Renditions maps a rendition height (e.g. 720) to the URL it's served from.
+// It's stored as a JSON object in a single TEXT column.
+type Renditions map[int]string
+
+func (r Renditions) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (r *Renditions) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	case []byte:
+		return json.Unmarshal(v, r)
+	default:
+		return fmt.Errorf("unsupported type for renditions: %T", src)
+	}
+}
+
+// Captions maps a language tag (e.g. en or pt-BR) to the URL of the WebVTT
+// track in that language. It's stored like Renditions.
+type Captions map[string]string
+
+func (c Captions) Value() (driver.Value, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (c *Captions) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	case []byte:
+		return json.Unmarshal(v, c)
+	default:
+		return fmt.Errorf("unsupported type for captions: %T", src)
+	}
+}
+
+// ThumbnailSource is one size of a thumbnail, encoded as both WebP and JPEG
+// so clients can offer the WebP in a <picture> with the JPEG as fallback.
+type ThumbnailSource struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	WebP   string `json:"webp"`
+	JPEG   string `json:"jpeg"`
+}
+
+// ThumbnailSrcset lists a thumbnail's sizes, smallest first. It's stored
+// like Renditions.
+type ThumbnailSrcset []ThumbnailSource
+
+func (s ThumbnailSrcset) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (s *ThumbnailSrcset) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	case []byte:
+		return json.Unmarshal(v, s)
+	default:
+		return fmt.Errorf("unsupported type for thumbnail srcset: %T", src)
+	}
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// videoColumns are the columns scanVideo reads, in order.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +172,61 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+		renditions,
+		audio_url,
+		sprite_vtt_url,
+		preview_url,
+		perceptual_hash,
+		content_sha256,
+		integrity_checked_at,
+		integrity_error,
+		width,
+		height,
+		duration,
+		codec,
+		fast_start,
+		storage_bytes,
+		captions,
+		thumbnail_srcset,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
-	rows, err := c.db.Query(query, userID)
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.Renditions,
+		&video.AudioURL,
+		&video.SpriteVTTURL,
+		&video.PreviewURL,
+		&video.PerceptualHash,
+		&video.ContentSHA256,
+		&video.IntegrityCheckedAt,
+		&video.IntegrityError,
+		&video.Width,
+		&video.Height,
+		&video.Duration,
+		&video.Codec,
+		&video.FastStart,
+		&video.StorageBytes,
+		&video.Captions,
+		&video.ThumbnailSrcset,
+		&video.UserID,
+	)
+	return video, err
+}
+
+func (c Client) queryVideos(query string, args ...interface{}) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,23 +234,139 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(query, userID)
+}
+
+// GetUserStorageUsage returns the bytes userID's stored video files take up.
+// Deleting or replacing a video frees its bytes.
+func (c Client) GetUserStorageUsage(userID uuid.UUID) (int64, error) {
+	var usage int64
+	err := c.db.QueryRow(`
+	SELECT COALESCE(SUM(storage_bytes), 0)
+	FROM videos
+	WHERE user_id = ?
+	`, userID).Scan(&usage)
+	return usage, err
+}
+
+// VideoStats sums up a user's videos.
+type VideoStats struct {
+	Videos          int
+	StorageBytes    int64
+	DurationSeconds float64
+	// Dimensions counts the videos of each size, among those whose size is
+	// known
+	Dimensions []DimensionCount
+}
+
+// DimensionCount is the number of videos of one width and height.
+type DimensionCount struct {
+	Width  int
+	Height int
+	Count  int
+}
+
+// GetUserVideoStats sums up userID's videos: how many there are, the bytes
+// and seconds their files add up to, and how many there are of each size.
+func (c Client) GetUserVideoStats(userID uuid.UUID) (VideoStats, error) {
+	var stats VideoStats
+	err := c.db.QueryRow(`
+	SELECT COUNT(*), COALESCE(SUM(storage_bytes), 0), COALESCE(SUM(duration), 0)
+	FROM videos
+	WHERE user_id = ?
+	`, userID).Scan(&stats.Videos, &stats.StorageBytes, &stats.DurationSeconds)
+	if err != nil {
+		return VideoStats{}, err
+	}
+
+	rows, err := c.db.Query(`
+	SELECT width, height, COUNT(*)
+	FROM videos
+	WHERE user_id = ? AND width > 0 AND height > 0
+	GROUP BY width, height
+	`, userID)
+	if err != nil {
+		return VideoStats{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DimensionCount
+		if err := rows.Scan(&d.Width, &d.Height, &d.Count); err != nil {
+			return VideoStats{}, err
+		}
+		stats.Dimensions = append(stats.Dimensions, d)
+	}
+	return stats, rows.Err()
+}
+
+// VideoCursor marks a place in a newest-first listing of videos: the
+// creation time and ID of the last video seen. Unlike an offset, it stays put
+// when videos are added ahead of it.
+type VideoCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// sqliteTimeFormat is how CURRENT_TIMESTAMP stores times, so cursor times
+// compare correctly against created_at.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// GetVideosByUser returns one page of userID's videos, newest first, along
+// with the total number of videos matching the filter. A non-empty search
+// keeps only videos whose title contains it (case-insensitively). With a
+// cursor, the page starts after the video it marks, and offset counts from
+// there.
+func (c Client) GetVideosByUser(userID uuid.UUID, limit, offset int, search string, after *VideoCursor) ([]Video, int, error) {
+	filter := `
+	FROM videos
+	WHERE user_id = ?`
+	args := []interface{}{userID}
+	if search != "" {
+		filter += ` AND title LIKE ? ESCAPE '\'`
+		args = append(args, "%"+escapeLike(search)+"%")
+	}
+
+	var total int
+	if err := c.db.QueryRow(`SELECT COUNT(*)`+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	if after != nil {
+		filter += ` AND (created_at, id) < (?, ?)`
+		args = append(args, after.CreatedAt.UTC().Format(sqliteTimeFormat), after.ID)
+	}
+	query := `
+	SELECT` + videoColumns + filter + `
+	ORDER BY created_at DESC, id DESC
+	LIMIT ? OFFSET ?
+	`
+	videos, err := c.queryVideos(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return videos, total, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -86,34 +389,21 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	return c.GetVideo(id)
 }
 
+// ErrVideoNotFound is returned (wrapping sql.ErrNoRows) when no video has
+// the requested ID.
+var ErrVideoNotFound = errors.New("video not found")
+
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return Video{}, nil
+			return Video{}, fmt.Errorf("%w: %w", ErrVideoNotFound, err)
 		}
 		return Video{}, err
 	}
@@ -129,6 +419,20 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
+		renditions = ?,
+		audio_url = ?,
+		sprite_vtt_url = ?,
+		preview_url = ?,
+		perceptual_hash = ?,
+		content_sha256 = ?,
+		width = ?,
+		height = ?,
+		duration = ?,
+		codec = ?,
+		fast_start = ?,
+		storage_bytes = ?,
+		captions = ?,
+		thumbnail_srcset = ?,
 		user_id = ?
 	WHERE id = ?
 	`
@@ -139,17 +443,138 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
+		video.Renditions,
+		video.AudioURL,
+		video.SpriteVTTURL,
+		video.PreviewURL,
+		video.PerceptualHash,
+		video.ContentSHA256,
+		video.Width,
+		video.Height,
+		video.Duration,
+		video.Codec,
+		video.FastStart,
+		video.StorageBytes,
+		video.Captions,
+		video.ThumbnailSrcset,
 		video.UserID,
 		video.ID,
 	)
 	return err
 }
 
+// GetVideosForIntegrityCheck returns up to limit uploaded videos with a
+// recorded content hash, least recently checked first.
+func (c Client) GetVideosForIntegrityCheck(limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL AND content_sha256 IS NOT NULL
+	ORDER BY integrity_checked_at IS NOT NULL, integrity_checked_at ASC
+	LIMIT ?
+	`
+	return c.queryVideos(query, limit)
+}
+
+// SetVideoIntegrity records the outcome of an integrity check. A nil
+// integrityError means the stored object matched its hash.
+func (c Client) SetVideoIntegrity(id uuid.UUID, checkedAt time.Time, integrityError *string) error {
+	query := `
+	UPDATE videos
+	SET
+		integrity_checked_at = ?,
+		integrity_error = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, checkedAt.UTC(), integrityError, id)
+	return err
+}
+
+// DeleteVideo deletes a video along with its thumbnail gallery and jobs.
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM video_thumbnails WHERE video_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM video_jobs WHERE video_id = ?`, id); err != nil {
+		return err
+	}
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	if _, err := tx.Exec(query, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CountOtherVideosWithURL returns how many videos other than id point at
+// videoURL. Deduplicated uploads share a single stored object.
+func (c Client) CountOtherVideosWithURL(videoURL string, id uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE video_url = ? AND id != ?
+	`
+	var count int
+	err := c.db.QueryRow(query, videoURL, id).Scan(&count)
+	return count, err
+}
+
+// GetVideosNeedingFastStart returns up to limit uploaded videos not known to
+// be laid out for fast start, ordered by ID and starting after afterID, so
+// a caller can page through them while updating the ones it has seen.
+func (c Client) GetVideosNeedingFastStart(afterID uuid.UUID, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL AND (fast_start IS NULL OR NOT fast_start) AND id > ?
+	ORDER BY id
+	LIMIT ?
+	`
+	return c.queryVideos(query, afterID, limit)
+}
+
+// GetVideosAfter returns up to limit videos with IDs after afterID, in ID
+// order, for walking every video a page at a time. Pass uuid.Nil for the
+// first page.
+func (c Client) GetVideosAfter(afterID uuid.UUID, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE id > ?
+	ORDER BY id
+	LIMIT ?
+	`
+	return c.queryVideos(query, afterID, limit)
+}
+
+// SetVideoFastStart records that the object at videoURL is laid out for fast
+// start, on every video stored there.
+func (c Client) SetVideoFastStart(videoURL string) error {
+	query := `
+	UPDATE videos
+	SET fast_start = TRUE
+	WHERE video_url = ?
+	`
+	_, err := c.db.Exec(query, videoURL)
+	return err
+}
+
+// ReplaceVideoFile points every video stored at oldURL at newURL, a fast
+// start copy of the same video with the given content hash and size.
+func (c Client) ReplaceVideoFile(oldURL, newURL, contentSHA256 string, size int64) error {
+	query := `
+	UPDATE videos
+	SET video_url = ?, content_sha256 = ?, storage_bytes = ?, fast_start = TRUE
+	WHERE video_url = ?
+	`
+	_, err := c.db.Exec(query, newURL, contentSHA256, size, oldURL)
 	return err
 }
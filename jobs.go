@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// jobPollInterval is how often idle workers check for jobs queued by another
+// server sharing the database. Jobs queued here wake them right away.
+const jobPollInterval = 5 * time.Second
+
+// maxJobRetryDelay caps the backoff between a job's attempts.
+const maxJobRetryDelay = time.Hour
+
+// staleJobSweepInterval is how often workers look for jobs abandoned by a
+// server that stopped mid-job.
+const staleJobSweepInterval = time.Minute
+
+// jobSourcePrefix is where uploads waiting for a processing job are kept.
+// Each job deletes its file when it finishes.
+const jobSourcePrefix = "jobs/"
+
+// jobQueue wakes idle workers when a job is queued.
+type jobQueue struct {
+	wake chan struct{}
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{wake: make(chan struct{}, 1)}
+}
+
+// notify wakes one idle worker, if there is one.
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+type jobUserContextKey struct{}
+
+// jobUser returns the owner of the video a worker is processing, when ctx is
+// a job's. Job runs aren't HTTP requests, so they're authenticated by this
+// rather than a token.
+func jobUser(ctx context.Context) (uuid.UUID, bool) {
+	userID, ok := ctx.Value(jobUserContextKey{}).(uuid.UUID)
+	return userID, ok
+}
+
+// enqueueVideoJob stores the received file at filePath as it is and queues a
+// job to run the rest of the pipeline on it. It responds 202 Accepted with
+// the job and, in Location, the URL its status can be polled at, along with
+// any warnings about the upload.
+func (cfg *apiConfig) enqueueVideoJob(w http.ResponseWriter, r *http.Request, video *database.Video, filePath, contentType string, replace bool, warnings []uploadWarning) error {
+	type response struct {
+		database.VideoJob
+		StatusURL string          `json:"status_url"`
+		Warnings  []uploadWarning `json:"warnings,omitempty"`
+	}
+
+	name, err := cfg.generateS3Key(containerForType(contentType).ext)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return err
+	}
+	key, err := normalizeS3Key(jobSourcePrefix + video.ID.String() + "/" + name)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open video", err)
+		return err
+	}
+	defer f.Close()
+	if err := cfg.uploadToS3(r.Context(), w, f, key, contentType, video.UserID); err != nil {
+		return err
+	}
+
+	// The job replays the upload's options, except the ones that only
+	// made sense for this request
+	options := url.Values{}
+	for name, values := range r.Form {
+		if name == "upload_id" || name == "dryRun" {
+			continue
+		}
+		options[name] = values
+	}
+	job, err := cfg.db.CreateVideoJob(database.CreateVideoJobParams{
+		VideoID:   video.ID,
+		SourceKey: key,
+		Options:   options.Encode(),
+		Replace:   replace,
+	})
+	if err != nil {
+		cfg.deleteJobSource(r.Context(), key)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return err
+	}
+	cfg.jobQueue.notify()
+
+	statusURL := "/api/videos/" + video.ID.String() + "/status"
+	w.Header().Set("Location", statusURL)
+	respondWithJSON(w, http.StatusAccepted, response{
+		VideoJob:  job,
+		StatusURL: statusURL,
+		Warnings:  warnings,
+	})
+	return nil
+}
+
+// handlerGetVideoStatus returns the state of the latest processing job for
+// one of the user's videos: pending, processing, ready or failed, and how
+// many attempts it has had. A pending job with an error is waiting to be
+// retried. A video uploaded without a job is ready once it has a file.
+func (cfg *apiConfig) handlerGetVideoStatus(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoID   uuid.UUID          `json:"video_id"`
+		Status    database.JobStatus `json:"status"`
+		Error     *string            `json:"error"`
+		Attempts  int                `json:"attempts"`
+		UpdatedAt time.Time          `json:"updated_at"`
+	}
+
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	job, err := cfg.db.GetLatestVideoJob(video.ID)
+	if errors.Is(err, database.ErrJobNotFound) {
+		if video.VideoURL == nil {
+			respondWithError(w, http.StatusNotFound, "Video has no upload", nil)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, response{
+			VideoID:   video.ID,
+			Status:    database.JobReady,
+			UpdatedAt: video.UpdatedAt,
+		})
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video status", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		VideoID:   video.ID,
+		Status:    job.Status,
+		Error:     job.Error,
+		Attempts:  job.Attempts,
+		UpdatedAt: job.UpdatedAt,
+	})
+}
+
+// startVideoJobWorkers starts workers goroutines processing queued jobs,
+// and one requeueing jobs abandoned mid-job, until the process exits.
+func (cfg *apiConfig) startVideoJobWorkers(workers int) {
+	if cfg.uploadTimeout > 0 {
+		go cfg.runStaleJobSweeper()
+	} else if cfg.asyncProcessing {
+		slog.Warn("UPLOAD_TIMEOUT is 0, so jobs interrupted by a restart won't be requeued")
+	}
+	for range workers {
+		go cfg.runVideoJobWorker()
+	}
+}
+
+// runStaleJobSweeper requeues, now and then every staleJobSweepInterval,
+// jobs claimed longer ago than the upload timeout. A job is cancelled at
+// that timeout, so one still processing after it, and a little more for
+// recording the failure, was claimed by a server that stopped. Other servers
+// sharing the database keep their running jobs.
+func (cfg *apiConfig) runStaleJobSweeper() {
+	ticker := time.NewTicker(staleJobSweepInterval)
+	defer ticker.Stop()
+	for {
+		claimedBefore := time.Now().Add(-cfg.uploadTimeout - staleJobSweepInterval)
+		if n, err := cfg.db.RequeueStaleJobs(claimedBefore); err != nil {
+			slog.Error("couldn't requeue interrupted jobs", "error", err)
+		} else if n > 0 {
+			slog.Info("requeued interrupted jobs", "count", n)
+			cfg.jobQueue.notify()
+		}
+		<-ticker.C
+	}
+}
+
+func (cfg *apiConfig) runVideoJobWorker() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := cfg.db.ClaimVideoJob()
+		if err == nil {
+			cfg.processVideoJob(job)
+			continue
+		}
+		if !errors.Is(err, database.ErrJobNotFound) {
+			slog.Error("couldn't claim job", "error", err)
+		}
+		select {
+		case <-cfg.jobQueue.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processVideoJob runs the upload pipeline on a job's file, as the video's
+// owner with the upload's original options, and records the outcome. A
+// failure the pipeline puts down to the server rather than the file (a 5xx
+// or 429 response, such as a storage error or ffmpeg being killed) is
+// transient: the job is requeued with exponential backoff until it has had
+// cfg.videoJobMaxAttempts attempts. Other failures are final. The job's file
+// is kept until the job is done with it, one way or the other.
+func (cfg *apiConfig) processVideoJob(job database.VideoJob) {
+	logger := slog.Default().With("job_id", job.ID, "video_id", job.VideoID, "attempt", job.Attempts)
+	ctx := context.WithValue(context.Background(), loggerContextKey{}, logger)
+	if cfg.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.uploadTimeout)
+		defer cancel()
+	}
+
+	fail := func(err error, transient bool) {
+		msg := err.Error()
+		if transient && job.Attempts < cfg.videoJobMaxAttempts {
+			delay := jobRetryDelay(cfg.videoJobRetryDelay, job.Attempts)
+			logger.Warn("job failed, retrying", "error", err, "max_attempts", cfg.videoJobMaxAttempts, "delay", delay)
+			if err := cfg.db.RetryVideoJob(job.ID, time.Now().Add(delay), &msg); err != nil {
+				logger.Error("couldn't requeue job", "error", err)
+			}
+			return
+		}
+		logger.Warn("job failed", "error", err)
+		cfg.deleteJobSource(ctx, job.SourceKey)
+		if err := cfg.db.FinishVideoJob(job.ID, database.JobFailed, &msg); err != nil {
+			logger.Error("couldn't record job failure", "error", err)
+		}
+	}
+
+	// A job requeued by the stale job sweep more often than it may run is
+	// likely what stopped its servers
+	if job.Attempts > cfg.videoJobMaxAttempts {
+		fail(fmt.Errorf("gave up after %d attempts", cfg.videoJobMaxAttempts), false)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		fail(fmt.Errorf("couldn't get video: %w", err), !errors.Is(err, database.ErrVideoNotFound))
+		return
+	}
+	options, err := url.ParseQuery(job.Options)
+	if err != nil {
+		fail(fmt.Errorf("invalid job options: %w", err), false)
+		return
+	}
+
+	ctx = context.WithValue(ctx, jobUserContextKey{}, video.UserID)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/video_upload/"+video.ID.String(), nil)
+	if err != nil {
+		fail(err, false)
+		return
+	}
+	r.SetPathValue("videoID", video.ID.String())
+	r.Form = options
+	r.PostForm = url.Values{}
+
+	rec := &jobResponseWriter{header: http.Header{}}
+	w := &loggingResponseWriter{ResponseWriter: rec, logger: logger}
+	cfg.uploadVideo(w, r, job.Replace, func(w http.ResponseWriter, r *http.Request) (videoSource, error) {
+		return cfg.openJobSource(w, r, job.SourceKey)
+	})
+
+	if rec.status < 200 || rec.status > 299 {
+		var body errorResponse
+		if err := json.Unmarshal(rec.body.Bytes(), &body); err != nil || body.Error == "" {
+			body.Error = http.StatusText(rec.status)
+		}
+		fail(errors.New(body.Error), rec.status >= 500 || rec.status == http.StatusTooManyRequests)
+		return
+	}
+	cfg.deleteJobSource(ctx, job.SourceKey)
+	if err := cfg.db.FinishVideoJob(job.ID, database.JobReady, nil); err != nil {
+		logger.Error("couldn't record job completion", "error", err)
+		return
+	}
+	logger.Info("job finished")
+}
+
+// jobRetryDelay returns how long a job waits before its next attempt, after
+// attempts failed ones: base, doubled for each attempt after the first,
+// capped at maxJobRetryDelay.
+func jobRetryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for range attempts - 1 {
+		if delay >= maxJobRetryDelay/2 {
+			return maxJobRetryDelay
+		}
+		delay *= 2
+	}
+	return min(delay, maxJobRetryDelay)
+}
+
+// openJobSource opens the file a job was queued with.
+func (cfg *apiConfig) openJobSource(w http.ResponseWriter, r *http.Request, key string) (videoSource, error) {
+	out, err := cfg.s3Client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't get uploaded video", err)
+		return videoSource{}, err
+	}
+	size := int64(-1)
+	if out.ContentLength != nil {
+		size = *out.ContentLength
+	}
+	var contentType string
+	if out.ContentType != nil {
+		contentType = *out.ContentType
+	}
+	return videoSource{body: out.Body, size: size, contentType: contentType}, nil
+}
+
+// deleteJobSource deletes a job's file, logging rather than returning any
+// error: a leftover file only costs storage.
+func (cfg *apiConfig) deleteJobSource(ctx context.Context, key string) {
+	ctx = context.WithoutCancel(ctx)
+	if _, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	}); err != nil {
+		loggerFromContext(ctx).Warn("couldn't delete job file", "key", key, "error", err)
+	}
+}
+
+// jobResponseWriter collects the response the pipeline sends for a job, to
+// tell whether it succeeded.
+type jobResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jobResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *jobResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *jobResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
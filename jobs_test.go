@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestVideoJobReachesReady(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	cfg.asyncProcessing = true
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: status = %d, want %d (body %s)", w.Code, http.StatusAccepted, w.Body)
+	}
+	job, err := cfg.db.GetLatestVideoJob(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.JobPending {
+		t.Fatalf("queued job status = %q, want %q", job.Status, database.JobPending)
+	}
+
+	claimed, err := cfg.db.ClaimVideoJob()
+	if err != nil {
+		t.Fatalf("couldn't claim job: %v", err)
+	}
+	if claimed.ID != job.ID || claimed.Status != database.JobProcessing {
+		t.Fatalf("claimed %v (%s), want %v processing", claimed.ID, claimed.Status, job.ID)
+	}
+	cfg.processVideoJob(claimed)
+
+	job, err = cfg.db.GetVideoJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.JobReady {
+		t.Fatalf("job status = %q (error %v), want %q", job.Status, job.Error, database.JobReady)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.VideoURL == nil {
+		t.Error("video has no URL after its job finished")
+	}
+	for _, key := range mock.Keys() {
+		if strings.HasPrefix(key, jobSourcePrefix) {
+			t.Errorf("job file %s wasn't deleted", key)
+		}
+	}
+}
+
+func TestRequeueStaleJobs(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	job, err := cfg.db.CreateVideoJob(database.CreateVideoJobParams{
+		VideoID:   video.ID,
+		SourceKey: jobSourcePrefix + video.ID.String() + "/video.mp4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.ClaimVideoJob(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another server claimed it just now, and may still be running it
+	n, err := cfg.db.RequeueStaleJobs(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("requeued %d jobs claimed within the timeout, want 0", n)
+	}
+	if job, _ := cfg.db.GetVideoJob(job.ID); job.Status != database.JobProcessing {
+		t.Errorf("fresh claim status = %q, want %q", job.Status, database.JobProcessing)
+	}
+
+	// Once the claim is older than the timeout, its server must have stopped
+	n, err = cfg.db.RequeueStaleJobs(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("requeued %d stale jobs, want 1", n)
+	}
+	if job, _ := cfg.db.GetVideoJob(job.ID); job.Status != database.JobPending {
+		t.Errorf("stale claim status = %q, want %q", job.Status, database.JobPending)
+	}
+	if _, err := cfg.db.ClaimVideoJob(); err != nil {
+		t.Errorf("couldn't claim the requeued job: %v", err)
+	}
+}
+
+// enqueueTestJob uploads a video with asyncProcessing on and claims the job
+// it queues.
+func enqueueTestJob(t *testing.T, cfg *apiConfig) (database.Video, database.VideoJob) {
+	t.Helper()
+	cfg.asyncProcessing = true
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: status = %d, want %d (body %s)", w.Code, http.StatusAccepted, w.Body)
+	}
+	job, err := cfg.db.ClaimVideoJob()
+	if err != nil {
+		t.Fatalf("couldn't claim job: %v", err)
+	}
+	return video, job
+}
+
+func TestVideoJobRetries(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	cfg.videoJobMaxAttempts = 3
+	_, job := enqueueTestJob(t, cfg)
+
+	// Storage fails once, which isn't the file's fault
+	failing := true
+	mock.putErr = func(key string) error {
+		if failing && !strings.HasPrefix(key, jobSourcePrefix) {
+			return errors.New("InternalError")
+		}
+		return nil
+	}
+	cfg.processVideoJob(job)
+
+	job, err := cfg.db.GetVideoJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != database.JobPending || job.Attempts != 1 || job.Error == nil {
+		t.Fatalf("after a transient failure: status %q, attempts %d, error %v, want pending for a retry", job.Status, job.Attempts, job.Error)
+	}
+	if _, ok := mock.Object(job.SourceKey); !ok {
+		t.Fatal("job file was deleted before the retry")
+	}
+
+	failing = false
+	job, err = cfg.db.ClaimVideoJob()
+	if err != nil {
+		t.Fatalf("couldn't claim the retry: %v", err)
+	}
+	cfg.processVideoJob(job)
+	job, _ = cfg.db.GetVideoJob(job.ID)
+	if job.Status != database.JobReady || job.Attempts != 2 {
+		t.Errorf("after the retry: status %q, attempts %d, want ready after 2", job.Status, job.Attempts)
+	}
+	if _, ok := mock.Object(job.SourceKey); ok {
+		t.Error("job file wasn't deleted once the job was done")
+	}
+}
+
+func TestVideoJobGivesUpAfterMaxAttempts(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	cfg.videoJobMaxAttempts = 2
+	_, job := enqueueTestJob(t, cfg)
+	mock.putErr = func(key string) error { return errors.New("InternalError") }
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if attempt > 1 {
+			var err error
+			if job, err = cfg.db.ClaimVideoJob(); err != nil {
+				t.Fatalf("attempt %d: couldn't claim job: %v", attempt, err)
+			}
+		}
+		cfg.processVideoJob(job)
+	}
+	job, _ = cfg.db.GetVideoJob(job.ID)
+	if job.Status != database.JobFailed || job.Attempts != 2 {
+		t.Errorf("status %q after %d attempts, want failed after 2", job.Status, job.Attempts)
+	}
+	if _, err := cfg.db.ClaimVideoJob(); !errors.Is(err, database.ErrJobNotFound) {
+		t.Errorf("claim after the last attempt: %v, want nothing left to claim", err)
+	}
+	if _, ok := mock.Object(job.SourceKey); ok {
+		t.Error("job file wasn't deleted after the last attempt")
+	}
+}
+
+func TestVideoJobPermanentFailureIsNotRetried(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	_, job := enqueueTestJob(t, cfg)
+
+	// The stored file turns out to have no video stream
+	installFakeMedia(t, `{"streams": [{"codec_type": "audio", "codec_name": "aac"}], "format": {"duration": "3.0"}}`)
+	cfg.processVideoJob(job)
+
+	job, _ = cfg.db.GetVideoJob(job.ID)
+	if job.Status != database.JobFailed || job.Attempts != 1 {
+		t.Errorf("status %q after %d attempts, want failed after 1", job.Status, job.Attempts)
+	}
+	if job.Error == nil || *job.Error != "File has no video stream" {
+		t.Errorf("error = %v, want the pipeline's", job.Error)
+	}
+	if _, ok := mock.Object(job.SourceKey); ok {
+		t.Error("job file wasn't deleted")
+	}
+}
+
+func TestJobRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{20, maxJobRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := jobRetryDelay(30*time.Second, tt.attempts); got != tt.want {
+			t.Errorf("jobRetryDelay(30s, %d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestVideoJobReplaysOptions(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	cfg.asyncProcessing = true
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	r := newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil)
+	r.URL.RawQuery = "extractAudio=true"
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: status = %d, want %d (body %s)", w.Code, http.StatusAccepted, w.Body)
+	}
+	job, err := cfg.db.ClaimVideoJob()
+	if err != nil {
+		t.Fatalf("couldn't claim job: %v", err)
+	}
+	cfg.processVideoJob(job)
+
+	if job, _ = cfg.db.GetVideoJob(job.ID); job.Status != database.JobReady {
+		t.Fatalf("job status = %q (error %v), want %q", job.Status, job.Error, database.JobReady)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.AudioURL == nil {
+		t.Error("job didn't extract the audio the upload asked for")
+	}
+}
+
+// newVideoStatusRequest returns a request for the status of videoID.
+func newVideoStatusRequest(videoID uuid.UUID, token string) *http.Request {
+	r := newUserRequest(http.MethodGet, "/api/videos/"+videoID.String()+"/status", token)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestVideoStatus(t *testing.T) {
+	type status struct {
+		Status   database.JobStatus `json:"status"`
+		Error    *string            `json:"error"`
+		Attempts int                `json:"attempts"`
+	}
+	getStatus := func(t *testing.T, cfg *apiConfig, videoID uuid.UUID, token string) (int, status) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.handlerGetVideoStatus(w, newVideoStatusRequest(videoID, token))
+		var got status
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, got
+	}
+
+	t.Run("uploaded without a job", func(t *testing.T) {
+		installFakeMedia(t, testProbeOutput)
+		cfg, _ := newTestConfig(t)
+		userID, token := createTestUser(t, cfg)
+		video := createTestVideo(t, cfg, userID)
+
+		if code, _ := getStatus(t, cfg, video.ID, token); code != http.StatusNotFound {
+			t.Errorf("before upload: status code = %d, want %d", code, http.StatusNotFound)
+		}
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("upload: status = %d, want %d (body %s)", w.Code, http.StatusCreated, w.Body)
+		}
+		code, got := getStatus(t, cfg, video.ID, token)
+		if code != http.StatusOK || got.Status != database.JobReady {
+			t.Errorf("after upload: %d %+v, want 200 ready", code, got)
+		}
+	})
+
+	t.Run("failed job", func(t *testing.T) {
+		installFakeMedia(t, testProbeOutput)
+		cfg, _ := newTestConfig(t)
+		video, job := enqueueTestJob(t, cfg)
+		installFakeMedia(t, `{"streams": [{"codec_type": "audio", "codec_name": "aac"}], "format": {"duration": "3.0"}}`)
+		cfg.processVideoJob(job)
+
+		token, err := auth.MakeJWT(video.UserID, cfg.jwtSecret, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, got := getStatus(t, cfg, video.ID, token)
+		if code != http.StatusOK || got.Status != database.JobFailed || got.Attempts != 1 {
+			t.Fatalf("status = %d %+v, want 200 failed after 1 attempt", code, got)
+		}
+		if got.Error == nil || *got.Error != "File has no video stream" {
+			t.Errorf("error = %v, want the pipeline's", got.Error)
+		}
+	})
+}
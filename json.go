@@ -2,22 +2,36 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
-	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
-	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	respondWithErrorCode(w, code, defaultErrorCode(code), msg, err)
+}
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error string    `json:"error"`
+	Code  errorCode `json:"code"`
+	// Field names the request field that failed validation, if any
+	Field string `json:"field,omitempty"`
+}
+
+// respondWithErrorCode is respondWithError with a specific error code instead
+// of the generic one for the status.
+func respondWithErrorCode(w http.ResponseWriter, status int, errCode errorCode, msg string, err error) {
+	logger := loggerFromWriter(w)
+	switch {
+	case status > 499:
+		logger.Error("responding with 5XX error", "status", status, "message", msg, "error", err)
+	case err != nil:
+		logger.Info("request failed", "status", status, "message", msg, "error", err)
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
+	respondWithJSON(w, status, errorResponse{
+		Error: localize(localeFromWriter(w), msg),
+		Code:  errCode,
 	})
 }
 
@@ -32,3 +46,21 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.WriteHeader(code)
 	w.Write(dat)
 }
+
+// formatBytes renders n in binary units, e.g. 1073741824 -> "1 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	value := float64(n) / float64(div)
+	if value == float64(int64(value)) {
+		return fmt.Sprintf("%d %ciB", int64(value), "KMGTPE"[exp])
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[exp])
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxKeyRotationAttempts is how many fresh keys are tried before giving up
+// on finding one that's free
+const maxKeyRotationAttempts = 3
+
+// handlerRotateVideoKey moves a video's objects to a new random key, so
+// URLs to the old one (say a presigned URL that leaked and got cached) stop
+// working. The file and the assets derived from it are copied to the new
+// key, the video is pointed at the copies, and only then are the originals
+// deleted. CDN caches of the old URLs aren't invalidated.
+func (cfg *apiConfig) handlerRotateVideoKey(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	oldKey, err := cfg.s3KeyFromURL(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video in S3", err)
+		return
+	}
+	// An HLS package is a prefix of segments rather than a key
+	if path.Base(oldKey) == hlsPlaylistName {
+		respondWithError(w, http.StatusConflict, "HLS videos can't be moved to a new key", nil)
+		return
+	}
+	// Deduplicated videos sharing the objects would keep using the old key
+	others, err := cfg.db.CountOtherVideosWithURL(*video.VideoURL, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check for shared objects", err)
+		return
+	}
+	if others > 0 {
+		respondWithError(w, http.StatusConflict, "Video's file is shared with other videos", nil)
+		return
+	}
+
+	moves, err := cfg.planKeyRotation(r.Context(), video, oldKey)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't generate key", err)
+		return
+	}
+
+	for i, move := range moves {
+		if err := cfg.copyObject(r.Context(), move.from, move.to); err != nil {
+			for _, copied := range moves[:i] {
+				cfg.deleteObjectQuietly(r.Context(), copied.to)
+			}
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't copy video", err)
+			return
+		}
+	}
+
+	previous := video
+	rotated := rotateVideoURLs(video, func(objectURL string) string {
+		key, err := cfg.s3KeyFromURL(objectURL)
+		if err != nil {
+			return objectURL
+		}
+		for _, move := range moves {
+			if move.from == key {
+				return cfg.objectURL(move.to)
+			}
+		}
+		return objectURL
+	})
+	if err := cfg.db.UpdateVideo(rotated); err != nil {
+		for _, move := range moves {
+			cfg.deleteObjectQuietly(r.Context(), move.to)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	// The video is on the new key now, so failing here only leaves the old
+	// objects behind
+	if err := cfg.deleteObjectURLs(r.Context(), videoObjectURLs(previous)); err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't delete old objects", err)
+		return
+	}
+	loggerFromContext(r.Context()).Info("rotated video key", "video_id", video.ID, "old_key", oldKey, "new_key", moves[0].to)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(rotated)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// keyMove is an object to copy from one key to another.
+type keyMove struct {
+	from, to string
+}
+
+// planKeyRotation picks a new random key for the video stored at oldKey,
+// next to it, and maps each of the video's objects to theirs: derived assets
+// are stored under the video key's base, so they follow it. Keys already in
+// use are skipped.
+func (cfg *apiConfig) planKeyRotation(ctx context.Context, video database.Video, oldKey string) ([]keyMove, error) {
+	oldBase := strings.TrimSuffix(oldKey, path.Ext(oldKey))
+	for range maxKeyRotationAttempts {
+		name, err := cfg.generateS3Key(path.Ext(oldKey))
+		if err != nil {
+			return nil, err
+		}
+		newKey, err := normalizeS3Key(path.Dir(oldKey) + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		newBase := strings.TrimSuffix(newKey, path.Ext(newKey))
+
+		var moves []keyMove
+		collides := false
+		for _, objectURL := range videoObjectURLs(video) {
+			key, err := cfg.s3KeyFromURL(objectURL)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(key, oldBase) {
+				return nil, fmt.Errorf("object %s isn't stored under the video's key", key)
+			}
+			to := newBase + strings.TrimPrefix(key, oldBase)
+			exists, err := cfg.objectExists(ctx, to)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				collides = true
+				break
+			}
+			moves = append(moves, keyMove{from: key, to: to})
+		}
+		if !collides {
+			return moves, nil
+		}
+	}
+	return nil, errors.New("every key tried is already in use")
+}
+
+// copyObject copies the object at from to to within the bucket, with the
+// storage class, ACL and encryption new objects get.
+func (cfg *apiConfig) copyObject(ctx context.Context, from, to string) error {
+	source := (&url.URL{Path: cfg.s3Bucket + "/" + from}).EscapedPath()
+	input := &s3.CopyObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &to,
+		CopySource:   &source,
+		StorageClass: cfg.s3StorageClass,
+		ACL:          cfg.s3ACL,
+	}
+	if cfg.s3KMSKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = &cfg.s3KMSKeyID
+	}
+	_, err := cfg.s3Client.CopyObject(ctx, input)
+	return err
+}
+
+// deleteObjectQuietly deletes the object at key, logging rather than
+// returning any error.
+func (cfg *apiConfig) deleteObjectQuietly(ctx context.Context, key string) {
+	ctx = context.WithoutCancel(ctx)
+	if _, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	}); err != nil {
+		loggerFromContext(ctx).Warn("couldn't delete object", "key", key, "error", err)
+	}
+}
+
+// rotateVideoURLs returns video with each of the URLs videoObjectURLs lists
+// replaced by rotate's result.
+func rotateVideoURLs(video database.Video, rotate func(string) string) database.Video {
+	rotatePtr := func(u *string) *string {
+		if u == nil {
+			return nil
+		}
+		rotated := rotate(*u)
+		return &rotated
+	}
+	video.VideoURL = rotatePtr(video.VideoURL)
+	if video.Renditions != nil {
+		renditions := database.Renditions{}
+		for height, renditionURL := range video.Renditions {
+			renditions[height] = rotate(renditionURL)
+		}
+		video.Renditions = renditions
+	}
+	video.AudioURL = rotatePtr(video.AudioURL)
+	video.PreviewURL = rotatePtr(video.PreviewURL)
+	video.SpriteVTTURL = rotatePtr(video.SpriteVTTURL)
+	return video
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func rotateVideoKey(cfg *apiConfig, video database.Video) *httptest.ResponseRecorder {
+	r := newAdminRequest(http.MethodPost, "/admin/videos/"+video.ID.String()+"/rotate_key")
+	r.SetPathValue("videoID", video.ID.String())
+	w := httptest.NewRecorder()
+	cfg.handlerRotateVideoKey(w, r)
+	return w
+}
+
+func TestRotateVideoKey(t *testing.T) {
+	cfg, mock := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	audioURL := cfg.objectURL("landscape/old.m4a")
+	video.AudioURL = &audioURL
+	mock.Put("landscape/old.m4a", []byte("audio"), "audio/mp4")
+	storeTestVideoFile(t, cfg, mock, &video, "landscape/old.mp4", testMP4(16))
+
+	// Whenever an old object is deleted, the video must already be off it
+	mock.onCall = func(call string) {
+		if !strings.HasPrefix(call, "Delete") {
+			return
+		}
+		current, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Errorf("%s: %v", call, err)
+			return
+		}
+		if *current.VideoURL == *video.VideoURL || *current.AudioURL == *video.AudioURL {
+			t.Errorf("%s ran while the video still pointed at the old key", call)
+		}
+	}
+
+	w := rotateVideoKey(cfg, video)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusOK, w.Body)
+	}
+	rotated, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := cfg.s3KeyFromURL(*rotated.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBase := strings.TrimSuffix(newKey, ".mp4")
+	if newBase == "landscape/old" || !strings.HasPrefix(newBase, "landscape/") {
+		t.Fatalf("video moved to %s, want a new key in landscape/", newKey)
+	}
+	if want := cfg.objectURL(newBase + ".m4a"); *rotated.AudioURL != want {
+		t.Errorf("audio URL = %s, want %s", *rotated.AudioURL, want)
+	}
+
+	wantCalls := []string{
+		"HeadObject " + newBase + ".mp4",
+		"HeadObject " + newBase + ".m4a",
+		"CopyObject landscape/old.mp4 -> " + newBase + ".mp4",
+		"CopyObject landscape/old.m4a -> " + newBase + ".m4a",
+		"DeleteObject landscape/old.mp4",
+		"DeleteObject landscape/old.m4a",
+	}
+	if calls := mock.Calls(); !slices.Equal(calls, wantCalls) {
+		t.Errorf("calls = %q, want %q", calls, wantCalls)
+	}
+	if keys := mock.Keys(); !slices.Equal(keys, []string{newBase + ".m4a", newKey}) {
+		t.Errorf("bucket holds %q, want only the new keys", keys)
+	}
+	if obj, _ := mock.Object(newKey); !bytes.Equal(obj.data, testMP4(16)) {
+		t.Error("new key doesn't hold the video")
+	}
+}
+
+func TestRotateVideoKeySkipsKeysInUse(t *testing.T) {
+	cfg, mock := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	storeTestVideoFile(t, cfg, mock, &video, "landscape/old.mp4", testMP4(16))
+
+	// The first key tried turns out to hold another object
+	var taken string
+	mock.onCall = func(call string) {
+		if key, ok := strings.CutPrefix(call, "HeadObject "); ok && taken == "" {
+			taken = key
+			mock.objects[key] = mockObject{data: []byte("someone else's")}
+		}
+	}
+
+	w := rotateVideoKey(cfg, video)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusOK, w.Body)
+	}
+	rotated, _ := cfg.db.GetVideo(video.ID)
+	if *rotated.VideoURL == cfg.objectURL(taken) {
+		t.Errorf("video moved to %s, which was in use", taken)
+	}
+	if obj, _ := mock.Object(taken); string(obj.data) != "someone else's" {
+		t.Errorf("object at %s was overwritten", taken)
+	}
+	if heads := mock.CallsTo("HeadObject"); len(heads) != 2 {
+		t.Errorf("HeadObject calls = %q, want 2", heads)
+	}
+}
+
+func TestRotateVideoKeyConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, cfg *apiConfig, mock *mockS3, video *database.Video)
+	}{
+		{
+			name:  "not uploaded",
+			setup: func(t *testing.T, cfg *apiConfig, mock *mockS3, video *database.Video) {},
+		},
+		{
+			name: "HLS",
+			setup: func(t *testing.T, cfg *apiConfig, mock *mockS3, video *database.Video) {
+				storeTestVideoFile(t, cfg, mock, video, "landscape/hls/"+hlsPlaylistName, []byte("#EXTM3U\n"))
+			},
+		},
+		{
+			name: "shared file",
+			setup: func(t *testing.T, cfg *apiConfig, mock *mockS3, video *database.Video) {
+				storeTestVideoFile(t, cfg, mock, video, "landscape/shared.mp4", testMP4(16))
+				other := createTestVideo(t, cfg, video.UserID)
+				storeTestVideoFile(t, cfg, mock, &other, "landscape/shared.mp4", testMP4(16))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			userID, _ := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			tt.setup(t, cfg, mock, &video)
+			before := mock.Keys()
+
+			w := rotateVideoKey(cfg, video)
+			if w.Code != http.StatusConflict {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusConflict, w.Body)
+			}
+			if calls := mock.Calls(); len(calls) != 0 {
+				t.Errorf("calls = %q, want none", calls)
+			}
+			if keys := mock.Keys(); !slices.Equal(keys, before) {
+				t.Errorf("bucket holds %q, want %q", keys, before)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// requestIDHeader carries the request ID. A well-formed ID sent by the
+// client (or a proxy in front of us) is kept, so logs line up end to end.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type loggerContextKey struct{}
+
+// loggingResponseWriter carries the request's logger so respondWithError can
+// log with the request ID, the same way localizedResponseWriter carries the
+// locale.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	logger *slog.Logger
+}
+
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestIDMiddleware assigns each request an ID, echoes it in the response
+// and attaches a logger tagged with it to the request context.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		ctx := context.WithValue(r.Context(), loggerContextKey{}, logger)
+		next.ServeHTTP(&loggingResponseWriter{ResponseWriter: w, logger: logger}, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// loggerFromContext returns the request's logger, or the default logger
+// outside a request.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// loggerFromWriter returns the logger attached by requestIDMiddleware,
+// looking through any other wrappers around w.
+func loggerFromWriter(w http.ResponseWriter) *slog.Logger {
+	for {
+		switch v := w.(type) {
+		case *loggingResponseWriter:
+			return v.logger
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return slog.Default()
+		}
+	}
+}
+
+// logStage logs the start of a pipeline stage and returns a function that
+// logs its end, duration and error, if any. args are extra attributes for
+// both lines, as in slog.Logger.With. The duration is also added to the
+// context's stageTimings, if it has any.
+func logStage(ctx context.Context, stage string, args ...any) func(err error) {
+	logger := loggerFromContext(ctx).With("stage", stage).With(args...)
+	logger.Info("stage started")
+	start := time.Now()
+	return func(err error) {
+		recordStageDuration(ctx, stage, time.Since(start))
+		if err != nil {
+			logger.Warn("stage failed", "duration", time.Since(start), "error", err)
+			return
+		}
+		logger.Info("stage finished", "duration", time.Since(start))
+	}
+}
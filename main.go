@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"slices"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 
@@ -25,7 +33,242 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client         *s3.Client
+	s3Client         S3API
+
+	// s3Endpoint, when set, points the S3 client at an S3-compatible store
+	// such as MinIO instead of AWS, addressing buckets by path when
+	// s3UsePathStyle is set. Without a CloudFront distribution, object URLs
+	// are built on the endpoint too.
+	s3Endpoint     *url.URL
+	s3UsePathStyle bool
+	// s3URLMode is how stored video URLs reach the bucket: through
+	// s3CfDistribution, or from the bucket itself, virtual-hosted or
+	// path-style
+	s3URLMode string
+
+	// s3Replica, when set, is a replica of s3Bucket in another region that
+	// response URLs point at instead.
+	s3Replica *s3Replica
+
+	// s3CORSOrigins, when set, are the origins the buckets' CORS
+	// configuration is set to allow at startup, so browsers can play their
+	// objects.
+	s3CORSOrigins []string
+
+	// Uploads larger than s3MultipartThreshold bytes are sent to S3 in
+	// s3PartSize chunks, s3UploadConcurrency parts at a time.
+	s3MultipartThreshold int64
+	s3PartSize           int64
+	s3UploadConcurrency  int
+
+	// s3StorageClass is set on every uploaded object; empty means the
+	// bucket default. With s3TagObjects, objects are also tagged with their
+	// owner's user ID and upload time for lifecycle rules and cost reports.
+	s3StorageClass types.StorageClass
+	s3TagObjects   bool
+	// s3ACL is the canned ACL set on every uploaded object. Empty, the
+	// default, sends none and leaves access to the bucket policy.
+	s3ACL types.ObjectCannedACL
+	// s3KeyLayout is keyLayoutFlat or keyLayoutUser.
+	s3KeyLayout string
+	// s3KMSKeyID is the KMS key ARN objects are encrypted with (SSE-KMS).
+	// Empty leaves encryption to the bucket default.
+	s3KMSKeyID string
+	// s3CacheControl is the Cache-Control header stored with uploaded
+	// objects. Keys are random and never rewritten, so objects can be cached
+	// for good; images (sprites, previews) get s3ImageCacheControl instead.
+	s3CacheControl      string
+	s3ImageCacheControl string
+
+	// Retryable PutObject failures are retried up to s3MaxRetries times,
+	// backing off exponentially from s3RetryBaseDelay.
+	s3MaxRetries     int
+	s3RetryBaseDelay time.Duration
+
+	// Lifetimes of the access tokens (JWTs) and refresh tokens issued at
+	// login. Clients trade a refresh token for a new access token at
+	// /api/refresh.
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	// jwtCookieName, when set, is a cookie access tokens are read from
+	// when a request has no Authorization header, for browser clients that
+	// keep the token in an HttpOnly cookie.
+	jwtCookieName string
+	// jwtCookieOrigins are the origins, besides the API's own, whose pages
+	// may send the cookie with requests that change something.
+	jwtCookieOrigins []string
+
+	// similarityMaxDistance is the default Hamming distance between
+	// perceptual hashes under which two videos count as similar.
+	similarityMaxDistance int
+
+	uploadProgress *progressTracker
+
+	// uploadLimiter caps video uploads per user. It's nil when uploads
+	// aren't rate limited.
+	uploadLimiter *rateLimiter
+
+	// uploadIdempotency stores video upload responses by Idempotency-Key
+	uploadIdempotency *idempotencyStore
+
+	// webhookURL, when set, is POSTed an event after each successful upload.
+	webhookURL string
+
+	// mediaCheck caches the readiness check of ffmpeg and ffprobe
+	mediaCheck *cachedCheck
+
+	// maxVideoUploadBytes caps the size of a video upload request, and
+	// multipartMemoryBytes is how much of a multipart form is held in memory
+	// before the rest spills to temp files. Thumbnail forms get their own,
+	// smaller, cap and threshold, as many small uploads can be in flight at
+	// once.
+	maxVideoUploadBytes           int64
+	multipartMemoryBytes          int64
+	maxThumbnailUploadBytes       int64
+	thumbnailMultipartMemoryBytes int64
+	// storageQuotaBytes caps the total size of each user's stored video
+	// files, not counting renditions and other derived objects. Zero means
+	// no quota.
+	storageQuotaBytes int64
+
+	// Thumbnails larger than thumbnailMaxEdge pixels on their longest edge
+	// are scaled down and re-encoded as JPEGs at thumbnailQuality.
+	thumbnailMaxEdge int
+	thumbnailQuality int
+	// Each uploaded thumbnail is also stored scaled to every one of
+	// thumbnailSrcsetSizes (long edges in pixels), as a WebP and a JPEG.
+	// Empty turns this off.
+	thumbnailSrcsetSizes []int
+	// Stored thumbnails are stripped of all metadata. With
+	// thumbnailKeepOrientation, a JPEG's EXIF orientation is applied to its
+	// pixels first, so it doesn't end up sideways.
+	thumbnailKeepOrientation bool
+	// posterCache holds poster frames extracted on demand
+	posterCache *posterCache
+
+	// With moderateThumbnails, every uploaded thumbnail is checked by
+	// imageModerator before it's used.
+	moderateThumbnails bool
+	imageModerator     ImageModerator
+
+	// Uploaded thumbnails must be between thumbnailMinDimension and
+	// thumbnailMaxDimension pixels on each side.
+	thumbnailMinDimension int
+	thumbnailMaxDimension int
+
+	// Uploads are saved and processed in tempDir. Temp files there older
+	// than tempFileMaxAge are deleted at startup. Uploads are refused while
+	// its filesystem has less than minFreeDiskBytes free beyond their size;
+	// zero disables the check.
+	tempDir          string
+	tempFileMaxAge   time.Duration
+	minFreeDiskBytes int64
+
+	// When signedURLTTL is non-zero, video URLs in responses are signed and
+	// expire after that long. They're signed by CloudFront when a key pair is
+	// configured (cfKeyPairID and cfPrivateKey), and presigned by S3
+	// otherwise.
+	signedURLTTL time.Duration
+	cfKeyPairID  string
+	cfPrivateKey *rsa.PrivateKey
+	// Signed cookies, which grant access to all of a user's objects at
+	// once, last signedCookieTTL. signedCookieDomain is the domain they're
+	// set on, a parent of the distribution's; empty means the API's host.
+	signedCookieTTL    time.Duration
+	signedCookieDomain string
+
+	// processingLimiter caps concurrent ffmpeg work across uploads
+	processingLimiter *processingLimiter
+
+	// adminAPIKey authorizes requests to the /admin endpoints other than
+	// the dev-only reset. Empty turns them off.
+	adminAPIKey       string
+	fastStartBackfill *fastStartBackfill
+
+	// uploadTimeout is the overall deadline of an upload request, after
+	// which its work is cancelled and it gets a 504. Zero means no limit.
+	uploadTimeout time.Duration
+	// gzipMinBytes is the smallest JSON response that's gzipped. Zero turns
+	// compression off.
+	gzipMinBytes int
+
+	// importClient fetches videos imported from a URL
+	importClient *http.Client
+	// directUploadURLTTL is how long presigned URLs for uploading straight
+	// to S3 stay valid.
+	directUploadURLTTL time.Duration
+
+	// mediaTimeout bounds each ffmpeg/ffprobe invocation. Zero means no
+	// limit beyond the request's own lifetime.
+	mediaTimeout time.Duration
+	// probeTimeout bounds each ffprobe run more tightly, since probing
+	// should be quick and a file that hangs it is malformed. Zero leaves
+	// probes to mediaTimeout.
+	probeTimeout time.Duration
+	// slowUploadThreshold is how long an upload can take to respond before
+	// it's logged as slow. Zero disables the warning.
+	slowUploadThreshold time.Duration
+
+	// When reencodeCodec is set, videos whose codec browsers can't play are
+	// re-encoded to it at reencodeCRF with reencodePreset during fast start
+	// processing. Otherwise streams are always copied.
+	reencodeCodec  string
+	reencodeCRF    int
+	reencodePreset string
+
+	// watermarkPath is the image uploads may ask to have burned into their
+	// video, in watermarkPosition unless they pick another corner, at
+	// watermarkOpacity. Empty disables watermarking.
+	watermarkPath     string
+	watermarkPosition string
+	watermarkOpacity  float64
+
+	// uploadPipeline is the stages uploads go through once they've been
+	// received and probed, in order
+	uploadPipeline []uploadStage
+
+	// aspectRatios map video shapes to key prefixes. A video goes under the
+	// prefix of the closest ratio within aspectRatioTolerance, or "other/".
+	aspectRatios         []aspectRatioPrefix
+	aspectRatioTolerance float64
+
+	// hlsSegmentSeconds is the target segment length for HLS uploads.
+	hlsSegmentSeconds int
+
+	// verifyUploads checks each uploaded video with HeadObject before its
+	// URL is saved, so a video never points at a missing or empty object.
+	verifyUploads bool
+
+	// dedupe stores videos under the SHA-256 of their contents, so
+	// byte-identical uploads share a single S3 object.
+	dedupe bool
+
+	// With streamUploads, fast start MP4s that need no processing are
+	// streamed from the request body to S3 instead of being saved to disk
+	// first. Other uploads, and ones asking for derived assets, still are.
+	streamUploads bool
+
+	// With asyncProcessing, uploads are stored as they are and answered
+	// with 202 Accepted, and videoJobWorkers workers process them in the
+	// background.
+	asyncProcessing bool
+	videoJobWorkers int
+	jobQueue        *jobQueue
+	// A job failing for a transient reason is retried, after
+	// videoJobRetryDelay doubled for each attempt so far, until it has run
+	// videoJobMaxAttempts times.
+	videoJobMaxAttempts int
+	videoJobRetryDelay  time.Duration
+
+	// maxVideoDuration is the longest video accepted for upload. Zero means
+	// no limit.
+	maxVideoDuration time.Duration
+
+	// Every integritySweepInterval, integritySweepSampleSize stored videos
+	// are re-hashed and compared with the hash recorded at upload. A zero
+	// interval disables the sweep.
+	integritySweepInterval   time.Duration
+	integritySweepSampleSize int
 }
 
 type thumbnail struct {
@@ -78,9 +321,56 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
+	var s3Endpoint *url.URL
+	if value := os.Getenv("S3_ENDPOINT"); value != "" {
+		s3Endpoint, err = url.Parse(value)
+		if err != nil || (s3Endpoint.Scheme != "http" && s3Endpoint.Scheme != "https") || s3Endpoint.Host == "" {
+			log.Fatal("S3_ENDPOINT must be an http(s) URL")
+		}
+	}
+	// S3-compatible stores mostly don't support virtual-hosted buckets
+	s3UsePathStyle := envBool("S3_FORCE_PATH_STYLE", s3Endpoint != nil)
+
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	// By default, URLs go through CloudFront when there's a distribution,
+	// and are addressed like the client addresses the bucket otherwise
+	s3URLMode := os.Getenv("S3_URL_MODE")
+	if s3URLMode == "" {
+		switch {
+		case s3CfDistribution != "":
+			s3URLMode = urlModeCloudFront
+		case s3UsePathStyle:
+			s3URLMode = urlModeS3PathStyle
+		default:
+			s3URLMode = urlModeS3VirtualHosted
+		}
+	}
+	switch s3URLMode {
+	case urlModeCloudFront:
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO must be set when S3_URL_MODE is cloudfront")
+		}
+	case urlModeS3VirtualHosted, urlModeS3PathStyle:
+	default:
+		log.Fatalf("S3_URL_MODE must be %q, %q or %q", urlModeCloudFront, urlModeS3VirtualHosted, urlModeS3PathStyle)
+	}
+
+	s3ReplicaBucket := os.Getenv("S3_REPLICA_BUCKET")
+	s3ReplicaRegion := os.Getenv("S3_REPLICA_REGION")
+	if s3ReplicaBucket != "" && s3ReplicaRegion == "" {
+		log.Fatal("S3_REPLICA_REGION must be set with S3_REPLICA_BUCKET")
+	}
+	if s3ReplicaBucket == s3Bucket {
+		log.Fatal("S3_REPLICA_BUCKET must differ from S3_BUCKET")
+	}
+
+	// Applying CORS replaces the buckets' existing rules, so it's opt-in
+	var s3CORSOrigins []string
+	if envBool("S3_APPLY_CORS", false) {
+		s3CORSOrigins, err = parseCORSOrigins(os.Getenv("S3_CORS_ORIGINS"))
+		if err != nil {
+			log.Fatalf("Invalid S3_CORS_ORIGINS: %v", err)
+		}
 	}
 
 	port := os.Getenv("PORT")
@@ -88,11 +378,336 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(context.TODO())
+	s3MultipartThreshold := envInt64("S3_MULTIPART_THRESHOLD_BYTES", 100<<20)
+	s3PartSize := envInt64("S3_PART_SIZE_BYTES", 16<<20)
+	if s3PartSize < manager.MinUploadPartSize {
+		log.Fatalf("S3_PART_SIZE_BYTES must be at least %d", manager.MinUploadPartSize)
+	}
+	s3UploadConcurrency := envInt("S3_UPLOAD_CONCURRENCY", manager.DefaultUploadConcurrency)
+	if s3UploadConcurrency < 1 {
+		log.Fatal("S3_UPLOAD_CONCURRENCY must be at least 1")
+	}
+
+	s3MaxRetries := envInt("S3_MAX_RETRIES", 3)
+	if s3MaxRetries < 0 {
+		log.Fatal("S3_MAX_RETRIES can't be negative")
+	}
+	s3RetryBaseDelay := envDuration("S3_RETRY_BASE_DELAY", 200*time.Millisecond)
+	if s3RetryBaseDelay <= 0 {
+		log.Fatal("S3_RETRY_BASE_DELAY must be positive")
+	}
+
+	accessTokenTTL := envDuration("ACCESS_TOKEN_TTL", time.Hour)
+	refreshTokenTTL := envDuration("REFRESH_TOKEN_TTL", 60*24*time.Hour)
+	if accessTokenTTL <= 0 || refreshTokenTTL <= 0 {
+		log.Fatal("ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL must be positive")
+	}
+	var jwtCookieOrigins []string
+	if value := os.Getenv("JWT_COOKIE_ORIGINS"); value != "" {
+		jwtCookieOrigins, err = parseCORSOrigins(value)
+		if err != nil {
+			log.Fatalf("Invalid JWT_COOKIE_ORIGINS: %v", err)
+		}
+		if slices.Contains(jwtCookieOrigins, "*") {
+			log.Fatal("JWT_COOKIE_ORIGINS can't be \"*\"")
+		}
+	}
+
+	similarityMaxDistance := envInt("SIMILARITY_MAX_DISTANCE", 10)
+	uploadsPerMinute := envInt("UPLOADS_PER_MINUTE", 0)
+	if uploadsPerMinute < 0 {
+		log.Fatal("UPLOADS_PER_MINUTE can't be negative")
+	}
+	var uploadLimiter *rateLimiter
+	if uploadsPerMinute > 0 {
+		uploadLimiter = newRateLimiter(uploadsPerMinute)
+	}
+
+	uploadProgressTTL := envDuration("UPLOAD_PROGRESS_TTL", 5*time.Minute)
+
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	if webhookURL != "" {
+		if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("WEBHOOK_URL must be an http(s) URL")
+		}
+	}
+
+	idempotencyKeyTTL := envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+	if idempotencyKeyTTL <= 0 {
+		log.Fatal("IDEMPOTENCY_KEY_TTL must be positive")
+	}
+
+	maxVideoUploadBytes := envInt64("MAX_VIDEO_UPLOAD_BYTES", 1<<30)
+	if maxVideoUploadBytes <= 0 {
+		log.Fatal("MAX_VIDEO_UPLOAD_BYTES must be positive")
+	}
+	storageQuotaBytes := envInt64("STORAGE_QUOTA_BYTES", 0)
+	if storageQuotaBytes < 0 {
+		log.Fatal("STORAGE_QUOTA_BYTES can't be negative")
+	}
+	multipartMemoryBytes := envInt64("MULTIPART_MEMORY_BYTES", 10<<20)
+	if multipartMemoryBytes <= 0 {
+		log.Fatal("MULTIPART_MEMORY_BYTES must be positive")
+	}
+	maxThumbnailUploadBytes := envInt64("MAX_THUMBNAIL_UPLOAD_BYTES", 10<<20)
+	if maxThumbnailUploadBytes <= 0 {
+		log.Fatal("MAX_THUMBNAIL_UPLOAD_BYTES must be positive")
+	}
+	thumbnailMultipartMemoryBytes := envInt64("THUMBNAIL_MULTIPART_MEMORY_BYTES", 1<<20)
+	if thumbnailMultipartMemoryBytes <= 0 {
+		log.Fatal("THUMBNAIL_MULTIPART_MEMORY_BYTES must be positive")
+	}
+
+	thumbnailMaxEdge := envInt("THUMBNAIL_MAX_EDGE", 1280)
+	if thumbnailMaxEdge < 1 {
+		log.Fatal("THUMBNAIL_MAX_EDGE must be positive")
+	}
+	thumbnailMinDimension := envInt("THUMBNAIL_MIN_DIMENSION", 16)
+	thumbnailMaxDimension := envInt("THUMBNAIL_MAX_DIMENSION", 10000)
+	if thumbnailMinDimension < 1 || thumbnailMaxDimension < thumbnailMinDimension {
+		log.Fatal("THUMBNAIL_MIN_DIMENSION must be positive and at most THUMBNAIL_MAX_DIMENSION")
+	}
+	thumbnailQuality := envInt("THUMBNAIL_JPEG_QUALITY", 85)
+	if thumbnailQuality < 1 || thumbnailQuality > 100 {
+		log.Fatal("THUMBNAIL_JPEG_QUALITY must be between 1 and 100")
+	}
+	thumbnailKeepOrientation := envBool("THUMBNAIL_KEEP_ORIENTATION", false)
+	thumbnailSrcsetSizes, err := parseThumbnailSrcsetSizes(os.Getenv("THUMBNAIL_SRCSET_SIZES"))
+	if err != nil {
+		log.Fatalf("Invalid THUMBNAIL_SRCSET_SIZES: %v", err)
+	}
+	posterCacheTTL := envDuration("POSTER_CACHE_TTL", 5*time.Minute)
+	if posterCacheTTL < 0 {
+		log.Fatal("POSTER_CACHE_TTL can't be negative")
+	}
+
+	moderateThumbnails := envBool("MODERATE_THUMBNAILS", false)
+	var imageModerator ImageModerator = noopModerator{}
+	if moderationURL := os.Getenv("MODERATION_API_URL"); moderationURL != "" {
+		if u, err := url.Parse(moderationURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("MODERATION_API_URL must be an http(s) URL")
+		}
+		imageModerator = newHTTPModerator(moderationURL)
+	}
+
+	tempDir := os.Getenv("TEMP_DIR")
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	if err := checkTempDir(tempDir); err != nil {
+		log.Fatalf("TEMP_DIR is unusable: %v", err)
+	}
+	// Multipart forms spill large files to os.TempDir, which follows TMPDIR
+	os.Setenv("TMPDIR", tempDir)
+	tempFileMaxAge := envDuration("TEMP_FILE_MAX_AGE", time.Hour)
+	minFreeDiskBytes := envInt64("MIN_FREE_DISK_BYTES", 0)
+	if minFreeDiskBytes < 0 {
+		log.Fatal("MIN_FREE_DISK_BYTES can't be negative")
+	}
+
+	signedURLTTL := envDuration("SIGNED_URL_TTL", 0)
+	if signedURLTTL < 0 {
+		log.Fatal("SIGNED_URL_TTL can't be negative")
+	}
+	signedCookieTTL := envDuration("SIGNED_COOKIE_TTL", time.Hour)
+	if signedCookieTTL <= 0 {
+		log.Fatal("SIGNED_COOKIE_TTL must be positive")
+	}
+	cfKeyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID")
+	var cfPrivateKey *rsa.PrivateKey
+	if cfKeyPath := os.Getenv("CLOUDFRONT_PRIVATE_KEY_PATH"); cfKeyPath != "" {
+		if cfKeyPairID == "" {
+			log.Fatal("CLOUDFRONT_KEY_PAIR_ID must be set with CLOUDFRONT_PRIVATE_KEY_PATH")
+		}
+		cfPrivateKey, err = loadCloudFrontPrivateKey(cfKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't load CloudFront private key: %v", err)
+		}
+	}
+
+	mediaTimeout := envDuration("MEDIA_COMMAND_TIMEOUT", 30*time.Minute)
+	if mediaTimeout < 0 {
+		log.Fatal("MEDIA_COMMAND_TIMEOUT can't be negative")
+	}
+	probeTimeout := envDuration("FFPROBE_TIMEOUT", 30*time.Second)
+	if probeTimeout < 0 {
+		log.Fatal("FFPROBE_TIMEOUT can't be negative")
+	}
+	uploadTimeout := envDuration("UPLOAD_TIMEOUT", time.Hour)
+	if uploadTimeout < 0 {
+		log.Fatal("UPLOAD_TIMEOUT can't be negative")
+	}
+	slowUploadThreshold := envDuration("SLOW_UPLOAD_THRESHOLD", 0)
+	if slowUploadThreshold < 0 {
+		log.Fatal("SLOW_UPLOAD_THRESHOLD can't be negative")
+	}
+	gzipMinBytes := envInt("GZIP_MIN_BYTES", 1024)
+	if gzipMinBytes < 0 {
+		log.Fatal("GZIP_MIN_BYTES can't be negative")
+	}
+	// Only for local development: lets imports reach localhost and private
+	// networks, which is an SSRF hole on a public server
+	importAllowPrivate := envBool("IMPORT_ALLOW_PRIVATE_ADDRESSES", false)
+	directUploadURLTTL := envDuration("DIRECT_UPLOAD_URL_TTL", 15*time.Minute)
+	if directUploadURLTTL <= 0 {
+		log.Fatal("DIRECT_UPLOAD_URL_TTL must be positive")
+	}
+
+	maxConcurrentProcessing := envInt64("MAX_CONCURRENT_PROCESSING", int64(runtime.NumCPU()))
+	if maxConcurrentProcessing < 1 {
+		log.Fatal("MAX_CONCURRENT_PROCESSING must be at least 1")
+	}
+	processingQueueWait := envDuration("PROCESSING_QUEUE_WAIT", 5*time.Second)
+	if processingQueueWait < 0 {
+		log.Fatal("PROCESSING_QUEUE_WAIT can't be negative")
+	}
+
+	reencodeCodec := os.Getenv("VIDEO_REENCODE_CODEC")
+	reencodeCRF := envInt("VIDEO_REENCODE_CRF", 23)
+	if err := validateReencodeSettings(reencodeCodec, reencodeCRF); err != nil {
+		log.Fatalf("Invalid video re-encode settings: %v", err)
+	}
+	reencodePreset := os.Getenv("VIDEO_REENCODE_PRESET")
+	if reencodePreset == "" {
+		reencodePreset = "medium"
+	}
+
+	watermarkPath := os.Getenv("WATERMARK_PATH")
+	if watermarkPath != "" {
+		if _, err := os.Stat(watermarkPath); err != nil {
+			log.Fatalf("Couldn't read WATERMARK_PATH: %v", err)
+		}
+	}
+	watermarkPosition := os.Getenv("WATERMARK_POSITION")
+	if watermarkPosition == "" {
+		watermarkPosition = "bottom-right"
+	}
+	if _, ok := watermarkPositions[watermarkPosition]; !ok {
+		log.Fatal("WATERMARK_POSITION must be top-left, top-right, bottom-left or bottom-right")
+	}
+	watermarkOpacity := envFloat64("WATERMARK_OPACITY", 0.8)
+	if watermarkOpacity <= 0 || watermarkOpacity > 1 {
+		log.Fatal("WATERMARK_OPACITY must be greater than 0 and at most 1")
+	}
+
+	uploadPipeline, err := parseUploadPipeline(os.Getenv("UPLOAD_PIPELINE"), os.Getenv("UPLOAD_PIPELINE_SKIP"))
+	if err != nil {
+		log.Fatalf("Invalid UPLOAD_PIPELINE: %v", err)
+	}
+	fastStartStage := uploadStageIndex(uploadPipeline, stageFastStart)
+	if reencodeCodec != "" && fastStartStage < 0 {
+		log.Fatal("VIDEO_REENCODE_CODEC needs the faststart stage in UPLOAD_PIPELINE")
+	}
+	// Watermarked videos are written in an intermediate container that
+	// fast start processing remuxes
+	if i := uploadStageIndex(uploadPipeline, stageWatermark); watermarkPath != "" && i >= 0 && fastStartStage < i {
+		log.Fatal("WATERMARK_PATH needs the faststart stage after watermark in UPLOAD_PIPELINE")
+	}
+
+	aspectRatioValue := os.Getenv("ASPECT_RATIO_PREFIXES")
+	if aspectRatioValue == "" {
+		aspectRatioValue = defaultAspectRatioPrefixes
+	}
+	aspectRatios, err := parseAspectRatioPrefixes(aspectRatioValue)
+	if err != nil {
+		log.Fatalf("ASPECT_RATIO_PREFIXES is invalid: %v", err)
+	}
+	aspectRatioTolerance := envFloat64("ASPECT_RATIO_TOLERANCE", 0.1)
+	if aspectRatioTolerance <= 0 {
+		log.Fatal("ASPECT_RATIO_TOLERANCE must be positive")
+	}
+
+	hlsSegmentSeconds := envInt("HLS_SEGMENT_SECONDS", 6)
+	if hlsSegmentSeconds < 1 {
+		log.Fatal("HLS_SEGMENT_SECONDS must be positive")
+	}
+
+	verifyUploads := envBool("VERIFY_UPLOADS", false)
+
+	dedupe := envBool("DEDUPE_UPLOADS", false)
+	streamUploads := envBool("STREAM_UPLOADS", false)
+	asyncProcessing := envBool("ASYNC_PROCESSING", false)
+	videoJobWorkers := envInt("VIDEO_JOB_WORKERS", 2)
+	if videoJobWorkers < 1 {
+		log.Fatal("VIDEO_JOB_WORKERS must be at least 1")
+	}
+	videoJobMaxAttempts := envInt("VIDEO_JOB_MAX_ATTEMPTS", 3)
+	if videoJobMaxAttempts < 1 {
+		log.Fatal("VIDEO_JOB_MAX_ATTEMPTS must be at least 1")
+	}
+	videoJobRetryDelay := envDuration("VIDEO_JOB_RETRY_DELAY", 30*time.Second)
+	if videoJobRetryDelay < 0 {
+		log.Fatal("VIDEO_JOB_RETRY_DELAY can't be negative")
+	}
+
+	maxVideoDuration := envDuration("MAX_VIDEO_DURATION", 0)
+	if maxVideoDuration < 0 {
+		log.Fatal("MAX_VIDEO_DURATION can't be negative")
+	}
+
+	integritySweepInterval := envDuration("INTEGRITY_SWEEP_INTERVAL", 0)
+	integritySweepSampleSize := envInt("INTEGRITY_SWEEP_SAMPLE_SIZE", 10)
+	if integritySweepSampleSize < 1 {
+		log.Fatal("INTEGRITY_SWEEP_SAMPLE_SIZE must be at least 1")
+	}
+
+	s3StorageClass := types.StorageClass(os.Getenv("S3_STORAGE_CLASS"))
+	if s3StorageClass != "" && !slices.Contains(s3StorageClass.Values(), s3StorageClass) {
+		log.Fatalf("S3_STORAGE_CLASS must be one of %v", s3StorageClass.Values())
+	}
+	s3TagObjects := envBool("S3_TAG_OBJECTS", false)
+	// No ACL by default: buckets with Object Ownership set to "bucket owner
+	// enforced" (the default for new buckets) reject requests that send one
+	var s3ACL types.ObjectCannedACL
+	if value := os.Getenv("S3_ACL"); value != "" && value != "none" {
+		s3ACL = types.ObjectCannedACL(value)
+		if !slices.Contains(s3ACL.Values(), s3ACL) {
+			log.Fatalf("S3_ACL must be \"none\" or one of %v", s3ACL.Values())
+		}
+	}
+	// A public object can be fetched without a signature, so signing its
+	// URLs protects nothing
+	if (s3ACL == types.ObjectCannedACLPublicRead || s3ACL == types.ObjectCannedACLPublicReadWrite) && signedURLTTL > 0 {
+		log.Printf("WARNING: S3_ACL is %q, so uploaded objects are readable by anyone despite SIGNED_URL_TTL; use \"none\" or \"private\" to keep them behind signed URLs", s3ACL)
+	}
+	s3KMSKeyID := os.Getenv("S3_KMS_KEY_ARN")
+	s3CacheControl := os.Getenv("S3_CACHE_CONTROL")
+	if s3CacheControl == "" {
+		s3CacheControl = "public, max-age=31536000, immutable"
+	}
+	s3ImageCacheControl := os.Getenv("S3_IMAGE_CACHE_CONTROL")
+	if s3ImageCacheControl == "" {
+		s3ImageCacheControl = "public, max-age=86400"
+	}
+	s3KeyLayout := os.Getenv("S3_KEY_LAYOUT")
+	if s3KeyLayout == "" {
+		s3KeyLayout = keyLayoutFlat
+	}
+	if s3KeyLayout != keyLayoutFlat && s3KeyLayout != keyLayoutUser {
+		log.Fatalf("S3_KEY_LAYOUT must be %q or %q", keyLayoutFlat, keyLayoutUser)
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
 	if err != nil {
 		log.Fatalf("failed to load AWS config: %v", err)
 	}
-	s3Client := s3.NewFromConfig(awsCfg)
+	s3Client := newS3Client(s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if s3Endpoint != nil {
+			o.BaseEndpoint = aws.String(s3Endpoint.String())
+		}
+		o.UsePathStyle = s3UsePathStyle
+	}))
+	var replica *s3Replica
+	if s3ReplicaBucket != "" {
+		replicaClient := newS3Client(s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			o.Region = s3ReplicaRegion
+			if s3Endpoint != nil {
+				o.BaseEndpoint = aws.String(s3Endpoint.String())
+			}
+			o.UsePathStyle = s3UsePathStyle
+		}))
+		replica = newS3Replica(s3ReplicaBucket, s3ReplicaRegion, os.Getenv("S3_REPLICA_CF_DISTRO"), replicaClient, envBool("S3_REPLICA_VERIFY", false))
+	}
 
 	cfg := apiConfig{
 		db:               db,
@@ -105,6 +720,95 @@ func main() {
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
 		s3Client:         s3Client,
+		s3Endpoint:       s3Endpoint,
+		s3UsePathStyle:   s3UsePathStyle,
+		s3URLMode:        s3URLMode,
+		s3Replica:        replica,
+		s3CORSOrigins:    s3CORSOrigins,
+
+		s3MultipartThreshold: s3MultipartThreshold,
+		s3PartSize:           s3PartSize,
+		s3UploadConcurrency:  s3UploadConcurrency,
+		s3StorageClass:       s3StorageClass,
+		s3ACL:                s3ACL,
+		s3TagObjects:         s3TagObjects,
+		s3KeyLayout:          s3KeyLayout,
+		s3KMSKeyID:           s3KMSKeyID,
+		s3CacheControl:       s3CacheControl,
+		s3ImageCacheControl:  s3ImageCacheControl,
+		s3MaxRetries:         s3MaxRetries,
+		s3RetryBaseDelay:     s3RetryBaseDelay,
+
+		accessTokenTTL:   accessTokenTTL,
+		jwtCookieName:    os.Getenv("JWT_COOKIE_NAME"),
+		jwtCookieOrigins: jwtCookieOrigins,
+		refreshTokenTTL:  refreshTokenTTL,
+
+		similarityMaxDistance: similarityMaxDistance,
+
+		uploadProgress: newProgressTracker(uploadProgressTTL),
+		uploadLimiter:  uploadLimiter,
+
+		uploadIdempotency: newIdempotencyStore(idempotencyKeyTTL),
+		mediaCheck:        &cachedCheck{},
+		webhookURL:        webhookURL,
+
+		maxVideoUploadBytes:           maxVideoUploadBytes,
+		storageQuotaBytes:             storageQuotaBytes,
+		multipartMemoryBytes:          multipartMemoryBytes,
+		maxThumbnailUploadBytes:       maxThumbnailUploadBytes,
+		thumbnailMultipartMemoryBytes: thumbnailMultipartMemoryBytes,
+		maxVideoDuration:              maxVideoDuration,
+		dedupe:                        dedupe,
+		streamUploads:                 streamUploads,
+		asyncProcessing:               asyncProcessing,
+		videoJobWorkers:               videoJobWorkers,
+		videoJobMaxAttempts:           videoJobMaxAttempts,
+		videoJobRetryDelay:            videoJobRetryDelay,
+		jobQueue:                      newJobQueue(),
+		verifyUploads:                 verifyUploads,
+		hlsSegmentSeconds:             hlsSegmentSeconds,
+		aspectRatios:                  aspectRatios,
+		aspectRatioTolerance:          aspectRatioTolerance,
+		mediaTimeout:                  mediaTimeout,
+		probeTimeout:                  probeTimeout,
+		uploadTimeout:                 uploadTimeout,
+		slowUploadThreshold:           slowUploadThreshold,
+		gzipMinBytes:                  gzipMinBytes,
+		adminAPIKey:                   os.Getenv("ADMIN_API_KEY"),
+		fastStartBackfill:             &fastStartBackfill{},
+		importClient:                  newImportClient(importAllowPrivate),
+		directUploadURLTTL:            directUploadURLTTL,
+		processingLimiter:             newProcessingLimiter(maxConcurrentProcessing, processingQueueWait),
+		reencodeCodec:                 reencodeCodec,
+		reencodeCRF:                   reencodeCRF,
+		reencodePreset:                reencodePreset,
+		watermarkPath:                 watermarkPath,
+		watermarkPosition:             watermarkPosition,
+		watermarkOpacity:              watermarkOpacity,
+		uploadPipeline:                uploadPipeline,
+		signedURLTTL:                  signedURLTTL,
+		cfKeyPairID:                   cfKeyPairID,
+		cfPrivateKey:                  cfPrivateKey,
+		signedCookieTTL:               signedCookieTTL,
+		signedCookieDomain:            os.Getenv("SIGNED_COOKIE_DOMAIN"),
+		tempDir:                       tempDir,
+		tempFileMaxAge:                tempFileMaxAge,
+		minFreeDiskBytes:              minFreeDiskBytes,
+		thumbnailMaxEdge:              thumbnailMaxEdge,
+		thumbnailQuality:              thumbnailQuality,
+		thumbnailSrcsetSizes:          thumbnailSrcsetSizes,
+
+		thumbnailKeepOrientation: thumbnailKeepOrientation,
+		posterCache:              newPosterCache(posterCacheTTL),
+
+		thumbnailMinDimension: thumbnailMinDimension,
+		moderateThumbnails:    moderateThumbnails,
+		imageModerator:        imageModerator,
+		thumbnailMaxDimension: thumbnailMaxDimension,
+
+		integritySweepInterval:   integritySweepInterval,
+		integritySweepSampleSize: integritySweepSampleSize,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -112,32 +816,100 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	if len(cfg.s3CORSOrigins) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := cfg.applyBucketCORS(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Couldn't apply bucket CORS configuration: %v", err)
+		}
+		log.Printf("Applied bucket CORS configuration for %v", cfg.s3CORSOrigins)
+	}
+
+	removed, err := cleanupStaleTempFiles(cfg.tempDir, cfg.tempFileMaxAge)
+	if err != nil {
+		log.Printf("Couldn't clean up stale temp files: %v", err)
+	} else if removed > 0 {
+		log.Printf("Removed %d stale temp files", removed)
+	}
+
+	go cfg.uploadProgress.runCleanup(time.Minute)
+	go cfg.uploadIdempotency.runCleanup(time.Minute)
+	if cfg.uploadLimiter != nil {
+		go cfg.uploadLimiter.runCleanup(time.Minute)
+	}
+	if cfg.integritySweepInterval > 0 {
+		go cfg.runIntegritySweep(cfg.integritySweepInterval, cfg.integritySweepSampleSize)
+	}
+	// Workers run even with asyncProcessing off, to finish jobs queued
+	// before it was turned off
+	cfg.startVideoJobWorkers(cfg.videoJobWorkers)
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
+	// http.FileServer answers Range requests with 206 Partial Content (and
+	// If-Range against the ETag), so players can seek in local files
+	assetsFS := http.Dir(assetsRoot)
+	assetsHandler := http.StripPrefix("/assets", etagMiddleware(assetsFS, http.FileServer(assetsFS)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
+	mux.Handle("GET /metrics", metricsHandler())
+
+	// JSON responses from the API are compressed; thumbnail bytes and event
+	// streams pass through as they are
+	apiMux := http.NewServeMux()
+	mux.Handle("/api/", gzipMiddleware(cfg.gzipMinBytes, apiMux))
+
+	apiMux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	apiMux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	apiMux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	apiMux.HandleFunc("POST /api/cloudfront_cookies", cfg.handlerCreateSignedCookies)
+
+	apiMux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	apiMux.HandleFunc("POST /api/uploads", cfg.handlerUploadCreate)
+	apiMux.HandleFunc("GET /api/uploads/{uploadID}/events", cfg.handlerUploadEvents)
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	apiMux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
+	apiMux.Handle("POST /api/thumbnail_upload/{videoID}", timeoutMiddleware(cfg.uploadTimeout, http.HandlerFunc(cfg.handlerUploadThumbnail)))
+	apiMux.HandleFunc("POST /api/videos/{videoID}/thumbnail", cfg.handlerRegenerateThumbnail)
+	apiMux.HandleFunc("POST /api/videos/{videoID}/sprites", cfg.handlerGenerateSprites)
+	apiMux.HandleFunc("POST /api/videos/{videoID}/thumbnail_candidates", cfg.handlerGenerateThumbnailCandidates)
+	apiMux.HandleFunc("POST /api/videos/{videoID}/thumbnail_candidates/{candidateID}/select", cfg.handlerSelectThumbnailCandidate)
+	apiMux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerUploadCaptions)
+	apiMux.HandleFunc("GET /api/videos/{videoID}/poster", cfg.handlerGetPosterFrame)
+	apiMux.HandleFunc("GET /api/videos/{videoID}/thumbnails", cfg.handlerListGalleryThumbnails)
+	apiMux.Handle("POST /api/videos/{videoID}/thumbnails", timeoutMiddleware(cfg.uploadTimeout, http.HandlerFunc(cfg.handlerAddGalleryThumbnail)))
+	apiMux.HandleFunc("PUT /api/videos/{videoID}/thumbnails", cfg.handlerReorderGalleryThumbnails)
+	apiMux.HandleFunc("PUT /api/videos/{videoID}/thumbnails/{thumbnailID}/primary", cfg.handlerSetPrimaryGalleryThumbnail)
+	apiMux.HandleFunc("DELETE /api/videos/{videoID}/thumbnails/{thumbnailID}", cfg.handlerDeleteGalleryThumbnail)
+	apiMux.Handle("POST /api/video_upload/{videoID}", timeoutMiddleware(cfg.uploadTimeout, http.HandlerFunc(cfg.handlerUploadVideo)))
+	apiMux.Handle("PATCH /api/video_upload/{videoID}", timeoutMiddleware(cfg.uploadTimeout, http.HandlerFunc(cfg.handlerReplaceVideo)))
+	apiMux.HandleFunc("POST /api/video_upload/{videoID}/url", cfg.handlerCreateUploadURL)
+	apiMux.Handle("POST /api/video_upload/{videoID}/finalize", timeoutMiddleware(cfg.uploadTimeout, http.HandlerFunc(cfg.handlerFinalizeUpload)))
+	apiMux.Handle("POST /api/videos/{videoID}/import", timeoutMiddleware(cfg.uploadTimeout, http.HandlerFunc(cfg.handlerImportVideoFromURL)))
+	apiMux.HandleFunc("GET /api/videos", cfg.handlerListVideos)
+	apiMux.HandleFunc("GET /api/stats", cfg.handlerGetUserStats)
+	apiMux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerGetVideo)
+	apiMux.HandleFunc("GET /api/videos/{videoID}/status", cfg.handlerGetVideoStatus)
+	apiMux.HandleFunc("PUT /api/videos/{videoID}", cfg.handlerUpdateVideoMetadata)
+	apiMux.HandleFunc("GET /api/videos/{videoID}/similar", cfg.handlerFindSimilar)
+	apiMux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
+	apiMux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerDeleteVideo)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/videos/faststart", cfg.handlerStartFastStartBackfill)
+	mux.HandleFunc("GET /admin/videos/faststart", cfg.handlerGetFastStartBackfill)
+	mux.HandleFunc("POST /admin/orphans", cfg.handlerFindOrphanedObjects)
+	mux.HandleFunc("POST /admin/videos/{videoID}/rotate_key", cfg.handlerRotateVideoKey)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: requestIDMiddleware(localeMiddleware(mux)),
 	}
 
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// mediaWaitDelay is how long a killed ffmpeg/ffprobe gets to release its
+// output pipes before Wait gives up on them.
+const mediaWaitDelay = 5 * time.Second
+
+// runMedia runs an ffmpeg or ffprobe command and returns its stdout. The
+// command is bounded by ctx and by cfg.mediaTimeout; when either runs out,
+// its whole process group is killed (so helpers ffmpeg spawned die too) and
+// the context's error is returned.
+func (cfg *apiConfig) runMedia(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if cfg.mediaTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.mediaTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	killProcessGroupOnCancel(cmd)
+	cmd.WaitDelay = mediaWaitDelay
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err := cmd.Run()
+	observeDuration(mediaCommandDuration, start, name, outcome(err))
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("%s stopped: %w", name, ctxErr)
+		}
+		return nil, fmt.Errorf("%s error: %s: %w", name, stderr.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// errProbeTimeout is returned when ffprobe runs past cfg.probeTimeout.
+// Probing reads little of a file, so one that takes that long is taken to be
+// malformed rather than big.
+var errProbeTimeout = errors.New("ffprobe timed out")
+
+// runProbe runs ffprobe like runMedia, but bounded by cfg.probeTimeout, and
+// runs it a second time when the first run failed for a reason other than
+// the file.
+func (cfg *apiConfig) runProbe(ctx context.Context, args ...string) ([]byte, error) {
+	stdout, err := cfg.runProbeOnce(ctx, args...)
+	if err != nil && transientProbeError(ctx, err) {
+		loggerFromContext(ctx).Warn("retrying ffprobe", "error", err)
+		stdout, err = cfg.runProbeOnce(ctx, args...)
+	}
+	return stdout, err
+}
+
+func (cfg *apiConfig) runProbeOnce(ctx context.Context, args ...string) ([]byte, error) {
+	probeCtx := ctx
+	if cfg.probeTimeout > 0 {
+		var cancel context.CancelFunc
+		probeCtx, cancel = context.WithTimeout(ctx, cfg.probeTimeout)
+		defer cancel()
+	}
+	stdout, err := cfg.runMedia(probeCtx, "ffprobe", args...)
+	if err != nil && ctx.Err() == nil && probeCtx.Err() != nil {
+		return nil, fmt.Errorf("%w after %s", errProbeTimeout, cfg.probeTimeout)
+	}
+	return stdout, err
+}
+
+// transientProbeError reports whether ffprobe failed in a way a second run
+// might not: it was killed by a signal, or couldn't be started for a reason
+// other than not being installed. An error exit means it rejected the file,
+// and timeouts and cancellation are final too.
+func transientProbeError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, errProbeTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, exec.ErrNotFound) {
+		return false
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode() == -1
+	}
+	return true
+}
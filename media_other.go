@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroupOnCancel is a no-op where process groups aren't available;
+// cancellation kills just cmd's process.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// installHangingFFmpeg puts an ffmpeg on PATH that never finishes. It
+// starts a child that holds its output open, as a real ffmpeg's helpers can,
+// so returning promptly takes killing the whole process group.
+func installHangingFFmpeg(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake media commands are shell scripts")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\nsleep 60\necho done\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunMediaStopsWhenCancelled(t *testing.T) {
+	installHangingFFmpeg(t)
+	cfg, _ := newTestConfig(t)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     func() (context.Context, context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name: "request cancelled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			wantErr: context.Canceled,
+		},
+		{
+			name:    "timed out",
+			timeout: 100 * time.Millisecond,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.mediaTimeout = tt.timeout
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			start := time.Now()
+			_, err := cfg.runMedia(ctx, "ffmpeg", "-i", "input.mp4", "output.mp4")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("runMedia error = %v, want %v", err, tt.wantErr)
+			}
+			// Well under mediaWaitDelay, so the sleeping child was killed
+			// too rather than waited out
+			if elapsed := time.Since(start); elapsed > mediaWaitDelay/2 {
+				t.Errorf("runMedia took %v to return", elapsed)
+			}
+		})
+	}
+}
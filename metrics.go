@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcome label values. Labels are kept low-cardinality: no user or video
+// IDs.
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	videoUploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_video_uploads_total",
+		Help: "Video uploads handled, by outcome.",
+	}, []string{"outcome"})
+
+	videoUploadBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "tubely_video_upload_bytes",
+		Help: "Size of received video files.",
+		// 1 MiB to 16 GiB
+		Buckets: prometheus.ExponentialBuckets(1<<20, 4, 8),
+	})
+
+	mediaCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_media_command_duration_seconds",
+		Help:    "Duration of ffmpeg and ffprobe runs, by command and outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"command", "outcome"})
+
+	s3UploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_s3_upload_duration_seconds",
+		Help:    "Latency of S3 object uploads, including retries, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"outcome"})
+
+	slowUploadsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tubely_slow_uploads_total",
+		Help: "Video uploads that took longer than SLOW_UPLOAD_THRESHOLD to respond.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		videoUploadsTotal,
+		videoUploadBytes,
+		mediaCommandDuration,
+		s3UploadDuration,
+		slowUploadsTotal,
+	)
+}
+
+// metricsHandler serves the registry in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// observeDuration records the time since start in the histogram for the
+// given labels.
+func observeDuration(h *prometheus.HistogramVec, start time.Time, labels ...string) {
+	h.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ImageModerator decides whether an uploaded image may be published. It
+// returns false and a human-readable reason for images it rejects; an error
+// means the image couldn't be checked.
+type ImageModerator interface {
+	ModerateImage(ctx context.Context, path string) (allowed bool, reason string, err error)
+}
+
+// noopModerator allows every image.
+type noopModerator struct{}
+
+func (noopModerator) ModerateImage(ctx context.Context, path string) (bool, string, error) {
+	return true, "", nil
+}
+
+// moderationTimeout bounds each call to an external moderation API.
+const moderationTimeout = 10 * time.Second
+
+// httpModerator asks an external classification API about each image. The
+// image is POSTed as the request body, and the API responds with JSON like
+// {"allowed": false, "reason": "nudity"}.
+type httpModerator struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPModerator(url string) *httpModerator {
+	return &httpModerator{
+		url:    url,
+		client: &http.Client{Timeout: moderationTimeout},
+	}
+}
+
+func (m *httpModerator) ModerateImage(ctx context.Context, path string) (bool, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(data))
+	if err != nil {
+		return false, "", err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return false, "", fmt.Errorf("moderation API responded %s", resp.Status)
+	}
+
+	var verdict struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return false, "", fmt.Errorf("couldn't decode moderation response: %w", err)
+	}
+	return verdict.Allowed, verdict.Reason, nil
+}
+
+// moderateThumbnail runs the moderator over a thumbnail saved at filePath.
+// A rejected or unchecked thumbnail is deleted and an error response sent.
+// It does nothing when moderation is turned off.
+func (cfg *apiConfig) moderateThumbnail(w http.ResponseWriter, r *http.Request, filePath string) error {
+	if !cfg.moderateThumbnails {
+		return nil
+	}
+
+	done := logStage(r.Context(), "moderation")
+	allowed, reason, err := cfg.imageModerator.ModerateImage(r.Context(), filePath)
+	done(err)
+	if err != nil {
+		os.Remove(filePath)
+		respondWithError(w, http.StatusBadGateway, "Couldn't check image", err)
+		return err
+	}
+	if !allowed {
+		os.Remove(filePath)
+		if reason == "" {
+			reason = "content policy"
+		}
+		msg := translatef(w, "Image rejected: %s", reason)
+		err := fmt.Errorf("image rejected by moderation: %s", reason)
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeImageRejected, msg, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// orphanScanPageSize is how many videos are read at a time while
+	// collecting the objects they use
+	orphanScanPageSize = 500
+	// defaultOrphanLimit and maxOrphanLimit bound how many orphans one
+	// request reports (and deletes)
+	defaultOrphanLimit = 1000
+	maxOrphanLimit     = 10000
+	// defaultOrphanMinAge keeps objects of uploads still in progress, which
+	// are stored before the video is pointed at them, from counting as
+	// orphans
+	defaultOrphanMinAge = 24 * time.Hour
+	// maxDeleteObjectsKeys is how many keys one DeleteObjects call takes
+	maxDeleteObjectsKeys = 1000
+)
+
+type orphanedObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// orphanReport is the response of an orphan scan.
+type orphanReport struct {
+	DryRun bool `json:"dry_run"`
+	// Checked counts the objects listed, old enough to be considered
+	Checked     int              `json:"checked"`
+	Orphans     []orphanedObject `json:"orphans"`
+	OrphanBytes int64            `json:"orphan_bytes"`
+	// Truncated reports that there are more orphans than were listed
+	Truncated bool `json:"truncated"`
+	// UnresolvedURLs counts video URLs that don't map to a key in the
+	// bucket, e.g. because the CloudFront domain changed since. Their
+	// objects may be among the orphans, so nothing is deleted while there
+	// are any.
+	UnresolvedURLs int `json:"unresolved_urls"`
+	Deleted        int `json:"deleted"`
+}
+
+// handlerFindOrphanedObjects lists objects in the bucket that no video
+// points at, such as those left by failed uploads. Objects younger than
+// min_age (24h by default) and files waiting for a processing job are left
+// out. It's a dry run unless dryRun=false, in which case the orphans
+// listed, up to limit of them, are deleted.
+func (cfg *apiConfig) handlerFindOrphanedObjects(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultOrphanLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxOrphanLimit {
+			msg := translatef(w, "limit must be between 1 and %d", maxOrphanLimit)
+			respondWithError(w, http.StatusBadRequest, msg, err)
+			return
+		}
+		limit = n
+	}
+	minAge := defaultOrphanMinAge
+	if value := query.Get("min_age"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid min_age", err)
+			return
+		}
+		minAge = d
+	}
+	dryRun := true
+	if value := query.Get("dryRun"); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid dryRun", err)
+			return
+		}
+	}
+
+	// Videos are read before the bucket is listed, so an object stored
+	// since is only missed if it's younger than minAge
+	cutoff := time.Now().Add(-minAge)
+	refs, err := cfg.referencedObjects()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get videos", err)
+		return
+	}
+	report, err := cfg.findOrphanedObjects(r.Context(), refs, cutoff, limit)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't list objects", err)
+		return
+	}
+	report.DryRun = dryRun
+	if dryRun || len(report.Orphans) == 0 {
+		respondWithJSON(w, http.StatusOK, report)
+		return
+	}
+	if report.UnresolvedURLs > 0 {
+		msg := translatef(w, "%d video URLs don't match the bucket, so orphans can't be deleted safely", report.UnresolvedURLs)
+		respondWithError(w, http.StatusConflict, msg, nil)
+		return
+	}
+
+	deleted, err := cfg.deleteKeys(r.Context(), report.Orphans)
+	report.Deleted = deleted
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't delete orphaned objects", err)
+		return
+	}
+	loggerFromContext(r.Context()).Info("deleted orphaned objects", "count", deleted, "bytes", report.OrphanBytes)
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// objectRefs are the objects videos point at.
+type objectRefs struct {
+	keys map[string]bool
+	// hlsDirs are the prefixes of HLS packages, whose segments aren't
+	// recorded one by one
+	hlsDirs map[string]bool
+	// unresolved counts URLs that couldn't be mapped to a key
+	unresolved int
+}
+
+// referencedObjects collects the objects of every video: its files as
+// videoObjectURLs lists them, and its captions.
+func (cfg *apiConfig) referencedObjects() (objectRefs, error) {
+	refs := objectRefs{keys: map[string]bool{}, hlsDirs: map[string]bool{}}
+	after := uuid.Nil
+	for {
+		videos, err := cfg.db.GetVideosAfter(after, orphanScanPageSize)
+		if err != nil {
+			return objectRefs{}, err
+		}
+		if len(videos) == 0 {
+			return refs, nil
+		}
+		after = videos[len(videos)-1].ID
+
+		for _, video := range videos {
+			urls := append(videoObjectURLs(video), slices.Collect(maps.Values(video.Captions))...)
+			for _, objectURL := range urls {
+				key, err := cfg.s3KeyFromURL(objectURL)
+				if err != nil {
+					refs.unresolved++
+					continue
+				}
+				refs.keys[key] = true
+				if path.Base(key) == hlsPlaylistName {
+					refs.hlsDirs[path.Dir(key)+"/"] = true
+				}
+			}
+		}
+	}
+}
+
+// findOrphanedObjects lists the bucket for objects last modified before
+// cutoff that refs doesn't include, reporting up to limit of them.
+func (cfg *apiConfig) findOrphanedObjects(ctx context.Context, refs objectRefs, cutoff time.Time, limit int) (orphanReport, error) {
+	report := orphanReport{
+		Orphans:        []orphanedObject{},
+		UnresolvedURLs: refs.unresolved,
+	}
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &cfg.s3Bucket,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return orphanReport{}, err
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			// Jobs delete their own files once they've run
+			if strings.HasPrefix(key, jobSourcePrefix) || aws.ToTime(obj.LastModified).After(cutoff) {
+				continue
+			}
+			report.Checked++
+			if refs.keys[key] || refs.hlsDirs[path.Dir(key)+"/"] {
+				continue
+			}
+			if len(report.Orphans) == limit {
+				report.Truncated = true
+				continue
+			}
+			report.Orphans = append(report.Orphans, orphanedObject{
+				Key:          key,
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+			report.OrphanBytes += aws.ToInt64(obj.Size)
+		}
+	}
+	return report, nil
+}
+
+// deleteKeys deletes objects in batches, returning how many were deleted
+// before any error.
+func (cfg *apiConfig) deleteKeys(ctx context.Context, objects []orphanedObject) (int, error) {
+	deleted := 0
+	for batch := range slices.Chunk(objects, maxDeleteObjectsKeys) {
+		ids := make([]types.ObjectIdentifier, 0, len(batch))
+		for _, obj := range batch {
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(obj.Key)})
+		}
+		out, err := cfg.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &cfg.s3Bucket,
+			Delete: &types.Delete{Objects: ids},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += len(out.Deleted)
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return deleted, fmt.Errorf("couldn't delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newOrphanTestConfig returns a test config whose bucket holds two videos'
+// files, one of them HLS, a job's file, and the orphans stored.
+func newOrphanTestConfig(t *testing.T, orphans ...string) (*apiConfig, *mockS3) {
+	t.Helper()
+	cfg, mock := newTestConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	plain := createTestVideo(t, cfg, userID)
+	storeTestVideoFile(t, cfg, mock, &plain, "landscape/plain.mp4", testMP4(16))
+	hls := createTestVideo(t, cfg, userID)
+	storeTestVideoFile(t, cfg, mock, &hls, "landscape/hls/"+hlsPlaylistName, []byte("#EXTM3U\n"))
+	mock.Put("landscape/hls/segment0.ts", []byte("segment"), "video/mp2t")
+	mock.Put(jobSourcePrefix+plain.ID.String()+"/queued.mp4", testMP4(16), "video/mp4")
+	for _, key := range orphans {
+		mock.Put(key, []byte("orphan"), "video/mp4")
+	}
+	return cfg, mock
+}
+
+func findOrphans(t *testing.T, cfg *apiConfig, query string) orphanReport {
+	t.Helper()
+	w := httptest.NewRecorder()
+	cfg.handlerFindOrphanedObjects(w, newAdminRequest(http.MethodPost, "/admin/orphans?"+query))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusOK, w.Body)
+	}
+	var report orphanReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func orphanKeys(report orphanReport) []string {
+	var keys []string
+	for _, obj := range report.Orphans {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+func TestFindOrphanedObjectsDryRun(t *testing.T) {
+	cfg, mock := newOrphanTestConfig(t, "landscape/failed.mp4", "portrait/failed.mp4")
+	// Small pages make the scan follow continuation tokens
+	mock.listPageSize = 2
+
+	report := findOrphans(t, cfg, "min_age=0")
+	wantOrphans := []string{"landscape/failed.mp4", "portrait/failed.mp4"}
+	if keys := orphanKeys(report); !slices.Equal(keys, wantOrphans) {
+		t.Errorf("orphans = %q, want %q", keys, wantOrphans)
+	}
+	// Every object but the job's file
+	if report.Checked != 5 {
+		t.Errorf("checked = %d, want 5", report.Checked)
+	}
+	if !report.DryRun || report.Deleted != 0 {
+		t.Errorf("dry_run = %v, deleted = %d, want a dry run", report.DryRun, report.Deleted)
+	}
+	if lists := mock.CallsTo("ListObjectsV2"); len(lists) != 3 {
+		t.Errorf("ListObjectsV2 calls = %d, want 3 pages", len(lists))
+	}
+	for _, call := range mock.Calls() {
+		if strings.HasPrefix(call, "Delete") {
+			t.Errorf("dry run called %s", call)
+		}
+	}
+}
+
+func TestFindOrphanedObjectsDeletes(t *testing.T) {
+	cfg, mock := newOrphanTestConfig(t, "landscape/failed.mp4", "portrait/failed.mp4")
+	before := mock.Keys()
+
+	report := findOrphans(t, cfg, "min_age=0&dryRun=false")
+	if report.DryRun || report.Deleted != 2 {
+		t.Errorf("dry_run = %v, deleted = %d, want 2 deleted", report.DryRun, report.Deleted)
+	}
+	// The bucket is listed in full before anything is deleted
+	wantCalls := []string{
+		"ListObjectsV2 ",
+		"DeleteObjects landscape/failed.mp4",
+		"DeleteObjects portrait/failed.mp4",
+	}
+	if calls := mock.Calls(); !slices.Equal(calls, wantCalls) {
+		t.Errorf("calls = %q, want %q", calls, wantCalls)
+	}
+	wantKeys := slices.DeleteFunc(before, func(key string) bool { return strings.HasSuffix(key, "/failed.mp4") })
+	if keys := mock.Keys(); !slices.Equal(keys, wantKeys) {
+		t.Errorf("bucket holds %q, want %q", keys, wantKeys)
+	}
+}
+
+func TestFindOrphanedObjectsMinAgeAndLimit(t *testing.T) {
+	cfg, _ := newOrphanTestConfig(t, "landscape/a.mp4", "landscape/b.mp4", "landscape/c.mp4")
+
+	// Objects stored just now may belong to uploads still in progress
+	if report := findOrphans(t, cfg, ""); report.Checked != 0 || len(report.Orphans) != 0 {
+		t.Errorf("default min_age: checked %d, found %q, want nothing", report.Checked, orphanKeys(report))
+	}
+
+	report := findOrphans(t, cfg, "min_age=0&limit=2")
+	if keys := orphanKeys(report); !slices.Equal(keys, []string{"landscape/a.mp4", "landscape/b.mp4"}) {
+		t.Errorf("orphans = %q, want the first 2", keys)
+	}
+	if !report.Truncated {
+		t.Error("report isn't truncated with more orphans than the limit")
+	}
+}
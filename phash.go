@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// pHash parameters: frames are reduced to a phashSize x phashSize grayscale
+// image, and the hash is built from the lowest phashBits x phashBits DCT
+// frequencies, which survive re-encoding and rescaling.
+const (
+	phashSize = 32
+	phashBits = 8
+)
+
+// computePerceptualHash samples a representative frame from the video at
+// filePath and returns its DCT-based perceptual hash. Near-identical content
+// (e.g. the same clip at a different bitrate) produces hashes with a small
+// Hamming distance.
+func (cfg *apiConfig) computePerceptualHash(ctx context.Context, filePath string) (uint64, error) {
+	pixels, err := cfg.runMedia(ctx, "ffmpeg",
+		"-i", filePath,
+		"-vf", fmt.Sprintf("thumbnail,scale=%d:%d:flags=area,format=gray", phashSize, phashSize),
+		"-frames:v", "1",
+		"-f", "rawvideo",
+		"pipe:1",
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(pixels) != phashSize*phashSize {
+		return 0, fmt.Errorf("unexpected frame size: got %d bytes, want %d", len(pixels), phashSize*phashSize)
+	}
+	return perceptualHash(pixels), nil
+}
+
+// perceptualHash hashes a phashSize x phashSize grayscale image. Each bit
+// records whether a low-frequency DCT coefficient is above the median.
+func perceptualHash(pixels []byte) uint64 {
+	const n = phashSize
+
+	// Separable 2D DCT-II: transform rows, then columns.
+	rows := make([][]float64, n)
+	for y := 0; y < n; y++ {
+		row := make([]float64, n)
+		for x := 0; x < n; x++ {
+			row[x] = float64(pixels[y*n+x])
+		}
+		rows[y] = dct1D(row)
+	}
+	coeffs := make([][]float64, n)
+	for y := range coeffs {
+		coeffs[y] = make([]float64, n)
+	}
+	for x := 0; x < n; x++ {
+		col := make([]float64, n)
+		for y := 0; y < n; y++ {
+			col[y] = rows[y][x]
+		}
+		transformed := dct1D(col)
+		for y := 0; y < n; y++ {
+			coeffs[y][x] = transformed[y]
+		}
+	}
+
+	lowFreq := make([]float64, 0, phashBits*phashBits)
+	for y := 0; y < phashBits; y++ {
+		for x := 0; x < phashBits; x++ {
+			lowFreq = append(lowFreq, coeffs[y][x])
+		}
+	}
+
+	// The DC term only reflects average brightness, so it's left out of the
+	// median.
+	sorted := append([]float64(nil), lowFreq[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, c := range lowFreq {
+		if i > 0 && c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+func dct1D(in []float64) []float64 {
+	n := len(in)
+	out := make([]float64, n)
+	for k := 0; k < n; k++ {
+		var sum float64
+		for i, v := range in {
+			sum += v * math.Cos(math.Pi/float64(n)*(float64(i)+0.5)*float64(k))
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parsePerceptualHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// The stages of the upload pipeline, in their default order
+const (
+	stageWatermark   = "watermark"
+	stageFastStart   = "faststart"
+	stageFingerprint = "fingerprint"
+	stageStore       = "store"
+	stageRenditions  = "renditions"
+	stageAudio       = "audio"
+	stagePreview     = "preview"
+)
+
+// defaultUploadPipeline is the order stages run in unless UPLOAD_PIPELINE
+// says otherwise.
+var defaultUploadPipeline = []string{
+	stageWatermark, stageFastStart, stageFingerprint, stageStore,
+	stageRenditions, stageAudio, stagePreview,
+}
+
+// uploadStage is a step of the upload pipeline. Like the handlers' other
+// helpers, a stage responds itself when it fails, and returns the error.
+type uploadStage struct {
+	name string
+	run  func(cfg *apiConfig, ctx context.Context, s *pipelineState) error
+}
+
+// uploadStageFuncs are the stages by name.
+var uploadStageFuncs = map[string]func(*apiConfig, context.Context, *pipelineState) error{
+	stageWatermark:   (*apiConfig).watermarkStage,
+	stageFastStart:   (*apiConfig).fastStartStage,
+	stageFingerprint: (*apiConfig).fingerprintStage,
+	stageStore:       (*apiConfig).storeStage,
+	stageRenditions:  (*apiConfig).renditionsStage,
+	stageAudio:       (*apiConfig).audioStage,
+	stagePreview:     (*apiConfig).previewStage,
+}
+
+// pipelineState is what the stages of one upload share. Stages that change
+// the file move filePath along, and the rest work on it as they find it.
+type pipelineState struct {
+	w        http.ResponseWriter
+	video    *database.Video
+	userID   uuid.UUID
+	uploadID string
+	meta     VideoMeta
+
+	// The upload's options
+	format            string
+	watermark         bool
+	watermarkPosition string
+	renditionHeights  []int
+	extractAudio      bool
+	audioCodec        string
+	animatedPreview   bool
+	previewStart      float64
+	previewDuration   float64
+
+	// filePath is the video as processed so far, codec its codec and
+	// container and contentType what it's stored as
+	filePath    string
+	codec       string
+	container   videoContainer
+	contentType string
+	// prefix is the key prefix: the override, or, once known, the one
+	// for the aspect ratio
+	prefix string
+	// prefixedKey is the stored video's key, which the keys of the assets
+	// derived from it are based on, and objectKey the one VideoURL points
+	// at
+	prefixedKey string
+	objectKey   string
+
+	// cleanup removes what the stages left behind
+	cleanup []func()
+}
+
+// removeLater removes path once the upload is done.
+func (s *pipelineState) removeLater(path string) {
+	s.cleanup = append(s.cleanup, func() { os.Remove(path) })
+}
+
+// parseUploadPipeline builds the pipeline from a comma-separated order of
+// stage names, such as UPLOAD_PIPELINE's, without those in skip. An empty
+// order is the default one. Stages that change the file have to run before
+// it's stored, and those deriving assets from it after, since their keys are
+// based on its.
+func parseUploadPipeline(order, skip string) ([]uploadStage, error) {
+	names := defaultUploadPipeline
+	if strings.TrimSpace(order) != "" {
+		names = splitStageNames(order)
+	}
+	skipped := splitStageNames(skip)
+	for _, name := range skipped {
+		if _, ok := uploadStageFuncs[name]; !ok {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+	}
+	if slices.Contains(skipped, stageStore) {
+		return nil, fmt.Errorf("the %s stage can't be skipped", stageStore)
+	}
+
+	var stages []uploadStage
+	seen := map[string]bool{}
+	for _, name := range names {
+		run, ok := uploadStageFuncs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("stage %q listed twice", name)
+		}
+		seen[name] = true
+		if slices.Contains(skipped, name) {
+			continue
+		}
+		stages = append(stages, uploadStage{name: name, run: run})
+	}
+
+	position := func(name string) int {
+		return uploadStageIndex(stages, name)
+	}
+	store := position(stageStore)
+	if store < 0 {
+		return nil, fmt.Errorf("the %s stage is required", stageStore)
+	}
+	for _, name := range []string{stageWatermark, stageFastStart} {
+		if i := position(name); i > store {
+			return nil, fmt.Errorf("the %s stage must run before %s", name, stageStore)
+		}
+	}
+	for _, name := range []string{stageRenditions, stageAudio, stagePreview} {
+		if i := position(name); i >= 0 && i < store {
+			return nil, fmt.Errorf("the %s stage must run after %s", name, stageStore)
+		}
+	}
+	return stages, nil
+}
+
+// uploadStageIndex returns where the stage is in stages, or -1 if it's not
+// there.
+func uploadStageIndex(stages []uploadStage, name string) int {
+	return slices.IndexFunc(stages, func(stage uploadStage) bool { return stage.name == name })
+}
+
+func splitStageNames(value string) []string {
+	var names []string
+	for _, field := range strings.Split(value, ",") {
+		if name := strings.TrimSpace(field); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// hasUploadStage reports whether the pipeline includes the stage.
+func (cfg *apiConfig) hasUploadStage(name string) bool {
+	return uploadStageIndex(cfg.uploadPipeline, name) >= 0
+}
+
+// runUploadPipeline runs the pipeline's stages in order, stopping at the
+// first that fails. The stage has responded by then; the error returned
+// names it.
+func (cfg *apiConfig) runUploadPipeline(ctx context.Context, s *pipelineState) error {
+	for _, stage := range cfg.uploadPipeline {
+		if err := stage.run(cfg, ctx, s); err != nil {
+			return fmt.Errorf("%s stage: %w", stage.name, err)
+		}
+	}
+	return nil
+}
+
+// watermarkStage burns the watermark into videos uploaded with one.
+func (cfg *apiConfig) watermarkStage(ctx context.Context, s *pipelineState) error {
+	if !s.watermark {
+		return nil
+	}
+	path, err := cfg.watermarkVideo(ctx, s.filePath, cfg.watermarkPath, s.watermarkPosition, s.meta.Width)
+	if err != nil {
+		respondWithErrorCode(s.w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't watermark video", err)
+		return err
+	}
+	s.removeLater(path)
+	s.filePath = path
+	s.codec = cfg.watermarkEncoder().probeName
+	s.video.Codec = &s.codec
+	return nil
+}
+
+// fastStartStage remuxes the video with its index up front, re-encoding it
+// if need be, and gets the aspect ratio for the key prefix.
+func (cfg *apiConfig) fastStartStage(ctx context.Context, s *pipelineState) error {
+	processedPath, container, prefix, err := cfg.prepareVideo(ctx, s.filePath, s.codec, s.prefix)
+	if errors.Is(err, errProbeTimeout) {
+		respondWithErrorCode(s.w, http.StatusUnprocessableEntity, errCodeInvalidVideo, "Timed out reading video metadata", err)
+		return err
+	}
+	if err != nil {
+		respondWithErrorCode(s.w, http.StatusInternalServerError, errCodeProcessingFailed, "Failed to process video", err)
+		return err
+	}
+	s.removeLater(processedPath)
+	s.filePath = processedPath
+	s.container = container
+	s.prefix = prefix
+	// The object is served as what processing made of it, whatever the
+	// client said it uploaded
+	s.contentType = container.contentType
+
+	// ffmpeg can quietly leave the index at the end, e.g. when it can't
+	// reserve space for it up front, so check the remux did its job
+	fastStart, err := mp4FastStart(processedPath)
+	if err != nil {
+		loggerFromContext(ctx).Warn("couldn't check fast start", "video_id", s.video.ID, "error", err)
+	} else {
+		s.video.FastStart = &fastStart
+		if !fastStart {
+			loggerFromContext(ctx).Warn("fast start remux left the moov atom after the media", "video_id", s.video.ID)
+		}
+	}
+	return nil
+}
+
+// fingerprintStage computes the video's perceptual hash so near-duplicates
+// can be found later. This is best-effort: a video without a hash just
+// won't show up as similar.
+func (cfg *apiConfig) fingerprintStage(ctx context.Context, s *pipelineState) error {
+	hash, err := cfg.computePerceptualHash(ctx, s.filePath)
+	if err != nil {
+		loggerFromContext(ctx).Warn("couldn't compute perceptual hash", "video_id", s.video.ID, "error", err)
+		return nil
+	}
+	phash := formatPerceptualHash(hash)
+	s.video.PerceptualHash = &phash
+	return nil
+}
+
+// storeStage uploads the video, as an MP4 or an HLS package, unless
+// deduplication finds it's already stored.
+func (cfg *apiConfig) storeStage(ctx context.Context, s *pipelineState) error {
+	// Without fast start processing, the video is stored as it was received
+	if s.prefix == "" {
+		s.prefix = cfg.aspectPrefixFor(s.meta.Width, s.meta.Height)
+	}
+
+	// Record the uploaded object's hash so the integrity sweep can detect
+	// corruption later. HLS packages aren't a single object, so they're
+	// not swept.
+	contentHash, err := hashFile(s.filePath)
+	if err != nil {
+		respondWithError(s.w, http.StatusInternalServerError, "Couldn't hash video", err)
+		return err
+	}
+	s.video.ContentSHA256 = &contentHash
+	if s.format == videoFormatHLS {
+		s.video.ContentSHA256 = nil
+	}
+
+	// Open processed file
+	processedFile, err := os.Open(s.filePath)
+	if err != nil {
+		respondWithError(s.w, http.StatusInternalServerError, "Couldn't open processed video", err)
+		return err
+	}
+	defer processedFile.Close()
+	processedSize, _ := readerSize(processedFile)
+	if err := cfg.checkStorageQuota(s.w, *s.video, processedSize); err != nil {
+		return err
+	}
+	s.video.StorageBytes = &processedSize
+
+	// Generate S3 key: the content hash when deduplicating, so identical
+	// uploads share one object, otherwise a random filename
+	var key string
+	if cfg.dedupe {
+		key = contentAddressedKey(contentHash, s.container.ext)
+	} else {
+		key, err = cfg.generateS3Key(s.container.ext)
+		if err != nil {
+			respondWithError(s.w, http.StatusInternalServerError, "Couldn't generate key", err)
+			return err
+		}
+	}
+
+	// pseudo file path. With per-user keys, deduplication only matches the
+	// user's own uploads.
+	s.prefixedKey, err = cfg.videoKey(s.userID, s.prefix, key)
+	if err != nil {
+		respondWithError(s.w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return err
+	}
+
+	// The key VideoURL points at: the MP4 itself, or the HLS playlist
+	s.objectKey = s.prefixedKey
+	if s.format == videoFormatHLS {
+		s.objectKey = hlsPlaylistKey(s.prefixedKey)
+	}
+
+	// Skip the upload when an identical video is already stored
+	exists := false
+	if cfg.dedupe {
+		exists, err = cfg.objectExists(ctx, s.objectKey)
+		if err != nil {
+			respondWithErrorCode(s.w, http.StatusInternalServerError, errCodeStorageError, "Couldn't check for an existing video", err)
+			return err
+		}
+	}
+
+	// Upload to S3 with prefixed key
+	onProgress := func(fraction float64) {
+		cfg.uploadProgress.update(s.uploadID, stageUploading, 50+fraction*50)
+	}
+	if exists {
+		loggerFromContext(ctx).Info("video matches stored object, skipping upload", "video_id", s.video.ID, "key", s.objectKey)
+		cfg.uploadProgress.update(s.uploadID, stageUploading, 100)
+		return nil
+	}
+	if s.format == videoFormatHLS {
+		_, segmentDir, err := cfg.packageHLS(ctx, s.filePath, cfg.hlsSegmentSeconds)
+		if err != nil {
+			respondWithErrorCode(s.w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't package HLS", err)
+			return err
+		}
+		defer os.RemoveAll(segmentDir)
+		return cfg.uploadHLS(ctx, s.w, segmentDir, s.prefixedKey, s.userID, onProgress)
+	}
+	body := newProgressReader(processedFile, processedSize, onProgress)
+	return cfg.uploadToS3(ctx, s.w, body, s.prefixedKey, s.contentType, s.userID)
+}
+
+// renditionsStage transcodes and uploads the requested renditions alongside
+// the video.
+func (cfg *apiConfig) renditionsStage(ctx context.Context, s *pipelineState) error {
+	if len(s.renditionHeights) == 0 {
+		return nil
+	}
+	renditionPaths, err := cfg.transcodeRenditions(ctx, s.filePath, s.renditionHeights)
+	if err != nil {
+		respondWithErrorCode(s.w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't transcode renditions", err)
+		return err
+	}
+	for _, p := range renditionPaths {
+		s.removeLater(p)
+	}
+
+	renditions, err := cfg.uploadRenditions(ctx, s.w, renditionPaths, s.prefixedKey, s.contentType, s.userID)
+	if err != nil {
+		return err
+	}
+	s.video.Renditions = renditions
+	return nil
+}
+
+// audioStage extracts and uploads the audio-only copy, when one was asked
+// for.
+func (cfg *apiConfig) audioStage(ctx context.Context, s *pipelineState) error {
+	if !s.extractAudio {
+		return nil
+	}
+	audioPath, err := cfg.extractAudio(ctx, s.filePath, s.audioCodec)
+	if err != nil {
+		respondWithErrorCode(s.w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't extract audio", err)
+		return err
+	}
+	s.removeLater(audioPath)
+
+	audioFile, err := os.Open(audioPath)
+	if err != nil {
+		respondWithError(s.w, http.StatusInternalServerError, "Couldn't open audio", err)
+		return err
+	}
+	defer audioFile.Close()
+
+	key := audioKey(s.prefixedKey, s.audioCodec)
+	if err := cfg.uploadToS3(ctx, s.w, audioFile, key, audioFormats[s.audioCodec].contentType, s.userID); err != nil {
+		return err
+	}
+	audioURL := cfg.objectURL(key)
+	s.video.AudioURL = &audioURL
+	return nil
+}
+
+// previewStage renders and uploads the animated preview, when one was asked
+// for.
+func (cfg *apiConfig) previewStage(ctx context.Context, s *pipelineState) error {
+	if !s.animatedPreview {
+		return nil
+	}
+	previewPath, err := cfg.generateAnimatedPreview(ctx, s.filePath, s.previewStart, s.previewDuration, previewFPS)
+	if err != nil {
+		respondWithErrorCode(s.w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't generate preview", err)
+		return err
+	}
+	s.removeLater(previewPath)
+
+	previewFile, err := os.Open(previewPath)
+	if err != nil {
+		respondWithError(s.w, http.StatusInternalServerError, "Couldn't open preview", err)
+		return err
+	}
+	defer previewFile.Close()
+
+	key := previewKey(s.prefixedKey)
+	if err := cfg.uploadToS3(ctx, s.w, previewFile, key, "image/gif", s.userID); err != nil {
+		return err
+	}
+	previewURL := cfg.objectURL(key)
+	s.video.PreviewURL = &previewURL
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestStoreStageDeduplicates(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	cfg.dedupe = true
+	userID, token := createTestUser(t, cfg)
+	data := testMP4(4096)
+
+	var videos []database.Video
+	for range 2 {
+		video := createTestVideo(t, cfg, userID)
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, data, nil))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("upload: status = %d, want %d (body %s)", w.Code, http.StatusCreated, w.Body)
+		}
+		video, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		videos = append(videos, video)
+	}
+
+	if videos[0].VideoURL == nil || videos[1].VideoURL == nil || *videos[0].VideoURL != *videos[1].VideoURL {
+		t.Fatalf("video URLs = %v and %v, want the same object", videos[0].VideoURL, videos[1].VideoURL)
+	}
+	key, err := cfg.s3KeyFromURL(*videos[0].VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var puts int
+	for _, call := range mock.CallsTo("PutObject") {
+		if call == "PutObject "+key {
+			puts++
+		}
+	}
+	if puts != 1 {
+		t.Errorf("%s was uploaded %d times, want once (calls %q)", key, puts, mock.Calls())
+	}
+	if heads := mock.CallsTo("HeadObject"); len(heads) != 2 {
+		t.Errorf("HeadObject calls = %q, want one per upload", heads)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Animated preview defaults and limits. Previews are previewWidth pixels
+// wide, with the height following the video's aspect ratio.
+const (
+	defaultPreviewDurationSeconds = 3
+	maxPreviewDurationSeconds     = 10
+	previewFPS                    = 10
+	previewWidth                  = 320
+)
+
+// previewKey returns the S3 key for the animated preview of the video stored
+// at videoKey, e.g. landscape/abc.mp4 -> landscape/abc/preview.gif.
+func previewKey(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/preview.gif"
+}
+
+// parsePreviewSeconds parses an optional preview_start or preview_duration
+// form value, returning def when it's empty.
+func parsePreviewSeconds(value string, def float64) (float64, error) {
+	if value == "" {
+		return def, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, fmt.Errorf("invalid seconds %q", value)
+	}
+	return seconds, nil
+}
+
+// generateAnimatedPreview renders durSec seconds of the video at filePath,
+// from startSec on, as a looping GIF at fps frames a second and returns its
+// path. A palette is generated from the clip first, so the GIF's 256 colours
+// are the ones the clip actually uses. The caller removes the file.
+func (cfg *apiConfig) generateAnimatedPreview(ctx context.Context, filePath string, startSec, durSec float64, fps int) (string, error) {
+	done := logStage(ctx, "animated_preview", "start", startSec, "duration", durSec)
+	outputPath := filePath + ".preview.gif"
+	_, err := cfg.runMedia(ctx, "ffmpeg",
+		"-ss", strconv.FormatFloat(startSec, 'f', 3, 64),
+		"-t", strconv.FormatFloat(durSec, 'f', 3, 64),
+		"-i", filePath,
+		"-filter_complex", fmt.Sprintf("fps=%d,scale=%d:-2:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse", fps, previewWidth),
+		"-loop", "0",
+		"-an",
+		outputPath,
+	)
+	done(err)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
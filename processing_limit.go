@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// processingLimiter bounds how much ffmpeg work runs at once. Each job
+// weighs as many units as the transcodes it runs, so a video with renditions
+// counts for more than a plain upload.
+type processingLimiter struct {
+	sem      *semaphore.Weighted
+	capacity int64
+	// wait is how long a job queues for capacity before it's turned away
+	wait time.Duration
+}
+
+func newProcessingLimiter(capacity int64, wait time.Duration) *processingLimiter {
+	return &processingLimiter{
+		sem:      semaphore.NewWeighted(capacity),
+		capacity: capacity,
+		wait:     wait,
+	}
+}
+
+// acquireProcessingSlot reserves weight units of processing capacity for
+// the request, waiting up to the limiter's wait. When none frees up in time
+// it responds 503 with Retry-After and returns false. Otherwise the caller
+// must call release once its processing is done. Background jobs have no
+// client to turn away, so they wait as long as it takes.
+func (cfg *apiConfig) acquireProcessingSlot(w http.ResponseWriter, r *http.Request, weight int64) (release func(), ok bool) {
+	l := cfg.processingLimiter
+	// A job heavier than the whole limiter would never get in
+	weight = min(max(weight, 1), l.capacity)
+
+	ctx, cancel := context.WithTimeout(r.Context(), l.wait)
+	defer cancel()
+	if _, ok := jobUser(r.Context()); ok {
+		ctx = r.Context()
+	}
+	if err := l.sem.Acquire(ctx, weight); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(l.wait, time.Second).Seconds()))))
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeServerBusy, "Server is busy processing other videos, try again later", err)
+		return nil, false
+	}
+	return func() { l.sem.Release(weight) }, true
+}
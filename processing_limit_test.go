@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUploadVideoServerBusy(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, mock := newTestConfig(t)
+	cfg.processingLimiter = newProcessingLimiter(2, 10*time.Millisecond)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	// Other uploads hold all of the capacity
+	if err := cfg.processingLimiter.sem.Acquire(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	if got := responseErrorCode(t, w); got != errCodeServerBusy {
+		t.Errorf("code = %q, want %q", got, errCodeServerBusy)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if puts := mock.CallsTo("PutObject"); len(puts) != 0 {
+		t.Errorf("PutObject calls = %q, want none", puts)
+	}
+
+	// Once they finish, the retry gets in
+	cfg.processingLimiter.sem.Release(2)
+	w = httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("retry: status = %d, want %d (body %s)", w.Code, http.StatusCreated, w.Body)
+	}
+}
+
+func TestAcquireProcessingSlotCapsWeight(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.processingLimiter = newProcessingLimiter(2, 10*time.Millisecond)
+
+	// A job weighing more than the capacity still runs, alone
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/x", nil)
+	release, ok := cfg.acquireProcessingSlot(httptest.NewRecorder(), r, 5)
+	if !ok {
+		t.Fatal("heavy job was turned away from an idle limiter")
+	}
+	w := httptest.NewRecorder()
+	if _, ok := cfg.acquireProcessingSlot(w, r, 1); ok {
+		t.Fatal("second job got in while the heavy one held all the capacity")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	release()
+	if release, ok := cfg.acquireProcessingSlot(httptest.NewRecorder(), r, 2); !ok {
+		t.Error("job was turned away after the heavy one released its capacity")
+	} else {
+		release()
+	}
+}
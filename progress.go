@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// abandonedUploadAge is how long an unfinished upload can go without a
+// progress update before it's assumed to be abandoned.
+const abandonedUploadAge = time.Hour
+
+// Upload stages reported to progress subscribers. Saving covers the first
+// half of the progress bar and uploading to S3 the second half.
+const (
+	stageCreated    = "created"
+	stageSaving     = "saving"
+	stageProcessing = "processing"
+	stageUploading  = "uploading"
+	stageComplete   = "complete"
+	stageFailed     = "failed"
+)
+
+type uploadProgress struct {
+	Stage   string  `json:"stage"`
+	Percent float64 `json:"percent"`
+	Done    bool    `json:"done"`
+
+	userID    uuid.UUID
+	updatedAt time.Time
+}
+
+// progressTracker holds the progress of in-flight uploads, keyed by upload ID.
+type progressTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadProgress
+	ttl     time.Duration
+}
+
+func newProgressTracker(ttl time.Duration) *progressTracker {
+	return &progressTracker{
+		uploads: map[string]*uploadProgress{},
+		ttl:     ttl,
+	}
+}
+
+// create registers a new upload for userID and returns its ID.
+func (t *progressTracker) create(userID uuid.UUID) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uploads[id] = &uploadProgress{
+		Stage:     stageCreated,
+		userID:    userID,
+		updatedAt: time.Now(),
+	}
+	return id, nil
+}
+
+// belongsTo reports whether id is a known, unfinished upload owned by userID.
+func (t *progressTracker) belongsTo(id string, userID uuid.UUID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.uploads[id]
+	return ok && !p.Done && p.userID == userID
+}
+
+func (t *progressTracker) get(id string) (uploadProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.uploads[id]
+	if !ok {
+		return uploadProgress{}, false
+	}
+	return *p, true
+}
+
+// update records progress for an upload. Progress never moves backwards, so
+// a retried read doesn't make the bar jump back. An empty id is ignored, which
+// lets callers report unconditionally.
+func (t *progressTracker) update(id, stage string, percent float64) {
+	if id == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.uploads[id]
+	if !ok || p.Done {
+		return
+	}
+	if percent > p.Percent {
+		p.Percent = percent
+	}
+	p.Stage = stage
+	p.updatedAt = time.Now()
+}
+
+func (t *progressTracker) finish(id string, succeeded bool) {
+	if id == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.uploads[id]
+	if !ok {
+		return
+	}
+	p.Done = true
+	p.Stage = stageFailed
+	if succeeded {
+		p.Stage = stageComplete
+		p.Percent = 100
+	}
+	p.updatedAt = time.Now()
+}
+
+// cleanup drops uploads that finished more than ttl ago, and unfinished ones
+// that have stopped reporting progress.
+func (t *progressTracker) cleanup(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, p := range t.uploads {
+		age := now.Sub(p.updatedAt)
+		if (p.Done && age > t.ttl) || age > abandonedUploadAge {
+			delete(t.uploads, id)
+		}
+	}
+}
+
+func (t *progressTracker) runCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.cleanup(now)
+	}
+}
+
+// progressReader counts the bytes read through it and reports the position
+// as a fraction of total. Seeks are passed through (and tracked) when the
+// underlying reader supports them, so S3 uploads can still size and rewind
+// the body.
+type progressReader struct {
+	r          io.Reader
+	total      int64
+	pos        int64
+	onProgress func(fraction float64)
+}
+
+func newProgressReader(r io.Reader, total int64, onProgress func(fraction float64)) *progressReader {
+	return &progressReader{r: r, total: total, onProgress: onProgress}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.pos += int64(n)
+		if p.total > 0 {
+			p.onProgress(min(float64(p.pos)/float64(p.total), 1))
+		}
+	}
+	return n, err
+}
+
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := p.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("progressReader: underlying reader isn't seekable")
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	p.pos = pos
+	return pos, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// checkStorageQuota responds 413 QUOTA_EXCEEDED when storing a video file
+// of size bytes for video would take its owner over cfg.storageQuotaBytes.
+// The bytes of the file the video has now don't count, as the new one
+// replaces it. Two uploads checked at once can both pass: the quota bounds
+// costs rather than being exact.
+//
+// Only the main video files count. Objects derived from them (renditions,
+// audio copies, previews, sprite sheets, HLS segments) aren't known until
+// after the check and are left out, so a user's bucket usage can run past
+// the quota by however much those add.
+func (cfg *apiConfig) checkStorageQuota(w http.ResponseWriter, video database.Video, size int64) error {
+	if cfg.storageQuotaBytes == 0 {
+		return nil
+	}
+	usage, err := cfg.db.GetUserStorageUsage(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage usage", err)
+		return err
+	}
+	if video.StorageBytes != nil {
+		usage -= *video.StorageBytes
+	}
+	if usage+size > cfg.storageQuotaBytes {
+		msg := translatef(w, "Video would exceed your storage quota of %s (%s used)", formatBytes(cfg.storageQuotaBytes), formatBytes(usage))
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeQuotaExceeded, msg, nil)
+		return errors.New("storage quota exceeded")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUploadVideoStorageQuota(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	const quota = 1 << 20
+	tests := []struct {
+		name string
+		// otherBytes is stored in another of the user's videos, and
+		// ownBytes in the file the upload replaces
+		otherBytes, ownBytes int64
+		wantCode             int
+	}{
+		{name: "well under", otherBytes: 0, wantCode: http.StatusCreated},
+		{name: "staying under", otherBytes: quota - 64<<10, wantCode: http.StatusCreated},
+		{name: "crossing", otherBytes: quota - 1000, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "already over", otherBytes: quota + 1, wantCode: http.StatusRequestEntityTooLarge},
+		// The replaced file's bytes are freed by the upload, so it fits
+		// though the user is at the quota
+		{name: "replacing a file", otherBytes: quota - 64<<10, ownBytes: 64 << 10, wantCode: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.storageQuotaBytes = quota
+			userID, token := createTestUser(t, cfg)
+			other := createTestVideo(t, cfg, userID)
+			other.StorageBytes = &tt.otherBytes
+			if err := cfg.db.UpdateVideo(other); err != nil {
+				t.Fatal(err)
+			}
+			video := createTestVideo(t, cfg, userID)
+			if tt.ownBytes != 0 {
+				storeTestVideoFile(t, cfg, mock, &video, "landscape/old.mp4", testMP4(32<<10))
+				video.StorageBytes = &tt.ownBytes
+				if err := cfg.db.UpdateVideo(video); err != nil {
+					t.Fatal(err)
+				}
+			}
+			keysBefore := len(mock.Keys())
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusRequestEntityTooLarge {
+				return
+			}
+			if code := responseErrorCode(t, w); code != errCodeQuotaExceeded {
+				t.Errorf("error code = %q, want %q", code, errCodeQuotaExceeded)
+			}
+			if keys := mock.Keys(); len(keys) != keysBefore {
+				t.Errorf("stored %q over the quota", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// rateLimiter is a per-user token bucket. Each user can make up to burst
+// requests at once, refilled at perMinute tokens a minute.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[uuid.UUID]*tokenBucket
+	perMinute float64
+	burst     float64
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		buckets:   map[uuid.UUID]*tokenBucket{},
+		perMinute: float64(perMinute),
+		burst:     float64(perMinute),
+	}
+}
+
+// allow takes a token from userID's bucket. When the bucket is empty it
+// returns false and how long until a token is available.
+func (l *rateLimiter) allow(userID uuid.UUID, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[userID]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[userID] = b
+	}
+
+	elapsed := now.Sub(b.updated).Minutes()
+	b.tokens = math.Min(l.burst, b.tokens+elapsed*l.perMinute)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.perMinute * float64(time.Minute))
+	return false, wait
+}
+
+// cleanup drops buckets that have refilled completely, which is the same as
+// not having one.
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for userID, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Minutes()*l.perMinute >= l.burst {
+			delete(l.buckets, userID)
+		}
+	}
+}
+
+func (l *rateLimiter) runCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.cleanup(now)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(6)
+	userID := uuid.New()
+	now := time.Now()
+
+	for i := range 6 {
+		if ok, _ := limiter.allow(userID, now); !ok {
+			t.Fatalf("request %d of the burst was rejected", i+1)
+		}
+	}
+	ok, wait := limiter.allow(userID, now)
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if wait != 10*time.Second {
+		t.Errorf("wait = %v, want 10s for 6 a minute", wait)
+	}
+	// Other users have buckets of their own
+	if ok, _ := limiter.allow(uuid.New(), now); !ok {
+		t.Error("another user's first request was rejected")
+	}
+
+	if ok, _ := limiter.allow(userID, now.Add(10*time.Second)); !ok {
+		t.Error("request after the wait was rejected")
+	}
+
+	// Buckets that refill completely are dropped
+	limiter.cleanup(now.Add(time.Minute))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets after cleanup, want the 1 still refilling", len(limiter.buckets))
+	}
+	limiter.cleanup(now.Add(2 * time.Minute))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("%d buckets after cleanup, want none", len(limiter.buckets))
+	}
+}
+
+func TestUploadVideoRateLimit(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	cfg.uploadLimiter = newRateLimiter(2)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	for i := 1; i <= 3; i++ {
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+		if i <= 2 {
+			if w.Code != http.StatusCreated {
+				t.Fatalf("upload %d: status = %d, want %d (body %s)", i, w.Code, http.StatusCreated, w.Body)
+			}
+			continue
+		}
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("upload %d: status = %d, want %d", i, w.Code, http.StatusTooManyRequests)
+		}
+		if got := responseErrorCode(t, w); got != errCodeRateLimited {
+			t.Errorf("code = %q, want %q", got, errCodeRateLimited)
+		}
+		retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		if err != nil || retryAfter < 1 || retryAfter > 30 {
+			t.Errorf("Retry-After = %q, want up to the 30s a token takes", w.Header().Get("Retry-After"))
+		}
+	}
+}
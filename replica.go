@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxReplicatedKeys bounds the set of keys known to have reached the
+// replica. It's cleared when full, costing a round of HEAD requests.
+const maxReplicatedKeys = 10000
+
+// s3Replica is a copy of the bucket in another region, kept in sync by S3
+// replication, that objects are served from. Uploads and deletes still go
+// to the primary bucket.
+type s3Replica struct {
+	bucket string
+	region string
+	// cfDistribution is the CloudFront distribution in front of the
+	// replica. Without one, replica URLs point at the bucket directly.
+	cfDistribution string
+	client         S3API
+
+	// verify makes objects be HEAD-checked in the replica before they're
+	// served from it. Until replication catches up they're served from the
+	// primary instead.
+	verify bool
+
+	mu         sync.Mutex
+	replicated map[string]struct{}
+}
+
+func newS3Replica(bucket, region, cfDistribution string, client S3API, verify bool) *s3Replica {
+	return &s3Replica{
+		bucket:         bucket,
+		region:         region,
+		cfDistribution: cfDistribution,
+		client:         client,
+		verify:         verify,
+		replicated:     map[string]struct{}{},
+	}
+}
+
+// hasObject reports whether the object at key has been replicated. Without
+// verify it's assumed to have been.
+func (r *s3Replica) hasObject(ctx context.Context, key string) (bool, error) {
+	if !r.verify {
+		return true, nil
+	}
+	r.mu.Lock()
+	_, ok := r.replicated[key]
+	r.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+
+	_, err := r.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &r.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	r.mu.Lock()
+	if len(r.replicated) >= maxReplicatedKeys {
+		clear(r.replicated)
+	}
+	r.replicated[key] = struct{}{}
+	r.mu.Unlock()
+	return true, nil
+}
+
+// objectLocation is where an object is served from: the primary bucket or
+// the replica.
+type objectLocation struct {
+	bucket         string
+	cfDistribution string
+	client         S3API
+	// url is the object's unsigned URL
+	url string
+}
+
+// serveLocation picks where the object at key is served from: the replica
+// when there is one and it has the object, and the primary bucket
+// otherwise. A failed check against the replica is logged and falls back to
+// the primary.
+func (cfg *apiConfig) serveLocation(ctx context.Context, key string) objectLocation {
+	primary := objectLocation{
+		bucket: cfg.s3Bucket,
+		client: cfg.s3Client,
+		url:    cfg.objectURL(key),
+	}
+	// Objects are only served through the distribution in CloudFront mode
+	if cfg.s3URLMode == urlModeCloudFront {
+		primary.cfDistribution = cfg.s3CfDistribution
+	}
+	if cfg.s3Replica == nil {
+		return primary
+	}
+	ok, err := cfg.s3Replica.hasObject(ctx, key)
+	if err != nil {
+		loggerFromContext(ctx).Warn("couldn't check replica for object", "key", key, "error", err)
+	}
+	if !ok {
+		return primary
+	}
+	return objectLocation{
+		bucket:         cfg.s3Replica.bucket,
+		cfDistribution: cfg.s3Replica.cfDistribution,
+		client:         cfg.s3Replica.client,
+		url:            cfg.replicaObjectURL(key),
+	}
+}
+
+// replicaObjectURL is objectURL for the replica: its CloudFront
+// distribution when it has one, then the custom S3 endpoint, and otherwise
+// the bucket's regional S3 URL.
+func (cfg *apiConfig) replicaObjectURL(key string) string {
+	replica := cfg.s3Replica
+	if replica.cfDistribution != "" {
+		return fmt.Sprintf("https://%s/%s", replica.cfDistribution, key)
+	}
+	pathStyle := cfg.s3Endpoint != nil && cfg.s3UsePathStyle
+	return bucketObjectURL(cfg.s3BaseURL(replica.region), replica.bucket, key, pathStyle)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxS3RetryDelay caps the backoff between PutObject attempts.
+const maxS3RetryDelay = 10 * time.Second
+
+// s3Retryables classifies errors the same way the SDK's own retryer does:
+// throttling, 5xx responses and dropped connections are retryable, while
+// client errors such as AccessDenied are not.
+var s3Retryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+
+func isRetryableS3Error(err error) bool {
+	return s3Retryables.IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// putObjectWithRetry sends input to S3, retrying transient failures up to
+// cfg.s3MaxRetries times with exponential backoff and full jitter. The body
+// is rewound between attempts, so bodies that can't seek get a single
+// attempt. It stops as soon as ctx is done.
+func (cfg *apiConfig) putObjectWithRetry(ctx context.Context, input *s3.PutObjectInput) error {
+	seeker, seekable := input.Body.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			seekable = false
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return fmt.Errorf("couldn't rewind body for retry: %w", err)
+			}
+		}
+
+		// The SDK's built-in retries are turned off for this call so the
+		// attempt count and backoff are ours alone.
+		_, err := cfg.s3Client.PutObject(ctx, input, func(o *s3.Options) {
+			o.RetryMaxAttempts = 1
+		})
+		if err == nil {
+			return nil
+		}
+		if !seekable || attempt >= cfg.s3MaxRetries || !isRetryableS3Error(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := s3RetryDelay(cfg.s3RetryBaseDelay, attempt)
+		loggerFromContext(ctx).Warn("retrying PutObject",
+			"key", aws.ToString(input.Key),
+			"attempt", attempt+1,
+			"max_attempts", cfg.s3MaxRetries+1,
+			"delay", delay,
+			"error", err,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// s3RetryDelay returns a random delay of up to base * 2^attempt, capped at
+// maxS3RetryDelay.
+func s3RetryDelay(base time.Duration, attempt int) time.Duration {
+	ceiling := base << attempt
+	if ceiling <= 0 || ceiling > maxS3RetryDelay {
+		ceiling = maxS3RetryDelay
+	}
+	return rand.N(ceiling) + 1
+}
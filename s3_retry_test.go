@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestPutObjectWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "fails twice, then succeeds",
+			failures:  2,
+			err:       s3ResponseError(http.StatusServiceUnavailable, "SlowDown"),
+			wantCalls: 3,
+		},
+		{
+			name:      "out of retries",
+			failures:  5,
+			err:       s3ResponseError(http.StatusInternalServerError, "InternalError"),
+			wantCalls: 4,
+			wantErr:   true,
+		},
+		{
+			name:      "client error isn't retried",
+			failures:  5,
+			err:       s3ResponseError(http.StatusForbidden, "AccessDenied"),
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			cfg.s3MaxRetries = 3
+			attempts := 0
+			mock.putErr = func(key string) error {
+				attempts++
+				if attempts <= tt.failures {
+					return tt.err
+				}
+				return nil
+			}
+
+			data := []byte("a video that takes a few tries")
+			err := cfg.putObjectWithRetry(context.Background(), &s3.PutObjectInput{
+				Bucket: aws.String(cfg.s3Bucket),
+				Key:    aws.String("video.mp4"),
+				Body:   bytes.NewReader(data),
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("putObjectWithRetry error = %v, want error %v", err, tt.wantErr)
+			}
+			if calls := mock.CallsTo("PutObject"); len(calls) != tt.wantCalls {
+				t.Errorf("PutObject calls = %d, want %d", len(calls), tt.wantCalls)
+			}
+			obj, ok := mock.Object("video.mp4")
+			if tt.wantErr {
+				if ok {
+					t.Error("object was stored despite the error")
+				}
+				return
+			}
+			// Each retry rewinds the body, so the whole file is stored
+			if !ok || !bytes.Equal(obj.data, data) {
+				t.Errorf("stored %q, want %q", obj.data, data)
+			}
+		})
+	}
+}
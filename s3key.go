@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errInvalidS3Key is returned by normalizeS3Key for keys that can't be
+// stored.
+var errInvalidS3Key = errors.New("invalid S3 key")
+
+// normalizeS3Key cleans up a key composed from prefixes and names, any of
+// which may be empty or carry their own slashes: it collapses repeated
+// slashes and drops leading and trailing ones, e.g. /landscape//abc.mp4 ->
+// landscape/abc.mp4. Empty keys and keys with a ".." segment are rejected,
+// so a composed key can't climb out of its prefix.
+func normalizeS3Key(key string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			continue
+		}
+		if segment == ".." {
+			return "", fmt.Errorf("%w: %q has a .. segment", errInvalidS3Key, key)
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("%w: %q is empty", errInvalidS3Key, key)
+	}
+	return strings.Join(segments, "/"), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeS3Key(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "landscape/abc.mp4", want: "landscape/abc.mp4"},
+		// An empty prefix leaves a leading slash
+		{key: "/abc.mp4", want: "abc.mp4"},
+		{key: "//landscape//abc.mp4", want: "landscape/abc.mp4"},
+		{key: "user/landscape/", want: "user/landscape"},
+		{key: "user///landscape/abc.mp4", want: "user/landscape/abc.mp4"},
+		{key: "", wantErr: true},
+		{key: "///", wantErr: true},
+		{key: "../abc.mp4", wantErr: true},
+		{key: "landscape/../../abc.mp4", wantErr: true},
+		{key: "landscape//..//abc.mp4", wantErr: true},
+		// Only whole .. segments climb
+		{key: "landscape/..abc.mp4", want: "landscape/..abc.mp4"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeS3Key(tt.key)
+		if tt.wantErr {
+			if !errors.Is(err, errInvalidS3Key) {
+				t.Errorf("normalizeS3Key(%q) = %q, %v, want errInvalidS3Key", tt.key, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeS3Key(%q) = %q, %v, want %q", tt.key, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// mockS3 is an in-memory S3API for a single bucket. It records each call as
+// "Operation key" (or "CopyObject from -> to"), in order, so tests can check
+// what was sent to S3 and when.
+type mockS3 struct {
+	mu      sync.Mutex
+	objects map[string]mockObject
+	uploads map[string]map[int32][]byte
+	calls   []string
+	// inputs holds the latest PutObject or CreateMultipartUpload input for
+	// each key
+	inputs map[string]any
+
+	// putErr, when set, is called with each PutObject key; an error it
+	// returns fails the call.
+	putErr func(key string) error
+	// listPageSize, when set, caps the keys in each ListObjectsV2 page.
+	listPageSize int
+	// onCall, when set, is called with each call as it's recorded, before
+	// the call is carried out. The mock is locked meanwhile, so onCall may
+	// change objects directly but mustn't call the mock's methods.
+	onCall func(call string)
+}
+
+type mockObject struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+var _ S3API = (*mockS3)(nil)
+
+// s3ResponseError returns an error like the SDK's for an S3 response with
+// the given HTTP status and error code, e.g. 503 SlowDown.
+func s3ResponseError(status int, code string) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      &smithy.GenericAPIError{Code: code, Message: http.StatusText(status)},
+		},
+	}
+}
+
+func newMockS3() *mockS3 {
+	return &mockS3{
+		objects: map[string]mockObject{},
+		uploads: map[string]map[int32][]byte{},
+		inputs:  map[string]any{},
+	}
+}
+
+func (m *mockS3) record(call string) {
+	m.calls = append(m.calls, call)
+	if m.onCall != nil {
+		m.onCall(call)
+	}
+}
+
+// Calls returns the calls made so far.
+func (m *mockS3) Calls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.calls)
+}
+
+// CallsTo returns the calls made so far to operation.
+func (m *mockS3) CallsTo(operation string) []string {
+	var calls []string
+	for _, call := range m.Calls() {
+		if strings.HasPrefix(call, operation+" ") {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Put stores an object directly, without recording a call.
+func (m *mockS3) Put(key string, data []byte, contentType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = mockObject{data: data, contentType: contentType, lastModified: time.Now()}
+}
+
+// Object returns the object stored under key.
+func (m *mockS3) Object(key string) (mockObject, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	return obj, ok
+}
+
+// PutInput returns the input of the latest PutObject of key.
+func (m *mockS3) PutInput(key string) (*s3.PutObjectInput, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	input, ok := m.inputs[key].(*s3.PutObjectInput)
+	return input, ok
+}
+
+// MultipartInput returns the input of the latest CreateMultipartUpload of
+// key.
+func (m *mockS3) MultipartInput(key string) (*s3.CreateMultipartUploadInput, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	input, ok := m.inputs[key].(*s3.CreateMultipartUploadInput)
+	return input, ok
+}
+
+// Keys returns the stored keys, sorted.
+func (m *mockS3) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (m *mockS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	key := aws.ToString(params.Key)
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("PutObject " + key)
+	m.inputs[key] = params
+	if m.putErr != nil {
+		if err := m.putErr(key); err != nil {
+			return nil, err
+		}
+	}
+	if params.ContentMD5 != nil {
+		sum := md5.Sum(data)
+		if *params.ContentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return nil, errors.New("BadDigest: the Content-MD5 you specified did not match what we received")
+		}
+	}
+	m.objects[key] = mockObject{data: data, contentType: aws.ToString(params.ContentType), lastModified: time.Now()}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("CreateMultipartUpload " + aws.ToString(params.Key))
+	m.inputs[aws.ToString(params.Key)] = params
+	uploadID := strconv.Itoa(len(m.uploads) + 1)
+	m.uploads[uploadID] = map[int32][]byte{}
+	return &s3.CreateMultipartUploadOutput{UploadId: &uploadID}, nil
+}
+
+func (m *mockS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts, ok := m.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	parts[aws.ToInt32(params.PartNumber)] = data
+	etag := fmt.Sprintf("%q", strconv.Itoa(int(aws.ToInt32(params.PartNumber))))
+	return &s3.UploadPartOutput{ETag: &etag}, nil
+}
+
+func (m *mockS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	key := aws.ToString(params.Key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("CompleteMultipartUpload " + key)
+	parts, ok := m.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	var data []byte
+	for _, part := range params.MultipartUpload.Parts {
+		data = append(data, parts[aws.ToInt32(part.PartNumber)]...)
+	}
+	delete(m.uploads, aws.ToString(params.UploadId))
+	m.objects[key] = mockObject{data: data, lastModified: time.Now()}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("AbortMultipartUpload " + aws.ToString(params.Key))
+	delete(m.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	key := aws.ToString(params.Key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetObject " + key)
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	data := obj.data
+	if r := aws.ToString(params.Range); r != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, fmt.Errorf("unsupported range %q", r)
+		}
+		data = data[min(start, len(data)):min(end+1, len(data))]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String(obj.contentType),
+	}, nil
+}
+
+func (m *mockS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	key := aws.ToString(params.Key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("HeadObject " + key)
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.data))),
+		ContentType:   aws.String(obj.contentType),
+		LastModified:  aws.Time(obj.lastModified),
+	}, nil
+}
+
+func (m *mockS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *mockS3) PutBucketCors(ctx context.Context, params *s3.PutBucketCorsInput, optFns ...func(*s3.Options)) (*s3.PutBucketCorsOutput, error) {
+	return &s3.PutBucketCorsOutput{}, nil
+}
+
+func (m *mockS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("ListObjectsV2 " + aws.ToString(params.Prefix))
+
+	after := aws.ToString(params.StartAfter)
+	if token := aws.ToString(params.ContinuationToken); token != "" {
+		after = token
+	}
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	pageSize := 1000
+	if params.MaxKeys != nil && *params.MaxKeys > 0 {
+		pageSize = int(*params.MaxKeys)
+	}
+	if m.listPageSize > 0 {
+		pageSize = min(pageSize, m.listPageSize)
+	}
+	out := &s3.ListObjectsV2Output{}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		obj := m.objects[key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			LastModified: aws.Time(obj.lastModified),
+		})
+	}
+	out.KeyCount = aws.Int32(int32(len(out.Contents)))
+	return out, nil
+}
+
+func (m *mockS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	key := aws.ToString(params.Key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("DeleteObject " + key)
+	delete(m.objects, key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := &s3.DeleteObjectsOutput{}
+	for _, obj := range params.Delete.Objects {
+		key := aws.ToString(obj.Key)
+		m.record("DeleteObjects " + key)
+		delete(m.objects, key)
+		out.Deleted = append(out.Deleted, types.DeletedObject{Key: obj.Key})
+	}
+	return out, nil
+}
+
+func (m *mockS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	_, from, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	to := aws.ToString(params.Key)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("CopyObject " + from + " -> " + to)
+	obj, ok := m.objects[from]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	obj.lastModified = time.Now()
+	m.objects[to] = obj
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// PresignGetObject returns a URL with a fake signature. Like S3's, it
+// carries a requested Content-Disposition override in its query.
+func (m *mockS3) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	query := url.Values{"X-Amz-Signature": {"mock"}}
+	if params.ResponseContentDisposition != nil {
+		query.Set("response-content-disposition", *params.ResponseContentDisposition)
+	}
+	return &v4.PresignedHTTPRequest{
+		URL:    "https://" + aws.ToString(params.Bucket) + ".s3.amazonaws.com/" + aws.ToString(params.Key) + "?" + query.Encode(),
+		Method: "GET",
+	}, nil
+}
+
+func (m *mockS3) PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	return &v4.PresignedHTTPRequest{
+		URL:    "https://" + aws.ToString(params.Bucket) + ".s3.amazonaws.com/" + aws.ToString(params.Key) + "?X-Amz-Signature=mock",
+		Method: "PUT",
+	}, nil
+}
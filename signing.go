@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// cloudFrontBase64 is the URL-safe base64 variant CloudFront expects in
+// signed URLs and cookies.
+var cloudFrontBase64 = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+// generatePresignedURL presigns a GET of key. A non-empty disposition
+// overrides the Content-Disposition S3 serves the object with.
+func generatePresignedURL(s3Client S3API, bucket, key string, expireTime time.Duration, disposition string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if disposition != "" {
+		input.ResponseContentDisposition = &disposition
+	}
+	req, err := s3Client.PresignGetObject(context.Background(), input, s3.WithPresignExpires(expireTime))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign URL: %w", err)
+	}
+	return req.URL, nil
+}
+
+// cloudFrontPolicy is a CloudFront access policy. Field order matters: a
+// canned policy must match the JSON CloudFront reconstructs byte for byte.
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement `json:"Statement"`
+}
+
+type cloudFrontStatement struct {
+	Resource  string              `json:"Resource"`
+	Condition cloudFrontCondition `json:"Condition"`
+}
+
+type cloudFrontCondition struct {
+	DateLessThan cloudFrontEpochTime `json:"DateLessThan"`
+}
+
+type cloudFrontEpochTime struct {
+	EpochTime int64 `json:"AWS:EpochTime"`
+}
+
+// generateCloudFrontSignedURL signs resource, a distribution URL, with a
+// canned policy that expires after expires.
+func (cfg *apiConfig) generateCloudFrontSignedURL(resource string, expires time.Duration) (string, error) {
+	if cfg.cfPrivateKey == nil || cfg.cfKeyPairID == "" {
+		return "", errors.New("no CloudFront key pair configured")
+	}
+
+	expiresAt := time.Now().Add(expires).Unix()
+
+	policy := cloudFrontPolicy{Statement: []cloudFrontStatement{{
+		Resource: resource,
+		Condition: cloudFrontCondition{
+			DateLessThan: cloudFrontEpochTime{EpochTime: expiresAt},
+		},
+	}}}
+	policyJSON, err := marshalCloudFrontPolicy(policy)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := cfg.signCloudFrontPolicy(policyJSON)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("Expires", strconv.FormatInt(expiresAt, 10))
+	query.Set("Signature", signature)
+	query.Set("Key-Pair-Id", cfg.cfKeyPairID)
+	separator := "?"
+	if strings.Contains(resource, "?") {
+		separator = "&"
+	}
+	return resource + separator + query.Encode(), nil
+}
+
+// generateSignedCookies returns the CloudFront signed cookies, by name,
+// granting access to every object under keyPrefix on the distribution for
+// expires. Unlike signed URLs they need a custom policy, as the resource is
+// a wildcard.
+func (cfg *apiConfig) generateSignedCookies(keyPrefix string, expires time.Duration) (map[string]string, error) {
+	if cfg.cfPrivateKey == nil || cfg.cfKeyPairID == "" {
+		return nil, errors.New("no CloudFront key pair configured")
+	}
+	if cfg.s3URLMode != urlModeCloudFront {
+		return nil, errors.New("objects aren't served through CloudFront")
+	}
+
+	policy := cloudFrontPolicy{Statement: []cloudFrontStatement{{
+		Resource: cfg.objectURL(keyPrefix) + "*",
+		Condition: cloudFrontCondition{
+			DateLessThan: cloudFrontEpochTime{EpochTime: time.Now().Add(expires).Unix()},
+		},
+	}}}
+	policyJSON, err := marshalCloudFrontPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := cfg.signCloudFrontPolicy(policyJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"CloudFront-Policy":      cloudFrontBase64.Replace(base64.StdEncoding.EncodeToString(policyJSON)),
+		"CloudFront-Signature":   signature,
+		"CloudFront-Key-Pair-Id": cfg.cfKeyPairID,
+	}, nil
+}
+
+// marshalCloudFrontPolicy encodes policy without escaping HTML characters
+// such as &, which CloudFront would otherwise see as a different resource.
+func marshalCloudFrontPolicy(policy cloudFrontPolicy) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(policy); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// signCloudFrontPolicy returns the RSA-SHA1 signature of policy, encoded the
+// way CloudFront expects.
+func (cfg *apiConfig) signCloudFrontPolicy(policy []byte) (string, error) {
+	digest := sha1.Sum(policy)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, cfg.cfPrivateKey, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign CloudFront policy: %w", err)
+	}
+	return cloudFrontBase64.Replace(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// loadCloudFrontPrivateKey reads a PEM-encoded RSA private key (PKCS#1 or
+// PKCS#8) from filePath.
+func loadCloudFrontPrivateKey(filePath string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key isn't an RSA key")
+	}
+	return key, nil
+}
+
+// signObjectURL returns the URL the object behind objectURL is served from,
+// in the replica bucket when it has the object. With URL signing on it's
+// time-limited: signed by CloudFront when a key pair is configured and the
+// bucket is behind a distribution (the key pair must be trusted by the
+// replica's distribution too), and presigned by S3 otherwise.
+func (cfg *apiConfig) signObjectURL(objectURL string) (string, error) {
+	return cfg.signObjectURLWithDisposition(objectURL, "")
+}
+
+// signObjectURLWithDisposition is signObjectURL for a URL that serves the
+// object with the given Content-Disposition, e.g. to force a download. S3
+// only honours the override on signed requests, so it needs URL signing on.
+// Through CloudFront, the distribution must forward the
+// response-content-disposition query parameter to S3.
+func (cfg *apiConfig) signObjectURLWithDisposition(objectURL, disposition string) (string, error) {
+	key, err := cfg.s3KeyFromURL(objectURL)
+	if err != nil {
+		return "", err
+	}
+	loc := cfg.serveLocation(context.Background(), key)
+	if cfg.signedURLTTL == 0 {
+		if disposition != "" {
+			return "", errors.New("URL signing is off")
+		}
+		return loc.url, nil
+	}
+	if cfg.cfPrivateKey != nil && loc.cfDistribution != "" {
+		resource := loc.url
+		if disposition != "" {
+			resource += "?" + url.Values{"response-content-disposition": {disposition}}.Encode()
+		}
+		return cfg.generateCloudFrontSignedURL(resource, cfg.signedURLTTL)
+	}
+	return generatePresignedURL(loc.client, loc.bucket, key, cfg.signedURLTTL, disposition)
+}
+
+// maxDownloadNameLength bounds the length, in characters, of the file name
+// downloads are saved as.
+const maxDownloadNameLength = 100
+
+// attachmentDisposition returns a Content-Disposition that saves a video
+// titled title, with extension ext, as a file named after it. Characters
+// that are unsafe in file names are replaced.
+func attachmentDisposition(title, ext string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(" -_.", r) {
+			return r
+		}
+		return '_'
+	}, title)
+	name = strings.Trim(name, " ._")
+	if runes := []rune(name); len(runes) > maxDownloadNameLength {
+		name = strings.TrimRight(string(runes[:maxDownloadNameLength]), " ._")
+	}
+	if name == "" {
+		name = "video"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name + ext})
+}
+
+// dbVideoToSignedVideo replaces the video's stored URLs with the ones they're
+// served from: signed ones, in the replica bucket when there is one, and
+// fills in PreviewThumbnailsURL. The URLs are left as they are when URL
+// signing is turned off and there's no replica.
+func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
+	video.PreviewThumbnailsURL = video.SpriteVTTURL
+	if (cfg.signedURLTTL == 0 && cfg.s3Replica == nil) || video.VideoURL == nil {
+		return video, nil
+	}
+
+	signedURL, err := cfg.signObjectURL(*video.VideoURL)
+	if err != nil {
+		return video, fmt.Errorf("failed to sign video URL: %w", err)
+	}
+	video.VideoURL = &signedURL
+
+	if len(video.Renditions) > 0 {
+		renditions := make(database.Renditions, len(video.Renditions))
+		for height, renditionURL := range video.Renditions {
+			signed, err := cfg.signObjectURL(renditionURL)
+			if err != nil {
+				return video, fmt.Errorf("failed to sign %dp rendition URL: %w", height, err)
+			}
+			renditions[height] = signed
+		}
+		video.Renditions = renditions
+	}
+
+	if video.AudioURL != nil {
+		signed, err := cfg.signObjectURL(*video.AudioURL)
+		if err != nil {
+			return video, fmt.Errorf("failed to sign audio URL: %w", err)
+		}
+		video.AudioURL = &signed
+	}
+
+	if video.PreviewURL != nil {
+		signed, err := cfg.signObjectURL(*video.PreviewURL)
+		if err != nil {
+			return video, fmt.Errorf("failed to sign preview URL: %w", err)
+		}
+		video.PreviewURL = &signed
+	}
+
+	// The track refers to the sprite sheet by a relative name, so the sheet
+	// must be reachable without a signature of its own, which
+	// handlerGenerateSprites checks with spriteSheetReachable.
+	if video.SpriteVTTURL != nil {
+		signed, err := cfg.signObjectURL(*video.SpriteVTTURL)
+		if err != nil {
+			return video, fmt.Errorf("failed to sign sprite track URL: %w", err)
+		}
+		video.SpriteVTTURL = &signed
+		video.PreviewThumbnailsURL = &signed
+	}
+
+	if len(video.Captions) > 0 {
+		captions := make(database.Captions, len(video.Captions))
+		for lang, captionURL := range video.Captions {
+			signed, err := cfg.signObjectURL(captionURL)
+			if err != nil {
+				return video, fmt.Errorf("failed to sign %s captions URL: %w", lang, err)
+			}
+			captions[lang] = signed
+		}
+		video.Captions = captions
+	}
+	return video, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const testCfDistribution = "d111111abcdef8.cloudfront.net"
+
+// testCloudFrontKey is the key pair CloudFront signing tests share, as
+// generating one per test is slow.
+var testCloudFrontKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// useCloudFrontSigning serves cfg's objects through testCfDistribution, with
+// URLs signed by testCloudFrontKey.
+func useCloudFrontSigning(cfg *apiConfig) {
+	cfg.s3URLMode = urlModeCloudFront
+	cfg.s3CfDistribution = testCfDistribution
+	cfg.cfKeyPairID = "K2JCJMDEHXQW5F"
+	cfg.cfPrivateKey = testCloudFrontKey()
+	cfg.signedURLTTL = time.Hour
+}
+
+// verifyCloudFrontSignedURL checks that signedURL carries a valid canned
+// policy signature for the URL it was made from, and returns that URL.
+func verifyCloudFrontSignedURL(t *testing.T, cfg *apiConfig, signedURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	for _, name := range []string{"Expires", "Signature", "Key-Pair-Id"} {
+		if query.Get(name) == "" {
+			t.Fatalf("%s has no %s", signedURL, name)
+		}
+	}
+	if got := query.Get("Key-Pair-Id"); got != cfg.cfKeyPairID {
+		t.Errorf("Key-Pair-Id = %q, want %q", got, cfg.cfKeyPairID)
+	}
+	expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The resource is the URL up to the signing parameters
+	resource, _, _ := strings.Cut(signedURL, "Expires=")
+	resource = strings.TrimRight(resource, "?&")
+	policy, err := marshalCloudFrontPolicy(cloudFrontPolicy{Statement: []cloudFrontStatement{{
+		Resource:  resource,
+		Condition: cloudFrontCondition{DateLessThan: cloudFrontEpochTime{EpochTime: expires}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Signature")))
+	if err != nil {
+		t.Fatalf("signature isn't CloudFront base64: %v", err)
+	}
+	digest := sha1.Sum(policy)
+	if err := rsa.VerifyPKCS1v15(&cfg.cfPrivateKey.PublicKey, crypto.SHA1, digest[:], sig); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+	return u
+}
+
+func TestSignObjectURLWithCloudFront(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	useCloudFrontSigning(cfg)
+
+	videoURL := cfg.objectURL("landscape/video.mp4")
+	start := time.Now()
+	video, err := cfg.dbVideoToSignedVideo(database.Video{VideoURL: &videoURL})
+	if err != nil {
+		t.Fatalf("dbVideoToSignedVideo: %v", err)
+	}
+	signed := *video.VideoURL
+	u := verifyCloudFrontSignedURL(t, cfg, signed)
+	if u.Scheme != "https" || u.Host != testCfDistribution || u.Path != "/landscape/video.mp4" {
+		t.Errorf("signed URL %s isn't the object on the distribution", signed)
+	}
+	expires, _ := strconv.ParseInt(u.Query().Get("Expires"), 10, 64)
+	if got := time.Unix(expires, 0).Sub(start); got < 59*time.Minute || got > 61*time.Minute {
+		t.Errorf("URL expires in %v, want the signed URL TTL of an hour", got)
+	}
+}
+
+func TestSignObjectURLFallsBackToPresigning(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	useCloudFrontSigning(cfg)
+	cfg.cfPrivateKey = nil
+
+	signed, err := cfg.signObjectURL(cfg.objectURL("landscape/video.mp4"))
+	if err != nil {
+		t.Fatalf("signObjectURL: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host == testCfDistribution || u.Query().Get("X-Amz-Signature") == "" || u.Query().Has("Key-Pair-Id") {
+		t.Errorf("signed URL %s isn't presigned by S3", signed)
+	}
+}
+
+func TestAttachmentDisposition(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Boots the bear", `attachment; filename="Boots the bear.mp4"`},
+		{`../"quoted"/name`, "attachment; filename=quoted__name.mp4"},
+		{"Ours à la crème", `attachment; filename*=utf-8''Ours%20%C3%A0%20la%20cr%C3%A8me.mp4`},
+		{"...", "attachment; filename=video.mp4"},
+		{strings.Repeat("a", maxDownloadNameLength+10), "attachment; filename=" + strings.Repeat("a", maxDownloadNameLength) + ".mp4"},
+	}
+	for _, tt := range tests {
+		if got := attachmentDisposition(tt.title, ".mp4"); got != tt.want {
+			t.Errorf("attachmentDisposition(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
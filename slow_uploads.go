@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// stageTimings adds up how long each stage of a request took, in the order
+// the stages first ran. Stages that run more than once, such as an S3 upload
+// per rendition, are summed.
+type stageTimings struct {
+	mu        sync.Mutex
+	stages    []string
+	durations map[string]time.Duration
+}
+
+type stageTimingsContextKey struct{}
+
+// withStageTimings returns ctx with a stageTimings attached, which logStage
+// records each stage's duration in.
+func withStageTimings(ctx context.Context) (context.Context, *stageTimings) {
+	timings := &stageTimings{durations: map[string]time.Duration{}}
+	return context.WithValue(ctx, stageTimingsContextKey{}, timings), timings
+}
+
+// recordStageDuration adds d to stage's time in ctx's stageTimings, if it
+// has any.
+func recordStageDuration(ctx context.Context, stage string, d time.Duration) {
+	timings, ok := ctx.Value(stageTimingsContextKey{}).(*stageTimings)
+	if !ok {
+		return
+	}
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	if _, seen := timings.durations[stage]; !seen {
+		timings.stages = append(timings.stages, stage)
+	}
+	timings.durations[stage] += d
+}
+
+// attrs returns each stage's duration as a log attribute.
+func (t *stageTimings) attrs() []any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	attrs := make([]any, 0, len(t.stages))
+	for _, stage := range t.stages {
+		attrs = append(attrs, slog.Duration(stage, t.durations[stage]))
+	}
+	return attrs
+}
+
+// logSlowUpload warns, with the time each stage took, when the upload r
+// started at start took longer than cfg.slowUploadThreshold to respond.
+func (cfg *apiConfig) logSlowUpload(r *http.Request, start time.Time, timings *stageTimings) {
+	if cfg.slowUploadThreshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed <= cfg.slowUploadThreshold {
+		return
+	}
+	slowUploadsTotal.Inc()
+	loggerFromContext(r.Context()).Warn("slow upload",
+		"video_id", r.PathValue("videoID"),
+		"duration", elapsed,
+		"threshold", cfg.slowUploadThreshold,
+		slog.Group("stages", timings.attrs()...),
+	)
+}
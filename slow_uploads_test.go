@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSlowUploadWarning(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	const delay = 50 * time.Millisecond
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		wantWarn  bool
+	}{
+		{name: "over the threshold", threshold: delay / 2, wantWarn: true},
+		{name: "under the threshold", threshold: time.Minute},
+		{name: "warning off", threshold: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.slowUploadThreshold = tt.threshold
+			cfg.uploadPipeline = append(slices.Clone(cfg.uploadPipeline), uploadStage{
+				name: "sleep",
+				run: func(cfg *apiConfig, ctx context.Context, s *pipelineState) error {
+					done := logStage(ctx, "sleep")
+					time.Sleep(delay)
+					done(nil)
+					return nil
+				},
+			})
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			slowBefore := testutil.ToFloat64(slowUploadsTotal)
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&logs, nil))
+			r := newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil)
+			r = r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, logger))
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, r)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+			}
+
+			var warning map[string]any
+			for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+				var entry map[string]any
+				if err := json.Unmarshal(line, &entry); err != nil {
+					t.Fatalf("log line %q: %v", line, err)
+				}
+				if entry["msg"] == "slow upload" {
+					warning = entry
+				}
+			}
+			if (warning != nil) != tt.wantWarn {
+				t.Fatalf("slow upload warning = %v, want one: %v", warning, tt.wantWarn)
+			}
+			wantCounted := 0.0
+			if tt.wantWarn {
+				wantCounted = 1
+			}
+			if counted := testutil.ToFloat64(slowUploadsTotal) - slowBefore; counted != wantCounted {
+				t.Errorf("slow uploads counted %v, want %v", counted, wantCounted)
+			}
+			if warning == nil {
+				return
+			}
+			if warning["level"] != "WARN" || warning["video_id"] != video.ID.String() {
+				t.Errorf("warning = %v", warning)
+			}
+			// The slow stage is named, with its time
+			stages, _ := warning["stages"].(map[string]any)
+			if took, _ := stages["sleep"].(float64); time.Duration(took) < delay {
+				t.Errorf("stages = %v, want sleep to have taken at least %v", stages, delay)
+			}
+			if _, ok := stages["probe"]; !ok {
+				t.Errorf("stages = %v, want the other stages too", stages)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// untrustedContentType reports whether a declared Content-Type says nothing
+// useful about the file, in which case the type is sniffed from the content
+// instead.
+func untrustedContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err != nil || mediaType == "application/octet-stream"
+}
+
+// sniffContentType detects the media type of r from its first bytes and
+// rewinds it, so the caller can still read the whole file.
+func sniffContentType(r io.ReadSeeker) (string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	return mediaType, nil
+}
+
+// videoContainer is a container format videos are stored in, with the media
+// type and key extension that let browsers and CDNs recognize it.
+type videoContainer struct {
+	contentType string
+	ext         string
+}
+
+// videoContainers are the containers videos can be stored in, by ffmpeg
+// muxer name.
+var videoContainers = map[string]videoContainer{
+	"mp4":  {contentType: "video/mp4", ext: ".mp4"},
+	"mov":  {contentType: "video/quicktime", ext: ".mov"},
+	"webm": {contentType: "video/webm", ext: ".webm"},
+}
+
+// containerForType returns the container of the given media type, or MP4
+// when it isn't one of videoContainers.
+func containerForType(contentType string) videoContainer {
+	for _, container := range videoContainers {
+		if container.contentType == contentType {
+			return container
+		}
+	}
+	return videoContainers["mp4"]
+}
+
+// videoTypeFromFormat maps ffprobe's format_name (a comma-separated list of
+// demuxers, e.g. "mov,mp4,m4a,3gp,3g2,mj2") to a media type we accept.
+func videoTypeFromFormat(formatName string) (string, bool) {
+	for _, name := range strings.Split(formatName, ",") {
+		if name == "mp4" {
+			return "video/mp4", true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Scrub preview defaults and limits. Tiles are spriteTileWidth pixels wide,
+// with the height following the video's aspect ratio.
+const (
+	defaultSpriteIntervalSeconds = 10
+	defaultSpriteColumns         = 10
+	maxSpriteColumns             = 20
+	maxSpriteTiles               = 1000
+	spriteTileWidth              = 160
+)
+
+// Object names of the sprite sheet and its WebVTT track, stored next to the
+// video. The track refers to the sheet by its relative name.
+const (
+	spriteSheetName = "sprites.jpg"
+	spriteVTTName   = "sprites.vtt"
+)
+
+// handlerGenerateSprites builds a scrub preview for an uploaded video: a
+// sprite sheet of frames taken every interval_seconds, and a WebVTT track
+// mapping each interval to its tile.
+func (cfg *apiConfig) handlerGenerateSprites(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IntervalSeconds int `json:"interval_seconds"`
+		Columns         int `json:"columns"`
+	}
+
+	video, userID, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	// The body is optional
+	params := parameters{
+		IntervalSeconds: defaultSpriteIntervalSeconds,
+		Columns:         defaultSpriteColumns,
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.IntervalSeconds < 1 {
+		respondWithError(w, http.StatusBadRequest, "interval_seconds must be at least 1", nil)
+		return
+	}
+	if params.Columns < 1 || params.Columns > maxSpriteColumns {
+		msg := translatef(w, "columns must be between 1 and %d", maxSpriteColumns)
+		respondWithError(w, http.StatusBadRequest, msg, nil)
+		return
+	}
+
+	if !cfg.spriteSheetReachable() {
+		respondWithError(w, http.StatusNotImplemented, "Scrub previews need CloudFront signing or unsigned URLs", nil)
+		return
+	}
+
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	key, err := cfg.s3KeyFromURL(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video in S3", err)
+		return
+	}
+	if path.Base(key) == hlsPlaylistName {
+		respondWithError(w, http.StatusConflict, "Previews can't be generated from HLS videos", nil)
+		return
+	}
+
+	release, ok := cfg.acquireProcessingSlot(w, r, 1)
+	if !ok {
+		return
+	}
+	defer release()
+
+	sourcePath, err := cfg.downloadToTempFile(r.Context(), key)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't download video", err)
+		return
+	}
+	defer os.Remove(sourcePath)
+
+	spritePath, vttPath, err := cfg.generateSpriteSheet(r.Context(), sourcePath, params.IntervalSeconds, params.Columns)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't generate preview", err)
+		return
+	}
+	defer os.Remove(spritePath)
+	defer os.Remove(vttPath)
+
+	base := spriteBaseKey(key)
+	uploads := []struct {
+		filePath    string
+		key         string
+		contentType string
+	}{
+		{spritePath, base + spriteSheetName, "image/jpeg"},
+		{vttPath, base + spriteVTTName, "text/vtt"},
+	}
+	for _, upload := range uploads {
+		f, err := os.Open(upload.filePath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't open preview", err)
+			return
+		}
+		err = cfg.uploadToS3(r.Context(), w, f, upload.key, upload.contentType, userID)
+		f.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	vttURL := cfg.objectURL(base + spriteVTTName)
+	video.SpriteVTTURL = &vttURL
+	if err := cfg.db.UpdateVideo(*video); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(*video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// spriteSheetReachable reports whether a player can load the sprite sheet
+// through the track's relative reference to it. That holds when URLs aren't
+// signed, and when CloudFront signs them, as a wildcard policy or signed
+// cookies can cover the sheet. A presigned S3 URL is good for one object
+// only, so a sheet next to a presigned track would be refused.
+func (cfg *apiConfig) spriteSheetReachable() bool {
+	return cfg.signedURLTTL == 0 || (cfg.s3URLMode == urlModeCloudFront && cfg.cfPrivateKey != nil)
+}
+
+// spriteBaseKey returns the key prefix the scrub preview of the video stored
+// at videoKey goes under, e.g. landscape/abc.mp4 -> landscape/abc/.
+func spriteBaseKey(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/"
+}
+
+// generateSpriteSheet tiles a frame from every intervalSeconds of the video
+// at filePath into a JPEG sprite sheet cols tiles wide, and writes a WebVTT
+// track mapping each interval to its tile. The caller removes both files.
+func (cfg *apiConfig) generateSpriteSheet(ctx context.Context, filePath string, intervalSeconds int, cols int) (spritePath, vttPath string, err error) {
+	meta, err := cfg.probeVideo(ctx, filePath)
+	if err != nil {
+		return "", "", err
+	}
+
+	tiles := int(math.Ceil(meta.Duration / float64(intervalSeconds)))
+	if tiles < 1 {
+		tiles = 1
+	}
+	if tiles > maxSpriteTiles {
+		return "", "", fmt.Errorf("%d tiles exceeds the maximum of %d, use a longer interval", tiles, maxSpriteTiles)
+	}
+	cols = min(cols, tiles)
+	rows := (tiles + cols - 1) / cols
+	tileWidth := spriteTileWidth
+	// Even heights keep the JPEG encoder happy with subsampled chroma
+	tileHeight := int(math.Round(float64(tileWidth)*float64(meta.Height)/float64(meta.Width)/2)) * 2
+
+	done := logStage(ctx, "sprite_sheet", "tiles", tiles)
+	spritePath = filePath + "." + spriteSheetName
+	_, err = cfg.runMedia(ctx, "ffmpeg",
+		"-i", filePath,
+		"-vf", fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", intervalSeconds, tileWidth, tileHeight, cols, rows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		spritePath,
+	)
+	done(err)
+	if err != nil {
+		os.Remove(spritePath)
+		return "", "", err
+	}
+
+	vttPath = filePath + "." + spriteVTTName
+	vtt := spriteVTT(meta.Duration, intervalSeconds, cols, tileWidth, tileHeight)
+	if err := os.WriteFile(vttPath, []byte(vtt), 0o600); err != nil {
+		os.Remove(spritePath)
+		return "", "", err
+	}
+	return spritePath, vttPath, nil
+}
+
+// spriteVTT returns a WebVTT track with one cue per interval of a video
+// lasting duration seconds, each pointing at its tile in the sprite sheet.
+func spriteVTT(duration float64, intervalSeconds, cols, tileWidth, tileHeight int) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; float64(i*intervalSeconds) < duration || i == 0; i++ {
+		start := float64(i * intervalSeconds)
+		end := math.Min(start+float64(intervalSeconds), duration)
+		x := (i % cols) * tileWidth
+		y := (i / cols) * tileHeight
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end), spriteSheetName, x, y, tileWidth, tileHeight)
+	}
+	return b.String()
+}
+
+// formatVTTTimestamp formats seconds as a WebVTT timestamp, e.g.
+// 01:02:03.500.
+func formatVTTTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
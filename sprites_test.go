@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateSpritesNeedsReachableSheet(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	tests := []struct {
+		name     string
+		signing  func(cfg *apiConfig)
+		wantCode int
+	}{
+		{name: "unsigned URLs", signing: func(cfg *apiConfig) {}, wantCode: http.StatusOK},
+		{name: "CloudFront signing", signing: useCloudFrontSigning, wantCode: http.StatusOK},
+		{
+			name:     "presigned S3 URLs",
+			signing:  func(cfg *apiConfig) { cfg.signedURLTTL = time.Hour },
+			wantCode: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, mock := newTestConfig(t)
+			tt.signing(cfg)
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			storeTestVideoFile(t, cfg, mock, &video, "landscape/abc.mp4", testMP4(4096))
+
+			r := newUserRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/sprites", token)
+			r.Body = http.NoBody
+			r.SetPathValue("videoID", video.ID.String())
+			w := httptest.NewRecorder()
+			cfg.handlerGenerateSprites(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			vtt, stored := mock.Object("landscape/abc/" + spriteVTTName)
+			if tt.wantCode != http.StatusOK {
+				if stored {
+					t.Error("stored a sprite track players couldn't use")
+				}
+				return
+			}
+			if !stored {
+				t.Fatal("sprite track wasn't stored")
+			}
+			if _, ok := mock.Object("landscape/abc/" + spriteSheetName); !ok {
+				t.Error("sprite sheet wasn't stored")
+			}
+			// A cue for each 10 second interval of the 3 second clip
+			if cues := strings.Count(string(vtt.data), spriteSheetName+"#xywh="); cues != 1 {
+				t.Errorf("track has %d cues, want 1:\n%s", cues, vtt.data)
+			}
+		})
+	}
+}
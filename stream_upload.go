@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Limits on reading a streamed upload's form.
+const (
+	// maxStreamHeadBytes is how much of a streamed video is read looking
+	// for its moov atom before falling back to buffering it on disk
+	maxStreamHeadBytes = 32 << 20
+	// maxStreamFieldBytes caps each form field ahead of the video part
+	maxStreamFieldBytes = 64 << 10
+)
+
+// openVideoUploadStream opens the video part of the request's multipart
+// form without parsing the whole form first, so the file can be read
+// straight off the request body. Form fields, and the thumbnail, are only
+// seen if they come before the video part (or are in the query string);
+// later ones are ignored.
+func (cfg *apiConfig) openVideoUploadStream(w http.ResponseWriter, r *http.Request) (source videoSource, err error) {
+	done := logStage(r.Context(), "receive_upload", "streaming", true)
+	defer func() { done(err) }()
+
+	if err := cfg.limitVideoUploadBody(w, r); err != nil {
+		return videoSource{}, err
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+		return videoSource{}, err
+	}
+
+	// Fill in r.Form ourselves, so FormValue doesn't try to parse the form
+	// (and read the video) again
+	form, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		form = url.Values{}
+	}
+	r.Form = form
+	r.PostForm = url.Values{}
+	var thumbnail *formThumbnail
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			err := errors.New("no video part in form")
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeMissingFile, "Missing video file", err)
+			return videoSource{}, err
+		}
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+			return videoSource{}, err
+		}
+
+		name := part.FormName()
+		if name == "video" && part.FileName() != "" {
+			return videoSource{
+				body:        part,
+				size:        -1,
+				contentType: part.Header.Get("Content-Type"),
+				thumbnail:   thumbnail,
+				contentMD5:  part.Header.Get("Content-MD5"),
+			}, nil
+		}
+		if name == "thumbnail" && part.FileName() != "" {
+			thumbnail, err = cfg.readFormThumbnail(part)
+			part.Close()
+			if err != nil {
+				respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+				return videoSource{}, err
+			}
+			continue
+		}
+		if part.FileName() != "" {
+			part.Close()
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxStreamFieldBytes+1))
+		part.Close()
+		if err != nil || len(value) > maxStreamFieldBytes {
+			if err == nil {
+				err = fmt.Errorf("form field %q is too long", name)
+			}
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't parse form", err)
+			return videoSource{}, err
+		}
+		r.Form.Add(name, string(value))
+		r.PostForm.Add(name, string(value))
+	}
+}
+
+// readMP4Head reads the top-level boxes at the start of the MP4 in r until
+// it reaches the moov or mdat atom, and reports whether moov came first,
+// i.e. whether the file is already laid out for fast start. When it is,
+// head ends with the whole moov atom, which is all ffprobe needs to read the
+// video's metadata. Everything read is returned in head, so the caller can
+// put it back in front of the rest of r. Files that don't look like MP4s, or
+// whose moov atom is beyond limit, are reported as not fast start.
+func readMP4Head(r io.Reader, limit int64) (head []byte, fastStart bool, err error) {
+	var buf bytes.Buffer
+	read := func(n int64) error {
+		_, err := io.CopyN(&buf, r, n)
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	for {
+		start := buf.Len()
+		if err := read(8); err != nil {
+			return buf.Bytes(), false, ignoreUnexpectedEOF(err)
+		}
+		size := int64(binary.BigEndian.Uint32(buf.Bytes()[start : start+4]))
+		boxType := string(buf.Bytes()[start+4 : start+8])
+		headerSize := int64(8)
+		if size == 1 {
+			if err := read(8); err != nil {
+				return buf.Bytes(), false, ignoreUnexpectedEOF(err)
+			}
+			size = int64(binary.BigEndian.Uint64(buf.Bytes()[start+8 : start+16]))
+			headerSize = 16
+		}
+
+		if boxType == "mdat" || size < headerSize || int64(start)+size > limit {
+			return buf.Bytes(), false, nil
+		}
+		if err := read(size - headerSize); err != nil {
+			return buf.Bytes(), false, ignoreUnexpectedEOF(err)
+		}
+		if boxType == "moov" {
+			return buf.Bytes(), true, nil
+		}
+	}
+}
+
+// ignoreUnexpectedEOF turns the error for a file ending mid-box into nil:
+// such a file isn't fast start, and the pipeline rejects it later anyway.
+func ignoreUnexpectedEOF(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// streamVideoToS3 uploads head followed by the rest of the video in rest to
+// key, without writing it to disk, and returns the SHA-256 of what it
+// uploaded. It responds with an error itself.
+func (cfg *apiConfig) streamVideoToS3(ctx context.Context, w http.ResponseWriter, head, rest io.Reader, key, contentType string, ownerID uuid.UUID) (string, error) {
+	done := logStage(ctx, "s3_upload", "key", key, "streaming", true)
+	h := sha256.New()
+	err := cfg.uploadObject(ctx, io.TeeReader(io.MultiReader(head, rest), h), key, contentType, ownerID)
+	done(err)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			msg := translatef(w, "Video exceeds the maximum upload size of %s (%d bytes)", formatBytes(maxBytesErr.Limit), maxBytesErr.Limit)
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+			return "", err
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeTruncatedUpload, "Video upload was truncated", err)
+			return "", err
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeStorageError, "Couldn't upload to S3", err)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadStreamedVideo stores a fast start video that needs no processing
+// straight from the request: head, the part already read and probed, then
+// the rest of the body in rest. It records the hash and layout on video
+// and returns the key it was stored under.
+func (cfg *apiConfig) uploadStreamedVideo(ctx context.Context, w http.ResponseWriter, video *database.Video, meta VideoMeta, head, rest io.Reader, prefixOverride, contentType string, ownerID uuid.UUID) (string, error) {
+	prefix := prefixOverride
+	if prefix == "" {
+		prefix = cfg.aspectPrefixFor(meta.Width, meta.Height)
+	}
+	key, err := cfg.generateS3Key(containerForType(contentType).ext)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return "", err
+	}
+	prefixedKey, err := cfg.videoKey(ownerID, prefix, key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate key", err)
+		return "", err
+	}
+
+	contentHash, err := cfg.streamVideoToS3(ctx, w, head, rest, prefixedKey, contentType, ownerID)
+	if err != nil {
+		return "", err
+	}
+	video.ContentSHA256 = &contentHash
+	fastStart := true
+	video.FastStart = &fastStart
+	return prefixedKey, nil
+}
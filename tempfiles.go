@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tempFilePrefix starts the name of every temp file (and directory) an upload
+// creates, including the processed and transcoded files derived from it.
+const tempFilePrefix = "tubely-upload-"
+
+// checkTempDir makes sure dir is a directory uploads can write temp files
+// to.
+func checkTempDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, tempFilePrefix+"check-*")
+	if err != nil {
+		return fmt.Errorf("%s isn't writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// isNoSpace reports whether err is due to the disk (or quota) being full.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// checkFreeDiskSpace rejects an upload with a 507 when the temp dir's
+// filesystem doesn't have cfg.minFreeDiskBytes free on top of the declared
+// size, which is -1 when unknown. Failing fast beats running out of space
+// part way through processing. Where free space can't be read, uploads are
+// let through.
+func (cfg *apiConfig) checkFreeDiskSpace(w http.ResponseWriter, r *http.Request, declared int64) error {
+	if cfg.minFreeDiskBytes == 0 {
+		return nil
+	}
+	free, err := freeDiskSpace(cfg.tempDir)
+	if err != nil {
+		loggerFromContext(r.Context()).Warn("couldn't check free disk space", "dir", cfg.tempDir, "error", err)
+		return nil
+	}
+	needed := uint64(cfg.minFreeDiskBytes) + uint64(max(declared, 0))
+	if free < needed {
+		err := fmt.Errorf("%d bytes free in %s, need %d", free, cfg.tempDir, needed)
+		respondWithErrorCode(w, http.StatusInsufficientStorage, errCodeInsufficientStorage, "Not enough disk space to process the upload", err)
+		return err
+	}
+	return nil
+}
+
+// cleanupStaleTempFiles deletes upload temp files and directories in dir that were last
+// modified more than maxAge ago. They're left behind when the server crashes
+// or is killed mid-upload, before the handler's deferred cleanup runs. It
+// returns how many files were removed.
+func cleanupStaleTempFiles(dir string, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, entry := range entries {
+		if !(entry.Type().IsRegular() || entry.IsDir()) || !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// The file was removed after the directory was read
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
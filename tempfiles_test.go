@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCleanupStaleTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	create := func(name string, isDir bool, modTime time.Time) {
+		path := filepath.Join(dir, name)
+		var err error
+		if isDir {
+			err = os.Mkdir(path, 0755)
+		} else {
+			err = os.WriteFile(path, []byte("partial upload"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create(tempFilePrefix+"stale.mp4", false, old)
+	create(tempFilePrefix+"hls-stale", true, old)
+	create(tempFilePrefix+"fresh.mp4", false, time.Now())
+	// Files the server didn't create are left alone, however old
+	create("someone-elses.mp4", false, old)
+
+	removed, err := cleanupStaleTempFiles(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("cleanupStaleTempFiles: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("removed %d, want 2", removed)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	if want := []string{"someone-elses.mp4", tempFilePrefix + "fresh.mp4"}; !slices.Equal(left, want) {
+		t.Errorf("left %q, want %q", left, want)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// thumbnailCandidatesDir is where, under assetsRoot, each video's
+	// candidate thumbnails are kept until one is selected
+	thumbnailCandidatesDir = "candidates"
+
+	defaultThumbnailCandidates = 5
+	maxThumbnailCandidates     = 10
+)
+
+type thumbnailCandidate struct {
+	ID string `json:"id"`
+	// Timestamp is the position of the frame, in seconds
+	Timestamp float64 `json:"timestamp"`
+	URL       string  `json:"url"`
+}
+
+// handlerGenerateThumbnailCandidates extracts count frames (5 by default)
+// spread evenly across the stored video and keeps them as candidates for
+// its thumbnail, replacing any candidates generated before. One is picked
+// with handlerSelectThumbnailCandidate.
+func (cfg *apiConfig) handlerGenerateThumbnailCandidates(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Count int `json:"count"`
+	}
+	type response struct {
+		Candidates []thumbnailCandidate `json:"candidates"`
+	}
+
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	// The body is optional
+	params := parameters{Count: defaultThumbnailCandidates}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Count < 1 || params.Count > maxThumbnailCandidates {
+		msg := translatef(w, "count must be between 1 and %d", maxThumbnailCandidates)
+		respondWithError(w, http.StatusBadRequest, msg, nil)
+		return
+	}
+
+	key, err := cfg.frameSourceKey(w, video)
+	if err != nil {
+		return
+	}
+
+	release, ok := cfg.acquireProcessingSlot(w, r, 1)
+	if !ok {
+		return
+	}
+	defer release()
+
+	sourcePath, duration, err := cfg.downloadFrameSource(w, r, video, key)
+	if err != nil {
+		return
+	}
+	defer os.Remove(sourcePath)
+
+	if err := cfg.discardThumbnailCandidates(video.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete previous candidates", err)
+		return
+	}
+	dir := cfg.thumbnailCandidatesPath(video.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
+
+	candidates := make([]thumbnailCandidate, 0, params.Count)
+	for _, timestamp := range candidateTimestamps(duration, params.Count) {
+		filePath, err := cfg.saveThumbnailCandidate(r, sourcePath, timestamp)
+		if err != nil {
+			cfg.discardThumbnailCandidates(video.ID)
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeProcessingFailed, "Couldn't extract frame", err)
+			return
+		}
+		newPath := filepath.Join(dir, filepath.Base(filePath))
+		if err := os.Rename(filePath, newPath); err != nil {
+			os.Remove(filePath)
+			cfg.discardThumbnailCandidates(video.ID)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+			return
+		}
+		name := filepath.Base(newPath)
+		candidates = append(candidates, thumbnailCandidate{
+			ID:        strings.TrimSuffix(name, filepath.Ext(name)),
+			Timestamp: timestamp,
+			URL:       cfg.thumbnailCandidateURL(video.ID, name),
+		})
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{Candidates: candidates})
+}
+
+// handlerSelectThumbnailCandidate makes one of a video's candidates its
+// thumbnail and deletes the others.
+func (cfg *apiConfig) handlerSelectThumbnailCandidate(w http.ResponseWriter, r *http.Request) {
+	video, _, err := cfg.validateUserAndVideo(w, r)
+	if err != nil {
+		return
+	}
+
+	candidatePath, err := cfg.findThumbnailCandidate(video.ID, r.PathValue("candidateID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Thumbnail candidate not found", err)
+		return
+	}
+	filePath := filepath.Join(cfg.assetsRoot, filepath.Base(candidatePath))
+	if err := os.Rename(candidatePath, filePath); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
+
+	previousThumbnail := video.ThumbnailURL
+	if err := cfg.updateVideoThumbnail(w, video, filePath, nil); err != nil {
+		os.Remove(filePath)
+		return
+	}
+	if err := cfg.deleteThumbnailFile(previousThumbnail); err != nil {
+		loggerFromContext(r.Context()).Warn("couldn't delete previous thumbnail", "video_id", video.ID, "error", err)
+	}
+	if err := cfg.discardThumbnailCandidates(video.ID); err != nil {
+		loggerFromContext(r.Context()).Warn("couldn't delete thumbnail candidates", "video_id", video.ID, "error", err)
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(*video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate video URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// candidateTimestamps spreads count timestamps evenly across a video of
+// duration seconds, each in the middle of its share so none falls on the
+// very first or last frame.
+func candidateTimestamps(duration float64, count int) []float64 {
+	timestamps := make([]float64, count)
+	for i := range timestamps {
+		timestamps[i] = duration * (float64(i) + 0.5) / float64(count)
+	}
+	return timestamps
+}
+
+// saveThumbnailCandidate extracts the frame at timestamp from the video at
+// sourcePath and saves it as a thumbnail would be, returning its path.
+func (cfg *apiConfig) saveThumbnailCandidate(r *http.Request, sourcePath string, timestamp float64) (string, error) {
+	frame, err := cfg.extractFrame(r.Context(), sourcePath, timestamp, false)
+	if err != nil {
+		return "", err
+	}
+	resized, fileExtension, err := resizeThumbnail(bytes.NewReader(frame), cfg.thumbnailMaxEdge, cfg.thumbnailQuality)
+	if err != nil {
+		return "", err
+	}
+	return cfg.saveThumbnailFile(fileExtension, resized)
+}
+
+func (cfg *apiConfig) thumbnailCandidatesPath(videoID uuid.UUID) string {
+	return filepath.Join(cfg.assetsRoot, thumbnailCandidatesDir, videoID.String())
+}
+
+func (cfg *apiConfig) thumbnailCandidateURL(videoID uuid.UUID, name string) string {
+	return fmt.Sprintf("http://localhost:%s/assets/%s/%s/%s", cfg.port, thumbnailCandidatesDir, videoID, name)
+}
+
+// findThumbnailCandidate returns the path of the video's candidate with the
+// given ID.
+func (cfg *apiConfig) findThumbnailCandidate(videoID uuid.UUID, id string) (string, error) {
+	entries, err := os.ReadDir(cfg.thumbnailCandidatesPath(videoID))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.TrimSuffix(name, filepath.Ext(name)) == id {
+			return filepath.Join(cfg.thumbnailCandidatesPath(videoID), name), nil
+		}
+	}
+	return "", fmt.Errorf("no candidate %q", id)
+}
+
+// discardThumbnailCandidates deletes the video's candidates, if it has any.
+func (cfg *apiConfig) discardThumbnailCandidates(videoID uuid.UUID) error {
+	return os.RemoveAll(cfg.thumbnailCandidatesPath(videoID))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // register the PNG decoder
+	"io"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register the WebP decoder
+)
+
+// thumbnailExtensions maps the formats image.Decode recognizes to the file
+// extension they're stored with.
+var thumbnailExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"webp": ".webp",
+}
+
+// resizeThumbnail scales the image read from src down so its longest edge is
+// at most maxEdge pixels, preserving the aspect ratio, and re-encodes it as a
+// JPEG at the given quality (the standard library has no WebP encoder, so
+// resized WebP images become JPEGs too). Images that already fit are
+// returned unchanged. It returns the image bytes and the extension to store
+// them with.
+func resizeThumbnail(src io.Reader, maxEdge int, quality int) (io.Reader, string, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, "", err
+	}
+
+	imgCfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't read image: %w", err)
+	}
+	ext, ok := thumbnailExtensions[format]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported image format: %s", format)
+	}
+	if imgCfg.Width <= maxEdge && imgCfg.Height <= maxEdge {
+		return bytes.NewReader(data), ext, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't decode image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeScaledJPEG(&buf, img, maxEdge, quality); err != nil {
+		return nil, "", err
+	}
+	return &buf, ".jpg", nil
+}
+
+// encodeScaledJPEG writes img to w as a JPEG at the given quality, scaled so
+// its longest edge is maxEdge pixels.
+func encodeScaledJPEG(w io.Writer, img image.Image, maxEdge int, quality int) error {
+	bounds := img.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), maxEdge)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	// JPEG has no alpha channel, so transparent areas are flattened onto
+	// white rather than coming out black.
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	if err := jpeg.Encode(w, dst, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("couldn't encode thumbnail: %w", err)
+	}
+	return nil
+}
+
+// imageDimensions reads the width and height from the image header in r
+// without decoding the pixels, then rewinds r.
+func imageDimensions(r io.ReadSeeker) (int, int, error) {
+	imgCfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't read image: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	return imgCfg.Width, imgCfg.Height, nil
+}
+
+// fitWithin scales width x height so the longest edge is maxEdge.
+func fitWithin(width, height, maxEdge int) (int, int) {
+	if width >= height {
+		return maxEdge, max(1, height*maxEdge/width)
+	}
+	return max(1, width*maxEdge/height), maxEdge
+}
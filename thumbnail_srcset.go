@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// parseThumbnailSrcsetSizes parses a comma-separated list of long edge sizes
+// in pixels (e.g. "320,640,1280"), returning them smallest first. An empty
+// list turns srcset generation off.
+func parseThumbnailSrcsetSizes(value string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		size, err := strconv.Atoi(field)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid size %q", field)
+		}
+		sizes = append(sizes, size)
+	}
+	slices.Sort(sizes)
+	return slices.Compact(sizes), nil
+}
+
+// saveThumbnailSrcset stores the thumbnail saved at filePath scaled to each
+// of cfg.thumbnailSrcsetSizes, both as a JPEG and as a WebP, next to it under
+// assetsRoot. Sizes the thumbnail doesn't exceed are left out: scaling it up
+// would only add bytes. The JPEGs are encoded here and the WebPs by ffmpeg,
+// since the standard library has no WebP encoder. If any size fails, the
+// files already written are removed.
+func (cfg *apiConfig) saveThumbnailSrcset(ctx context.Context, filePath string) (srcset database.ThumbnailSrcset, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode thumbnail: %w", err)
+	}
+
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	bounds := img.Bounds()
+	for _, size := range cfg.thumbnailSrcsetSizes {
+		if size >= max(bounds.Dx(), bounds.Dy()) {
+			break
+		}
+		width, height := fitWithin(bounds.Dx(), bounds.Dy(), size)
+
+		jpegPath, err := cfg.newThumbnailPath(".jpg")
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, jpegPath)
+		if err := writeScaledJPEG(jpegPath, img, size, cfg.thumbnailQuality); err != nil {
+			return nil, err
+		}
+
+		webpPath, err := cfg.newThumbnailPath(".webp")
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, webpPath)
+		_, err = cfg.runMedia(ctx, "ffmpeg",
+			"-i", filePath,
+			"-vf", fmt.Sprintf("scale=%d:%d:flags=lanczos", width, height),
+			"-c:v", "libwebp",
+			"-quality", strconv.Itoa(cfg.thumbnailQuality),
+			"-map_metadata", "-1",
+			webpPath,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode WebP thumbnail: %w", err)
+		}
+
+		srcset = append(srcset, database.ThumbnailSource{
+			Width:  width,
+			Height: height,
+			WebP:   cfg.thumbnailURL(webpPath),
+			JPEG:   cfg.thumbnailURL(jpegPath),
+		})
+	}
+	return srcset, nil
+}
+
+// writeScaledJPEG is encodeScaledJPEG to a new file at path.
+func writeScaledJPEG(path string, img image.Image, maxEdge int, quality int) error {
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := encodeScaledJPEG(dst, img, maxEdge, quality); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
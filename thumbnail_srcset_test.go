@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestParseThumbnailSrcsetSizes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "640, 320,640", want: []int{320, 640}},
+		{value: "320,", want: []int{320}},
+		{value: "0", wantErr: true},
+		{value: "big", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseThumbnailSrcsetSizes(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseThumbnailSrcsetSizes(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseThumbnailSrcsetSizes(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUploadThumbnailSrcset(t *testing.T) {
+	// The fake ffmpeg copies its input, so the WebPs hold the source PNG
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	cfg.thumbnailSrcsetSizes = []int{160, 320, 1280}
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, token, video.ID, testPNG(t, 640, 360), "image/png"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusOK, w.Body)
+	}
+	var got database.Video
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1280 is larger than the image, so it isn't scaled up
+	want := []struct{ width, height int }{{160, 90}, {320, 180}}
+	if len(got.ThumbnailSrcset) != len(want) {
+		t.Fatalf("srcset = %+v, want %d sizes", got.ThumbnailSrcset, len(want))
+	}
+	for i, source := range got.ThumbnailSrcset {
+		if source.Width != want[i].width || source.Height != want[i].height {
+			t.Errorf("size %d is %dx%d, want %dx%d", i, source.Width, source.Height, want[i].width, want[i].height)
+		}
+		if !strings.HasSuffix(source.WebP, ".webp") || !strings.HasSuffix(source.JPEG, ".jpg") {
+			t.Errorf("size %d pairs %q with %q, want a WebP and a JPEG", i, source.WebP, source.JPEG)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.assetsRoot, path.Base(source.WebP))); err != nil {
+			t.Errorf("size %d WebP wasn't stored: %v", i, err)
+		}
+
+		f, err := os.Open(filepath.Join(cfg.assetsRoot, path.Base(source.JPEG)))
+		if err != nil {
+			t.Fatalf("size %d JPEG wasn't stored: %v", i, err)
+		}
+		imgCfg, format, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != "jpeg" || imgCfg.Width != source.Width || imgCfg.Height != source.Height {
+			t.Errorf("size %d JPEG is a %dx%d %s, want a %dx%d jpeg", i, imgCfg.Width, imgCfg.Height, format, source.Width, source.Height)
+		}
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stored.ThumbnailSrcset, got.ThumbnailSrcset) {
+		t.Errorf("stored srcset = %+v, want %+v", stored.ThumbnailSrcset, got.ThumbnailSrcset)
+	}
+}
+
+func TestUploadThumbnailWithoutSrcset(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, newThumbnailUploadRequest(t, token, video.ID, testPNG(t, 640, 360), "image/png"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusOK, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "thumbnail_srcset") {
+		t.Errorf("response lists a srcset with sizes off: %s", w.Body)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// timeoutMiddleware gives each request an overall deadline of timeout. The
+// deadline is on the request context, so ffmpeg runs and S3 calls made with
+// it are cancelled, and on reads of the request body. Once it has passed,
+// whatever the handler responds is replaced with a 504. A zero timeout
+// disables the deadline.
+func timeoutMiddleware(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		// Not every writer supports deadlines; the context still applies
+		deadline, _ := ctx.Deadline()
+		_ = http.NewResponseController(w).SetReadDeadline(deadline)
+
+		tw := &timeoutResponseWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		if !tw.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			tw.WriteHeader(http.StatusGatewayTimeout)
+		}
+	})
+}
+
+// timeoutResponseWriter turns the response into a 504 when it's started
+// after the request's deadline.
+type timeoutResponseWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (w *timeoutResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+		respondWithErrorCode(w.ResponseWriter, http.StatusGatewayTimeout, errCodeTimeout, "Request timed out", w.ctx.Err())
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timeoutResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timedOut {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxTitleLength is the longest video title, in characters.
+const maxTitleLength = 200
+
+// fieldError is a validation failure of one field in a request body.
+type fieldError struct {
+	Field string
+	// Message is an English message template, localized when sent, and
+	// Args fill in its verbs.
+	Message string
+	Args    []any
+}
+
+func (e *fieldError) Error() string {
+	return e.Field + ": " + fmt.Sprintf(e.Message, e.Args...)
+}
+
+// validateVideoTitle checks a title, ignoring leading and trailing
+// whitespace, which callers trim before storing it.
+func validateVideoTitle(title string) error {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return &fieldError{Field: "title", Message: "Title can't be empty"}
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return &fieldError{Field: "title", Message: "Title must be at most %d characters", Args: []any{maxTitleLength}}
+	}
+	return nil
+}
+
+// respondWithFieldError responds 400 to a failed validation. When err is a
+// fieldError, the response names the field.
+func respondWithFieldError(w http.ResponseWriter, err error) {
+	var fieldErr *fieldError
+	if !errors.As(err, &fieldErr) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeValidation, err.Error(), err)
+		return
+	}
+	loggerFromWriter(w).Info("request failed", "status", http.StatusBadRequest, "field", fieldErr.Field, "error", err)
+	respondWithJSON(w, http.StatusBadRequest, errorResponse{
+		Error: translatef(w, fieldErr.Message, fieldErr.Args...),
+		Code:  errCodeValidation,
+		Field: fieldErr.Field,
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateVideoTitle(t *testing.T) {
+	tests := []struct {
+		name    string
+		title   string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"whitespace only", " \t\n ", true},
+		{"too long", strings.Repeat("a", maxTitleLength+1), true},
+		{"longest", strings.Repeat("a", maxTitleLength), false},
+		// Length counts characters, not bytes
+		{"longest multibyte", strings.Repeat("é", maxTitleLength), false},
+		{"too long once trimmed", "  " + strings.Repeat("a", maxTitleLength+1) + "  ", true},
+		{"surrounded by spaces", "  Boots the bear  ", false},
+		{"valid", "Boots the bear", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVideoTitle(tt.title)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateVideoTitle(%q) = %v, want error: %v", tt.title, err, tt.wantErr)
+			}
+			var fieldErr *fieldError
+			if err != nil && (!errors.As(err, &fieldErr) || fieldErr.Field != "title") {
+				t.Errorf("error = %#v, want a fieldError for title", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// formThumbnail is a thumbnail sent in the same multipart form as a video.
+type formThumbnail struct {
+	data []byte
+	// size is the image's length in bytes. data is left empty when it's
+	// over the thumbnail upload limit.
+	size        int64
+	contentType string
+}
+
+// uploadWarning reports an optional part of an upload that was dropped
+// without failing the upload as a whole.
+type uploadWarning struct {
+	Field   string    `json:"field"`
+	Code    errorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// videoUploadResponse is the uploaded video, with a warning for each part of
+// the upload that was dropped.
+type videoUploadResponse struct {
+	database.Video
+	Warnings []uploadWarning `json:"warnings,omitempty"`
+}
+
+// openFormThumbnail reads the thumbnail file from the request's parsed
+// multipart form. It returns nil when there isn't one.
+func (cfg *apiConfig) openFormThumbnail(r *http.Request) (*formThumbnail, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["thumbnail"]) == 0 {
+		return nil, nil
+	}
+	header := r.MultipartForm.File["thumbnail"][0]
+	thumbnail := &formThumbnail{
+		size:        header.Size,
+		contentType: header.Header.Get("Content-Type"),
+	}
+	if header.Size > cfg.maxThumbnailUploadBytes {
+		return thumbnail, nil
+	}
+
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	thumbnail.data, err = io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return thumbnail, nil
+}
+
+// readFormThumbnail reads the thumbnail part of a streamed form, reading no
+// further than the thumbnail upload limit.
+func (cfg *apiConfig) readFormThumbnail(part *multipart.Part) (*formThumbnail, error) {
+	data, err := io.ReadAll(io.LimitReader(part, cfg.maxThumbnailUploadBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	thumbnail := &formThumbnail{
+		size:        int64(len(data)),
+		contentType: part.Header.Get("Content-Type"),
+	}
+	if thumbnail.size <= cfg.maxThumbnailUploadBytes {
+		thumbnail.data = data
+	}
+	return thumbnail, nil
+}
+
+// saveFormThumbnail runs a thumbnail sent along with a video through the
+// thumbnail pipeline and returns the saved file's path. A thumbnail that's
+// too large or fails validation doesn't fail the upload: it's dropped, and
+// the returned warning says why.
+func (cfg *apiConfig) saveFormThumbnail(w http.ResponseWriter, r *http.Request, thumbnail *formThumbnail) (string, *uploadWarning) {
+	if thumbnail.size > cfg.maxThumbnailUploadBytes {
+		limit := cfg.maxThumbnailUploadBytes
+		return "", &uploadWarning{
+			Field:   "thumbnail",
+			Code:    errCodeFileTooLarge,
+			Message: translatef(w, "Thumbnail exceeds the maximum upload size of %s (%d bytes)", formatBytes(limit), limit),
+		}
+	}
+
+	rec := &errorResponseRecorder{ResponseWriter: w, header: http.Header{}}
+	filePath, err := cfg.saveThumbnail(rec, r, bytes.NewReader(thumbnail.data), thumbnail.contentType)
+	if err == nil {
+		return filePath, nil
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &body); err != nil || body.Error == "" {
+		body.Error = http.StatusText(rec.status)
+		body.Code = defaultErrorCode(rec.status)
+	}
+	return "", &uploadWarning{Field: "thumbnail", Code: body.Code, Message: body.Error}
+}
+
+// deleteReplacedThumbnail removes the thumbnail file of previous, the video
+// before its upload, once the upload's own thumbnail has replaced it.
+func (cfg *apiConfig) deleteReplacedThumbnail(ctx context.Context, previous database.Video) {
+	if err := cfg.deleteThumbnailFile(previous.ThumbnailURL); err != nil {
+		loggerFromContext(ctx).Warn("couldn't delete previous thumbnail", "video_id", previous.ID, "error", err)
+	}
+}
+
+// errorResponseRecorder catches the error response a helper sends, so it
+// can be reported some other way. The locale and logger are still looked up
+// through the wrapped writer, which is never written to.
+type errorResponseRecorder struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *errorResponseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *errorResponseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *errorResponseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *errorResponseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// watermarkPositions are the corners a watermark can be placed in, mapped
+// to overlay filter coordinates, formatted with the margin from the video's
+// edges.
+var watermarkPositions = map[string]string{
+	"top-left":     "x=%[1]d:y=%[1]d",
+	"top-right":    "x=W-w-%[1]d:y=%[1]d",
+	"bottom-left":  "x=%[1]d:y=H-h-%[1]d",
+	"bottom-right": "x=W-w-%[1]d:y=H-h-%[1]d",
+}
+
+const (
+	// watermarkWidthFraction is the watermark's width relative to the
+	// video's, so it looks the same whatever the resolution
+	watermarkWidthFraction = 0.15
+	// watermarkMarginFraction is the watermark's distance from the edges,
+	// relative to the video's width
+	watermarkMarginFraction = 0.02
+)
+
+// watermarkEncoder returns the codec watermarked videos are encoded with:
+// the re-encode codec when one is configured, and H.264 otherwise.
+func (cfg *apiConfig) watermarkEncoder() videoEncoder {
+	if encoder, ok := videoEncoders[cfg.reencodeCodec]; ok {
+		return encoder
+	}
+	return videoEncoders["h264"]
+}
+
+// watermarkVideo burns the image at overlayPath into the video at filePath,
+// in the corner named by position, at cfg.watermarkOpacity. The image is
+// scaled to the video's width, videoWidth, so it's the same relative size at
+// any resolution. Burning it in means re-encoding, with watermarkEncoder;
+// the audio is copied. The result is written next to filePath, in a
+// container fast start processing then remuxes, and its path returned.
+func (cfg *apiConfig) watermarkVideo(ctx context.Context, filePath, overlayPath, position string, videoWidth int) (string, error) {
+	coords, ok := watermarkPositions[position]
+	if !ok {
+		return "", fmt.Errorf("unknown watermark position %q", position)
+	}
+	// Even dimensions keep chroma-subsampled encoders happy
+	overlayWidth := max(2, int(float64(videoWidth)*watermarkWidthFraction)/2*2)
+	margin := int(float64(videoWidth) * watermarkMarginFraction)
+	filter := fmt.Sprintf("[1:v]scale=%d:-2,format=rgba,colorchannelmixer=aa=%s[wm];[0:v][wm]overlay=%s[v]",
+		overlayWidth,
+		strconv.FormatFloat(cfg.watermarkOpacity, 'f', -1, 64),
+		fmt.Sprintf(coords, margin),
+	)
+
+	encoder := cfg.watermarkEncoder()
+	done := logStage(ctx, "watermark", "position", position)
+	outputPath := filePath + ".watermarked"
+	args := []string{
+		"-i", filePath,
+		"-i", overlayPath,
+		"-filter_complex", filter,
+		"-map", "[v]",
+		"-map", "0:a?",
+	}
+	args = append(args, encoder.args(min(cfg.reencodeCRF, encoder.maxCRF), cfg.reencodePreset)...)
+	args = append(args, "-c:a", "copy", "-f", "matroska", outputPath)
+	_, err := cfg.runMedia(ctx, "ffmpeg", args...)
+	done(err)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
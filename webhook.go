@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Webhook delivery settings. Each attempt gets webhookTimeout, and failed
+// attempts are retried after webhookRetryDelay, doubling each time.
+const (
+	webhookTimeout     = 5 * time.Second
+	webhookMaxAttempts = 3
+	webhookRetryDelay  = time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// uploadCompleteEvent is the payload POSTed to the webhook once a video has
+// been processed and stored.
+type uploadCompleteEvent struct {
+	Event    string    `json:"event"`
+	VideoID  uuid.UUID `json:"video_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	VideoURL string    `json:"video_url"`
+	Duration *float64  `json:"duration"`
+}
+
+// notifyUploadComplete sends the upload-complete webhook in the background.
+// Delivery failures are logged; the uploader never sees them.
+func (cfg *apiConfig) notifyUploadComplete(logger *slog.Logger, video database.Video) {
+	if cfg.webhookURL == "" || video.VideoURL == nil {
+		return
+	}
+	event := uploadCompleteEvent{
+		Event:    "video.uploaded",
+		VideoID:  video.ID,
+		UserID:   video.UserID,
+		VideoURL: *video.VideoURL,
+		Duration: video.Duration,
+	}
+	go func() {
+		if err := cfg.sendWebhook(context.Background(), event); err != nil {
+			logger.Error("webhook delivery failed", "video_id", video.ID, "error", err)
+		}
+	}()
+}
+
+// sendWebhook POSTs payload to the webhook URL, retrying connection errors,
+// 429s and 5xx responses.
+func (cfg *apiConfig) sendWebhook(ctx context.Context, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		retryable, err := postWebhook(ctx, cfg.webhookURL, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt == webhookMaxAttempts {
+			return fmt.Errorf("attempt %d: %w", attempt, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func postWebhook(ctx context.Context, url string, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+	retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("webhook responded %s", resp.Status)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUploadCompleteWebhook(t *testing.T) {
+	installFakeMedia(t, testProbeOutput)
+	cfg, _ := newTestConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	// The first delivery fails, so the event only arrives on the retry
+	deliveries := make(chan map[string]any, webhookMaxAttempts)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		deliveries <- payload
+	}))
+	defer srv.Close()
+	cfg.webhookURL = srv.URL
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newVideoUploadRequest(t, token, video.ID, testMP4(4096), nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	var payload map[string]any
+	select {
+	case payload = <-deliveries:
+	case <-time.After(5 * webhookRetryDelay):
+		t.Fatal("webhook wasn't retried")
+	}
+	keys := make([]string, 0, len(payload))
+	for key := range payload {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	if want := []string{"duration", "event", "user_id", "video_id", "video_url"}; !slices.Equal(keys, want) {
+		t.Errorf("payload fields = %q, want %q", keys, want)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload["event"] != "video.uploaded" ||
+		payload["video_id"] != video.ID.String() ||
+		payload["user_id"] != userID.String() ||
+		payload["video_url"] != *stored.VideoURL ||
+		payload["duration"] != 3.0 {
+		t.Errorf("payload = %v", payload)
+	}
+}